@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/db"
+)
+
+const defaultSchedulerPollInterval = time.Minute
+
+type AnnounceScheduler struct {
+	Client *Client
+	Clock  Clock
+	// Upper bound on sleeping, so newly opened torrents are picked up.
+	PollInterval time.Duration
+}
+
+func NewAnnounceScheduler(client *Client) *AnnounceScheduler {
+	var clock Clock = realClock{}
+	if client.Clock != nil {
+		clock = client.Clock
+	}
+
+	return &AnnounceScheduler{
+		Client:       client,
+		Clock:        clock,
+		PollInterval: defaultSchedulerPollInterval,
+	}
+}
+
+func (s *AnnounceScheduler) Run(ctx context.Context) error {
+	for {
+		now := s.Clock.Now()
+		wait := s.PollInterval
+
+		nextRun, err := s.RunOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			slog.Error("Announce scheduler run failed " + err.Error())
+		} else if nextRun.Sub(now) < wait {
+			wait = max(nextRun.Sub(now), 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.Clock.After(wait):
+		}
+	}
+}
+
+// RunOnce announces every active torrent whose announce is due and returns
+// the time of the earliest upcoming one.
+func (s *AnnounceScheduler) RunOnce(ctx context.Context) (time.Time, error) {
+	now := s.Clock.Now()
+	nextRun := now.Add(s.PollInterval)
+
+	dbTorrents, err := s.Client.TorrentRepo.GetAll()
+	if err != nil {
+		slog.Error("Could not retrieve torrents.")
+		return nextRun, err
+	}
+
+	// Every scheduled announce which is not done yet
+	scheduledAnnounces, err := s.Client.AnnounceRepo.GetScheduledAfter(time.Time{})
+	if err != nil {
+		slog.Error("Could not retrieve scheduled announces.")
+		return nextRun, err
+	}
+
+	pending := make(map[int][]db.TrackerAnnounce)
+	for i := range scheduledAnnounces {
+		if !scheduledAnnounces[i].Done {
+			torrentId := scheduledAnnounces[i].TorrentId
+			pending[torrentId] = append(pending[torrentId], scheduledAnnounces[i])
+		}
+	}
+
+	for i := range dbTorrents {
+		dbTorrent := &dbTorrents[i]
+
+		if dbTorrent.Paused {
+			continue
+		}
+
+		latest, err := s.closeOutdated(pending[dbTorrent.TorrentId])
+		if err != nil {
+			return nextRun, err
+		}
+
+		// Torrent was announced and its time has not come yet
+		if latest != nil && latest.ScheduledTime.After(now) {
+			nextRun = minTime(nextRun, *latest.ScheduledTime)
+			continue
+		}
+
+		// The announce closes the pending one as well
+
+		dbAnnounce, err := s.Client.AnnounceContext(ctx, dbTorrent)
+		if err != nil {
+			return nextRun, err
+		}
+
+		infoMsg := fmt.Sprintf("Announced %s, next announce at %v", dbTorrent.Name, dbAnnounce.ScheduledTime)
+		slog.Info(infoMsg)
+
+		nextRun = minTime(nextRun, *dbAnnounce.ScheduledTime)
+	}
+
+	return nextRun, nil
+}
+
+// Only the newest pending announce of a torrent schedules the next one, the others are marked done.
+func (s *AnnounceScheduler) closeOutdated(pending []db.TrackerAnnounce) (*db.TrackerAnnounce, error) {
+	var latest *db.TrackerAnnounce
+
+	for i := range pending {
+		if latest == nil || pending[i].TrackerAnnounceId > latest.TrackerAnnounceId {
+			latest = &pending[i]
+		}
+	}
+
+	for i := range pending {
+		if &pending[i] == latest {
+			continue
+		}
+
+		pending[i].Done = true
+
+		err := s.Client.AnnounceRepo.Update(&pending[i])
+		if err != nil {
+			slog.Error("Could not mark announce as done.")
+			return nil, err
+		}
+	}
+
+	return latest, nil
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+
+	return a
+}
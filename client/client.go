@@ -2,36 +2,111 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"math/rand"
+	"net"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"example.com/db"
+	"example.com/dht"
 	"example.com/torrent"
 )
 
+const announceRetryInterval = time.Minute
+const maxAnnounceBackoff = time.Hour
+
+const maxPieceAttempts = 3
+const pieceTimeout = 2 * time.Minute
+
+var ErrPieceHashMismatch = errors.New("piece hash mismatch")
+var ErrPieceNotDownloaded = errors.New("piece could not be downloaded")
+var ErrInvalidRequest = errors.New("invalid block request")
+var ErrPieceNotConfirmed = errors.New("requested piece is not confirmed")
+
+type DownloadStatus struct {
+	Done          bool
+	PieceCount    int
+	MissingPieces []int
+	BytesLeft     int
+}
+
 type SeederBuilder interface {
-	BuildSeeder(torrent *db.Torrent, pieceIndex int) (torrent.Seeder, error)
+	BuildSeeder(torrent *db.Torrent, pieceIndex int) (*torrent.Seeder, error)
+}
+
+// Implemented by torrent.TrackerClient, tests can use fake trackers
+type TrackerClient interface {
+	Announce(ctx context.Context, request *torrent.AnnounceRequest) (*torrent.AnnounceResponse, error)
+	Scrape(ctx context.Context, announceURL string, infoHashes [][]byte) (*torrent.ScrapeResponse, error)
 }
 
 type Client struct {
 	SeederBuilder
 	Client db.Client
 	Port   uint16
+	// Optional, announced to trackers by dual-stack clients
+	IPv4 net.IP
+	IPv6 net.IP
+	// Optional, overrides the address trackers see the announce coming from
+	AnnounceIP string
+	// Number of peers asked from trackers, tracker default if 0
+	NumWant int
 
 	ClientRepo   db.ClientRepository
 	TorrentRepo  db.TorrentRepository
 	AnnounceRepo db.TrackerAnnounceRepository
 	PieceRepo    db.PieceRepository
 	PeerRepo     db.PeerRepository
+	TrackerRepo  db.TrackerRepository
+
+	Clock         Clock
+	TrackerClient TrackerClient
+	// Optional, peers are only discovered through trackers without it
+	DHT DHT
+	// Turns off local service discovery
+	DisableLSD bool
+	// Extensions offered on every peer connection, see BEP 10
+	Extensions      *torrent.ExtensionRegistry
+	MetadataFetcher MetadataFetcher
 
 	initialized bool
+	// Stays the same for the whole session
+	announceKey uint32
+	// Connections of the same torrent share its counters
+	transferMutex sync.Mutex
+	// Pipeline of every peer we downloaded from, by address
+	pipelines      map[string]torrent.PipelineState
+	pipelinesMutex sync.Mutex
+	// Peer exchange of every torrent, by hex info hash
+	pexManagers map[string]*PexManager
+	pexMutex    sync.Mutex
+}
+
+func (c *Client) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+
+	return c.Clock.Now()
+}
+
+func (c *Client) trackerClient() TrackerClient {
+	if c.TrackerClient == nil {
+		return torrent.DefaultTrackerClient
+	}
+
+	return c.TrackerClient
 }
 
 func (c *Client) Initialize() error {
@@ -47,6 +122,7 @@ func (c *Client) Initialize() error {
 		clientDb = &db.Client{
 			ProtocolId: torrent.GenerateRandomProtocolId(),
 			Created:    time.Now(),
+			DHTNodeId:  dht.GenerateNodeId(),
 		}
 
 		err := c.ClientRepo.Create(clientDb)
@@ -58,7 +134,51 @@ func (c *Client) Initialize() error {
 		slog.Info("Created client record.")
 	}
 
+	// Clients created before DHT support have no node id yet
+	if len(clientDb.DHTNodeId) == 0 {
+		clientDb.DHTNodeId = dht.GenerateNodeId()
+
+		err := c.ClientRepo.Update(clientDb)
+		if err != nil {
+			slog.Error("Could not save DHT node id.")
+			return err
+		}
+	}
+
 	c.Client = *clientDb
+
+	if c.announceKey == 0 {
+		c.announceKey = rand.Uint32()
+	}
+
+	if c.Extensions == nil {
+		c.Extensions = torrent.NewExtensionRegistry()
+	}
+
+	// Other peers may fetch metadata of our torrents
+	if c.Extensions.LocalId(torrent.MetadataExtensionName) == 0 {
+		c.Extensions.Register(torrent.MetadataExtensionName, torrent.MetadataHandler{})
+	}
+
+	// Shared by all torrents, messages go to the manager of the connection's torrent
+	if c.Extensions.LocalId(torrent.PexExtensionName) == 0 {
+		c.Extensions.Register(torrent.PexExtensionName, torrent.ExtensionHandlerFunc(c.dispatchPex))
+	}
+
+	if c.SeederBuilder == nil || c.MetadataFetcher == nil {
+		seederBuilder := NewTCPSeederBuilder(c.PeerRepo, c.Client.ProtocolId)
+		seederBuilder.Extensions = c.Extensions
+		seederBuilder.Bitfield = c.bitfield
+
+		if c.SeederBuilder == nil {
+			c.SeederBuilder = seederBuilder
+		}
+
+		if c.MetadataFetcher == nil {
+			c.MetadataFetcher = seederBuilder
+		}
+	}
+
 	c.initialized = true
 
 	return nil
@@ -71,9 +191,16 @@ func (c *Client) OpenTorrent(reader io.Reader, downloadPath string) (*db.Torrent
 		return nil, err
 	}
 
+	// Crafted names could otherwise point outside of the download path
+	err = metaInfo.CheckPaths()
+	if err != nil {
+		slog.Error("Refusing torrent with unsafe file names.")
+		return nil, err
+	}
+
 	directoryPath := path.Join(downloadPath, metaInfo.Info.Name)
 
-	err = os.Mkdir(directoryPath, os.ModeDir)
+	err = os.Mkdir(directoryPath, 0755)
 	if err != nil {
 		slog.Error("Error creating directory " + directoryPath)
 		return nil, err
@@ -117,59 +244,241 @@ func (c *Client) OpenTorrent(reader io.Reader, downloadPath string) (*db.Torrent
 		return nil, err
 	}
 
+	err = c.createTrackers(dbTorrent, metaInfo)
+	if err != nil {
+		return nil, err
+	}
+
 	slog.Info("Created new torrent record.")
 
 	return dbTorrent, nil
 }
 
-func (c *Client) announceExistenceForTorrent(dbTorrent *db.Torrent) db.TrackerAnnounce {
-	announceTime := time.Now()
-	scheduledTime := announceTime.Add(time.Minute)
+func (c *Client) getMetaInfo(dbTorrent *db.Torrent) (*torrent.MetaInfo, error) {
+	return torrent.ParseMetaInfo(bytes.NewReader(dbTorrent.RawMetaInfo))
+}
+
+func (c *Client) lookupMetaInfo(infoHash []byte) (*torrent.MetaInfo, error) {
+	dbTorrent, err := c.TorrentRepo.GetByHashInfo(infoHash)
+	if err != nil {
+		slog.Error("Could not retrieve by infohash " + hex.EncodeToString(infoHash))
+		return nil, err
+	}
+
+	if dbTorrent == nil {
+		return nil, nil
+	}
+
+	return c.getMetaInfo(dbTorrent)
+}
+
+// Remote address identifies the peer, e.g. for its allowed fast set.
+func (c *Client) AcceptHandshake(reader io.Reader, writer io.Writer, remoteAddr net.Addr) (*torrent.Seeder, error) {
+	if !c.initialized {
+		return nil, errors.New("Client not initialized.")
+	}
+
+	seeder, err := torrent.AcceptHandshake(reader, writer, c.Client.ProtocolId, c.lookupMetaInfo)
+	if err != nil {
+		slog.Error("Could not accept incoming handshake " + err.Error())
+		return nil, err
+	}
+
+	seeder.Extensions = c.Extensions
+
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		seeder.SeederInfo.IP = tcpAddr.IP
+		seeder.SeederInfo.Port = tcpAddr.Port
+	}
+
+	dbTorrent, err := c.TorrentRepo.GetByHashInfo(seeder.RemoteHandshake.InfoHash)
+	if err != nil {
+		slog.Error("Could not retrieve by infohash " + hex.EncodeToString(seeder.RemoteHandshake.InfoHash))
+		return nil, err
+	}
+
+	bitfield, err := c.bitfield(dbTorrent, seeder.MetaInfo.GetPieceCount())
+	if err != nil {
+		return nil, err
+	}
+
+	err = seeder.Introduce(bitfield)
+	if err != nil {
+		return nil, err
+	}
+
+	return seeder, nil
+}
+
+// Every consecutive failed announce doubles the time until the next one.
+func (c *Client) announceBackoff(torrentId int) time.Duration {
+	dbAnnounces, err := c.AnnounceRepo.GetByTorrentId(torrentId)
+	if err != nil {
+		slog.Error("Could not retrieve previous announces, using default backoff.")
+		return announceRetryInterval
+	}
+
+	backoff := announceRetryInterval
+
+	for i := len(dbAnnounces) - 1; i >= 0 && dbAnnounces[i].Error != nil; i-- {
+		backoff *= 2
+
+		if backoff >= maxAnnounceBackoff {
+			return maxAnnounceBackoff
+		}
+	}
+
+	return backoff
+}
+
+func announceInterval(announceResponse *torrent.AnnounceResponse) time.Duration {
+	// Tracker does not want to hear from us more often than min interval
+	interval := max(announceResponse.Interval, announceResponse.MinInterval)
+
+	return time.Second * time.Duration(interval)
+}
+
+func (c *Client) bytesLeft(dbTorrent *db.Torrent) int {
+	metaInfo, err := c.getMetaInfo(dbTorrent)
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name + ", assuming nothing is downloaded.")
+		return dbTorrent.Size
+	}
+
+	status, err := c.getDownloadStatus(dbTorrent, metaInfo)
+	if err != nil {
+		slog.Error("Could not calculate download status of " + dbTorrent.Name + ", assuming nothing is downloaded.")
+		return dbTorrent.Size
+	}
+
+	return status.BytesLeft
+}
+
+func (c *Client) announceExistenceForTorrent(ctx context.Context, dbTorrent *db.Torrent, event string) db.TrackerAnnounce {
+	announceTime := c.now()
 
 	// Fill what we already now.
 	dbAnnounce := db.TrackerAnnounce{
 		TorrentId:     dbTorrent.TorrentId,
 		AnnounceTime:  announceTime,
-		ScheduledTime: &scheduledTime,
+		Announciation: event,
 		Done:          false,
 	}
 
-	// Form request for Tracker web server
+	// Form request for Tracker web server, URL is filled per tracker
 	announceRequest := torrent.AnnounceRequest{
-		AnnounceURL: dbTorrent.Announce,
-		PeerId:      c.Client.ProtocolId,
-		InfoHash:    dbTorrent.HashInfo,
-		Port:        int(c.Port),
-		Left:        dbTorrent.Size,
-		// TODO
-		// Fill this later.
-		Uploaded:   0,
-		Downloaded: 0,
+		PeerId:   c.Client.ProtocolId,
+		InfoHash: dbTorrent.HashInfo,
+		Port:     int(c.Port),
+		Left:     c.bytesLeft(dbTorrent),
+		Event:    event,
+		IPv4:     c.IPv4,
+		IPv6:     c.IPv6,
+		IP:       c.AnnounceIP,
+		Compact:  true,
+		NumWant:  c.NumWant,
+		Key:      c.announceKey,
 	}
 
-	announceResponse, err := torrent.Announce(&announceRequest)
+	c.transferMutex.Lock()
+	announceRequest.Uploaded = dbTorrent.Uploaded
+	announceRequest.Downloaded = dbTorrent.Downloaded
+	c.transferMutex.Unlock()
+
+	var scheduledTime time.Time
+
+	announceResponse, err := c.announceToTrackers(ctx, dbTorrent, &announceRequest)
 	if err != nil {
 		// Record an error
 		errMsg := err.Error()
 		dbAnnounce.Error = &errMsg
+
+		scheduledTime = announceTime.Add(c.announceBackoff(dbTorrent.TorrentId))
 	} else {
 		// Try again when tracker server said
-		scheduledTime = dbAnnounce.AnnounceTime.Add(time.Second * time.Duration(announceResponse.Interval))
+		scheduledTime = announceTime.Add(announceInterval(announceResponse))
 
 		dbAnnounce.RawResponse = announceResponse.RawResponse
 	}
 
+	dbAnnounce.ScheduledTime = &scheduledTime
+
 	return dbAnnounce
 }
 
-func (c *Client) Announce(dbTorrent *db.Torrent) (*db.TrackerAnnounce, error) {
+// Tracker has to hear started before anything else, also after we stopped.
+func (c *Client) nextAnnounceEvent(dbTorrent *db.Torrent) (string, error) {
+	dbAnnounces, err := c.AnnounceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		slog.Error("Could not retrieve previous announces.")
+		return torrent.EventNone, err
+	}
+
+	// Completed that didn't reach the tracker is sent again until one does
+	pending := torrent.EventNone
+
+	for i := len(dbAnnounces) - 1; i >= 0; i-- {
+		if dbAnnounces[i].Error != nil {
+			if dbAnnounces[i].Announciation == torrent.EventCompleted {
+				pending = torrent.EventCompleted
+			}
+
+			continue
+		}
+
+		if dbAnnounces[i].Announciation == torrent.EventStopped {
+			return torrent.EventStarted, nil
+		}
+
+		return pending, nil
+	}
+
+	return torrent.EventStarted, nil
+}
+
+// Only the newest announce may schedule the next one, otherwise announce chains multiply.
+func (c *Client) closePendingAnnounces(torrentId int) error {
+	dbAnnounces, err := c.AnnounceRepo.GetByTorrentId(torrentId)
+	if err != nil {
+		slog.Error("Could not retrieve previous announces.")
+		return err
+	}
+
+	for i := range dbAnnounces {
+		if dbAnnounces[i].Done || dbAnnounces[i].ScheduledTime == nil {
+			continue
+		}
+
+		dbAnnounces[i].Done = true
+
+		err = c.AnnounceRepo.Update(&dbAnnounces[i])
+		if err != nil {
+			slog.Error("Could not mark announce as done.")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) announceWithEvent(ctx context.Context, dbTorrent *db.Torrent, event string) (*db.TrackerAnnounce, error) {
 	if !c.initialized {
 		return nil, errors.New("Client not initialized.")
 	}
 
-	dbAnnounce := c.announceExistenceForTorrent(dbTorrent)
+	dbAnnounce := c.announceExistenceForTorrent(ctx, dbTorrent, event)
+
+	// Cancelled announce tells nothing about the tracker, so it is not recorded
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	err := c.closePendingAnnounces(dbTorrent.TorrentId)
+	if err != nil {
+		return nil, err
+	}
 
-	err := c.AnnounceRepo.Create(&dbAnnounce)
+	err = c.AnnounceRepo.Create(&dbAnnounce)
 	if err != nil {
 		slog.Error("Could not save tracker announce to database.")
 		return nil, err
@@ -178,6 +487,77 @@ func (c *Client) Announce(dbTorrent *db.Torrent) (*db.TrackerAnnounce, error) {
 	return &dbAnnounce, nil
 }
 
+func (c *Client) Announce(dbTorrent *db.Torrent) (*db.TrackerAnnounce, error) {
+	return c.AnnounceContext(context.Background(), dbTorrent)
+}
+
+// Same as Announce, ctx cancels the requests to the trackers.
+func (c *Client) AnnounceContext(ctx context.Context, dbTorrent *db.Torrent) (*db.TrackerAnnounce, error) {
+	if !c.initialized {
+		return nil, errors.New("Client not initialized.")
+	}
+
+	event, err := c.nextAnnounceEvent(dbTorrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.announceWithEvent(ctx, dbTorrent, event)
+}
+
+func (c *Client) PauseTorrent(dbTorrent *db.Torrent) error {
+	if dbTorrent.Paused {
+		return nil
+	}
+
+	dbTorrent.Paused = true
+
+	err := c.TorrentRepo.Update(dbTorrent)
+	if err != nil {
+		slog.Error("Could not update torrent record.")
+		return err
+	}
+
+	_, err = c.announceWithEvent(context.Background(), dbTorrent, torrent.EventStopped)
+
+	return err
+}
+
+func (c *Client) ResumeTorrent(dbTorrent *db.Torrent) error {
+	dbTorrent.Paused = false
+
+	err := c.TorrentRepo.Update(dbTorrent)
+	if err != nil {
+		slog.Error("Could not update torrent record.")
+		return err
+	}
+
+	// Announce scheduled before the pause is replaced by this one
+	_, err = c.announceWithEvent(context.Background(), dbTorrent, torrent.EventStarted)
+
+	return err
+}
+
+func (c *Client) RemoveTorrent(dbTorrent *db.Torrent) error {
+	// Paused torrents already said goodbye to the tracker
+	if !dbTorrent.Paused {
+		_, err := c.announceWithEvent(context.Background(), dbTorrent, torrent.EventStopped)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.TorrentRepo.Delete(dbTorrent)
+	if err != nil {
+		slog.Error("Could not delete torrent record.")
+		return err
+	}
+
+	slog.Info("Removed torrent " + dbTorrent.Name)
+
+	return nil
+}
+
 func (c *Client) ProcessTrackerAnnounce(trackerAnnounce *db.TrackerAnnounce) ([]db.Peer, error) {
 	var dbPeers []db.Peer
 
@@ -194,33 +574,59 @@ func (c *Client) ProcessTrackerAnnounce(trackerAnnounce *db.TrackerAnnounce) ([]
 		return dbPeers, err
 	}
 
-	for i := range announceResponse.Peers {
-		peer := announceResponse.Peers[i]
+	return c.storePeers(trackerAnnounce.TorrentId, announceResponse.Peers, db.PeerSourceTracker)
+}
+
+// Saves the peers not known yet for torrentId, peers from every source end up here.
+func (c *Client) storePeers(torrentId int, peers []torrent.PeerInfo, source string) ([]db.Peer, error) {
+	var dbPeers []db.Peer
+	var err error
+
+	for i := range peers {
+		peer := peers[i]
+
+		var dbPeer *db.Peer
+
+		// Compact responses carry no peer id, those peers are known by address
+		if len(peer.PeerId) == 0 {
+			dbPeer, err = c.findDbPeer(torrentId, peer)
+		} else {
+			dbPeer, err = c.PeerRepo.GetByTorrentIdAndProtocolPeerId(torrentId, peer.PeerId)
+		}
 
-		dbPeer, err := c.PeerRepo.GetByTorrentIdAndProtocolPeerId(trackerAnnounce.TorrentId, peer.PeerId)
 		if err != nil {
 			slog.Error("Error on peer database query.")
 			return dbPeers, err
 		}
 
 		if dbPeer != nil {
-			debugMsg := fmt.Sprintf("Protocol Peer Id %s for TorrentId %d already exists, skipping...", hex.EncodeToString(dbPeer.ProtocolPeerId), trackerAnnounce.TrackerAnnounceId)
+			debugMsg := fmt.Sprintf("Peer %s for TorrentId %d already exists, skipping...", net.JoinHostPort(dbPeer.IP, strconv.Itoa(dbPeer.Port)), torrentId)
 			slog.Debug(debugMsg)
 			// TODO
 			// Update port and IP maybe
 			continue
 		}
 
-		infoMsg := fmt.Sprintf("Creating new peer %s...", hex.EncodeToString(peer.PeerId))
+		peerAddress := net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port))
+
+		infoMsg := fmt.Sprintf("Creating new %s peer %s %s...", source, peerAddress, hex.EncodeToString(peer.PeerId))
 		slog.Info(infoMsg)
 
+		// Column is not nullable, unknown peer ids are stored empty
+		protocolPeerId := peer.PeerId
+		if protocolPeerId == nil {
+			protocolPeerId = []byte{}
+		}
+
 		newDbPeer := db.Peer{
-			TorrentId:      trackerAnnounce.TorrentId,
-			ProtocolPeerId: peer.PeerId,
-			IP:             peer.IP.String(),
-			Port:           peer.Port,
+			TorrentId:      torrentId,
+			ProtocolPeerId: protocolPeerId,
+			// Canonical form, IPv6 literals are stored without brackets
+			IP:   peer.IP.String(),
+			Port: peer.Port,
 			// Assume is reachable for now
 			Reachable: true,
+			Source:    source,
 		}
 
 		err = c.PeerRepo.Create(&newDbPeer)
@@ -229,7 +635,7 @@ func (c *Client) ProcessTrackerAnnounce(trackerAnnounce *db.TrackerAnnounce) ([]
 			return dbPeers, err
 		}
 
-		infoMsg = fmt.Sprintf("Created new peer %s.", hex.EncodeToString(peer.PeerId))
+		infoMsg = fmt.Sprintf("Created new peer %s.", peerAddress)
 		slog.Info(infoMsg)
 
 		dbPeers = append(dbPeers, newDbPeer)
@@ -238,10 +644,461 @@ func (c *Client) ProcessTrackerAnnounce(trackerAnnounce *db.TrackerAnnounce) ([]
 	return dbPeers, nil
 }
 
-func (c *Client) DownloadPiece(torrent *db.Torrent, index int) error {
+func (c *Client) findDbPeer(torrentId int, peerInfo torrent.PeerInfo) (*db.Peer, error) {
+	dbPeers, err := c.PeerRepo.GetByTorrentId(torrentId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dbPeers {
+		if dbPeers[i].Port == peerInfo.Port && net.ParseIP(dbPeers[i].IP).Equal(peerInfo.IP) {
+			return &dbPeers[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Calls handle for every file which overlaps with torrent data at [offset, offset+length).
+func forEachFileSpan(dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo, offset int, length int, handle func(filePath string, fileOffset int, dataStart int, dataEnd int) error) error {
+	end := offset + length
+	fileStart := 0
+	files := metaInfo.GetFiles()
+
+	for i := range files {
+		fileEnd := fileStart + files[i].Length
+
+		spanStart := max(offset, fileStart)
+		spanEnd := min(end, fileEnd)
+
+		if spanStart < spanEnd {
+			filePath := path.Join(append([]string{dbTorrent.Location, metaInfo.Info.Name}, files[i].Path...)...)
+
+			err := handle(filePath, spanStart-fileStart, spanStart-offset, spanEnd-offset)
+			if err != nil {
+				return err
+			}
+		}
+
+		fileStart = fileEnd
+	}
+
 	return nil
 }
 
-func (c *Client) CheckDownloadDone(torrent *db.Torrent) error {
+func (c *Client) writePiece(dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo, index int, data []byte) error {
+	pieceStart := index * metaInfo.Info.PieceLength
+
+	// Piece can span over multiple files
+	return forEachFileSpan(dbTorrent, metaInfo, pieceStart, len(data), func(filePath string, fileOffset int, dataStart int, dataEnd int) error {
+		err := os.MkdirAll(path.Dir(filePath), 0755)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.WriteAt(data[dataStart:dataEnd], int64(fileOffset))
+		return err
+	})
+}
+
+func (c *Client) readBlock(dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo, index int, begin int, length int) ([]byte, error) {
+	block := make([]byte, length)
+	blockStart := index*metaInfo.Info.PieceLength + begin
+
+	err := forEachFileSpan(dbTorrent, metaInfo, blockStart, length, func(filePath string, fileOffset int, dataStart int, dataEnd int) error {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.ReadAt(block[dataStart:dataEnd], int64(fileOffset))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (c *Client) addTransferred(dbTorrent *db.Torrent, downloaded int, uploaded int) error {
+	if downloaded == 0 && uploaded == 0 {
+		return nil
+	}
+
+	err := c.TorrentRepo.AddTransferred(dbTorrent.TorrentId, downloaded, uploaded)
+	if err != nil {
+		slog.Error("Could not update transfer counters of " + dbTorrent.Name)
+		return err
+	}
+
+	c.transferMutex.Lock()
+	dbTorrent.Downloaded += downloaded
+	dbTorrent.Uploaded += uploaded
+	c.transferMutex.Unlock()
+
 	return nil
 }
+
+func (c *Client) downloadPieceFromSeeder(seeder *torrent.Seeder, dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo, index int) (*db.Piece, error) {
+	pieceHash, err := metaInfo.GetPieceHash(index)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceLength, err := metaInfo.GetPieceLength(index)
+	if err != nil {
+		return nil, err
+	}
+
+	dbPeer, err := c.findDbPeer(dbTorrent.TorrentId, seeder.SeederInfo)
+	if err != nil {
+		slog.Error("Error on peer database query.")
+		return nil, err
+	}
+
+	if dbPeer == nil {
+		errMsg := fmt.Sprintf("Peer %s:%d is not known for torrent %d", seeder.SeederInfo.IP, seeder.SeederInfo.Port, dbTorrent.TorrentId)
+		return nil, errors.New(errMsg)
+	}
+
+	dbPiece := db.Piece{
+		TorrentId: dbTorrent.TorrentId,
+		PeerId:    dbPeer.PeerId,
+		Start:     time.Now(),
+		Index:     index,
+		Length:    pieceLength,
+	}
+
+	err = c.PieceRepo.Create(&dbPiece)
+	if err != nil {
+		slog.Error("Could not save piece record to database.")
+		return nil, err
+	}
+
+	if deadliner, ok := seeder.SeederReader.(interface{ SetDeadline(time.Time) error }); ok {
+		deadliner.SetDeadline(dbPiece.Start.Add(pieceTimeout))
+	}
+
+	data, downloadErr := seeder.DownloadPiece(index, pieceLength)
+
+	end := time.Now()
+	dbPiece.End = &end
+
+	if downloadErr == nil {
+		hash := sha1.Sum(data)
+		confirmed := bytes.Equal(hash[:], pieceHash)
+
+		dbPiece.IsDownloaded = true
+		dbPiece.Confirmed = &confirmed
+
+		if confirmed {
+			downloadErr = c.writePiece(dbTorrent, metaInfo, index, data)
+		} else {
+			downloadErr = ErrPieceHashMismatch
+		}
+	}
+
+	err = c.PieceRepo.Update(&dbPiece)
+	if err != nil {
+		slog.Error("Could not update piece record.")
+		return nil, err
+	}
+
+	return &dbPiece, downloadErr
+}
+
+func pipelineKey(seeder *torrent.Seeder) string {
+	return net.JoinHostPort(seeder.SeederInfo.IP.String(), strconv.Itoa(seeder.SeederInfo.Port))
+}
+
+// Seeders are built for every piece, the pipeline of their peer is carried over
+func (c *Client) buildSeeder(dbTorrent *db.Torrent, index int) (*torrent.Seeder, error) {
+	seeder, err := c.BuildSeeder(dbTorrent, index)
+	if err != nil {
+		return nil, err
+	}
+
+	c.pipelinesMutex.Lock()
+	state, exists := c.pipelines[pipelineKey(seeder)]
+	c.pipelinesMutex.Unlock()
+
+	if exists {
+		seeder.RestorePipelineState(state)
+	}
+
+	return seeder, nil
+}
+
+func (c *Client) savePipeline(seeder *torrent.Seeder) {
+	c.pipelinesMutex.Lock()
+	defer c.pipelinesMutex.Unlock()
+
+	if c.pipelines == nil {
+		c.pipelines = make(map[string]torrent.PipelineState)
+	}
+
+	c.pipelines[pipelineKey(seeder)] = seeder.PipelineState()
+}
+
+func (c *Client) DownloadPiece(dbTorrent *db.Torrent, index int) error {
+	if !c.initialized {
+		return errors.New("Client not initialized.")
+	}
+
+	metaInfo, err := c.getMetaInfo(dbTorrent)
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name)
+		return err
+	}
+
+	for attempt := 0; attempt < maxPieceAttempts; attempt++ {
+		// Seeder builder hands out a different peer on every call
+		seeder, err := c.buildSeeder(dbTorrent, index)
+		if err != nil {
+			slog.Error("Could not find seeder for " + dbTorrent.Name)
+			return err
+		}
+
+		dbPiece, err := c.downloadPieceFromSeeder(seeder, dbTorrent, metaInfo, index)
+		seeder.Close()
+		c.savePipeline(seeder)
+
+		// Bytes count even if the piece turned out to be corrupt
+		counterErr := c.addTransferred(dbTorrent, seeder.Downloaded, 0)
+		if counterErr != nil {
+			return counterErr
+		}
+
+		// Nothing was recorded, so there is no point in trying another peer
+		if dbPiece == nil {
+			return err
+		}
+
+		if err == nil {
+			infoMsg := fmt.Sprintf("Downloaded piece %d of %s from peer %d.", index, dbTorrent.Name, dbPiece.PeerId)
+			slog.Info(infoMsg)
+			return nil
+		}
+
+		warnMsg := fmt.Sprintf("Attempt %d to download piece %d of %s failed %v", attempt+1, index, dbTorrent.Name, err)
+		slog.Warn(warnMsg)
+	}
+
+	return ErrPieceNotDownloaded
+}
+
+// Serving state of one connection, so blocks don't need the meta info parsed
+// and the pieces queried again. Uploaded bytes are persisted in batches.
+type uploadSession struct {
+	dbTorrent *db.Torrent
+	metaInfo  *torrent.MetaInfo
+	confirmed map[int]bool
+	unsaved   int
+}
+
+func (c *Client) newUploadSession(dbTorrent *db.Torrent) (*uploadSession, error) {
+	metaInfo, err := c.getMetaInfo(dbTorrent)
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name)
+		return nil, err
+	}
+
+	return &uploadSession{dbTorrent: dbTorrent, metaInfo: metaInfo}, nil
+}
+
+// Pieces confirmed after the session started are picked up on their first request
+func (c *Client) isConfirmed(session *uploadSession, index int) (bool, error) {
+	if session.confirmed[index] {
+		return true, nil
+	}
+
+	confirmed, err := c.confirmedPieces(session.dbTorrent.TorrentId)
+	if err != nil {
+		return false, err
+	}
+
+	session.confirmed = confirmed
+
+	return confirmed[index], nil
+}
+
+func (c *Client) readRequestedBlock(session *uploadSession, request torrent.RequestPayload) ([]byte, error) {
+	dbTorrent := session.dbTorrent
+	metaInfo := session.metaInfo
+
+	pieceLength, err := metaInfo.GetPieceLength(int(request.Index))
+	if err != nil {
+		return nil, err
+	}
+
+	// Added as int, so large values can't wrap around
+	begin := int(request.Begin)
+	length := int(request.Length)
+
+	if begin < 0 || length <= 0 || length > torrent.MaxBlockLength || begin+length > pieceLength {
+		return nil, ErrInvalidRequest
+	}
+
+	confirmed, err := c.isConfirmed(session, int(request.Index))
+	if err != nil {
+		return nil, err
+	}
+
+	// Data on disk is only served once its hash was checked
+	if !confirmed {
+		return nil, ErrPieceNotConfirmed
+	}
+
+	block, err := c.readBlock(dbTorrent, metaInfo, int(request.Index), begin, length)
+	if err != nil {
+		slog.Error("Could not read requested block of " + dbTorrent.Name)
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (c *Client) UploadBlock(dbTorrent *db.Torrent, seeder *torrent.Seeder, request torrent.RequestPayload) error {
+	session, err := c.newUploadSession(dbTorrent)
+	if err != nil {
+		return err
+	}
+
+	block, err := c.readRequestedBlock(session, request)
+	if err != nil {
+		// Peers with the Fast Extension are told right away instead of waiting for a timeout
+		seeder.RejectRequest(request)
+		return err
+	}
+
+	uploadedBefore := seeder.Uploaded
+
+	err = seeder.SendBlock(int(request.Index), int(request.Begin), block)
+	if err != nil {
+		return err
+	}
+
+	return c.addTransferred(dbTorrent, 0, seeder.Uploaded-uploadedBefore)
+}
+
+func (c *Client) confirmedPieces(torrentId int) (map[int]bool, error) {
+	dbPieces, err := c.PieceRepo.GetByTorrentId(torrentId)
+	if err != nil {
+		slog.Error("Error on piece database query.")
+		return nil, err
+	}
+
+	// Same piece can be recorded multiple times, once per attempt
+	confirmed := make(map[int]bool)
+	for i := range dbPieces {
+		if dbPieces[i].Confirmed != nil && *dbPieces[i].Confirmed {
+			confirmed[dbPieces[i].Index] = true
+		}
+	}
+
+	return confirmed, nil
+}
+
+// Confirmed pieces in the form of the bitfield message
+func (c *Client) bitfield(dbTorrent *db.Torrent, pieceCount int) ([]byte, error) {
+	confirmed, err := c.confirmedPieces(dbTorrent.TorrentId)
+	if err != nil {
+		return nil, err
+	}
+
+	bitfield := make([]byte, (pieceCount+7)/8)
+	for index := range confirmed {
+		if index >= 0 && index < pieceCount {
+			bitfield[index/8] |= 1 << (7 - index%8)
+		}
+	}
+
+	return bitfield, nil
+}
+
+func (c *Client) getDownloadStatus(dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo) (*DownloadStatus, error) {
+	confirmed, err := c.confirmedPieces(dbTorrent.TorrentId)
+	if err != nil {
+		return nil, err
+	}
+
+	status := DownloadStatus{PieceCount: metaInfo.GetPieceCount()}
+
+	for index := 0; index < status.PieceCount; index++ {
+		if confirmed[index] {
+			continue
+		}
+
+		pieceLength, err := metaInfo.GetPieceLength(index)
+		if err != nil {
+			return nil, err
+		}
+
+		status.MissingPieces = append(status.MissingPieces, index)
+		status.BytesLeft += pieceLength
+	}
+
+	status.Done = len(status.MissingPieces) == 0
+
+	return &status, nil
+}
+
+func (c *Client) CheckDownloadDone(dbTorrent *db.Torrent) (*DownloadStatus, error) {
+	if !c.initialized {
+		return nil, errors.New("Client not initialized.")
+	}
+
+	metaInfo, err := c.getMetaInfo(dbTorrent)
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name)
+		return nil, err
+	}
+
+	status, err := c.getDownloadStatus(dbTorrent, metaInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	justCompleted := status.Done && !dbTorrent.Seeding
+
+	// Torrents added with all of their data never downloaded anything to complete
+	c.transferMutex.Lock()
+	downloaded := dbTorrent.Downloaded > 0
+	c.transferMutex.Unlock()
+
+	dbTorrent.Progress = 100
+	if status.PieceCount > 0 {
+		dbTorrent.Progress = 100 * (status.PieceCount - len(status.MissingPieces)) / status.PieceCount
+	}
+
+	if justCompleted {
+		dbTorrent.Seeding = true
+	}
+
+	err = c.TorrentRepo.Update(dbTorrent)
+	if err != nil {
+		slog.Error("Could not update torrent record.")
+		return nil, err
+	}
+
+	if justCompleted && downloaded {
+		slog.Info("Download of " + dbTorrent.Name + " is done, switching to seeding.")
+
+		// Let tracker know we are done
+		_, err = c.announceWithEvent(context.Background(), dbTorrent, torrent.EventCompleted)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"example.com/torrent"
+)
+
+func buildIncomingHandshake(infoHash []byte, peerId []byte) *bytes.Buffer {
+	buffer := bytes.NewBufferString(torrent.HandshakeMsg)
+	buffer.Write(make([]byte, 8))
+	buffer.Write(infoHash)
+	buffer.Write(peerId)
+
+	return buffer
+}
+
+func testAcceptKnownTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	peerId := torrent.GenerateRandomProtocolId()
+	reader := buildIncomingHandshake(dbTorrent.HashInfo, peerId)
+	writer := bytes.NewBuffer([]byte{})
+
+	// Test
+	seeder, err := client.AcceptHandshake(reader, writer, nil)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !bytes.Equal(seeder.MetaInfo.GetInfoHash(), dbTorrent.HashInfo) {
+		t.Errorf("Wrong torrent looked up %#v", seeder.MetaInfo)
+		return
+	}
+
+	if !bytes.Equal(seeder.SeederInfo.PeerId, peerId) {
+		t.Errorf("Remote peer id not set %#v", seeder.SeederInfo)
+		return
+	}
+
+	answer, err := torrent.ReadHandshake(writer)
+	if err != nil {
+		t.Errorf("Expected handshake to be answered %v", err)
+		return
+	}
+
+	if !bytes.Equal(answer.PeerId, client.Client.ProtocolId) {
+		t.Errorf("Expected our peer id in answer, got %#v", answer.PeerId)
+		return
+	}
+}
+
+func testAcceptUnknownTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	_, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	reader := buildIncomingHandshake(torrent.GenerateRandomProtocolId(), torrent.GenerateRandomProtocolId())
+	writer := bytes.NewBuffer([]byte{})
+
+	// Test
+	seeder, err := client.AcceptHandshake(reader, writer, nil)
+	if err != torrent.ErrUnknownInfoHash {
+		t.Errorf("Expected %v, got %v", torrent.ErrUnknownInfoHash, err)
+		return
+	}
+
+	if seeder != nil {
+		t.Errorf("Did not expect seeder here")
+		return
+	}
+}
+
+func testAcceptSendsExtensionHandshake(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	reader := bytes.NewBufferString(torrent.HandshakeMsg)
+	reader.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0})
+	reader.Write(dbTorrent.HashInfo)
+	reader.Write(torrent.GenerateRandomProtocolId())
+
+	writer := bytes.NewBuffer([]byte{})
+
+	// Test
+	_, err = client.AcceptHandshake(reader, writer, nil)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	_, err = torrent.ReadHandshake(writer)
+	if err != nil {
+		t.Errorf("Expected handshake to be answered %v", err)
+		return
+	}
+
+	msg, err := torrent.Receive(writer)
+	if err != nil || msg.Type != torrent.Extended {
+		t.Errorf("Expected extension handshake after the handshake %#v %v", msg, err)
+		return
+	}
+
+	handshake, err := torrent.ParseExtensionHandshake(msg.Payload.(torrent.ExtendedPayload).Payload)
+	if err != nil || handshake.M[torrent.MetadataExtensionName] == 0 {
+		t.Errorf("Expected ut_metadata to be offered %#v %v", handshake, err)
+	}
+}
+
+func testAcceptSendsAvailability(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	err = setupConfirmedPiece(client, dbTorrent, 1, content[testPieceLength:2*testPieceLength])
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	reader := bytes.NewBufferString(torrent.HandshakeMsg)
+	reader.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04})
+	reader.Write(dbTorrent.HashInfo)
+	reader.Write(torrent.GenerateRandomProtocolId())
+
+	writer := bytes.NewBuffer([]byte{})
+
+	// Test
+	_, err = client.AcceptHandshake(reader, writer, nil)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	_, err = torrent.ReadHandshake(writer)
+	if err != nil {
+		t.Errorf("Expected handshake to be answered %v", err)
+		return
+	}
+
+	msg, err := torrent.Receive(writer)
+	if err != nil || msg.Type != torrent.Bitfield || msg.Payload.(torrent.BitfieldPayload).Bitfield[0] != 0x40 {
+		t.Errorf("Expected confirmed pieces right after the handshake %#v %v", msg, err)
+		return
+	}
+
+	msg, err = torrent.Receive(writer)
+	if err != nil || msg.Type != torrent.Extended {
+		t.Errorf("Expected extension handshake after the bitfield %#v %v", msg, err)
+	}
+}
+
+func testAcceptSendsAllowedFast(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, buildTestContent(), t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	reader := bytes.NewBufferString(torrent.HandshakeMsg)
+	reader.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0x04})
+	reader.Write(dbTorrent.HashInfo)
+	reader.Write(torrent.GenerateRandomProtocolId())
+
+	writer := bytes.NewBuffer([]byte{})
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(80, 4, 4, 200), Port: 6881}
+
+	// Test
+	seeder, err := client.AcceptHandshake(reader, writer, remoteAddr)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !seeder.SeederInfo.IP.Equal(remoteAddr.IP) || seeder.SeederInfo.Port != remoteAddr.Port {
+		t.Errorf("Expected remote address in seeder info, got %#v", seeder.SeederInfo)
+		return
+	}
+
+	_, err = torrent.ReadHandshake(writer)
+	if err != nil {
+		t.Errorf("Expected handshake to be answered %v", err)
+		return
+	}
+
+	msg, err := torrent.Receive(writer)
+	if err != nil || msg.Type != torrent.HaveNone {
+		t.Errorf("Expected have none right after the handshake %#v %v", msg, err)
+		return
+	}
+
+	expected := torrent.GenerateAllowedFastSet(torrent.AllowedFastSetSize, remoteAddr.IP, dbTorrent.HashInfo, seeder.MetaInfo.GetPieceCount())
+	if len(expected) == 0 {
+		t.Errorf("Expected an allowed fast set for the torrent")
+		return
+	}
+
+	for _, index := range expected {
+		msg, err = torrent.Receive(writer)
+		if err != nil || msg.Type != torrent.AllowedFast || msg.Payload.(torrent.AllowedFastPayload).Index != int32(index) {
+			t.Errorf("Expected allowed fast %d, got %#v %v", index, msg, err)
+			return
+		}
+
+		if !seeder.AllowsFast(index) {
+			t.Errorf("Expected piece %d to be allowed fast", index)
+			return
+		}
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Known torrent",
+			dbSchemaPath: schemaPath,
+			testFunction: testAcceptKnownTorrent,
+		},
+		{
+			name:         "Unknown torrent",
+			dbSchemaPath: schemaPath,
+			testFunction: testAcceptUnknownTorrent,
+		},
+		{
+			name:         "Extension handshake follows",
+			dbSchemaPath: schemaPath,
+			testFunction: testAcceptSendsExtensionHandshake,
+		},
+		{
+			name:         "Availability comes first",
+			dbSchemaPath: schemaPath,
+			testFunction: testAcceptSendsAvailability,
+		},
+		{
+			name:         "Allowed fast set follows availability",
+			dbSchemaPath: schemaPath,
+			testFunction: testAcceptSendsAllowedFast,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/torrent"
+)
+
+func recordEvents(dependencies *testCaseDependencies, events *[]string, fail *bool) {
+	response := struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+	}{1800, ""}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*events = append(*events, r.URL.Query().Get("event"))
+
+		if *fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(responseBytes)
+	})
+}
+
+func testStartedOnFirstAnnounce(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := true
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	for i := 0; i < 3; i++ {
+		dbAnnounce, err := client.Announce(dbTorrent)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+
+		// Only the first one reaches the tracker
+		fail = false
+
+		if i < 2 && dbAnnounce.Announciation != torrent.EventStarted {
+			t.Errorf("Expected started to be stored %#v", dbAnnounce)
+			return
+		}
+	}
+
+	wanted := []string{torrent.EventStarted, torrent.EventStarted, torrent.EventNone}
+	if !reflect.DeepEqual(events, wanted) {
+		t.Errorf("Expected events %#v, got %#v", wanted, events)
+		return
+	}
+}
+
+func testStoppedOnPause(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := false
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	_, err = client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Test
+	err = client.PauseTorrent(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !dbTorrent.Paused {
+		t.Errorf("Expected torrent to be paused")
+		return
+	}
+
+	// Resuming announces right away instead of waiting for the schedule
+	err = client.ResumeTorrent(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	wanted := []string{torrent.EventStarted, torrent.EventStopped, torrent.EventStarted}
+	if !reflect.DeepEqual(events, wanted) {
+		t.Errorf("Expected events %#v, got %#v", wanted, events)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve announces %v", err)
+		return
+	}
+
+	if len(dbAnnounces) != 3 || dbAnnounces[1].Announciation != torrent.EventStopped {
+		t.Errorf("Expected stopped to be stored %#v", dbAnnounces)
+		return
+	}
+
+	if !dbAnnounces[1].Done || dbAnnounces[2].Done {
+		t.Errorf("Expected only the announce after resuming to be scheduled %#v", dbAnnounces)
+	}
+}
+
+func testStoppedOnRemove(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := false
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	err = client.RemoveTorrent(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(events, []string{torrent.EventStopped}) {
+		t.Errorf("Expected stopped event, got %#v", events)
+		return
+	}
+
+	removed, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil || removed != nil {
+		t.Errorf("Expected torrent to be removed %v", err)
+		return
+	}
+}
+
+func testCompletedOnDownloadDone(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := false
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0, 1, 2}, nil, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(events, []string{torrent.EventCompleted}) {
+		t.Errorf("Expected completed event, got %#v", events)
+		return
+	}
+}
+
+func testCompletedRetried(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := false
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0, 1, 2}, nil, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	_, err = client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Test
+	fail = true
+
+	_, err = client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Fails once more, then reaches the tracker, after that there is nothing left to tell
+	for i := 0; i < 3; i++ {
+		fail = i == 0
+
+		_, err = client.Announce(dbTorrent)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+	}
+
+	wanted := []string{torrent.EventStarted, torrent.EventCompleted, torrent.EventCompleted, torrent.EventCompleted, torrent.EventNone}
+	if !reflect.DeepEqual(events, wanted) {
+		t.Errorf("Expected events %#v, got %#v", wanted, events)
+	}
+}
+
+func testCompletedClosesPendingAnnounce(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var events []string
+	fail := false
+	recordEvents(dependencies, &events, &fail)
+
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0, 1, 2}, nil, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	_, err = client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve announces %v", err)
+		return
+	}
+
+	pending := 0
+	for i := range dbAnnounces {
+		if !dbAnnounces[i].Done {
+			pending++
+
+			if dbAnnounces[i].Announciation != torrent.EventCompleted {
+				t.Errorf("Expected completed to be the pending announce %#v", dbAnnounces[i])
+			}
+		}
+	}
+
+	if len(dbAnnounces) != 2 || pending != 1 {
+		t.Errorf("Expected one pending announce, got %d of %d", pending, len(dbAnnounces))
+	}
+}
+
+func TestAnnounceEvent(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Started on first announce",
+			dbSchemaPath: schemaPath,
+			testFunction: testStartedOnFirstAnnounce,
+		},
+		{
+			name:         "Stopped on pause",
+			dbSchemaPath: schemaPath,
+			testFunction: testStoppedOnPause,
+		},
+		{
+			name:         "Stopped on remove",
+			dbSchemaPath: schemaPath,
+			testFunction: testStoppedOnRemove,
+		},
+		{
+			name:         "Completed on download done",
+			dbSchemaPath: schemaPath,
+			testFunction: testCompletedOnDownloadDone,
+		},
+		{
+			name:         "Completed retried until it reaches the tracker",
+			dbSchemaPath: schemaPath,
+			testFunction: testCompletedRetried,
+		},
+		{
+			name:         "Completed closes the pending announce",
+			dbSchemaPath: schemaPath,
+			testFunction: testCompletedClosesPendingAnnounce,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
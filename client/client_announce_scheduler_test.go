@@ -0,0 +1,474 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/bencode"
+	"example.com/db"
+)
+
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	waiter := make(chan time.Time, 1)
+	f.waiters = append(f.waiters, waiter)
+
+	return waiter
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeClock) waiterCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.waiters)
+}
+
+func respondWithInterval(dependencies *testCaseDependencies, interval int, minInterval int, announced *int) {
+	response := struct {
+		Interval    int    `bencode:"interval"`
+		MinInterval int    `bencode:"min interval"`
+		Peers       string `bencode:"peers"`
+	}{interval, minInterval, ""}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*announced++
+		w.Write(responseBytes)
+	})
+}
+
+func setupScheduler(client *Client, dependencies *testCaseDependencies, t *testing.T) (*AnnounceScheduler, *fakeClock, error) {
+	clock := newFakeClock()
+	client.Clock = clock
+
+	_, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewAnnounceScheduler(client), clock, nil
+}
+
+func testSchedulerHonoursInterval(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 1800, 0, &announced)
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	nextRun, err := scheduler.RunOnce(context.Background())
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if announced != 1 {
+		t.Errorf("Expected torrent to be announced right away")
+		return
+	}
+
+	if !nextRun.Equal(clock.Now().Add(scheduler.PollInterval)) {
+		t.Errorf("Expected to wake up for polling, got %v", nextRun)
+		return
+	}
+
+	clock.Advance(time.Second * 1799)
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 1 {
+		t.Errorf("Did not expect announce before interval %v", err)
+		return
+	}
+
+	clock.Advance(time.Second)
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 2 {
+		t.Errorf("Expected announce after interval %v", err)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(1)
+	if err != nil {
+		t.Errorf("Could not retrieve announces %v", err)
+		return
+	}
+
+	if len(dbAnnounces) != 2 || !dbAnnounces[0].Done || dbAnnounces[1].Done {
+		t.Errorf("Expected only the first announce to be done %#v", dbAnnounces)
+		return
+	}
+}
+
+func testSchedulerHonoursMinInterval(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 10, 120, &announced)
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(1)
+	if err != nil || len(dbAnnounces) != 1 {
+		t.Errorf("Expected one announce %v", err)
+		return
+	}
+
+	if !dbAnnounces[0].ScheduledTime.Equal(clock.Now().Add(2 * time.Minute)) {
+		t.Errorf("Expected min interval to be honoured %v", dbAnnounces[0].ScheduledTime)
+		return
+	}
+}
+
+func testSchedulerBacksOff(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	for _, wantedBackoff := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		_, err = scheduler.RunOnce(context.Background())
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+
+		dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(1)
+		if err != nil {
+			t.Errorf("Could not retrieve announces %v", err)
+			return
+		}
+
+		last := dbAnnounces[len(dbAnnounces)-1]
+		if !last.ScheduledTime.Equal(clock.Now().Add(wantedBackoff)) {
+			t.Errorf("Expected backoff of %v, got %v", wantedBackoff, last.ScheduledTime.Sub(clock.Now()))
+			return
+		}
+
+		clock.Advance(wantedBackoff)
+	}
+}
+
+func testSchedulerSkipsPaused(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 1800, 0, &announced)
+
+	scheduler, _, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	dbTorrents, err := client.TorrentRepo.GetAll()
+	if err != nil || len(dbTorrents) != 1 {
+		t.Errorf("Could not retrieve torrents %v", err)
+		return
+	}
+
+	dbTorrents[0].Paused = true
+	if err := client.TorrentRepo.Update(&dbTorrents[0]); err != nil {
+		t.Errorf("Could not pause torrent %v", err)
+		return
+	}
+
+	// Test
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 0 {
+		t.Errorf("Did not expect paused torrent to be announced %v", err)
+		return
+	}
+}
+
+func testSchedulerStopsOnCancel(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 1800, 0, &announced)
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	// Test
+	go func() {
+		done <- scheduler.Run(ctx)
+	}()
+
+	for clock.waiterCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+		return
+	}
+
+	if announced != 1 {
+		t.Errorf("Expected one announce before stopping, got %d", announced)
+		return
+	}
+}
+
+func testSchedulerCancelsAnnounce(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	requested := make(chan bool, 1)
+
+	// Tracker never answers, only the cancelled request lets it go
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- true
+		<-r.Context().Done()
+	})
+
+	scheduler, _, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	// Test
+	go func() {
+		done <- scheduler.Run(ctx)
+	}()
+
+	<-requested
+	cancel()
+
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetScheduledAfter(time.Time{})
+	if err != nil || len(dbAnnounces) != 0 {
+		t.Errorf("Did not expect cancelled announce to be recorded %#v %v", dbAnnounces, err)
+	}
+}
+
+func testSchedulerManualAnnounceNotDoubled(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 1800, 0, &announced)
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	dbTorrents, err := client.TorrentRepo.GetAll()
+	if err != nil || len(dbTorrents) != 1 {
+		t.Errorf("Could not retrieve torrent %v", err)
+		return
+	}
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 1 {
+		t.Errorf("Expected torrent to be announced right away %v", err)
+		return
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	// Test
+	_, err = client.Announce(&dbTorrents[0])
+	if err != nil || announced != 2 {
+		t.Errorf("Expected manual announce %v", err)
+		return
+	}
+
+	// Schedule of the first announce is replaced by the manual one
+	clock.Advance(20 * time.Minute)
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 2 {
+		t.Errorf("Did not expect announce of the replaced schedule %d %v", announced, err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Minute)
+
+		_, err = scheduler.RunOnce(context.Background())
+		if err != nil || announced != 3+i {
+			t.Errorf("Expected one announce per interval, got %d %v", announced, err)
+			return
+		}
+
+		clock.Advance(20 * time.Minute)
+
+		_, err = scheduler.RunOnce(context.Background())
+		if err != nil || announced != 3+i {
+			t.Errorf("Did not expect another announce within the interval, got %d %v", announced, err)
+			return
+		}
+	}
+}
+
+func testSchedulerDedupesPending(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	respondWithInterval(dependencies, 1800, 0, &announced)
+
+	scheduler, clock, err := setupScheduler(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Left behind by older versions, only the newer one should be kept
+	for _, offset := range []time.Duration{10 * time.Minute, 20 * time.Minute} {
+		scheduledTime := clock.Now().Add(offset)
+		dbAnnounce := db.TrackerAnnounce{TorrentId: 1, AnnounceTime: clock.Now(), ScheduledTime: &scheduledTime}
+
+		err = client.AnnounceRepo.Create(&dbAnnounce)
+		if err != nil {
+			t.Errorf("Could not create announce %v", err)
+			return
+		}
+	}
+
+	// Test
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 0 {
+		t.Errorf("Did not expect announce yet, got %d %v", announced, err)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(1)
+	if err != nil || len(dbAnnounces) != 2 || !dbAnnounces[0].Done || dbAnnounces[1].Done {
+		t.Errorf("Expected only the newer announce to be pending %#v %v", dbAnnounces, err)
+		return
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 0 {
+		t.Errorf("Did not expect outdated announce to fire, got %d %v", announced, err)
+		return
+	}
+
+	clock.Advance(10 * time.Minute)
+
+	_, err = scheduler.RunOnce(context.Background())
+	if err != nil || announced != 1 {
+		t.Errorf("Expected a single announce, got %d %v", announced, err)
+	}
+}
+
+func TestAnnounceScheduler(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Honours interval",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerHonoursInterval,
+		},
+		{
+			name:         "Honours min interval",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerHonoursMinInterval,
+		},
+		{
+			name:         "Backs off on errors",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerBacksOff,
+		},
+		{
+			name:         "Skips paused torrents",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerSkipsPaused,
+		},
+		{
+			name:         "Stops on cancel",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerStopsOnCancel,
+		},
+		{
+			name:         "Cancels announce in flight",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerCancelsAnnounce,
+		},
+		{
+			name:         "Manual announce does not double the schedule",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerManualAnnounceNotDoubled,
+		},
+		{
+			name:         "Dedupes pending announces",
+			dbSchemaPath: schemaPath,
+			testFunction: testSchedulerDedupesPending,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
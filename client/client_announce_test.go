@@ -2,8 +2,8 @@ package client
 
 import (
 	"bytes"
-	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"testing"
 	"time"
@@ -11,20 +11,13 @@ import (
 	"example.com/bencode"
 	"example.com/db"
 	"example.com/torrent"
+	"example.com/tracker"
 )
 
 var capturedTrackerResponsePath = "../torrent/examples/ubuntu-22.04.3-desktop-amd64.iso.torrent.compact0.announce"
 
-func setupExistingTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) (*db.Torrent, error) {
-	metaInfo := torrent.MetaInfo{
-		Announce: dependencies.trackerServer.URL + "/announce",
-		Info: torrent.GeneralInfo{
-			Name:  "fake",
-			Files: &[]torrent.FileInfo{},
-		},
-	}
-
-	metaInfoBytes, err := bencode.Marshal(metaInfo)
+func setupTorrentFromMetaInfo(client *Client, metaInfo *torrent.MetaInfo, t *testing.T) (*db.Torrent, error) {
+	metaInfoBytes, err := bencode.Marshal(*metaInfo)
 	metaInfoBuffer := bytes.NewBuffer(metaInfoBytes)
 
 	tmpDir, err := os.MkdirTemp("", "")
@@ -48,6 +41,18 @@ func setupExistingTorrent(client *Client, dependencies *testCaseDependencies, t
 	return dbTorrent, nil
 }
 
+func setupExistingTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) (*db.Torrent, error) {
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce",
+		Info: torrent.GeneralInfo{
+			Name:  "fake",
+			Files: &[]torrent.FileInfo{},
+		},
+	}
+
+	return setupTorrentFromMetaInfo(client, &metaInfo, t)
+}
+
 func testAnnounce5xxError(client *Client, dependencies *testCaseDependencies, t *testing.T) {
 	// Setup
 	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -85,31 +90,12 @@ func testAnnounce5xxError(client *Client, dependencies *testCaseDependencies, t
 
 func testAnnounceGivingFailureReason(client *Client, dependencies *testCaseDependencies, t *testing.T) {
 	// Setup
-	bodyResponseStruct := struct {
-		FailureReason string `bencode:"failure reason"`
-	}{
-		FailureReason: "You asked for gibberish",
-	}
-
-	bodyBytes, err := bencode.Marshal(bodyResponseStruct)
-	if err != nil {
-		t.Errorf("Could not marshal response.")
-		return
-	}
+	trackerServer := tracker.NewServer()
+	// Only some other torrent is allowed
+	trackerServer.Allow(torrent.GenerateRandomProtocolId())
 
-	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-
-		n, err := w.Write(bodyBytes)
-		if err != nil {
-			t.Errorf("Could not send back response.")
-			return
-		}
-
-		if n < len(bodyBytes) {
-			t.Errorf("Not all bytes are sent.")
-		}
-	})
+	dependencies.trackerServer.Config.Handler = trackerServer
+	client.Port = 6881
 
 	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
 	if err != nil {
@@ -129,8 +115,8 @@ func testAnnounceGivingFailureReason(client *Client, dependencies *testCaseDepen
 		return
 	}
 
-	if dbAnnounce.Error == nil {
-		t.Errorf("Expected error to be specified.")
+	if dbAnnounce.Error == nil || *dbAnnounce.Error != tracker.ErrInfoHashNotAllowed.Error() {
+		t.Errorf("Expected failure reason to be specified.")
 		return
 	}
 
@@ -142,32 +128,8 @@ func testAnnounceGivingFailureReason(client *Client, dependencies *testCaseDepen
 
 func testAnnounceOK(client *Client, dependencies *testCaseDependencies, t *testing.T) {
 	// Setup
-	announceFile, err := os.Open(capturedTrackerResponsePath)
-	if err != nil {
-		t.Errorf("Could not open announce file.")
-		return
-	}
-
-	announceBytes, err := io.ReadAll(announceFile)
-	if err != nil {
-		t.Errorf("Could not read announce file")
-		return
-	}
-
-	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-
-		n, err := w.Write(announceBytes)
-		if err != nil {
-			t.Errorf("Failed to write announce response")
-			return
-		}
-
-		if n < len(announceBytes) {
-			t.Errorf("Failed to write complete response")
-			return
-		}
-	})
+	dependencies.trackerServer.Config.Handler = tracker.NewServer()
+	client.Port = 6881
 
 	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
 	if err != nil {
@@ -203,6 +165,61 @@ func testAnnounceOK(client *Client, dependencies *testCaseDependencies, t *testi
 	}
 }
 
+func testAnnounceParameters(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	response := struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+	}{1800, ""}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	var queries []url.Values
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write(responseBytes)
+	})
+
+	client.NumWant = 30
+
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce?passkey=secret",
+		Info: torrent.GeneralInfo{
+			Name:  "fake",
+			Files: &[]torrent.FileInfo{},
+		},
+	}
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, &metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	for i := 0; i < 2; i++ {
+		_, err = client.Announce(dbTorrent)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+	}
+
+	for _, query := range queries {
+		if query.Get("passkey") != "secret" || query.Get("compact") != "1" || query.Get("numwant") != "30" {
+			t.Errorf("Unexpected announce parameters %#v", query)
+			return
+		}
+	}
+
+	// Key stays the same for the session
+	if queries[0].Get("key") == "" || queries[0].Get("key") != queries[1].Get("key") {
+		t.Errorf("Expected stable key %#v", queries)
+		return
+	}
+}
+
 func TestAnnounce(t *testing.T) {
 	testCases := []testCase{
 		{
@@ -220,6 +237,11 @@ func TestAnnounce(t *testing.T) {
 			dbSchemaPath: schemaPath,
 			testFunction: testAnnounceOK,
 		},
+		{
+			name:         "Announce parameters",
+			dbSchemaPath: schemaPath,
+			testFunction: testAnnounceParameters,
+		},
 	}
 
 	for i := range testCases {
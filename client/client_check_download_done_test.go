@@ -0,0 +1,238 @@
+package client
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+func addPieceRecord(client *Client, dbTorrent *db.Torrent, dbPeer *db.Peer, index int, confirmed bool) error {
+	end := time.Now()
+
+	dbPiece := db.Piece{
+		TorrentId:    dbTorrent.TorrentId,
+		PeerId:       dbPeer.PeerId,
+		IsDownloaded: true,
+		Start:        end,
+		End:          &end,
+		Index:        index,
+		Confirmed:    &confirmed,
+	}
+
+	err := client.PieceRepo.Create(&dbPiece)
+	if err != nil {
+		return err
+	}
+
+	return client.addTransferred(dbTorrent, testPieceLength, 0)
+}
+
+func setupPieceRecords(client *Client, dependencies *testCaseDependencies, confirmedPieces []int, unconfirmedPieces []int, t *testing.T) (*db.Torrent, error) {
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, buildTestContent(), t)
+	if err != nil {
+		return nil, err
+	}
+
+	dbPeer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: torrent.GenerateRandomProtocolId(), IP: "127.0.0.1", Port: 6881, Reachable: true}
+
+	err = client.PeerRepo.Create(&dbPeer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range unconfirmedPieces {
+		if err := addPieceRecord(client, dbTorrent, &dbPeer, index, false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, index := range confirmedPieces {
+		if err := addPieceRecord(client, dbTorrent, &dbPeer, index, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return dbTorrent, nil
+}
+
+func testNothingDownloaded(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupPieceRecords(client, dependencies, nil, nil, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	status, err := client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if status.Done || !reflect.DeepEqual(status.MissingPieces, []int{0, 1, 2}) || status.BytesLeft != len(buildTestContent()) {
+		t.Errorf("Unexpected status %#v", status)
+		return
+	}
+
+	if dbTorrent.Progress != 0 || dbTorrent.Seeding {
+		t.Errorf("Unexpected torrent state %#v", dbTorrent)
+		return
+	}
+}
+
+func testPartiallyDownloaded(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0}, []int{0, 2}, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	status, err := client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if status.Done || !reflect.DeepEqual(status.MissingPieces, []int{1, 2}) || status.BytesLeft != testPieceLength+1000 {
+		t.Errorf("Unexpected status %#v", status)
+		return
+	}
+
+	storedTorrent, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil {
+		t.Errorf("Could not retrieve torrent %v", err)
+		return
+	}
+
+	if storedTorrent.Progress != 33 {
+		t.Errorf("Expected progress to be stored %#v", storedTorrent)
+		return
+	}
+}
+
+func testDownloadDone(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0, 1, 2}, nil, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	status, err := client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !status.Done || len(status.MissingPieces) != 0 || status.BytesLeft != 0 {
+		t.Errorf("Unexpected status %#v", status)
+		return
+	}
+
+	if dbTorrent.Progress != 100 || !dbTorrent.Seeding {
+		t.Errorf("Expected torrent to be seeding %#v", dbTorrent)
+		return
+	}
+
+	dbAnnounces, err := client.AnnounceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve announces %v", err)
+		return
+	}
+
+	if len(dbAnnounces) != 1 || announced != 1 {
+		t.Errorf("Expected tracker to be told about completion %#v", dbAnnounces)
+		return
+	}
+
+	// Checking again should not announce again
+	_, err = client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if announced != 1 {
+		t.Errorf("Did not expect another announce")
+		return
+	}
+}
+
+func testCompleteWhenAdded(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	announced := 0
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// Nothing to download at all
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	status, err := client.CheckDownloadDone(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if !status.Done || !dbTorrent.Seeding {
+		t.Errorf("Expected torrent to be seeding %#v %#v", status, dbTorrent)
+		return
+	}
+
+	if announced != 0 {
+		t.Errorf("Did not expect completed to be announced")
+	}
+}
+
+func TestCheckDownloadDone(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Nothing downloaded",
+			dbSchemaPath: schemaPath,
+			testFunction: testNothingDownloaded,
+		},
+		{
+			name:         "Partially downloaded",
+			dbSchemaPath: schemaPath,
+			testFunction: testPartiallyDownloaded,
+		},
+		{
+			name:         "Download done",
+			dbSchemaPath: schemaPath,
+			testFunction: testDownloadDone,
+		},
+		{
+			name:         "Complete when added",
+			dbSchemaPath: schemaPath,
+			testFunction: testCompleteWhenAdded,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+type fakeDHT struct {
+	peers         []torrent.PeerInfo
+	announcedHash []byte
+	announcedPort int
+}
+
+func (f *fakeDHT) GetPeers(ctx context.Context, infoHash []byte) ([]torrent.PeerInfo, error) {
+	return f.peers, nil
+}
+
+func (f *fakeDHT) AnnouncePeer(ctx context.Context, infoHash []byte, port int) error {
+	f.announcedHash = infoHash
+	f.announcedPort = port
+	return nil
+}
+
+func testDiscoverDHTPeers(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "dht", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Already known from a tracker
+	known := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: []byte{}, IP: "10.0.0.1", Port: 6881, Reachable: true}
+	err = client.PeerRepo.Create(&known)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	fake := fakeDHT{
+		peers: []torrent.PeerInfo{
+			{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+			{IP: net.ParseIP("10.0.0.2"), Port: 6882},
+		},
+	}
+
+	client.DHT = &fake
+	client.Port = 6889
+
+	// Test
+	dbPeers, err := client.DiscoverDHTPeers(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(dbPeers) != 1 || dbPeers[0].IP != "10.0.0.2" || dbPeers[0].Port != 6882 || dbPeers[0].Source != db.PeerSourceDHT {
+		t.Errorf("Expected only the new peer to be created %#v", dbPeers)
+		return
+	}
+
+	allPeers, err := client.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil || len(allPeers) != 2 {
+		t.Errorf("Expected 2 peers in repository %v %#v", err, allPeers)
+		return
+	}
+
+	if !bytes.Equal(fake.announcedHash, dbTorrent.HashInfo) || fake.announcedPort != 6889 {
+		t.Errorf("Expected announce of %x on 6889, got %x on %d", dbTorrent.HashInfo, fake.announcedHash, fake.announcedPort)
+	}
+}
+
+func testDiscoverDHTPeersPrivateTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	private := 1
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce",
+		Info: torrent.GeneralInfo{
+			Name:    "private",
+			Files:   &[]torrent.FileInfo{},
+			Private: &private,
+		},
+	}
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, &metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	fake := fakeDHT{peers: []torrent.PeerInfo{{IP: net.ParseIP("10.0.0.2"), Port: 6882}}}
+	client.DHT = &fake
+
+	// Test
+	_, err = client.DiscoverDHTPeers(dbTorrent)
+	if err != ErrPrivateTorrent {
+		t.Errorf("Expected ErrPrivateTorrent, got %v", err)
+		return
+	}
+
+	if fake.announcedHash != nil {
+		t.Errorf("Did not expect private torrent to be announced")
+	}
+}
+
+func testDiscoverDHTPeersDisabled(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "dht", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.DiscoverDHTPeers(dbTorrent)
+	if err != ErrDHTDisabled {
+		t.Errorf("Expected ErrDHTDisabled, got %v", err)
+	}
+}
+
+func testInitializeAssignsDHTNodeId(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbClient := db.Client{ProtocolId: torrent.GenerateRandomProtocolId()}
+	err := client.ClientRepo.Create(&dbClient)
+	if err != nil {
+		t.Errorf("Could not create pre-made client %v", err)
+		return
+	}
+
+	// Test
+	err = client.Initialize()
+	if err != nil {
+		t.Errorf("Could not initialize client %v", err)
+		return
+	}
+
+	if len(client.Client.DHTNodeId) != 20 {
+		t.Errorf("Expected DHT node id, got %x", client.Client.DHTNodeId)
+		return
+	}
+
+	saved, err := client.ClientRepo.GetLast()
+	if err != nil || !bytes.Equal(saved.DHTNodeId, client.Client.DHTNodeId) {
+		t.Errorf("Expected DHT node id to be saved %v %#v", err, saved)
+	}
+}
+
+func TestDHT(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Discovered peers are stored",
+			dbSchemaPath: schemaPath,
+			testFunction: testDiscoverDHTPeers,
+		},
+		{
+			name:         "Private torrents are not looked up",
+			dbSchemaPath: schemaPath,
+			testFunction: testDiscoverDHTPeersPrivateTorrent,
+		},
+		{
+			name:         "DHT disabled",
+			dbSchemaPath: schemaPath,
+			testFunction: testDiscoverDHTPeersDisabled,
+		},
+		{
+			name:         "Initialize assigns DHT node id",
+			dbSchemaPath: schemaPath,
+			testFunction: testInitializeAssignsDHTNodeId,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].name, func(t *testing.T) {
+			runTestCase(&testCases[i], t)
+		})
+	}
+}
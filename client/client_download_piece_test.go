@@ -0,0 +1,349 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+var testPieceLength = 2 * torrent.BlockSize
+
+func buildTestContent() []byte {
+	content := make([]byte, 2*testPieceLength+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	return content
+}
+
+func setupTorrentWithContent(client *Client, dependencies *testCaseDependencies, content []byte, t *testing.T) (*db.Torrent, error) {
+	var pieces []byte
+	for start := 0; start < len(content); start += testPieceLength {
+		hash := sha1.Sum(content[start:min(start+testPieceLength, len(content))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	length := len(content)
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce",
+		Info: torrent.GeneralInfo{
+			Name:        "content",
+			PieceLength: testPieceLength,
+			Pieces:      string(pieces),
+			Length:      &length,
+		},
+	}
+
+	return setupTorrentFromMetaInfo(client, &metaInfo, t)
+}
+
+// Writes the piece to disk and records it as downloaded by a peer and confirmed
+func setupConfirmedPiece(client *Client, dbTorrent *db.Torrent, index int, data []byte) error {
+	metaInfo, err := client.getMetaInfo(dbTorrent)
+	if err != nil {
+		return err
+	}
+
+	err = client.writePiece(dbTorrent, metaInfo, index, data)
+	if err != nil {
+		return err
+	}
+
+	dbPeer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: torrent.GenerateRandomProtocolId(), IP: "127.0.0.1", Port: 6881, Reachable: true}
+
+	err = client.PeerRepo.Create(&dbPeer)
+	if err != nil {
+		return err
+	}
+
+	confirmed := true
+	dbPiece := db.Piece{TorrentId: dbTorrent.TorrentId, PeerId: dbPeer.PeerId, IsDownloaded: true, Start: time.Now(), Index: index, Length: len(data), Confirmed: &confirmed}
+
+	return client.PieceRepo.Create(&dbPiece)
+}
+
+func serveContent(content []byte, corrupt bool) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		pieceCount := (len(content) + testPieceLength - 1) / testPieceLength
+		bitfield := make([]byte, (pieceCount+7)/8)
+		for i := 0; i < pieceCount; i++ {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+
+		for {
+			msg, err := torrent.Receive(conn)
+			if err != nil {
+				return
+			}
+
+			switch msg.Type {
+			case torrent.Interested:
+				torrent.Send(conn, &torrent.PeerMessage{Type: torrent.Bitfield, Payload: torrent.BitfieldPayload{Bitfield: bitfield}})
+				torrent.Send(conn, &torrent.UnchokeMessage)
+			case torrent.Request:
+				request := msg.Payload.(torrent.RequestPayload)
+				start := int(request.Index)*testPieceLength + int(request.Begin)
+
+				block := make([]byte, request.Length)
+				copy(block, content[start:])
+
+				if corrupt {
+					block[0]++
+				}
+
+				torrent.Send(conn, &torrent.PeerMessage{Type: torrent.Piece, Payload: torrent.PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+			}
+		}
+	}
+}
+
+func addFakePeer(client *Client, dbTorrent *db.Torrent, corrupt bool, content []byte) (*fakePeer, *db.Peer, error) {
+	peerId := torrent.GenerateRandomProtocolId()
+
+	remote, err := startFakePeer(dbTorrent.HashInfo, peerId, serveContent(content, corrupt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbPeer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: peerId, IP: "127.0.0.1", Port: remote.port(), Reachable: true}
+
+	err = client.PeerRepo.Create(&dbPeer)
+	if err != nil {
+		remote.close()
+		return nil, nil, err
+	}
+
+	return remote, &dbPeer, nil
+}
+
+func testDownloadAllPieces(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, dbPeer, err := addFakePeer(client, dbTorrent, false, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	// Test
+	for index := 0; index < 3; index++ {
+		err = client.DownloadPiece(dbTorrent, index)
+		if err != nil {
+			t.Errorf("Did not expect error on piece %d %v", index, err)
+			return
+		}
+	}
+
+	downloaded, err := os.ReadFile(path.Join(dbTorrent.Location, dbTorrent.Name, dbTorrent.Name))
+	if err != nil {
+		t.Errorf("Could not read downloaded file %v", err)
+		return
+	}
+
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("Downloaded content differs")
+		return
+	}
+
+	dbPieces, err := client.PieceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve pieces %v", err)
+		return
+	}
+
+	if len(dbPieces) != 3 {
+		t.Errorf("Expected 3 pieces, got %#v", dbPieces)
+		return
+	}
+
+	for i := range dbPieces {
+		piece := dbPieces[i]
+
+		if piece.PeerId != dbPeer.PeerId || !piece.IsDownloaded || piece.End == nil || piece.Confirmed == nil || !*piece.Confirmed {
+			t.Errorf("Piece not recorded properly %#v", piece)
+			return
+		}
+	}
+
+	if dbPieces[2].Length != 1000 {
+		t.Errorf("Expected last piece to be shorter %#v", dbPieces[2])
+		return
+	}
+}
+
+func testDownloadRetriesAfterHashMismatch(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	corruptRemote, corruptPeer, err := addFakePeer(client, dbTorrent, true, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer corruptRemote.close()
+
+	goodRemote, goodPeer, err := addFakePeer(client, dbTorrent, false, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer goodRemote.close()
+
+	// Test
+	err = client.DownloadPiece(dbTorrent, 1)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	dbPieces, err := client.PieceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve pieces %v", err)
+		return
+	}
+
+	if len(dbPieces) != 2 {
+		t.Errorf("Expected 2 attempts, got %#v", dbPieces)
+		return
+	}
+
+	if dbPieces[0].PeerId != corruptPeer.PeerId || *dbPieces[0].Confirmed {
+		t.Errorf("Expected first attempt to be unconfirmed %#v", dbPieces[0])
+		return
+	}
+
+	if dbPieces[1].PeerId != goodPeer.PeerId || !*dbPieces[1].Confirmed {
+		t.Errorf("Expected second attempt to be confirmed %#v", dbPieces[1])
+		return
+	}
+}
+
+func testDownloadOnlyCorruptPeers(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, _, err := addFakePeer(client, dbTorrent, true, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	// Test
+	err = client.DownloadPiece(dbTorrent, 0)
+	if err != ErrPieceNotDownloaded {
+		t.Errorf("Expected %v, got %v", ErrPieceNotDownloaded, err)
+		return
+	}
+
+	dbPieces, err := client.PieceRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve pieces %v", err)
+		return
+	}
+
+	for i := range dbPieces {
+		if dbPieces[i].Confirmed == nil || *dbPieces[i].Confirmed {
+			t.Errorf("Expected piece to be unconfirmed %#v", dbPieces[i])
+			return
+		}
+	}
+}
+
+func testPipelineCarriedOver(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, _, err := addFakePeer(client, dbTorrent, false, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	err = client.DownloadPiece(dbTorrent, 0)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Test
+	seeder, err := client.buildSeeder(dbTorrent, 1)
+	if err != nil {
+		t.Errorf("Could not build seeder %v", err)
+		return
+	}
+	defer seeder.Close()
+
+	// Fresh seeders start at DefaultPipelineDepth, measured ones were adapted
+	if seeder.PipelineDepth == 0 || seeder.PipelineState() != client.pipelines[pipelineKey(seeder)] {
+		t.Errorf("Expected pipeline of the first piece to be carried over, got depth %d", seeder.PipelineDepth)
+	}
+}
+
+func TestDownloadPiece(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Download all pieces",
+			dbSchemaPath: schemaPath,
+			testFunction: testDownloadAllPieces,
+		},
+		{
+			name:         "Retry after hash mismatch",
+			dbSchemaPath: schemaPath,
+			testFunction: testDownloadRetriesAfterHashMismatch,
+		},
+		{
+			name:         "Only corrupt peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testDownloadOnlyCorruptPeers,
+		},
+		{
+			name:         "Pipeline carried over between pieces",
+			dbSchemaPath: schemaPath,
+			testFunction: testPipelineCarriedOver,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+type fakePacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// In memory PacketConn, packets are pushed with deliver and collected in written
+type fakePacketConn struct {
+	incoming chan fakePacket
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex   sync.Mutex
+	written []fakePacket
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{incoming: make(chan fakePacket, 16), closed: make(chan struct{})}
+}
+
+func (f *fakePacketConn) deliver(data []byte, addr net.Addr) {
+	f.incoming <- fakePacket{data: data, addr: addr}
+}
+
+func (f *fakePacketConn) writtenPackets() []fakePacket {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]fakePacket{}, f.written...)
+}
+
+func (f *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	// Packets delivered before Close are still read
+	select {
+	case packet := <-f.incoming:
+		return copy(p, packet.data), packet.addr, nil
+	default:
+	}
+
+	select {
+	case packet := <-f.incoming:
+		return copy(p, packet.data), packet.addr, nil
+	case <-f.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (f *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.written = append(f.written, fakePacket{data: append([]byte{}, p...), addr: addr})
+	return len(p), nil
+}
+
+func (f *fakePacketConn) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakePacketConn) LocalAddr() net.Addr                { return LSDGroupIPv4 }
+func (f *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (f *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func testLSDAnnounce(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "lsd", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	clock := newFakeClock()
+	client.Clock = clock
+	client.Port = 6881
+
+	conn := newFakePacketConn()
+	lsd := NewLSD(client, conn)
+
+	// Test
+	err = lsd.Announce()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	written := conn.writtenPackets()
+	if len(written) != 1 || written[0].addr != LSDGroupIPv4 {
+		t.Errorf("Expected one multicast packet %#v", written)
+		return
+	}
+
+	announce, err := parseLSDAnnounce(written[0].data)
+	if err != nil {
+		t.Errorf("Could not parse own announce %v %q", err, written[0].data)
+		return
+	}
+
+	if announce.port != 6881 || len(announce.infoHashes) != 1 || !bytes.Equal(announce.infoHashes[0], dbTorrent.HashInfo) || announce.cookie != lsd.cookie {
+		t.Errorf("Unexpected announce %#v", announce)
+		return
+	}
+
+	if !strings.HasPrefix(string(written[0].data), "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\n") {
+		t.Errorf("Unexpected announce header %q", written[0].data)
+		return
+	}
+
+	// Rate limited
+	lsd.Announce()
+	if len(conn.writtenPackets()) != 1 {
+		t.Errorf("Expected no announce within the minimum interval")
+		return
+	}
+
+	clock.Advance(defaultLSDMinInterval)
+
+	lsd.Announce()
+	if len(conn.writtenPackets()) != 2 {
+		t.Errorf("Expected announce after the minimum interval")
+	}
+}
+
+func testLSDReceive(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "lsd", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	clock := newFakeClock()
+	client.Clock = clock
+
+	conn := newFakePacketConn()
+	lsd := NewLSD(client, conn)
+
+	done := make(chan error)
+	go func() { done <- lsd.Serve() }()
+
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 6771}
+	unknownHash := torrent.GenerateRandomProtocolId()
+
+	announce := lsdAnnounce{port: 51413, infoHashes: [][]byte{unknownHash, dbTorrent.HashInfo}, cookie: "other"}
+
+	// Test
+	conn.deliver(encodeLSDAnnounce(lsd.host(), &announce), from)
+	// Our own announcements come back as well
+	own := lsdAnnounce{port: 6881, infoHashes: [][]byte{dbTorrent.HashInfo}, cookie: lsd.cookie}
+	conn.deliver(encodeLSDAnnounce(lsd.host(), &own), &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 6771})
+	conn.deliver([]byte("garbage"), from)
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	dbPeers, err := client.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(dbPeers) != 1 || dbPeers[0].IP != "192.168.1.20" || dbPeers[0].Port != 51413 || dbPeers[0].Source != db.PeerSourceLSD {
+		t.Errorf("Expected one LSD peer %#v", dbPeers)
+	}
+}
+
+func testLSDReceiveRateLimited(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "lsd", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	clock := newFakeClock()
+	client.Clock = clock
+
+	lsd := NewLSD(client, newFakePacketConn())
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 6771}
+
+	first := lsdAnnounce{port: 51413, infoHashes: [][]byte{dbTorrent.HashInfo}}
+	second := lsdAnnounce{port: 51414, infoHashes: [][]byte{dbTorrent.HashInfo}}
+
+	// Test
+	dbPeers, err := lsd.handleAnnounce(encodeLSDAnnounce(lsd.host(), &first), from)
+	if err != nil || len(dbPeers) != 1 {
+		t.Errorf("Expected peer from first announce %v %#v", err, dbPeers)
+		return
+	}
+
+	dbPeers, err = lsd.handleAnnounce(encodeLSDAnnounce(lsd.host(), &second), from)
+	if err != nil || len(dbPeers) != 0 {
+		t.Errorf("Expected second announce to be ignored %v %#v", err, dbPeers)
+		return
+	}
+
+	clock.Advance(defaultLSDMinInterval)
+
+	dbPeers, err = lsd.handleAnnounce(encodeLSDAnnounce(lsd.host(), &second), from)
+	if err != nil || len(dbPeers) != 1 || dbPeers[0].Port != 51414 {
+		t.Errorf("Expected announce after the minimum interval %v %#v", err, dbPeers)
+	}
+}
+
+func testLSDDisabled(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	_, err := setupNamedTorrent(client, dependencies, "lsd", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	client.DisableLSD = true
+
+	conn := newFakePacketConn()
+	lsd := NewLSD(client, conn)
+
+	// Test
+	if err := lsd.Announce(); err != ErrLSDDisabled {
+		t.Errorf("Expected ErrLSDDisabled, got %v", err)
+	}
+
+	if err := lsd.Serve(); err != ErrLSDDisabled {
+		t.Errorf("Expected ErrLSDDisabled, got %v", err)
+	}
+
+	if len(conn.writtenPackets()) != 0 {
+		t.Errorf("Did not expect anything to be sent")
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	infoHash := "0123456789abcdef0123456789abcdef01234567"
+
+	valid := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n\r\n"
+
+	announce, err := parseLSDAnnounce([]byte(valid))
+	if err != nil || announce.port != 6881 || hex.EncodeToString(announce.infoHashes[0]) != infoHash {
+		t.Errorf("Unexpected announce %v %#v", err, announce)
+	}
+
+	invalid := []string{
+		"GET / HTTP/1.1\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + infoHash + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	}
+
+	for _, data := range invalid {
+		_, err := parseLSDAnnounce([]byte(data))
+		if err != ErrInvalidLSDMessage {
+			t.Errorf("Expected ErrInvalidLSDMessage on %q, got %v", data, err)
+		}
+	}
+}
+
+func testLSDReceivedPruned(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	clock := newFakeClock()
+	client.Clock = clock
+
+	lsd := NewLSD(client, newFakePacketConn())
+	announce := lsdAnnounce{port: 51413, infoHashes: [][]byte{torrent.GenerateRandomProtocolId()}}
+
+	// Test
+	for i := 1; i <= 3; i++ {
+		from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i)), Port: 6771}
+
+		_, err := lsd.handleAnnounce(encodeLSDAnnounce(lsd.host(), &announce), from)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			return
+		}
+	}
+
+	clock.Advance(defaultLSDMinInterval)
+
+	from := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 6771}
+
+	_, err := lsd.handleAnnounce(encodeLSDAnnounce(lsd.host(), &announce), from)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(lsd.received) != 1 {
+		t.Errorf("Expected expired senders to be forgotten, got %d entries", len(lsd.received))
+	}
+}
+
+func TestLSD(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Active torrents are announced",
+			dbSchemaPath: schemaPath,
+			testFunction: testLSDAnnounce,
+		},
+		{
+			name:         "Received announcements become peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testLSDReceive,
+		},
+		{
+			name:         "Received announcements are rate limited",
+			dbSchemaPath: schemaPath,
+			testFunction: testLSDReceiveRateLimited,
+		},
+		{
+			name:         "Expired rate limits are forgotten",
+			dbSchemaPath: schemaPath,
+			testFunction: testLSDReceivedPruned,
+		},
+		{
+			name:         "LSD can be turned off",
+			dbSchemaPath: schemaPath,
+			testFunction: testLSDDisabled,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].name, func(t *testing.T) {
+			runTestCase(&testCases[i], t)
+		})
+	}
+}
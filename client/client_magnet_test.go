@@ -0,0 +1,272 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// Answers handshakes with the extension bit set and serves the metadata of metaInfo
+func startMetadataPeer(metaInfo *torrent.MetaInfo) (*fakePeer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	peer := fakePeer{listener: listener, infoHash: metaInfo.GetInfoHash(), peerId: torrent.GenerateRandomProtocolId()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveMetadata(conn, &peer, metaInfo)
+		}
+	}()
+
+	return &peer, nil
+}
+
+func serveMetadata(conn net.Conn, peer *fakePeer, metaInfo *torrent.MetaInfo) {
+	defer conn.Close()
+
+	remoteHandshake, err := torrent.ReadHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	answer := bytes.NewBufferString(torrent.HandshakeMsg)
+	answer.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0})
+	answer.Write(peer.infoHash)
+	answer.Write(peer.peerId)
+
+	_, err = conn.Write(answer.Bytes())
+	if err != nil {
+		return
+	}
+
+	registry := torrent.NewExtensionRegistry()
+	registry.Register(torrent.MetadataExtensionName, torrent.MetadataHandler{})
+
+	seeder := torrent.Seeder{SeederReader: conn, SeederWriter: conn, MetaInfo: metaInfo, Extensions: registry, RemoteHandshake: remoteHandshake}
+
+	if seeder.SendExtensionHandshake() != nil {
+		return
+	}
+
+	for {
+		msg, err := torrent.Receive(conn)
+		if err != nil {
+			return
+		}
+
+		if msg.Type == torrent.Extended {
+			seeder.HandleExtended(msg.Payload.(torrent.ExtendedPayload))
+		}
+	}
+}
+
+func readHelloWorldMetaInfo() (*torrent.MetaInfo, error) {
+	file, err := os.Open(helloWorldTorrentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return torrent.ParseMetaInfo(file)
+}
+
+func testOpenMagnet(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	metaInfo, err := readHelloWorldMetaInfo()
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, err := startMetadataPeer(metaInfo)
+	if err != nil {
+		t.Errorf("Could not start fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	err = client.Initialize()
+	if err != nil {
+		t.Errorf("Could not initialize client %v", err)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Errorf("Could not create test directory %v", err)
+		return
+	}
+
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=hello&x.pe=127.0.0.1:%d", hex.EncodeToString(metaInfo.GetInfoHash()), remote.port())
+
+	// Test
+	dbTorrent, err := client.OpenMagnet(uri, tmpDir)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if !bytes.Equal(dbTorrent.HashInfo, metaInfo.GetInfoHash()) || dbTorrent.Name != metaInfo.Info.Name {
+		t.Errorf("Expected torrent of the magnet link %#v", dbTorrent)
+		return
+	}
+
+	peers, err := client.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil || len(peers) != 1 || peers[0].Port != remote.port() || peers[0].Source != db.PeerSourceMagnet {
+		t.Errorf("Expected peer of the magnet link to be stored %v %#v", err, peers)
+	}
+}
+
+func testOpenMagnetNoPeerHasMetadata(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	deadPort, err := closedPort()
+	if err != nil {
+		t.Errorf("Could not find closed port %v", err)
+		return
+	}
+
+	err = client.Initialize()
+	if err != nil {
+		t.Errorf("Could not initialize client %v", err)
+		return
+	}
+
+	infoHash := torrent.GenerateRandomProtocolId()
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&x.pe=127.0.0.1:%d", hex.EncodeToString(infoHash), deadPort)
+
+	// Test
+	_, err = client.OpenMagnet(uri, os.TempDir())
+	if err != ErrMetadataNotFound {
+		t.Errorf("Expected ErrMetadataNotFound, got %v", err)
+		return
+	}
+
+	dbTorrent, err := client.TorrentRepo.GetByHashInfo(infoHash)
+	if err != nil || dbTorrent != nil {
+		t.Errorf("Expected no torrent to be created %v %#v", err, dbTorrent)
+	}
+}
+
+func testOpenMagnetInvalid(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	err := client.Initialize()
+	if err != nil {
+		t.Errorf("Could not initialize client %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.OpenMagnet("magnet:?dn=nothing", os.TempDir())
+	if err != torrent.ErrMagnetInfoHashMissing {
+		t.Errorf("Expected ErrMagnetInfoHashMissing, got %v", err)
+	}
+}
+
+func testOpenMagnetUnsafeMetadata(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	length := 1
+	encoded, err := bencode.Marshal(torrent.MetaInfo{Info: torrent.GeneralInfo{Name: "..", PieceLength: 1, Pieces: strings.Repeat("x", 20), Length: &length}})
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	metaInfo, err := torrent.ParseMetaInfo(bytes.NewReader(encoded))
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, err := startMetadataPeer(metaInfo)
+	if err != nil {
+		t.Errorf("Could not start fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	err = client.Initialize()
+	if err != nil {
+		t.Errorf("Could not initialize client %v", err)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Errorf("Could not create test directory %v", err)
+		return
+	}
+	downloadPath := path.Join(tmpDir, "downloads")
+	err = os.Mkdir(downloadPath, 0755)
+	if err != nil {
+		t.Errorf("Could not create download directory %v", err)
+		return
+	}
+
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&x.pe=127.0.0.1:%d", hex.EncodeToString(metaInfo.GetInfoHash()), remote.port())
+
+	// Test
+	_, err = client.OpenMagnet(uri, downloadPath)
+	if err != torrent.ErrUnsafePath {
+		t.Errorf("Expected ErrUnsafePath, got %v", err)
+		return
+	}
+
+	dbTorrent, err := client.TorrentRepo.GetByHashInfo(metaInfo.GetInfoHash())
+	if err != nil || dbTorrent != nil {
+		t.Errorf("Expected no torrent to be created %v %#v", err, dbTorrent)
+		return
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected nothing created next to the download directory %v %v", entries, err)
+	}
+}
+
+func TestOpenMagnet(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Metadata is fetched from magnet peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenMagnet,
+		},
+		{
+			name:         "No peer has the metadata",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenMagnetNoPeerHasMetadata,
+		},
+		{
+			name:         "Magnet link without info hash",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenMagnetInvalid,
+		},
+		{
+			name:         "Metadata with unsafe file names",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenMagnetUnsafeMetadata,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].name, func(t *testing.T) {
+			runTestCase(&testCases[i], t)
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package client
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"path"
 	"strings"
 	"testing"
+
+	"example.com/bencode"
+	"example.com/torrent"
 )
 
 var helloWorldTorrentPath = "../torrent/examples/hello_world.torrent"
@@ -141,6 +145,86 @@ func testOpenFewTimes(client *Client, dependencies *testCaseDependencies, t *tes
 	})
 }
 
+func testOpenUnsafePaths(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Errorf("Could not create temp dir %v", err)
+		return
+	}
+	downloadPath := path.Join(tmpDir, "downloads")
+	err = os.Mkdir(downloadPath, 0755)
+	if err != nil {
+		t.Errorf("Could not create download dir %v", err)
+		return
+	}
+
+	infos := []torrent.GeneralInfo{
+		{Name: "..", PieceLength: 1, Files: &[]torrent.FileInfo{{Length: 1, Path: []string{"escaped"}}}},
+		{Name: "fake", PieceLength: 1, Files: &[]torrent.FileInfo{{Length: 1, Path: []string{"..", "..", "escaped"}}}},
+	}
+
+	// Test
+	for _, info := range infos {
+		metaInfoBytes, err := bencode.Marshal(torrent.MetaInfo{Announce: "http://localhost/announce", Info: info})
+		if err != nil {
+			t.Errorf("Could not marshal metainfo %v", err)
+			return
+		}
+
+		dbTorrent, err := client.OpenTorrent(bytes.NewReader(metaInfoBytes), downloadPath)
+		if err != torrent.ErrUnsafePath {
+			t.Errorf("Expected unsafe path error, got %v", err)
+			return
+		}
+
+		if dbTorrent != nil {
+			t.Errorf("Expected nil here")
+			return
+		}
+	}
+
+	entries, err := os.ReadDir(downloadPath)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected nothing created, got %v %v", entries, err)
+		return
+	}
+}
+
+func testOpenDirectoryMode(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	fileReader, err := os.Open(helloWorldTorrentPath)
+	if err != nil {
+		t.Errorf("Could not open test file %v", err)
+		return
+	}
+	defer fileReader.Close()
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Errorf("Could not create temp dir %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.OpenTorrent(fileReader, tmpDir)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	stat, err := os.Stat(path.Join(tmpDir, "hello_world"))
+	if err != nil {
+		t.Errorf("Could not stat torrent directory %v", err)
+		return
+	}
+
+	if stat.Mode().Perm()&0700 != 0700 {
+		t.Errorf("Expected owner access to torrent directory, got %v", stat.Mode())
+		return
+	}
+}
+
 func TestOpenTorrent(t *testing.T) {
 	testCases := []testCase{
 		{
@@ -158,6 +242,16 @@ func TestOpenTorrent(t *testing.T) {
 			dbSchemaPath: schemaPath,
 			testFunction: testOpenFewTimes,
 		},
+		{
+			name:         "Unsafe paths",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenUnsafePaths,
+		},
+		{
+			name:         "Directory mode",
+			dbSchemaPath: schemaPath,
+			testFunction: testOpenDirectoryMode,
+		},
 	}
 
 	for i := range testCases {
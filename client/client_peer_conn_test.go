@@ -0,0 +1,182 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+var errFakeTorrentRepo = errors.New("fake torrent repository failure")
+
+// Stored torrents can be read but their counters not updated
+type failingTorrentRepo struct {
+	db.TorrentRepository
+}
+
+func (f *failingTorrentRepo) AddTransferred(torrentId int, downloaded int, uploaded int) error {
+	return errFakeTorrentRepo
+}
+
+func testServePeerConn(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	metaInfo, err := client.getMetaInfo(dbTorrent)
+	if err != nil {
+		t.Errorf("Could not parse meta info %v", err)
+		return
+	}
+
+	err = setupConfirmedPiece(client, dbTorrent, 2, content[2*testPieceLength:])
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	fastHandshake := torrent.Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}}
+	seeder := torrent.Seeder{MetaInfo: metaInfo, RemoteHandshake: &fastHandshake}
+
+	pc := torrent.NewPeerConn(&seeder, local)
+	pc.Start()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- client.ServePeerConn(dbTorrent, pc)
+	}()
+
+	request := torrent.RequestPayload{Index: 2, Begin: 100, Length: 500}
+
+	steps := []struct {
+		name     string
+		sent     torrent.PeerMessage
+		expected torrent.PeerMessage
+	}{
+		{"Request while choked", torrent.PeerMessage{Type: torrent.Request, Payload: request}, torrent.PeerMessage{Type: torrent.RejectRequest, Payload: torrent.RejectRequestPayload(request)}},
+		{"Interested", torrent.InterestedMessage, torrent.UnchokeMessage},
+		{"Request", torrent.PeerMessage{Type: torrent.Request, Payload: request}, torrent.PeerMessage{Type: torrent.Piece, Payload: torrent.PiecePayload{Index: 2, Begin: 100, Piece: content[2*testPieceLength+100 : 2*testPieceLength+600]}}},
+		{"Request past the piece end", torrent.PeerMessage{Type: torrent.Request, Payload: torrent.RequestPayload{Index: 2, Begin: 900, Length: 500}}, torrent.PeerMessage{Type: torrent.RejectRequest, Payload: torrent.RejectRequestPayload{Index: 2, Begin: 900, Length: 500}}},
+	}
+
+	// Test
+	for _, step := range steps {
+		go torrent.Send(remote, &step.sent)
+
+		msg, err := torrent.Receive(remote)
+		if err != nil || !reflect.DeepEqual(*msg, step.expected) {
+			t.Errorf("%s expected %#v, got %#v %v", step.name, step.expected, msg, err)
+			return
+		}
+	}
+
+	pc.Close()
+
+	err = <-served
+	if err != nil {
+		t.Errorf("Did not expect error on close %v", err)
+		return
+	}
+
+	storedTorrent, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil || storedTorrent.Uploaded != 500 {
+		t.Errorf("Expected upload to be persisted %v %#v", err, storedTorrent)
+	}
+}
+
+func testServePeerConnHandlerError(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	metaInfo, err := client.getMetaInfo(dbTorrent)
+	if err != nil {
+		t.Errorf("Could not parse meta info %v", err)
+		return
+	}
+
+	err = setupConfirmedPiece(client, dbTorrent, 0, content)
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	client.TorrentRepo = &failingTorrentRepo{TorrentRepository: client.TorrentRepo}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	seeder := torrent.Seeder{MetaInfo: metaInfo, RemoteHandshake: &torrent.Handshake{}}
+
+	pc := torrent.NewPeerConn(&seeder, local)
+	pc.Start()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- client.ServePeerConn(dbTorrent, pc)
+	}()
+
+	// Test
+	go torrent.Send(remote, &torrent.InterestedMessage)
+
+	msg, err := torrent.Receive(remote)
+	if err != nil || msg.Type != torrent.Unchoke {
+		t.Errorf("Expected unchoke, got %#v %v", msg, err)
+		return
+	}
+
+	// Peer keeps reading so nothing we send blocks
+	go func() {
+		for {
+			if _, err := torrent.Receive(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Counters are written once a whole piece was sent
+	torrent.Send(remote, &torrent.PeerMessage{Type: torrent.Request, Payload: torrent.RequestPayload{Index: 0, Begin: 0, Length: torrent.BlockSize}})
+	torrent.Send(remote, &torrent.PeerMessage{Type: torrent.Request, Payload: torrent.RequestPayload{Index: 0, Begin: torrent.BlockSize, Length: torrent.BlockSize}})
+
+	err = <-served
+	if err != errFakeTorrentRepo {
+		t.Errorf("Expected error of the upload counter to be returned, got %v", err)
+	}
+}
+
+func TestServePeerConn(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Interested peers are served",
+			dbSchemaPath: schemaPath,
+			testFunction: testServePeerConn,
+		},
+		{
+			name:         "Failing handler ends the connection",
+			dbSchemaPath: schemaPath,
+			testFunction: testServePeerConnHandlerError,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].name, func(t *testing.T) {
+			runTestCase(&testCases[i], t)
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+func setupPexManager(client *Client, dependencies *testCaseDependencies, t *testing.T) (*PexManager, *fakeClock, error) {
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "pex", t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clock := newFakeClock()
+	client.Clock = clock
+
+	manager, err := client.NewPexManager(dbTorrent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return manager, clock, nil
+}
+
+func pexPeer(ip string, port int) torrent.PexPeer {
+	return torrent.PexPeer{PeerInfo: torrent.PeerInfo{IP: net.ParseIP(ip), Port: port}}
+}
+
+func testPexOutgoing(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	manager, clock, err := setupPexManager(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	manager.Connected("a", pexPeer("10.0.0.1", 6881))
+	manager.Connected("b", pexPeer("10.0.0.2", 6882))
+
+	// Test
+	message, ok := manager.Outgoing("a")
+	if !ok || len(message.Added) != 1 || message.Added[0].Port != 6882 || len(message.Dropped) != 0 {
+		t.Errorf("Expected b to be added %#v", message)
+		return
+	}
+
+	manager.Connected("c", pexPeer("10.0.0.3", 6883))
+	manager.Disconnected("b")
+
+	_, ok = manager.Outgoing("a")
+	if ok {
+		t.Errorf("Expected no message within the interval")
+		return
+	}
+
+	clock.Advance(defaultPexInterval)
+
+	message, ok = manager.Outgoing("a")
+	if !ok || len(message.Added) != 1 || message.Added[0].Port != 6883 || len(message.Dropped) != 1 || message.Dropped[0].Port != 6882 {
+		t.Errorf("Expected c added and b dropped %#v", message)
+		return
+	}
+
+	clock.Advance(defaultPexInterval)
+
+	_, ok = manager.Outgoing("a")
+	if ok {
+		t.Errorf("Expected no message when nothing changed")
+	}
+}
+
+func testPexOutgoingLimit(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	manager, clock, err := setupPexManager(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	manager.Connected("self", pexPeer("10.0.0.1", 6881))
+
+	for i := 0; i < torrent.PexMaxPeers+10; i++ {
+		manager.Connected(fmt.Sprintf("peer%d", i), pexPeer("10.0.1.1", 7000+i))
+	}
+
+	// Test
+	message, ok := manager.Outgoing("self")
+	if !ok || len(message.Added) != torrent.PexMaxPeers {
+		t.Errorf("Expected %d added peers, got %d", torrent.PexMaxPeers, len(message.Added))
+		return
+	}
+
+	clock.Advance(defaultPexInterval)
+
+	message, ok = manager.Outgoing("self")
+	if !ok || len(message.Added) != 10 {
+		t.Errorf("Expected the rest of the peers on the next message %#v", message)
+	}
+}
+
+func testPexReceive(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	manager, clock, err := setupPexManager(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	manager.Connected("a", pexPeer("10.0.0.1", 6881))
+
+	payload, _ := torrent.EncodePexMessage(&torrent.PexMessage{
+		Added: []torrent.PexPeer{pexPeer("10.0.0.2", 6882), pexPeer("2001:db8::1", 6883)},
+	})
+
+	// Test
+	dbPeers, err := manager.Receive("a", payload)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(dbPeers) != 2 || dbPeers[0].Source != db.PeerSourcePex || dbPeers[1].IP != "2001:db8::1" {
+		t.Errorf("Expected 2 pex peers %#v", dbPeers)
+		return
+	}
+
+	stored, err := client.PeerRepo.GetByTorrentId(manager.TorrentId)
+	if err != nil || len(stored) != 2 || stored[0].Source != db.PeerSourcePex {
+		t.Errorf("Expected stored pex peers %v %#v", err, stored)
+		return
+	}
+
+	_, err = manager.Receive("a", payload)
+	if err != ErrPexTooFrequent {
+		t.Errorf("Expected ErrPexTooFrequent, got %v", err)
+		return
+	}
+
+	clock.Advance(time.Minute)
+
+	dbPeers, err = manager.Receive("a", payload)
+	if err != nil || len(dbPeers) != 0 {
+		t.Errorf("Expected known peers to be skipped %v %#v", err, dbPeers)
+		return
+	}
+
+	_, err = manager.Receive("unknown", payload)
+	if err != ErrPexUnknownConnection {
+		t.Errorf("Expected ErrPexUnknownConnection, got %v", err)
+	}
+}
+
+func testPexThroughExtension(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	manager, _, err := setupPexManager(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	registry := torrent.NewExtensionRegistry()
+	pexId := registry.Register(torrent.PexExtensionName, manager)
+
+	seeder := torrent.Seeder{SeederInfo: torrent.PeerInfo{IP: net.ParseIP("10.0.0.1"), Port: 6881}, Extensions: registry}
+	manager.Connected("10.0.0.1:6881", pexPeer("10.0.0.1", 6881))
+
+	payload, _ := torrent.EncodePexMessage(&torrent.PexMessage{Added: []torrent.PexPeer{pexPeer("10.0.0.2", 6882)}})
+
+	// Test
+	err = seeder.HandleExtended(torrent.ExtendedPayload{ExtendedId: pexId, Payload: payload})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	stored, err := client.PeerRepo.GetByTorrentId(manager.TorrentId)
+	if err != nil || len(stored) != 1 || stored[0].Port != 6882 {
+		t.Errorf("Expected peer from extended message %v %#v", err, stored)
+	}
+}
+
+func testPexDispatchedByTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	first, _, err := setupPexManager(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	dbTorrent, err := setupNamedTorrent(client, dependencies, "other", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	second, err := client.NewPexManager(dbTorrent)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	first.Connected("10.0.0.1:6881", pexPeer("10.0.0.1", 6881))
+	second.Connected("10.0.0.1:6881", pexPeer("10.0.0.1", 6881))
+
+	reader := bytes.NewBufferString(torrent.HandshakeMsg)
+	reader.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0})
+	reader.Write(dbTorrent.HashInfo)
+	reader.Write(torrent.GenerateRandomProtocolId())
+
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+
+	seeder, err := client.AcceptHandshake(reader, bytes.NewBuffer([]byte{}), remoteAddr)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	payload, _ := torrent.EncodePexMessage(&torrent.PexMessage{Added: []torrent.PexPeer{pexPeer("10.0.0.2", 6882)}})
+	pexId := client.Extensions.LocalId(torrent.PexExtensionName)
+
+	// Test
+	err = seeder.HandleExtended(torrent.ExtendedPayload{ExtendedId: pexId, Payload: payload})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	stored, err := client.PeerRepo.GetByTorrentId(second.TorrentId)
+	if err != nil || len(stored) != 1 || stored[0].Port != 6882 {
+		t.Errorf("Expected peer stored for the connection's torrent %v %#v", err, stored)
+		return
+	}
+
+	stored, err = client.PeerRepo.GetByTorrentId(first.TorrentId)
+	if err != nil || len(stored) != 0 {
+		t.Errorf("Did not expect peers for the other torrent %v %#v", err, stored)
+		return
+	}
+
+	// Closed managers no longer receive anything
+	second.Close()
+
+	err = seeder.HandleExtended(torrent.ExtendedPayload{ExtendedId: pexId, Payload: payload})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	stored, err = client.PeerRepo.GetByTorrentId(second.TorrentId)
+	if err != nil || len(stored) != 1 {
+		t.Errorf("Did not expect peers after close %v %#v", err, stored)
+	}
+}
+
+func testPexPrivateTorrent(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	private := 1
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce",
+		Info: torrent.GeneralInfo{
+			Name:    "private",
+			Files:   &[]torrent.FileInfo{},
+			Private: &private,
+		},
+	}
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, &metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.NewPexManager(dbTorrent)
+	if err != ErrPrivateTorrent {
+		t.Errorf("Expected ErrPrivateTorrent, got %v", err)
+	}
+}
+
+func TestPex(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Added and dropped peers are sent",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexOutgoing,
+		},
+		{
+			name:         "Added peers are limited per message",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexOutgoingLimit,
+		},
+		{
+			name:         "Received peers are stored",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexReceive,
+		},
+		{
+			name:         "Peer exchange is routed through the extension protocol",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexThroughExtension,
+		},
+		{
+			name:         "Peer exchange goes to the manager of the torrent",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexDispatchedByTorrent,
+		},
+		{
+			name:         "Private torrents do not exchange peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testPexPrivateTorrent,
+		},
+	}
+
+	for i := range testCases {
+		t.Run(testCases[i].name, func(t *testing.T) {
+			runTestCase(&testCases[i], t)
+		})
+	}
+}
@@ -2,9 +2,11 @@ package client
 
 import (
 	"io"
+	"net"
 	"os"
 	"testing"
 
+	"example.com/bencode"
 	"example.com/db"
 )
 
@@ -139,6 +141,60 @@ func testAnnounceProccessingOK(client *Client, dependencies *testCaseDependencie
 	}
 }
 
+func testAnnounceProcessingCompactPeers(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error setting up torrent %v", err)
+		return
+	}
+
+	peers6 := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1)
+
+	rawResponse, _ := bencode.Marshal(map[string]any{
+		"interval": 1800,
+		"peers":    "\x7f\x00\x00\x01\x1a\xe1",
+		"peers6":   string(peers6),
+	})
+
+	// Test
+	for i := 0; i < 2; i++ {
+		dbAnnounce := db.TrackerAnnounce{
+			TorrentId:   dbTorrent.TorrentId,
+			RawResponse: rawResponse,
+		}
+
+		err = client.AnnounceRepo.Create(&dbAnnounce)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+
+		_, err := client.ProcessTrackerAnnounce(&dbAnnounce)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+	}
+
+	// Same addresses announced twice are stored once
+	dbPeers, err := client.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve peers %v", err)
+		return
+	}
+
+	if len(dbPeers) != 2 {
+		t.Errorf("Expected 2 peers, got %#v", dbPeers)
+		return
+	}
+
+	if dbPeers[0].IP != "127.0.0.1" || dbPeers[1].IP != "2001:db8::1" || dbPeers[1].Port != 0x1ae1 {
+		t.Errorf("Unexpected peers %#v", dbPeers)
+		return
+	}
+}
+
 func TestProcessTrackerAnnounce(t *testing.T) {
 	testCases := []testCase{
 		{
@@ -156,6 +212,11 @@ func TestProcessTrackerAnnounce(t *testing.T) {
 			dbSchemaPath: schemaPath,
 			testFunction: testAnnounceProccessingOK,
 		},
+		{
+			name:         "Compact IPv4 and IPv6 peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testAnnounceProcessingCompactPeers,
+		},
 	}
 
 	for i := range testCases {
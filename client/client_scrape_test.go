@@ -0,0 +1,135 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/db"
+	"example.com/torrent"
+)
+
+func setupNamedTorrent(client *Client, dependencies *testCaseDependencies, name string, t *testing.T) (*db.Torrent, error) {
+	metaInfo := torrent.MetaInfo{
+		Announce: dependencies.trackerServer.URL + "/announce",
+		Info: torrent.GeneralInfo{
+			Name:  name,
+			Files: &[]torrent.FileInfo{},
+		},
+	}
+
+	return setupTorrentFromMetaInfo(client, &metaInfo, t)
+}
+
+func testScrapeTorrents(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	first, err := setupNamedTorrent(client, dependencies, "first", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	second, err := setupNamedTorrent(client, dependencies, "second", t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	response := map[string]any{
+		"files": map[string]any{
+			string(first.HashInfo):  map[string]any{"complete": 5, "downloaded": 50, "incomplete": 10},
+			string(second.HashInfo): map[string]any{"complete": 1, "downloaded": 2, "incomplete": 3},
+		},
+	}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	scrapeRequests := 0
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		scrapeRequests++
+		w.Write(responseBytes)
+	})
+
+	// Test
+	err = client.ScrapeTorrents([]*db.Torrent{first, second})
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if scrapeRequests != 1 {
+		t.Errorf("Expected torrents to be scraped in one request, got %d", scrapeRequests)
+		return
+	}
+
+	dbTorrents, err := client.TorrentRepo.GetAll()
+	if err != nil {
+		t.Errorf("Could not retrieve torrents %v", err)
+		return
+	}
+
+	wanted := map[string][3]int{"first": {5, 10, 50}, "second": {1, 3, 2}}
+
+	for _, dbTorrent := range dbTorrents {
+		got := [3]int{dbTorrent.Seeders, dbTorrent.Leechers, dbTorrent.Completed}
+
+		if got != wanted[dbTorrent.Name] || dbTorrent.ScrapeTime == nil {
+			t.Errorf("Scrape results not persisted %#v", dbTorrent)
+			return
+		}
+	}
+}
+
+func testScrapeError(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	err = client.Scrape(dbTorrent)
+	if err == nil {
+		t.Errorf("Expected error here")
+		return
+	}
+
+	if dbTorrent.ScrapeTime != nil {
+		t.Errorf("Did not expect scrape time to be set %#v", dbTorrent)
+		return
+	}
+}
+
+func TestScrape(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Scrape torrents",
+			dbSchemaPath: schemaPath,
+			testFunction: testScrapeTorrents,
+		},
+		{
+			name:         "Scrape error",
+			dbSchemaPath: schemaPath,
+			testFunction: testScrapeError,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
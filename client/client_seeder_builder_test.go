@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+type fakePeer struct {
+	listener net.Listener
+	infoHash []byte
+	peerId   []byte
+	serve    func(conn net.Conn)
+}
+
+func startFakePeer(infoHash []byte, peerId []byte, serve func(conn net.Conn)) (*fakePeer, error) {
+	return startFakePeerOn("127.0.0.1:0", infoHash, peerId, serve)
+}
+
+func startFakePeerOn(address string, infoHash []byte, peerId []byte, serve func(conn net.Conn)) (*fakePeer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := fakePeer{listener: listener, infoHash: infoHash, peerId: peerId, serve: serve}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go peer.handle(conn)
+		}
+	}()
+
+	return &peer, nil
+}
+
+func (p *fakePeer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_, err := torrent.ReadHandshake(conn)
+	if err != nil {
+		return
+	}
+
+	answer := bytes.NewBufferString(torrent.HandshakeMsg)
+	answer.Write(make([]byte, 8))
+	answer.Write(p.infoHash)
+	answer.Write(p.peerId)
+
+	_, err = conn.Write(answer.Bytes())
+	if err != nil {
+		return
+	}
+
+	if p.serve != nil {
+		p.serve(conn)
+	}
+}
+
+func (p *fakePeer) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (p *fakePeer) close() {
+	p.listener.Close()
+}
+
+func closedPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	return port, nil
+}
+
+func testBuildSeederSkipsUnreachable(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	peerId := torrent.GenerateRandomProtocolId()
+	remote, err := startFakePeer(dbTorrent.HashInfo, peerId, nil)
+	if err != nil {
+		t.Errorf("Could not start fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	deadPort, err := closedPort()
+	if err != nil {
+		t.Errorf("Could not find closed port %v", err)
+		return
+	}
+
+	deadPeer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: torrent.GenerateRandomProtocolId(), IP: "127.0.0.1", Port: deadPort, Reachable: true}
+	livePeer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: peerId, IP: "127.0.0.1", Port: remote.port(), Reachable: true}
+
+	for _, peer := range []*db.Peer{&deadPeer, &livePeer} {
+		if err := client.PeerRepo.Create(peer); err != nil {
+			t.Errorf("Could not create peer %v", err)
+			return
+		}
+	}
+
+	// Test
+	seeder, err := client.BuildSeeder(dbTorrent, 0)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+	defer seeder.Close()
+
+	if seeder.SeederInfo.Port != remote.port() || !bytes.Equal(seeder.SeederInfo.PeerId, peerId) {
+		t.Errorf("Connected to wrong peer %#v", seeder.SeederInfo)
+		return
+	}
+
+	updatedDeadPeer, err := client.PeerRepo.GetByTorrentIdAndProtocolPeerId(dbTorrent.TorrentId, deadPeer.ProtocolPeerId)
+	if err != nil {
+		t.Errorf("Could not retrieve peer %v", err)
+		return
+	}
+
+	if updatedDeadPeer.Reachable {
+		t.Errorf("Expected dead peer to be marked unreachable")
+		return
+	}
+}
+
+func testBuildSeederWrongInfoHash(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	remote, err := startFakePeer(torrent.GenerateRandomProtocolId(), torrent.GenerateRandomProtocolId(), nil)
+	if err != nil {
+		t.Errorf("Could not start fake peer %v", err)
+		return
+	}
+	defer remote.close()
+
+	peer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: []byte{}, IP: "127.0.0.1", Port: remote.port(), Reachable: true}
+	if err := client.PeerRepo.Create(&peer); err != nil {
+		t.Errorf("Could not create peer %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.BuildSeeder(dbTorrent, 0)
+	if err != ErrNoReachablePeers {
+		t.Errorf("Expected %v, got %v", ErrNoReachablePeers, err)
+		return
+	}
+
+	peers, err := client.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		t.Errorf("Could not retrieve peers %v", err)
+		return
+	}
+
+	if len(peers) != 1 || peers[0].Reachable {
+		t.Errorf("Expected peer to be marked unreachable %#v", peers)
+		return
+	}
+}
+
+func testBuildSeederIPv6Peer(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	peerId := torrent.GenerateRandomProtocolId()
+	remote, err := startFakePeerOn("[::1]:0", dbTorrent.HashInfo, peerId, nil)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available %v", err)
+	}
+	defer remote.close()
+
+	peer := db.Peer{TorrentId: dbTorrent.TorrentId, ProtocolPeerId: peerId, IP: "::1", Port: remote.port(), Reachable: true}
+	if err := client.PeerRepo.Create(&peer); err != nil {
+		t.Errorf("Could not create peer %v", err)
+		return
+	}
+
+	// Test
+	seeder, err := client.BuildSeeder(dbTorrent, 0)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+	defer seeder.Close()
+
+	if !seeder.SeederInfo.IP.Equal(net.IPv6loopback) {
+		t.Errorf("Connected to wrong peer %#v", seeder.SeederInfo)
+		return
+	}
+}
+
+func testBuildSeederNoPeers(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	_, err = client.BuildSeeder(dbTorrent, 0)
+	if err != ErrNoReachablePeers {
+		t.Errorf("Expected %v, got %v", ErrNoReachablePeers, err)
+		return
+	}
+}
+
+func TestBuildSeeder(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Connects to IPv6 peer",
+			dbSchemaPath: schemaPath,
+			testFunction: testBuildSeederIPv6Peer,
+		},
+		{
+			name:         "Skips unreachable peer",
+			dbSchemaPath: schemaPath,
+			testFunction: testBuildSeederSkipsUnreachable,
+		},
+		{
+			name:         "Wrong info hash",
+			dbSchemaPath: schemaPath,
+			testFunction: testBuildSeederWrongInfoHash,
+		},
+		{
+			name:         "No peers",
+			dbSchemaPath: schemaPath,
+			testFunction: testBuildSeederNoPeers,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
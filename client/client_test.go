@@ -55,6 +55,7 @@ func runTestCase(testCase *testCase, t *testing.T) {
 		AnnounceRepo: &sqlite.TrackerAnnounceRepositorySQLite{SQLiteDB: *sqliteDb},
 		PieceRepo:    &sqlite.PieceRepositorySQLite{SQLiteDB: *sqliteDb},
 		PeerRepo:     &sqlite.PeerRepositorySQLite{SQLiteDB: *sqliteDb},
+		TrackerRepo:  &sqlite.TrackerRepositorySQLite{SQLiteDB: *sqliteDb},
 	}
 
 	testCase.testFunction(&client, &dependencies, t)
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/db"
+	"example.com/torrent"
+)
+
+type fakeTrackerClient struct {
+	announces []torrent.AnnounceRequest
+	scrapes   [][][]byte
+	fail      bool
+}
+
+var errFakeTracker = errors.New("fake tracker failure")
+
+func (f *fakeTrackerClient) Announce(ctx context.Context, request *torrent.AnnounceRequest) (*torrent.AnnounceResponse, error) {
+	f.announces = append(f.announces, *request)
+
+	if f.fail {
+		return nil, errFakeTracker
+	}
+
+	rawResponse, _ := bencode.Marshal(map[string]any{"interval": 1800, "peers": "\x7f\x00\x00\x01\x1a\xe1"})
+
+	return &torrent.AnnounceResponse{
+		Interval:    1800,
+		Peers:       []torrent.PeerInfo{{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+		RawResponse: rawResponse,
+	}, nil
+}
+
+func (f *fakeTrackerClient) Scrape(ctx context.Context, announceURL string, infoHashes [][]byte) (*torrent.ScrapeResponse, error) {
+	f.scrapes = append(f.scrapes, infoHashes)
+
+	if f.fail {
+		return nil, errFakeTracker
+	}
+
+	scrapeResponse := torrent.ScrapeResponse{Files: make(map[string]torrent.ScrapeFile)}
+	for i := range infoHashes {
+		scrapeResponse.Files[string(infoHashes[i])] = torrent.ScrapeFile{Complete: 4, Incomplete: 2}
+	}
+
+	return &scrapeResponse, nil
+}
+
+func testFakeTrackerAnnounce(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	fakeTracker := fakeTrackerClient{}
+	client.TrackerClient = &fakeTracker
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	dbAnnounce, err := client.Announce(dbTorrent)
+	if err != nil || dbAnnounce.Error != nil {
+		t.Errorf("Did not expect error here %v %#v", err, dbAnnounce)
+		return
+	}
+
+	if len(fakeTracker.announces) != 1 || fakeTracker.announces[0].AnnounceURL != dbTorrent.Announce {
+		t.Errorf("Expected announce to go through fake tracker %#v", fakeTracker.announces)
+		return
+	}
+
+	dbPeers, err := client.ProcessTrackerAnnounce(dbAnnounce)
+	if err != nil || len(dbPeers) != 1 {
+		t.Errorf("Expected peer from fake tracker %v %#v", err, dbPeers)
+		return
+	}
+}
+
+func testFakeTrackerFailure(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	fakeTracker := fakeTrackerClient{fail: true}
+	client.TrackerClient = &fakeTracker
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	dbAnnounce, err := client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if dbAnnounce.Error == nil || *dbAnnounce.Error != errFakeTracker.Error() {
+		t.Errorf("Expected fake tracker error to be stored %#v", dbAnnounce)
+		return
+	}
+
+	err = client.Scrape(dbTorrent)
+	if err != errFakeTracker {
+		t.Errorf("Expected fake tracker error, got %v", err)
+		return
+	}
+}
+
+func testFakeTrackerScrape(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	fakeTracker := fakeTrackerClient{}
+	client.TrackerClient = &fakeTracker
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	err = client.ScrapeTorrents([]*db.Torrent{dbTorrent})
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if len(fakeTracker.scrapes) != 1 || dbTorrent.Seeders != 4 || dbTorrent.Leechers != 2 {
+		t.Errorf("Expected scrape through fake tracker %#v", dbTorrent)
+		return
+	}
+}
+
+func TestTrackerClient(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Announce through fake tracker",
+			dbSchemaPath: schemaPath,
+			testFunction: testFakeTrackerAnnounce,
+		},
+		{
+			name:         "Fake tracker failure",
+			dbSchemaPath: schemaPath,
+			testFunction: testFakeTrackerFailure,
+		},
+		{
+			name:         "Scrape through fake tracker",
+			dbSchemaPath: schemaPath,
+			testFunction: testFakeTrackerScrape,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
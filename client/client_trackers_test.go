@@ -0,0 +1,278 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/torrent"
+)
+
+func respondOnGoodTracker(dependencies *testCaseDependencies, hits *[]string) {
+	response := struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+	}{1800, "\x7f\x00\x00\x01\x1a\xe1"}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits = append(*hits, r.URL.Path)
+
+		if r.URL.Path != "/good" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(responseBytes)
+	})
+}
+
+func multiTrackerMetaInfo(dependencies *testCaseDependencies, tiers [][]string) *torrent.MetaInfo {
+	announceList := [][]string{}
+	for _, tier := range tiers {
+		urls := []string{}
+		for _, path := range tier {
+			urls = append(urls, dependencies.trackerServer.URL+path)
+		}
+
+		announceList = append(announceList, urls)
+	}
+
+	metaInfo := torrent.MetaInfo{
+		Announce:     announceList[0][0],
+		AnnounceList: &announceList,
+		Info: torrent.GeneralInfo{
+			Name:  "fake",
+			Files: &[]torrent.FileInfo{},
+		},
+	}
+
+	return &metaInfo
+}
+
+func testTrackersCreatedFromAnnounceList(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	metaInfo := multiTrackerMetaInfo(dependencies, [][]string{{"/a", "/b"}, {"/c"}})
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	dbTrackers, err := client.GetTrackers(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if len(dbTrackers) != 3 {
+		t.Errorf("Expected 3 trackers, got %#v", dbTrackers)
+		return
+	}
+
+	if dbTrackers[0].Tier != 0 || dbTrackers[1].Tier != 0 || dbTrackers[2].Tier != 1 {
+		t.Errorf("Tiers not preserved %#v", dbTrackers)
+		return
+	}
+
+	if dbTrackers[2].URL != dependencies.trackerServer.URL+"/c" {
+		t.Errorf("Unexpected tracker in second tier %#v", dbTrackers[2])
+		return
+	}
+}
+
+func testAnnounceFallsThroughTiers(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var hits []string
+	respondOnGoodTracker(dependencies, &hits)
+
+	metaInfo := multiTrackerMetaInfo(dependencies, [][]string{{"/dead1"}, {"/dead2", "/good"}})
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	dbAnnounce, err := client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if dbAnnounce.Error != nil {
+		t.Errorf("Expected announce to succeed on the good tracker %v", *dbAnnounce.Error)
+		return
+	}
+
+	if hits[0] != "/dead1" || hits[len(hits)-1] != "/good" {
+		t.Errorf("Trackers not tried in tier order %#v", hits)
+		return
+	}
+
+	dbTrackers, err := client.GetTrackers(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if dbTrackers[0].LastError == nil {
+		t.Errorf("Expected first tier to be tried %#v", dbTrackers[0])
+		return
+	}
+
+	// Trackers inside a tier are shuffled, so the other dead one may not have been tried
+	for _, dbTracker := range dbTrackers {
+		if dbTracker.LastAnnounce == nil {
+			continue
+		}
+
+		isGood := dbTracker.URL == dependencies.trackerServer.URL+"/good"
+		if isGood && (dbTracker.LastSuccess == nil || dbTracker.PeerCount != 1 || dbTracker.LastError != nil) {
+			t.Errorf("Expected success to be recorded %#v", dbTracker)
+			return
+		}
+
+		if !isGood && dbTracker.LastError == nil {
+			t.Errorf("Expected error to be recorded %#v", dbTracker)
+			return
+		}
+	}
+
+	// Good tracker is moved to the front of its tier
+	if dbTrackers[1].URL != dependencies.trackerServer.URL+"/good" || dbTrackers[1].Position != 0 {
+		t.Errorf("Expected good tracker to be promoted %#v", dbTrackers)
+		return
+	}
+
+	hits = nil
+
+	_, err = client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if len(hits) != 2 || hits[1] != "/good" {
+		t.Errorf("Expected promoted tracker to be tried first in its tier %#v", hits)
+		return
+	}
+}
+
+func testAnnounceAllTrackersFail(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var hits []string
+	respondOnGoodTracker(dependencies, &hits)
+
+	metaInfo := multiTrackerMetaInfo(dependencies, [][]string{{"/dead1"}, {"/dead2"}})
+
+	dbTorrent, err := setupTorrentFromMetaInfo(client, metaInfo, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	dbAnnounce, err := client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if dbAnnounce.Error == nil {
+		t.Errorf("Expected error to be stored")
+		return
+	}
+
+	if len(hits) != 2 {
+		t.Errorf("Expected both trackers to be tried %#v", hits)
+		return
+	}
+}
+
+func testTrackerIdAndWarning(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	response := struct {
+		Interval       int    `bencode:"interval"`
+		Peers          string `bencode:"peers"`
+		TrackerId      string `bencode:"tracker id"`
+		WarningMessage string `bencode:"warning message"`
+	}{1800, "", "session-1", "ratio too low"}
+
+	responseBytes, _ := bencode.Marshal(response)
+
+	var sentTrackerIds []string
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sentTrackerIds = append(sentTrackerIds, r.URL.Query().Get("trackerid"))
+		w.Write(responseBytes)
+	})
+
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	// Test
+	for i := 0; i < 2; i++ {
+		_, err = client.Announce(dbTorrent)
+		if err != nil {
+			t.Errorf("Did not expect error here %v", err)
+			return
+		}
+	}
+
+	if len(sentTrackerIds) != 2 || sentTrackerIds[0] != "" || sentTrackerIds[1] != "session-1" {
+		t.Errorf("Expected tracker id to be sent back %#v", sentTrackerIds)
+		return
+	}
+
+	dbTrackers, err := client.GetTrackers(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	if len(dbTrackers) != 1 || dbTrackers[0].LastWarning == nil || *dbTrackers[0].LastWarning != "ratio too low" {
+		t.Errorf("Expected warning to be stored %#v", dbTrackers)
+		return
+	}
+}
+
+func TestTrackers(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Trackers created from announce-list",
+			dbSchemaPath: schemaPath,
+			testFunction: testTrackersCreatedFromAnnounceList,
+		},
+		{
+			name:         "Announce falls through tiers",
+			dbSchemaPath: schemaPath,
+			testFunction: testAnnounceFallsThroughTiers,
+		},
+		{
+			name:         "Announce when all trackers fail",
+			dbSchemaPath: schemaPath,
+			testFunction: testAnnounceAllTrackersFail,
+		},
+		{
+			name:         "Tracker id and warning",
+			dbSchemaPath: schemaPath,
+			testFunction: testTrackerIdAndWarning,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
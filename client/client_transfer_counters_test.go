@@ -0,0 +1,341 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"example.com/bencode"
+	"example.com/torrent"
+)
+
+func testDownloadedCounterPersisted(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	corruptRemote, _, err := addFakePeer(client, dbTorrent, true, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer corruptRemote.close()
+
+	goodRemote, _, err := addFakePeer(client, dbTorrent, false, content)
+	if err != nil {
+		t.Errorf("Could not add fake peer %v", err)
+		return
+	}
+	defer goodRemote.close()
+
+	// Test
+	err = client.DownloadPiece(dbTorrent, 0)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	// Corrupt attempt counts as well
+	if dbTorrent.Downloaded != 2*testPieceLength {
+		t.Errorf("Expected %d downloaded bytes, got %d", 2*testPieceLength, dbTorrent.Downloaded)
+		return
+	}
+
+	storedTorrent, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil {
+		t.Errorf("Could not retrieve torrent %v", err)
+		return
+	}
+
+	if storedTorrent.Downloaded != dbTorrent.Downloaded {
+		t.Errorf("Expected counter to be persisted %#v", storedTorrent)
+		return
+	}
+}
+
+func testUploadedCounterPersisted(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	err = setupConfirmedPiece(client, dbTorrent, 2, content[2*testPieceLength:])
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	received := make(chan *torrent.PeerMessage, 1)
+	go func() {
+		msg, _ := torrent.Receive(remote)
+		received <- msg
+	}()
+
+	seeder := torrent.Seeder{SeederReader: local, SeederWriter: local}
+
+	// Test
+	err = client.UploadBlock(dbTorrent, &seeder, torrent.RequestPayload{Index: 2, Begin: 100, Length: 500})
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	msg := <-received
+	if msg == nil || !bytes.Equal(msg.Payload.(torrent.PiecePayload).Piece, content[2*testPieceLength+100:2*testPieceLength+600]) {
+		t.Errorf("Wrong block sent %#v", msg)
+		return
+	}
+
+	storedTorrent, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil {
+		t.Errorf("Could not retrieve torrent %v", err)
+		return
+	}
+
+	if storedTorrent.Uploaded != 500 {
+		t.Errorf("Expected upload to be persisted %#v", storedTorrent)
+		return
+	}
+
+	err = client.UploadBlock(dbTorrent, &seeder, torrent.RequestPayload{Index: 2, Begin: 900, Length: 500})
+	if err != ErrInvalidRequest {
+		t.Errorf("Expected %v for request past the piece end, got %v", ErrInvalidRequest, err)
+		return
+	}
+}
+
+func testUploadBlockRejected(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	received := make(chan *torrent.PeerMessage, 1)
+	go func() {
+		msg, _ := torrent.Receive(remote)
+		received <- msg
+	}()
+
+	fastHandshake := torrent.Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}}
+	seeder := torrent.Seeder{SeederReader: local, SeederWriter: local, RemoteHandshake: &fastHandshake}
+
+	request := torrent.RequestPayload{Index: 2, Begin: 900, Length: 500}
+
+	// Test
+	err = client.UploadBlock(dbTorrent, &seeder, request)
+	if err != ErrInvalidRequest {
+		t.Errorf("Expected %v, got %v", ErrInvalidRequest, err)
+		return
+	}
+
+	msg := <-received
+	if msg == nil || msg.Type != torrent.RejectRequest || msg.Payload.(torrent.RejectRequestPayload) != torrent.RejectRequestPayload(request) {
+		t.Errorf("Expected request to be rejected %#v", msg)
+		return
+	}
+
+	if seeder.Uploaded != 0 {
+		t.Errorf("Did not expect upload to be counted %d", seeder.Uploaded)
+	}
+}
+
+func testUploadBlockRefused(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	content := buildTestContent()
+
+	dbTorrent, err := setupTorrentWithContent(client, dependencies, content, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	err = setupConfirmedPiece(client, dbTorrent, 0, content[:testPieceLength])
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	// On disk, but never checked
+	metaInfo, _ := client.getMetaInfo(dbTorrent)
+	err = client.writePiece(dbTorrent, metaInfo, 1, content[testPieceLength:2*testPieceLength])
+	if err != nil {
+		t.Errorf("Could not write piece %v", err)
+		return
+	}
+
+	testCases := []struct {
+		name        string
+		request     torrent.RequestPayload
+		wantedError error
+	}{
+		{"Length wraps around", torrent.RequestPayload{Index: 0, Begin: 1, Length: 0x7FFFFFFF}, ErrInvalidRequest},
+		{"Block too large", torrent.RequestPayload{Index: 0, Begin: 0, Length: torrent.MaxBlockLength + 1}, ErrInvalidRequest},
+		{"Piece not confirmed", torrent.RequestPayload{Index: 1, Begin: 0, Length: 100}, ErrPieceNotConfirmed},
+	}
+
+	// Test
+	for i := range testCases {
+		seeder := torrent.Seeder{SeederWriter: bytes.NewBuffer([]byte{})}
+
+		err = client.UploadBlock(dbTorrent, &seeder, testCases[i].request)
+		if err != testCases[i].wantedError {
+			t.Errorf("%s expected %v, got %v", testCases[i].name, testCases[i].wantedError, err)
+		}
+	}
+}
+
+func testAnnounceSendsCounters(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	var query map[string][]string
+
+	responseBytes, _ := bencode.Marshal(struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+	}{1800, ""})
+
+	dependencies.trackerServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write(responseBytes)
+	})
+
+	dbTorrent, err := setupPieceRecords(client, dependencies, []int{0}, []int{1}, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	dbTorrent.Uploaded = 123
+	dbTorrent.Downloaded = 456
+
+	// Test
+	_, err = client.Announce(dbTorrent)
+	if err != nil {
+		t.Errorf("Did not expect error here %v", err)
+		return
+	}
+
+	wanted := map[string]string{
+		"uploaded":   "123",
+		"downloaded": "456",
+		"left":       strconv.Itoa(testPieceLength + 1000),
+	}
+
+	for key, value := range wanted {
+		if len(query[key]) != 1 || query[key][0] != value {
+			t.Errorf("Expected %s=%s, got %v", key, value, query[key])
+		}
+	}
+}
+
+func testConcurrentCounters(client *Client, dependencies *testCaseDependencies, t *testing.T) {
+	// Setup
+	dbTorrent, err := setupExistingTorrent(client, dependencies, t)
+	if err != nil {
+		t.Errorf("Error on test case setup %v", err)
+		return
+	}
+
+	stale := *dbTorrent
+
+	// Test
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				client.addTransferred(dbTorrent, 1, 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Other fields are still written from a copy that never saw the counters change
+	stale.Progress = 1
+	err = client.TorrentRepo.Update(&stale)
+	if err != nil {
+		t.Errorf("Could not update torrent %v", err)
+		return
+	}
+
+	storedTorrent, err := client.TorrentRepo.GetByHashInfo(dbTorrent.HashInfo)
+	if err != nil {
+		t.Errorf("Could not retrieve torrent %v", err)
+		return
+	}
+
+	if storedTorrent.Downloaded != 200 || storedTorrent.Uploaded != 400 || storedTorrent.Progress != 1 {
+		t.Errorf("Expected every update to be counted %#v", storedTorrent)
+		return
+	}
+
+	if dbTorrent.Downloaded != 200 || dbTorrent.Uploaded != 400 {
+		t.Errorf("Expected counters in memory to follow %#v", dbTorrent)
+	}
+}
+
+func TestTransferCounters(t *testing.T) {
+	testCases := []testCase{
+		{
+			name:         "Downloaded counter persisted",
+			dbSchemaPath: schemaPath,
+			testFunction: testDownloadedCounterPersisted,
+		},
+		{
+			name:         "Uploaded counter persisted",
+			dbSchemaPath: schemaPath,
+			testFunction: testUploadedCounterPersisted,
+		},
+		{
+			name:         "Invalid and unconfirmed requests are refused",
+			dbSchemaPath: schemaPath,
+			testFunction: testUploadBlockRefused,
+		},
+		{
+			name:         "Rejected upload is not counted",
+			dbSchemaPath: schemaPath,
+			testFunction: testUploadBlockRejected,
+		},
+		{
+			name:         "Announce sends counters",
+			dbSchemaPath: schemaPath,
+			testFunction: testAnnounceSendsCounters,
+		},
+		{
+			name:         "Concurrent counters are not lost",
+			dbSchemaPath: schemaPath,
+			testFunction: testConcurrentCounters,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			runTestCase(&testCase, t)
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package client
+
+import "time"
+
+// Clock is swapped with a fake one in tests so that schedules can be driven manually.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+var ErrDHTDisabled = errors.New("DHT is disabled")
+var ErrPrivateTorrent = errors.New("torrent is private")
+
+// Implemented by dht.Node
+type DHT interface {
+	GetPeers(ctx context.Context, infoHash []byte) ([]torrent.PeerInfo, error)
+	AnnouncePeer(ctx context.Context, infoHash []byte, port int) error
+}
+
+// Private torrents must only get peers from their trackers, see BEP 27.
+func (c *Client) isPrivate(dbTorrent *db.Torrent) (bool, error) {
+	metaInfo, err := c.getMetaInfo(dbTorrent)
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name)
+		return false, err
+	}
+
+	return metaInfo.Info.Private != nil && *metaInfo.Info.Private == 1, nil
+}
+
+// Looks up peers of dbTorrent in the DHT, saves the new ones and announces ourselves.
+func (c *Client) DiscoverDHTPeers(dbTorrent *db.Torrent) ([]db.Peer, error) {
+	if c.DHT == nil {
+		return nil, ErrDHTDisabled
+	}
+
+	private, err := c.isPrivate(dbTorrent)
+	if err != nil {
+		return nil, err
+	}
+
+	if private {
+		return nil, ErrPrivateTorrent
+	}
+
+	peers, err := c.DHT.GetPeers(context.Background(), dbTorrent.HashInfo)
+	if err != nil {
+		slog.Error("DHT lookup failed for " + hex.EncodeToString(dbTorrent.HashInfo))
+		return nil, err
+	}
+
+	debugMsg := fmt.Sprintf("DHT returned %d peers for %s", len(peers), dbTorrent.Name)
+	slog.Debug(debugMsg)
+
+	dbPeers, err := c.storePeers(dbTorrent.TorrentId, peers, db.PeerSourceDHT)
+	if err != nil {
+		return dbPeers, err
+	}
+
+	// Not being announced only makes us harder to find
+	err = c.DHT.AnnouncePeer(context.Background(), dbTorrent.HashInfo, int(c.Port))
+	if err != nil {
+		slog.Warn("DHT announce failed for " + dbTorrent.Name + ": " + err.Error())
+	}
+
+	return dbPeers, nil
+}
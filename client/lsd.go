@@ -0,0 +1,326 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// Multicast groups of Local Service Discovery, see BEP 14.
+var LSDGroupIPv4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+var LSDGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+
+const defaultLSDInterval = 5 * time.Minute
+
+// Each info hash is announced at most once per minute, same goes for every sender
+const defaultLSDMinInterval = time.Minute
+
+// Keeps announcements well below a typical MTU
+const lsdMaxHashesPerPacket = 20
+
+const lsdMaxPacketSize = 1500
+
+var ErrLSDDisabled = errors.New("local service discovery is disabled")
+var ErrInvalidLSDMessage = errors.New("invalid local service discovery message")
+
+type lsdAnnounce struct {
+	port       int
+	infoHashes [][]byte
+	cookie     string
+}
+
+type LSD struct {
+	Client *Client
+	// Multicast socket, tests inject their own
+	Conn      net.PacketConn
+	GroupAddr net.Addr
+	Clock     Clock
+	// How often active torrents are announced
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	// Lets us recognize our own announcements coming back
+	cookie string
+
+	mutex     sync.Mutex
+	announced map[string]time.Time
+	received  map[string]time.Time
+	pruned    time.Time
+}
+
+func NewLSD(client *Client, conn net.PacketConn) *LSD {
+	var clock Clock = realClock{}
+	if client.Clock != nil {
+		clock = client.Clock
+	}
+
+	return &LSD{
+		Client:      client,
+		Conn:        conn,
+		GroupAddr:   LSDGroupIPv4,
+		Clock:       clock,
+		Interval:    defaultLSDInterval,
+		MinInterval: defaultLSDMinInterval,
+		cookie:      strconv.FormatUint(rand.Uint64(), 36),
+		announced:   make(map[string]time.Time),
+		received:    make(map[string]time.Time),
+	}
+}
+
+// Joins the IPv4 group on every multicast capable interface
+func ListenLSD() (net.PacketConn, error) {
+	return net.ListenMulticastUDP("udp4", nil, LSDGroupIPv4)
+}
+
+func (l *LSD) host() string {
+	return l.GroupAddr.String()
+}
+
+func encodeLSDAnnounce(host string, announce *lsdAnnounce) []byte {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buffer.WriteString("Host: " + host + "\r\n")
+	buffer.WriteString("Port: " + strconv.Itoa(announce.port) + "\r\n")
+
+	for _, infoHash := range announce.infoHashes {
+		buffer.WriteString("Infohash: " + hex.EncodeToString(infoHash) + "\r\n")
+	}
+
+	if announce.cookie != "" {
+		buffer.WriteString("cookie: " + announce.cookie + "\r\n")
+	}
+
+	buffer.WriteString("\r\n\r\n")
+
+	return buffer.Bytes()
+}
+
+func parseLSDAnnounce(data []byte) (*lsdAnnounce, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || request.Method != "BT-SEARCH" {
+		return nil, ErrInvalidLSDMessage
+	}
+
+	port, err := strconv.Atoi(request.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, ErrInvalidLSDMessage
+	}
+
+	announce := lsdAnnounce{port: port, cookie: request.Header.Get("Cookie")}
+
+	for _, value := range request.Header.Values("Infohash") {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(infoHash) != 20 {
+			return nil, ErrInvalidLSDMessage
+		}
+
+		announce.infoHashes = append(announce.infoHashes, infoHash)
+	}
+
+	if len(announce.infoHashes) == 0 {
+		return nil, ErrInvalidLSDMessage
+	}
+
+	return &announce, nil
+}
+
+// Multicasts every active public torrent not announced within MinInterval.
+func (l *LSD) Announce() error {
+	if l.Client.DisableLSD {
+		return ErrLSDDisabled
+	}
+
+	dbTorrents, err := l.Client.TorrentRepo.GetAll()
+	if err != nil {
+		slog.Error("Could not retrieve torrents.")
+		return err
+	}
+
+	now := l.Clock.Now()
+
+	var infoHashes [][]byte
+
+	l.mutex.Lock()
+	for i := range dbTorrents {
+		dbTorrent := &dbTorrents[i]
+
+		if dbTorrent.Paused {
+			continue
+		}
+
+		private, err := l.Client.isPrivate(dbTorrent)
+		if err != nil || private {
+			continue
+		}
+
+		key := string(dbTorrent.HashInfo)
+		if last, ok := l.announced[key]; ok && now.Sub(last) < l.MinInterval {
+			continue
+		}
+
+		l.announced[key] = now
+		infoHashes = append(infoHashes, dbTorrent.HashInfo)
+	}
+	l.mutex.Unlock()
+
+	for start := 0; start < len(infoHashes); start += lsdMaxHashesPerPacket {
+		end := min(start+lsdMaxHashesPerPacket, len(infoHashes))
+
+		announce := lsdAnnounce{port: int(l.Client.Port), infoHashes: infoHashes[start:end], cookie: l.cookie}
+
+		_, err := l.Conn.WriteTo(encodeLSDAnnounce(l.host(), &announce), l.GroupAddr)
+		if err != nil {
+			slog.Error("Could not send local service discovery announce.")
+			return err
+		}
+	}
+
+	if len(infoHashes) > 0 {
+		debugMsg := fmt.Sprintf("Announced %d torrents on the local network", len(infoHashes))
+		slog.Debug(debugMsg)
+	}
+
+	return nil
+}
+
+// Announces periodically until ctx is done.
+func (l *LSD) Run(ctx context.Context) error {
+	for {
+		err := l.Announce()
+		if err == ErrLSDDisabled {
+			return err
+		}
+
+		if err != nil {
+			slog.Error("Local service discovery announce failed " + err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.Clock.After(l.Interval):
+		}
+	}
+}
+
+// Turns announcements of other peers into peers of the matching torrents.
+// Blocks until Conn is closed.
+func (l *LSD) Serve() error {
+	if l.Client.DisableLSD {
+		return ErrLSDDisabled
+	}
+
+	packet := make([]byte, lsdMaxPacketSize)
+
+	for {
+		n, addr, err := l.Conn.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		_, err = l.handleAnnounce(packet[:n], udpAddr)
+		if err != nil {
+			slog.Debug("Dropping local service discovery message from " + addr.String() + ": " + err.Error())
+		}
+	}
+}
+
+// Forgets senders no longer rate limited, at most once per MinInterval.
+// Callers hold the mutex.
+func (l *LSD) pruneReceived(now time.Time) {
+	if now.Sub(l.pruned) < l.MinInterval {
+		return
+	}
+
+	for key, last := range l.received {
+		if now.Sub(last) >= l.MinInterval {
+			delete(l.received, key)
+		}
+	}
+
+	l.pruned = now
+}
+
+func (l *LSD) handleAnnounce(data []byte, from *net.UDPAddr) ([]db.Peer, error) {
+	announce, err := parseLSDAnnounce(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if announce.cookie == l.cookie {
+		return nil, nil
+	}
+
+	now := l.Clock.Now()
+	peer := torrent.PeerInfo{IP: from.IP, Port: announce.port}
+
+	l.mutex.Lock()
+	l.pruneReceived(now)
+	l.mutex.Unlock()
+
+	var dbPeers []db.Peer
+
+	for _, infoHash := range announce.infoHashes {
+		key := from.IP.String() + "/" + string(infoHash)
+
+		l.mutex.Lock()
+		last, ok := l.received[key]
+		limited := ok && now.Sub(last) < l.MinInterval
+		if !limited {
+			l.received[key] = now
+		}
+		l.mutex.Unlock()
+
+		if limited {
+			continue
+		}
+
+		dbTorrent, err := l.Client.TorrentRepo.GetByHashInfo(infoHash)
+		if err != nil {
+			slog.Error("Could not retrieve by infohash " + hex.EncodeToString(infoHash))
+			return dbPeers, err
+		}
+
+		if dbTorrent == nil {
+			continue
+		}
+
+		private, err := l.Client.isPrivate(dbTorrent)
+		if err != nil || private {
+			continue
+		}
+
+		created, err := l.Client.storePeers(dbTorrent.TorrentId, []torrent.PeerInfo{peer}, db.PeerSourceLSD)
+		if err != nil {
+			return dbPeers, err
+		}
+
+		dbPeers = append(dbPeers, created...)
+	}
+
+	return dbPeers, nil
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+var ErrMetadataNotFound = errors.New("no peer could provide the metadata")
+
+// Downloads the info dictionary of a magnet link from one of peers, implemented by TCPSeederBuilder
+type MetadataFetcher interface {
+	FetchMetadata(infoHash []byte, peers []torrent.PeerInfo) ([]byte, error)
+}
+
+type magnetPeers struct {
+	source string
+	peers  []torrent.PeerInfo
+}
+
+// Peers are collected from the link itself, its trackers and the DHT
+func (c *Client) findMagnetPeers(magnet *torrent.Magnet) []magnetPeers {
+	found := []magnetPeers{{source: db.PeerSourceMagnet, peers: magnet.Peers}}
+
+	for _, tracker := range magnet.Trackers {
+		announceRequest := torrent.AnnounceRequest{
+			AnnounceURL: tracker,
+			PeerId:      c.Client.ProtocolId,
+			InfoHash:    magnet.InfoHash,
+			Port:        int(c.Port),
+			// Size is unknown until the metadata arrives, anything but 0 keeps us a leecher
+			Left:    1,
+			Compact: true,
+			NumWant: c.NumWant,
+			Key:     c.announceKey,
+		}
+
+		announceResponse, err := c.trackerClient().Announce(context.Background(), &announceRequest)
+		if err != nil {
+			slog.Warn("Could not announce magnet link to " + tracker + ": " + err.Error())
+			continue
+		}
+
+		found = append(found, magnetPeers{source: db.PeerSourceTracker, peers: announceResponse.Peers})
+	}
+
+	if c.DHT != nil {
+		peers, err := c.DHT.GetPeers(context.Background(), magnet.InfoHash)
+		if err != nil {
+			slog.Warn("DHT lookup failed for " + hex.EncodeToString(magnet.InfoHash))
+		} else {
+			found = append(found, magnetPeers{source: db.PeerSourceDHT, peers: peers})
+		}
+	}
+
+	return found
+}
+
+// Fetches the metadata of the magnet link from its peers and opens it like OpenTorrent does.
+func (c *Client) OpenMagnet(uri string, downloadPath string) (*db.Torrent, error) {
+	if !c.initialized {
+		return nil, errors.New("Client not initialized.")
+	}
+
+	magnet, err := torrent.ParseMagnet(uri)
+	if err != nil {
+		slog.Error("This can't be parsed as a magnet link.")
+		return nil, err
+	}
+
+	dbTorrent, err := c.TorrentRepo.GetByHashInfo(magnet.InfoHash)
+	if err != nil {
+		slog.Error("Could not retrieve by infohash " + hex.EncodeToString(magnet.InfoHash))
+		return nil, err
+	}
+
+	if dbTorrent != nil {
+		return dbTorrent, errors.New("Torrent already exists.")
+	}
+
+	found := c.findMagnetPeers(magnet)
+
+	var peers []torrent.PeerInfo
+	for i := range found {
+		peers = append(peers, found[i].peers...)
+	}
+
+	infoMsg := fmt.Sprintf("Fetching metadata of %s from %d peers...", hex.EncodeToString(magnet.InfoHash), len(peers))
+	slog.Info(infoMsg)
+
+	info, err := c.MetadataFetcher.FetchMetadata(magnet.InfoHash, peers)
+	if err != nil {
+		slog.Error("Could not fetch metadata of " + hex.EncodeToString(magnet.InfoHash))
+		return nil, err
+	}
+
+	metaInfo, err := magnet.MetaInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	dbTorrent, err = c.OpenTorrent(bytes.NewReader(metaInfo.RawBytes), downloadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range found {
+		_, err = c.storePeers(dbTorrent.TorrentId, found[i].peers, found[i].source)
+		if err != nil {
+			return dbTorrent, err
+		}
+	}
+
+	return dbTorrent, nil
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// Uploads to the peer until the connection is closed. Everyone interested gets unchoked,
+// requests that can't be served are rejected. Requests while choked only reach here for allowed fast pieces, see PeerConn.
+func (c *Client) ServePeerConn(dbTorrent *db.Torrent, pc *torrent.PeerConn) error {
+	session, err := c.newUploadSession(dbTorrent)
+	if err == nil {
+		err = c.servePeerEvents(session, pc)
+
+		// Rest of the uploaded bytes that did not fill a batch
+		counterErr := c.saveUploaded(session)
+		if err == nil {
+			err = counterErr
+		}
+	}
+
+	if err != nil {
+		pc.Close()
+
+		// Read goroutine only finishes once its last events are taken
+		for range pc.Events() {
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) servePeerEvents(session *uploadSession, pc *torrent.PeerConn) error {
+	for event := range pc.Events() {
+		if event.Err != nil {
+			if event.Err == torrent.ErrPeerConnClosed {
+				return nil
+			}
+
+			return event.Err
+		}
+
+		err := c.handlePeerEvent(session, pc, event.Message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pc.Err()
+}
+
+func (c *Client) saveUploaded(session *uploadSession) error {
+	err := c.addTransferred(session.dbTorrent, 0, session.unsaved)
+	if err != nil {
+		return err
+	}
+
+	session.unsaved = 0
+
+	return nil
+}
+
+func (c *Client) handlePeerEvent(session *uploadSession, pc *torrent.PeerConn, msg *torrent.PeerMessage) error {
+	switch msg.Type {
+	case torrent.Interested:
+		return pc.Unchoke()
+	case torrent.NotInterested:
+		return pc.Choke()
+	case torrent.Request:
+		request := msg.Payload.(torrent.RequestPayload)
+
+		// Choke rejected it already, unless it is allowed fast
+		if pc.State().AmChoking && !pc.Seeder.AllowsFast(int(request.Index)) {
+			return nil
+		}
+
+		block, err := c.readRequestedBlock(session, request)
+		if err != nil {
+			debugMsg := fmt.Sprintf("Rejecting request of piece %d of %s %v", request.Index, session.dbTorrent.Name, err)
+			slog.Debug(debugMsg)
+
+			return pc.RejectRequest(request)
+		}
+
+		sent, err := pc.SendBlock(request, block)
+		if err != nil || !sent {
+			return err
+		}
+
+		// Counters are written once per piece worth of data instead of per block
+		session.unsaved += len(block)
+		if session.unsaved >= session.metaInfo.Info.PieceLength {
+			return c.saveUploaded(session)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// BEP 11 allows one message per minute in each direction
+const defaultPexInterval = time.Minute
+
+var ErrPexTooFrequent = errors.New("peer exchange message sent too frequently")
+var ErrPexUnknownConnection = errors.New("peer exchange on unknown connection")
+
+type pexConnection struct {
+	// What the remote side already heard from us, keyed by address
+	sent         map[string]torrent.PexPeer
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// Keeps track of the peers we are connected to for one torrent and
+// tells every connection which of them came and went since the last message.
+type PexManager struct {
+	Client    *Client
+	TorrentId int
+	InfoHash  []byte
+	Clock     Clock
+	Interval  time.Duration
+
+	mutex sync.Mutex
+	// Connected peers as advertised to others, keyed by connection
+	connected   map[string]torrent.PexPeer
+	connections map[string]*pexConnection
+}
+
+// Private torrents must not exchange peers, see BEP 27.
+// The manager receives the ut_pex messages of the torrent until it is closed.
+func (c *Client) NewPexManager(dbTorrent *db.Torrent) (*PexManager, error) {
+	private, err := c.isPrivate(dbTorrent)
+	if err != nil {
+		return nil, err
+	}
+
+	if private {
+		return nil, ErrPrivateTorrent
+	}
+
+	var clock Clock = realClock{}
+	if c.Clock != nil {
+		clock = c.Clock
+	}
+
+	manager := PexManager{
+		Client:      c,
+		TorrentId:   dbTorrent.TorrentId,
+		InfoHash:    dbTorrent.HashInfo,
+		Clock:       clock,
+		Interval:    defaultPexInterval,
+		connected:   make(map[string]torrent.PexPeer),
+		connections: make(map[string]*pexConnection),
+	}
+
+	c.pexMutex.Lock()
+	if c.pexManagers == nil {
+		c.pexManagers = make(map[string]*PexManager)
+	}
+	c.pexManagers[hex.EncodeToString(dbTorrent.HashInfo)] = &manager
+	c.pexMutex.Unlock()
+
+	return &manager, nil
+}
+
+// Stops routing the torrent's ut_pex messages to the manager.
+func (m *PexManager) Close() {
+	key := hex.EncodeToString(m.InfoHash)
+
+	m.Client.pexMutex.Lock()
+	defer m.Client.pexMutex.Unlock()
+
+	if m.Client.pexManagers[key] == m {
+		delete(m.Client.pexManagers, key)
+	}
+}
+
+// Hands a ut_pex payload to the manager of the connection's torrent.
+// Torrents without one, e.g. private ones, ignore peer exchange.
+func (c *Client) dispatchPex(seeder *torrent.Seeder, payload []byte) error {
+	if seeder.MetaInfo == nil {
+		return nil
+	}
+
+	key := hex.EncodeToString(seeder.MetaInfo.GetInfoHash())
+
+	c.pexMutex.Lock()
+	manager, ok := c.pexManagers[key]
+	c.pexMutex.Unlock()
+
+	if !ok {
+		slog.Debug("Ignoring peer exchange for torrent " + key)
+		return nil
+	}
+
+	return manager.HandleExtended(seeder, payload)
+}
+
+func pexAddress(peer torrent.PeerInfo) string {
+	return net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port))
+}
+
+// Connection is identified by key, peer is how it is advertised to the others.
+func (m *PexManager) Connected(key string, peer torrent.PexPeer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.connected[key] = peer
+	m.connections[key] = &pexConnection{sent: make(map[string]torrent.PexPeer)}
+}
+
+func (m *PexManager) Disconnected(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.connected, key)
+	delete(m.connections, key)
+}
+
+// Message due for the connection, false if it is too early or nothing changed.
+// Peers which do not fit into one message are sent on the next one.
+func (m *PexManager) Outgoing(key string) (*torrent.PexMessage, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	connection, ok := m.connections[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := m.Clock.Now()
+	if !connection.lastSent.IsZero() && now.Sub(connection.lastSent) < m.Interval {
+		return nil, false
+	}
+
+	current := make(map[string]torrent.PexPeer)
+	for otherKey, peer := range m.connected {
+		if otherKey != key {
+			current[pexAddress(peer.PeerInfo)] = peer
+		}
+	}
+
+	message := torrent.PexMessage{}
+
+	for _, address := range sortedKeys(current) {
+		if _, ok := connection.sent[address]; !ok && len(message.Added) < torrent.PexMaxPeers {
+			message.Added = append(message.Added, current[address])
+			connection.sent[address] = current[address]
+		}
+	}
+
+	for _, address := range sortedKeys(connection.sent) {
+		if _, ok := current[address]; !ok && len(message.Dropped) < torrent.PexMaxPeers {
+			message.Dropped = append(message.Dropped, connection.sent[address].PeerInfo)
+			delete(connection.sent, address)
+		}
+	}
+
+	if len(message.Added) == 0 && len(message.Dropped) == 0 {
+		return nil, false
+	}
+
+	connection.lastSent = now
+
+	return &message, true
+}
+
+func sortedKeys(peers map[string]torrent.PexPeer) []string {
+	keys := make([]string, 0, len(peers))
+	for key := range peers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Sends due messages to every connection until ctx is done.
+func (m *PexManager) Run(ctx context.Context, send func(key string, message *torrent.PexMessage) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.Clock.After(m.Interval):
+		}
+
+		m.mutex.Lock()
+		keys := make([]string, 0, len(m.connections))
+		for key := range m.connections {
+			keys = append(keys, key)
+		}
+		m.mutex.Unlock()
+
+		for _, key := range keys {
+			message, ok := m.Outgoing(key)
+			if !ok {
+				continue
+			}
+
+			err := send(key, message)
+			if err != nil {
+				slog.Warn("Could not send peer exchange to " + key + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// Lets the manager be registered as the ut_pex extension, connections are keyed by peer address.
+func (m *PexManager) HandleExtended(seeder *torrent.Seeder, payload []byte) error {
+	_, err := m.Receive(pexAddress(seeder.SeederInfo), payload)
+	return err
+}
+
+// Handles a ut_pex payload received on the connection and saves the added peers.
+func (m *PexManager) Receive(key string, payload []byte) ([]db.Peer, error) {
+	m.mutex.Lock()
+
+	connection, ok := m.connections[key]
+	if !ok {
+		m.mutex.Unlock()
+		return nil, ErrPexUnknownConnection
+	}
+
+	now := m.Clock.Now()
+	if !connection.lastReceived.IsZero() && now.Sub(connection.lastReceived) < m.Interval {
+		m.mutex.Unlock()
+		return nil, ErrPexTooFrequent
+	}
+
+	connection.lastReceived = now
+	m.mutex.Unlock()
+
+	message, err := torrent.ParsePexMessage(payload)
+	if err != nil {
+		slog.Error("Could not parse peer exchange from " + key)
+		return nil, err
+	}
+
+	// Anything above the limit is ignored
+	added := message.Added
+	if len(added) > torrent.PexMaxPeers {
+		added = added[:torrent.PexMaxPeers]
+	}
+
+	var peers []torrent.PeerInfo
+	for _, peer := range added {
+		if peer.Port != 0 {
+			peers = append(peers, peer.PeerInfo)
+		}
+	}
+
+	debugMsg := fmt.Sprintf("Peer exchange from %s added %d and dropped %d peers", key, len(message.Added), len(message.Dropped))
+	slog.Debug(debugMsg)
+
+	return m.Client.storePeers(m.TorrentId, peers, db.PeerSourcePex)
+}
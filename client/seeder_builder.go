@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+const defaultDialTimeout = 5 * time.Second
+const defaultHandshakeTimeout = 10 * time.Second
+const defaultMetadataTimeout = 30 * time.Second
+
+var ErrNoReachablePeers = errors.New("no reachable peers")
+
+type TCPSeederBuilder struct {
+	PeerRepo         db.PeerRepository
+	ClientId         []byte
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	MetadataTimeout  time.Duration
+	Dial             func(network, address string, timeout time.Duration) (net.Conn, error)
+	// Optional, extensions offered on the connections
+	Extensions *torrent.ExtensionRegistry
+	// Optional, pieces of the torrent we tell peers we have, none without it
+	Bitfield func(dbTorrent *db.Torrent, pieceCount int) ([]byte, error)
+
+	mutex    sync.Mutex
+	nextPeer map[int]int
+}
+
+func NewTCPSeederBuilder(peerRepo db.PeerRepository, clientId []byte) *TCPSeederBuilder {
+	return &TCPSeederBuilder{
+		PeerRepo:         peerRepo,
+		ClientId:         clientId,
+		DialTimeout:      defaultDialTimeout,
+		HandshakeTimeout: defaultHandshakeTimeout,
+		MetadataTimeout:  defaultMetadataTimeout,
+		Dial:             net.DialTimeout,
+		nextPeer:         make(map[int]int),
+	}
+}
+
+// Peers are tried round robin, so consecutive calls for the same torrent
+// don't keep landing on the same peer.
+func (b *TCPSeederBuilder) startingPeer(torrentId int, peerCount int) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.nextPeer == nil {
+		b.nextPeer = make(map[int]int)
+	}
+
+	start := b.nextPeer[torrentId] % peerCount
+	b.nextPeer[torrentId] = start + 1
+
+	return start
+}
+
+func (b *TCPSeederBuilder) connect(peer *db.Peer, metaInfo *torrent.MetaInfo, bitfield []byte) (*torrent.Seeder, error) {
+	address := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+
+	conn, err := b.Dial("tcp", address, b.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	seeder := torrent.Seeder{
+		SeederInfo:   torrent.PeerInfo{PeerId: peer.ProtocolPeerId, IP: net.ParseIP(peer.IP), Port: peer.Port},
+		SeederWriter: conn,
+		SeederReader: conn,
+		MetaInfo:     metaInfo,
+		ClientId:     b.ClientId,
+		Extensions:   b.Extensions,
+	}
+
+	conn.SetDeadline(time.Now().Add(b.HandshakeTimeout))
+
+	err = seeder.InitiateHandshake()
+	if err == nil {
+		_, err = seeder.ReceiveHandshake()
+	}
+
+	if err == nil {
+		err = seeder.Introduce(bitfield)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Handshake is done, from now on deadlines are up to the caller
+	conn.SetDeadline(time.Time{})
+
+	return &seeder, nil
+}
+
+func (b *TCPSeederBuilder) BuildSeeder(dbTorrent *db.Torrent, pieceIndex int) (*torrent.Seeder, error) {
+	metaInfo, err := torrent.ParseMetaInfo(bytes.NewReader(dbTorrent.RawMetaInfo))
+	if err != nil {
+		slog.Error("Could not parse meta info of " + dbTorrent.Name)
+		return nil, err
+	}
+
+	peers, err := b.PeerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		slog.Error("Error on peer database query.")
+		return nil, err
+	}
+
+	var reachablePeers []db.Peer
+	for i := range peers {
+		if peers[i].Reachable {
+			reachablePeers = append(reachablePeers, peers[i])
+		}
+	}
+
+	if len(reachablePeers) == 0 {
+		return nil, ErrNoReachablePeers
+	}
+
+	var bitfield []byte
+	if b.Bitfield != nil {
+		bitfield, err = b.Bitfield(dbTorrent, metaInfo.GetPieceCount())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := b.startingPeer(dbTorrent.TorrentId, len(reachablePeers))
+
+	for i := range reachablePeers {
+		peer := reachablePeers[(start+i)%len(reachablePeers)]
+
+		seeder, err := b.connect(&peer, metaInfo, bitfield)
+		if err == nil {
+			return seeder, nil
+		}
+
+		warnMsg := fmt.Sprintf("Could not connect to peer %s:%d %v, marking it unreachable...", peer.IP, peer.Port, err)
+		slog.Warn(warnMsg)
+
+		peer.Reachable = false
+
+		err = b.PeerRepo.Update(&peer)
+		if err != nil {
+			slog.Error("Could not update peer record.")
+			return nil, err
+		}
+	}
+
+	return nil, ErrNoReachablePeers
+}
+
+func (b *TCPSeederBuilder) fetchMetadataFrom(peer torrent.PeerInfo, infoHash []byte) ([]byte, error) {
+	address := net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port))
+
+	conn, err := b.Dial("tcp", address, b.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	seeder := torrent.Seeder{
+		SeederInfo:   peer,
+		SeederWriter: conn,
+		SeederReader: conn,
+		InfoHash:     infoHash,
+		ClientId:     b.ClientId,
+		Extensions:   b.Extensions,
+	}
+
+	conn.SetDeadline(time.Now().Add(b.HandshakeTimeout))
+
+	err = seeder.InitiateHandshake()
+	if err == nil {
+		_, err = seeder.ReceiveHandshake()
+	}
+
+	// Nothing to offer while the metadata is missing
+	if err == nil {
+		err = seeder.Introduce(nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(b.MetadataTimeout))
+
+	return seeder.FetchMetadata(infoHash)
+}
+
+// Peers are asked one after another until one of them gives us the metadata.
+func (b *TCPSeederBuilder) FetchMetadata(infoHash []byte, peers []torrent.PeerInfo) ([]byte, error) {
+	for _, peer := range peers {
+		info, err := b.fetchMetadataFrom(peer, infoHash)
+		if err == nil {
+			return info, nil
+		}
+
+		warnMsg := fmt.Sprintf("Could not fetch metadata from %s:%d %v", peer.IP, peer.Port, err)
+		slog.Warn(warnMsg)
+	}
+
+	return nil, ErrMetadataNotFound
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// Trackers inside a tier are shuffled once, when the torrent is opened (BEP 12).
+func (c *Client) createTrackers(dbTorrent *db.Torrent, metaInfo *torrent.MetaInfo) error {
+	for tier, urls := range metaInfo.GetAnnounceTiers() {
+		shuffled := append([]string{}, urls...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+
+		for position := range shuffled {
+			dbTracker := db.Tracker{
+				TorrentId: dbTorrent.TorrentId,
+				URL:       shuffled[position],
+				Tier:      tier,
+				Position:  position,
+			}
+
+			err := c.TrackerRepo.Create(&dbTracker)
+			if err != nil {
+				slog.Error("Could not save tracker record to database.")
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) GetTrackers(dbTorrent *db.Torrent) ([]db.Tracker, error) {
+	return c.TrackerRepo.GetByTorrentId(dbTorrent.TorrentId)
+}
+
+// First tracker of the first tier, or the announce URL if there are no tracker records
+func (c *Client) primaryTrackerURL(dbTorrent *db.Torrent) (string, error) {
+	dbTrackers, err := c.TrackerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		return "", err
+	}
+
+	if len(dbTrackers) == 0 {
+		return dbTorrent.Announce, nil
+	}
+
+	return dbTrackers[0].URL, nil
+}
+
+func groupByTier(dbTrackers []db.Tracker) [][]db.Tracker {
+	var tiers [][]db.Tracker
+
+	for i := range dbTrackers {
+		if i == 0 || dbTrackers[i].Tier != dbTrackers[i-1].Tier {
+			tiers = append(tiers, []db.Tracker{})
+		}
+
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], dbTrackers[i])
+	}
+
+	return tiers
+}
+
+func (c *Client) recordTrackerStatus(dbTracker *db.Tracker, announceResponse *torrent.AnnounceResponse, announceErr error) {
+	announceTime := c.now()
+	dbTracker.LastAnnounce = &announceTime
+
+	if announceErr != nil {
+		errMsg := announceErr.Error()
+		dbTracker.LastError = &errMsg
+	} else {
+		dbTracker.LastError = nil
+		dbTracker.LastSuccess = &announceTime
+		dbTracker.PeerCount = len(announceResponse.Peers)
+
+		// Tracker id is kept until the tracker hands out a new one
+		if announceResponse.TrackerId != "" {
+			trackerId := announceResponse.TrackerId
+			dbTracker.ProtocolTrackerId = &trackerId
+		}
+
+		dbTracker.LastWarning = nil
+
+		if announceResponse.WarningMessage != "" {
+			warning := announceResponse.WarningMessage
+			dbTracker.LastWarning = &warning
+
+			slog.Warn("Tracker " + dbTracker.URL + " warns: " + warning)
+		}
+	}
+
+	err := c.TrackerRepo.Update(dbTracker)
+	if err != nil {
+		slog.Error("Could not update tracker record " + dbTracker.URL)
+	}
+}
+
+// Tracker which answered moves to the front of its tier.
+func (c *Client) promoteTracker(tier []db.Tracker, index int) {
+	front := tier[0].Position
+
+	for i := 0; i <= index; i++ {
+		if i == index {
+			tier[i].Position = front
+		} else {
+			tier[i].Position++
+		}
+
+		err := c.TrackerRepo.Update(&tier[i])
+		if err != nil {
+			slog.Error("Could not update tracker record " + tier[i].URL)
+		}
+	}
+}
+
+func (c *Client) announceToTrackers(ctx context.Context, dbTorrent *db.Torrent, announceRequest *torrent.AnnounceRequest) (*torrent.AnnounceResponse, error) {
+	dbTrackers, err := c.TrackerRepo.GetByTorrentId(dbTorrent.TorrentId)
+	if err != nil {
+		slog.Error("Could not retrieve trackers of " + dbTorrent.Name)
+		return nil, err
+	}
+
+	// Torrents without tracker records just use the announce URL
+	if len(dbTrackers) == 0 {
+		announceRequest.AnnounceURL = dbTorrent.Announce
+		return c.trackerClient().Announce(ctx, announceRequest)
+	}
+
+	var lastErr error
+
+	for _, tier := range groupByTier(dbTrackers) {
+		for i := range tier {
+			announceRequest.AnnounceURL = tier[i].URL
+
+			announceRequest.TrackerId = ""
+			if tier[i].ProtocolTrackerId != nil {
+				announceRequest.TrackerId = *tier[i].ProtocolTrackerId
+			}
+
+			announceResponse, err := c.trackerClient().Announce(ctx, announceRequest)
+
+			// Cancelled announce is not the fault of the tracker
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			c.recordTrackerStatus(&tier[i], announceResponse, err)
+
+			if err == nil {
+				c.promoteTracker(tier, i)
+				return announceResponse, nil
+			}
+
+			warnMsg := fmt.Sprintf("Tracker %s failed %v, trying the next one...", tier[i].URL, err)
+			slog.Warn(warnMsg)
+
+			lastErr = err
+		}
+	}
+
+	return nil, lastErr
+}
+
+// Torrents sharing a tracker are scraped with a single request
+func (c *Client) ScrapeTorrents(dbTorrents []*db.Torrent) error {
+	byTracker := make(map[string][]*db.Torrent)
+	var trackerURLs []string
+
+	for _, dbTorrent := range dbTorrents {
+		trackerURL, err := c.primaryTrackerURL(dbTorrent)
+		if err != nil {
+			slog.Error("Could not retrieve trackers of " + dbTorrent.Name)
+			return err
+		}
+
+		if _, exists := byTracker[trackerURL]; !exists {
+			trackerURLs = append(trackerURLs, trackerURL)
+		}
+
+		byTracker[trackerURL] = append(byTracker[trackerURL], dbTorrent)
+	}
+
+	var lastErr error
+
+	for _, trackerURL := range trackerURLs {
+		var infoHashes [][]byte
+		for _, dbTorrent := range byTracker[trackerURL] {
+			infoHashes = append(infoHashes, dbTorrent.HashInfo)
+		}
+
+		scrapeResponse, err := c.trackerClient().Scrape(context.Background(), trackerURL, infoHashes)
+		if err != nil {
+			warnMsg := fmt.Sprintf("Could not scrape %s %v", trackerURL, err)
+			slog.Warn(warnMsg)
+
+			lastErr = err
+			continue
+		}
+
+		scrapeTime := c.now()
+
+		for _, dbTorrent := range byTracker[trackerURL] {
+			scrapeFile, exists := scrapeResponse.Files[string(dbTorrent.HashInfo)]
+			if !exists {
+				continue
+			}
+
+			dbTorrent.Seeders = scrapeFile.Complete
+			dbTorrent.Leechers = scrapeFile.Incomplete
+			dbTorrent.Completed = scrapeFile.Downloaded
+			dbTorrent.ScrapeTime = &scrapeTime
+
+			err = c.TorrentRepo.Update(dbTorrent)
+			if err != nil {
+				slog.Error("Could not update torrent record " + dbTorrent.Name)
+				return err
+			}
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Client) Scrape(dbTorrent *db.Torrent) error {
+	return c.ScrapeTorrents([]*db.Torrent{dbTorrent})
+}
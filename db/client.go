@@ -6,9 +6,12 @@ type Client struct {
 	ClientId   int
 	ProtocolId []byte
 	Created    time.Time
+	// Node id in the DHT, kept the same across restarts
+	DHTNodeId []byte
 }
 
 type ClientRepository interface {
 	Create(client *Client) error
+	Update(client *Client) error
 	GetLast() (*Client, error)
 }
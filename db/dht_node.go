@@ -0,0 +1,18 @@
+package db
+
+import "time"
+
+// Routing table entry of our DHT node
+type DHTNode struct {
+	DHTNodeId      int
+	ProtocolNodeId []byte
+	IP             string
+	Port           int
+	LastSeen       time.Time
+}
+
+type DHTNodeRepository interface {
+	Create(node *DHTNode) error
+	DeleteAll() error
+	GetAll() ([]DHTNode, error)
+}
@@ -1,5 +1,15 @@
 package db
 
+// Where a peer was learned from
+const (
+	PeerSourceTracker = "tracker"
+	PeerSourceDHT     = "dht"
+	PeerSourcePex     = "pex"
+	PeerSourceLSD     = "lsd"
+	// Given with x.pe in a magnet link
+	PeerSourceMagnet = "magnet"
+)
+
 type Peer struct {
 	PeerId         int
 	ProtocolPeerId []byte
@@ -7,6 +17,7 @@ type Peer struct {
 	Port           int
 	TorrentId      int
 	Reachable      bool
+	Source         string
 }
 
 type PeerRepository interface {
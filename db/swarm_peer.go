@@ -0,0 +1,23 @@
+package db
+
+import "time"
+
+// Peer as seen by the built-in tracker, not to be confused with Peer of a torrent we download
+type SwarmPeer struct {
+	SwarmPeerId    int
+	HashInfo       []byte
+	ProtocolPeerId []byte
+	IP             string
+	Port           int
+	Uploaded       int
+	Downloaded     int
+	Left           int
+	LastSeen       time.Time
+}
+
+type SwarmPeerRepository interface {
+	Create(peer *SwarmPeer) error
+	Update(peer *SwarmPeer) error
+	Delete(peer *SwarmPeer) error
+	GetAll() ([]SwarmPeer, error)
+}
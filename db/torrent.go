@@ -12,6 +12,13 @@ type Torrent struct {
 	Paused      bool
 	Location    string
 	Progress    int
+	Seeding     bool
+	Uploaded    int
+	Downloaded  int
+	Seeders     int
+	Leechers    int
+	Completed   int
+	ScrapeTime  *time.Time
 	Announces   []TrackerAnnounce
 	Pieces      []Piece
 	RawMetaInfo []byte
@@ -23,4 +30,6 @@ type TorrentRepository interface {
 	Delete(torrent *Torrent) error
 	GetAll() ([]Torrent, error)
 	GetByHashInfo(hashInfo []byte) (*Torrent, error)
+	// Counters are only changed here, Update leaves them alone
+	AddTransferred(torrentId int, downloaded int, uploaded int) error
 }
@@ -0,0 +1,25 @@
+package db
+
+import "time"
+
+type Tracker struct {
+	TrackerId    int
+	TorrentId    int
+	URL          string
+	Tier         int
+	Position     int
+	LastAnnounce *time.Time
+	LastSuccess  *time.Time
+	LastError    *string
+	PeerCount    int
+	// Tracker id handed out by the tracker, sent back on later announces
+	ProtocolTrackerId *string
+	LastWarning       *string
+}
+
+type TrackerRepository interface {
+	Create(tracker *Tracker) error
+	Update(tracker *Tracker) error
+	// Ordered by tier and position inside the tier
+	GetByTorrentId(torrentId int) ([]Tracker, error)
+}
@@ -0,0 +1,3 @@
+module example.com/dht
+
+go 1.21.5
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"example.com/bencode"
+)
+
+const (
+	messageQuery    = "q"
+	messageResponse = "r"
+	messageError    = "e"
+)
+
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	errorGeneric       = 201
+	errorServer        = 202
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+)
+
+const nodeIdLength = 20
+
+// 20 bytes node id, 4 bytes IPv4 address, 2 bytes port
+const compactNodeSize = nodeIdLength + 6
+const compactPeerSize = 6
+
+var ErrInvalidMessage = errors.New("invalid KRPC message")
+
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+type message struct {
+	TransactionId string
+	Type          string
+	Method        string
+	Args          map[string]any
+	Response      map[string]any
+	Err           *KRPCError
+}
+
+func (m *message) encode() ([]byte, error) {
+	encoded := map[string]any{"t": m.TransactionId, "y": m.Type}
+
+	switch m.Type {
+	case messageQuery:
+		encoded["q"] = m.Method
+		encoded["a"] = m.Args
+	case messageResponse:
+		encoded["r"] = m.Response
+	case messageError:
+		encoded["e"] = []any{m.Err.Code, m.Err.Message}
+	}
+
+	return bencode.Marshal(encoded)
+}
+
+func decodeMessage(data []byte) (*message, error) {
+	var decoded map[string]any
+
+	err := bencode.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	m := message{}
+
+	var ok bool
+
+	m.TransactionId, ok = decoded["t"].(string)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	m.Type, ok = decoded["y"].(string)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	switch m.Type {
+	case messageQuery:
+		m.Method, _ = decoded["q"].(string)
+		m.Args, ok = decoded["a"].(map[string]any)
+	case messageResponse:
+		m.Response, ok = decoded["r"].(map[string]any)
+	case messageError:
+		var list []any
+		list, ok = decoded["e"].([]any)
+		if ok && len(list) == 2 {
+			code, _ := list[0].(int)
+			msg, _ := list[1].(string)
+			m.Err = &KRPCError{Code: code, Message: msg}
+		}
+	default:
+		ok = false
+	}
+
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+
+	return &m, nil
+}
+
+// Node id of the sender, every query and response carries it
+func senderId(values map[string]any) ([]byte, error) {
+	id, ok := values["id"].(string)
+	if !ok || len(id) != nodeIdLength {
+		return nil, ErrInvalidMessage
+	}
+
+	return []byte(id), nil
+}
+
+func encodeCompactAddr(addr *net.UDPAddr) []byte {
+	encoded := make([]byte, 6)
+	copy(encoded, addr.IP.To4())
+	binary.BigEndian.PutUint16(encoded[4:], uint16(addr.Port))
+
+	return encoded
+}
+
+func decodeCompactAddr(data []byte) *net.UDPAddr {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, data[0:4])
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[4:6]))}
+}
+
+// Only IPv4 contacts fit into the compact format of BEP 5
+func encodeCompactNodes(contacts []Contact) string {
+	encoded := []byte{}
+
+	for _, contact := range contacts {
+		if contact.Addr.IP.To4() == nil {
+			continue
+		}
+
+		encoded = append(encoded, contact.Id...)
+		encoded = append(encoded, encodeCompactAddr(contact.Addr)...)
+	}
+
+	return string(encoded)
+}
+
+func decodeCompactNodes(data string) ([]Contact, error) {
+	if len(data)%compactNodeSize != 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	var contacts []Contact
+
+	for i := 0; i < len(data); i += compactNodeSize {
+		entry := []byte(data[i : i+compactNodeSize])
+
+		contacts = append(contacts, Contact{Id: entry[:nodeIdLength], Addr: decodeCompactAddr(entry[nodeIdLength:])})
+	}
+
+	return contacts, nil
+}
@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	query := message{TransactionId: "aa", Type: messageQuery, Method: methodGetPeers, Args: map[string]any{"id": string(GenerateNodeId()), "info_hash": string(GenerateNodeId())}}
+
+	encoded, err := query.encode()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	decoded, err := decodeMessage(encoded)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if decoded.TransactionId != "aa" || decoded.Method != methodGetPeers || decoded.Args["info_hash"] != query.Args["info_hash"] {
+		t.Errorf("Unexpected message %#v", decoded)
+	}
+
+	errorMessage := message{TransactionId: "bb", Type: messageError, Err: &KRPCError{Code: errorProtocol, Message: "bad token"}}
+
+	encoded, err = errorMessage.encode()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	decoded, err = decodeMessage(encoded)
+	if err != nil || decoded.Err == nil || decoded.Err.Code != errorProtocol || decoded.Err.Message != "bad token" {
+		t.Errorf("Unexpected error message %v %#v", err, decoded)
+	}
+}
+
+func TestDecodeInvalidMessage(t *testing.T) {
+	invalid := []string{
+		"i42e",
+		"d1:t2:aae",
+		"d1:t2:aa1:y1:xe",
+		"d1:t2:aa1:y1:q1:q4:ping1:ai1ee",
+	}
+
+	for _, data := range invalid {
+		_, err := decodeMessage([]byte(data))
+		if err == nil {
+			t.Errorf("Expected error on %s", data)
+		}
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	contacts := []Contact{
+		{Id: GenerateNodeId(), Addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}},
+		{Id: GenerateNodeId(), Addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6882}},
+		{Id: GenerateNodeId(), Addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 51413}},
+	}
+
+	encoded := encodeCompactNodes(contacts)
+	if len(encoded) != 2*compactNodeSize {
+		t.Errorf("Expected IPv6 contact to be left out, got %d bytes", len(encoded))
+		return
+	}
+
+	decoded, err := decodeCompactNodes(encoded)
+	if err != nil || len(decoded) != 2 {
+		t.Errorf("Unexpected decoded nodes %v %#v", err, decoded)
+		return
+	}
+
+	if !bytes.Equal(decoded[1].Id, contacts[2].Id) || !decoded[1].Addr.IP.Equal(contacts[2].Addr.IP) || decoded[1].Addr.Port != 51413 {
+		t.Errorf("Unexpected contact %#v", decoded[1])
+	}
+
+	_, err = decodeCompactNodes(encoded[1:])
+	if err != ErrInvalidMessage {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+}
@@ -0,0 +1,619 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+// Number of queries in flight during a lookup
+const lookupAlpha = 3
+
+const defaultQueryTimeout = 2 * time.Second
+
+// Announced peers are forgotten unless they announce again
+const peerTimeout = 30 * time.Minute
+
+// Bounds on what announcing nodes can make us store
+const maxStoredInfoHashes = 1000
+const maxStoredPeersPerInfoHash = 200
+
+const maxPacketSize = 65536
+
+var ErrNoContacts = errors.New("routing table is empty")
+var ErrQueryTimeout = errors.New("query timed out")
+var ErrAnnounceFailed = errors.New("no node accepted the announce")
+
+func GenerateNodeId() []byte {
+	id := make([]byte, nodeIdLength)
+	rand.Read(id)
+
+	return id
+}
+
+type storedPeer struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+// Query waiting for its response, only the queried node may answer it
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *message
+}
+
+// Mainline DHT node, see BEP 5.
+type Node struct {
+	Id   []byte
+	Conn net.PacketConn
+	// host:port of the nodes used to join the network
+	BootstrapNodes []string
+	// Optional, routing table is persisted there
+	NodeRepo db.DHTNodeRepository
+	Timeout  time.Duration
+	Now      func() time.Time
+
+	table  *RoutingTable
+	tokens tokenManager
+
+	mutex         sync.Mutex
+	transactionId uint16
+	pending       map[string]pendingQuery
+	peers         map[string]map[string]storedPeer
+}
+
+func NewNode(id []byte, conn net.PacketConn) *Node {
+	return &Node{
+		Id:      id,
+		Conn:    conn,
+		Timeout: defaultQueryTimeout,
+		Now:     time.Now,
+		table:   NewRoutingTable(id),
+		pending: make(map[string]pendingQuery),
+		peers:   make(map[string]map[string]storedPeer),
+	}
+}
+
+func (n *Node) RoutingTable() *RoutingTable {
+	return n.table
+}
+
+// Blocks until Conn is closed
+func (n *Node) Serve() error {
+	packet := make([]byte, maxPacketSize)
+
+	for {
+		size, addr, err := n.Conn.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		m, err := decodeMessage(packet[:size])
+		if err != nil {
+			slog.Debug("Dropping invalid KRPC message from " + addr.String())
+			continue
+		}
+
+		if m.Type == messageQuery {
+			n.handleQuery(m, udpAddr)
+			continue
+		}
+
+		n.mutex.Lock()
+		waiting, ok := n.pending[m.TransactionId]
+		if ok && !sameAddr(waiting.addr, udpAddr) {
+			ok = false
+		}
+
+		if ok {
+			delete(n.pending, m.TransactionId)
+		}
+		n.mutex.Unlock()
+
+		if !ok {
+			slog.Debug("Dropping unexpected KRPC response from " + addr.String())
+			continue
+		}
+
+		waiting.response <- m
+	}
+}
+
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func (n *Node) send(m *message, addr *net.UDPAddr) error {
+	encoded, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = n.Conn.WriteTo(encoded, addr)
+
+	return err
+}
+
+func (n *Node) nextTransactionId() string {
+	n.transactionId++
+
+	id := make([]byte, 2)
+	binary.BigEndian.PutUint16(id, n.transactionId)
+
+	return string(id)
+}
+
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]any) (map[string]any, error) {
+	args["id"] = string(n.Id)
+
+	waiting := make(chan *message, 1)
+
+	n.mutex.Lock()
+	transactionId := n.nextTransactionId()
+	n.pending[transactionId] = pendingQuery{addr: addr, response: waiting}
+	n.mutex.Unlock()
+
+	defer func() {
+		n.mutex.Lock()
+		delete(n.pending, transactionId)
+		n.mutex.Unlock()
+	}()
+
+	err := n.send(&message{TransactionId: transactionId, Type: messageQuery, Method: method, Args: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrQueryTimeout
+	case m := <-waiting:
+		if m.Type == messageError {
+			return nil, m.Err
+		}
+
+		id, err := senderId(m.Response)
+		if err != nil {
+			return nil, err
+		}
+
+		n.table.Insert(Contact{Id: id, Addr: addr, LastSeen: n.Now()})
+
+		return m.Response, nil
+	}
+}
+
+func (n *Node) Ping(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := n.query(ctx, addr, methodPing, map[string]any{})
+	return err
+}
+
+// Contacts the bootstrap nodes and looks up our own id to fill the routing table.
+func (n *Node) Bootstrap(ctx context.Context) error {
+	for _, bootstrapNode := range n.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", bootstrapNode)
+		if err != nil {
+			slog.Warn("Could not resolve bootstrap node " + bootstrapNode)
+			continue
+		}
+
+		_, err = n.query(ctx, addr, methodFindNode, map[string]any{"target": string(n.Id)})
+		if err != nil {
+			slog.Warn("Bootstrap node " + bootstrapNode + " did not respond: " + err.Error())
+		}
+	}
+
+	if n.table.Len() == 0 {
+		return ErrNoContacts
+	}
+
+	_, err := n.lookup(ctx, n.Id, methodFindNode)
+
+	return err
+}
+
+type lookupResult struct {
+	closest []Contact
+	// Keyed by node id
+	tokens map[string]string
+	peers  []torrent.PeerInfo
+}
+
+// Iterative lookup, queries the closest known nodes until no closer ones show up.
+func (n *Node) lookup(ctx context.Context, target []byte, method string) (*lookupResult, error) {
+	shortlist := n.table.Closest(target, bucketSize)
+	if len(shortlist) == 0 {
+		return nil, ErrNoContacts
+	}
+
+	result := lookupResult{tokens: make(map[string]string)}
+
+	queried := make(map[string]bool)
+	responded := make(map[string]bool)
+	seen := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+
+	// Other nodes may return us as one of the closest
+	seen[string(n.Id)] = true
+
+	for _, contact := range shortlist {
+		seen[string(contact.Id)] = true
+	}
+
+	var mutex sync.Mutex
+
+	for {
+		var batch []Contact
+
+		for _, contact := range shortlist {
+			if len(batch) == lookupAlpha {
+				break
+			}
+
+			if !queried[string(contact.Id)] {
+				queried[string(contact.Id)] = true
+				batch = append(batch, contact)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+
+		for _, contact := range batch {
+			wg.Add(1)
+
+			go func(contact Contact) {
+				defer wg.Done()
+
+				args := map[string]any{"target": string(target)}
+				if method == methodGetPeers {
+					args = map[string]any{"info_hash": string(target)}
+				}
+
+				response, err := n.query(ctx, contact.Addr, method, args)
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				responded[string(contact.Id)] = true
+
+				if token, ok := response["token"].(string); ok {
+					result.tokens[string(contact.Id)] = token
+				}
+
+				values, _ := response["values"].([]any)
+				for _, value := range values {
+					compact, ok := value.(string)
+					if !ok || len(compact) != compactPeerSize || seenPeers[compact] {
+						continue
+					}
+
+					seenPeers[compact] = true
+
+					addr := decodeCompactAddr([]byte(compact))
+					result.peers = append(result.peers, torrent.PeerInfo{IP: addr.IP, Port: addr.Port})
+				}
+
+				nodes, _ := response["nodes"].(string)
+				contacts, err := decodeCompactNodes(nodes)
+				if err != nil {
+					return
+				}
+
+				for _, found := range contacts {
+					if seen[string(found.Id)] || len(found.Id) != nodeIdLength {
+						continue
+					}
+
+					seen[string(found.Id)] = true
+					shortlist = append(shortlist, found)
+				}
+			}(contact)
+		}
+
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		sortByDistance(shortlist, target)
+		if len(shortlist) > bucketSize {
+			shortlist = shortlist[:bucketSize]
+		}
+	}
+
+	for _, contact := range shortlist {
+		if responded[string(contact.Id)] {
+			result.closest = append(result.closest, contact)
+		}
+	}
+
+	return &result, nil
+}
+
+func (n *Node) GetPeers(ctx context.Context, infoHash []byte) ([]torrent.PeerInfo, error) {
+	result, err := n.lookup(ctx, infoHash, methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.peers, nil
+}
+
+// Announces to the closest nodes that we are downloading infoHash on port.
+func (n *Node) AnnouncePeer(ctx context.Context, infoHash []byte, port int) error {
+	result, err := n.lookup(ctx, infoHash, methodGetPeers)
+	if err != nil {
+		return err
+	}
+
+	accepted := 0
+
+	for _, contact := range result.closest {
+		token, ok := result.tokens[string(contact.Id)]
+		if !ok {
+			continue
+		}
+
+		args := map[string]any{
+			"info_hash": string(infoHash),
+			"port":      port,
+			"token":     token,
+		}
+
+		_, err := n.query(ctx, contact.Addr, methodAnnouncePeer, args)
+		if err != nil {
+			slog.Debug("Announce to " + contact.Addr.String() + " failed: " + err.Error())
+			continue
+		}
+
+		accepted++
+	}
+
+	if accepted == 0 {
+		return ErrAnnounceFailed
+	}
+
+	return nil
+}
+
+func (n *Node) respondError(m *message, addr *net.UDPAddr, code int, text string) {
+	response := message{TransactionId: m.TransactionId, Type: messageError, Err: &KRPCError{Code: code, Message: text}}
+
+	err := n.send(&response, addr)
+	if err != nil {
+		slog.Debug("Could not send error to " + addr.String() + ": " + err.Error())
+	}
+}
+
+func (n *Node) handleQuery(m *message, addr *net.UDPAddr) {
+	id, err := senderId(m.Args)
+	if err != nil {
+		n.respondError(m, addr, errorProtocol, "invalid node id")
+		return
+	}
+
+	n.table.Insert(Contact{Id: id, Addr: addr, LastSeen: n.Now()})
+
+	values := map[string]any{"id": string(n.Id)}
+
+	switch m.Method {
+	case methodPing:
+	case methodFindNode:
+		target, ok := m.Args["target"].(string)
+		if !ok || len(target) != nodeIdLength {
+			n.respondError(m, addr, errorProtocol, "invalid target")
+			return
+		}
+
+		values["nodes"] = encodeCompactNodes(n.table.Closest([]byte(target), bucketSize))
+	case methodGetPeers:
+		infoHash, ok := m.Args["info_hash"].(string)
+		if !ok || len(infoHash) != nodeIdLength {
+			n.respondError(m, addr, errorProtocol, "invalid info_hash")
+			return
+		}
+
+		values["token"] = string(n.tokens.token(addr.IP, n.Now()))
+
+		peers := n.storedPeers(infoHash)
+		if len(peers) > 0 {
+			values["values"] = peers
+		} else {
+			values["nodes"] = encodeCompactNodes(n.table.Closest([]byte(infoHash), bucketSize))
+		}
+	case methodAnnouncePeer:
+		infoHash, ok := m.Args["info_hash"].(string)
+		if !ok || len(infoHash) != nodeIdLength {
+			n.respondError(m, addr, errorProtocol, "invalid info_hash")
+			return
+		}
+
+		token, _ := m.Args["token"].(string)
+		if !n.tokens.valid([]byte(token), addr.IP, n.Now()) {
+			n.respondError(m, addr, errorProtocol, "bad token")
+			return
+		}
+
+		port, _ := m.Args["port"].(int)
+		if impliedPort, _ := m.Args["implied_port"].(int); impliedPort == 1 {
+			port = addr.Port
+		}
+
+		if port <= 0 || port > 65535 {
+			n.respondError(m, addr, errorProtocol, "invalid port")
+			return
+		}
+
+		n.storePeer(infoHash, &net.UDPAddr{IP: addr.IP, Port: port})
+	default:
+		n.respondError(m, addr, errorMethodUnknown, "method unknown")
+		return
+	}
+
+	err = n.send(&message{TransactionId: m.TransactionId, Type: messageResponse, Response: values}, addr)
+	if err != nil {
+		slog.Debug("Could not respond to " + addr.String() + ": " + err.Error())
+	}
+}
+
+func (n *Node) storePeer(infoHash string, addr *net.UDPAddr) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := n.Now()
+
+	swarm, ok := n.peers[infoHash]
+	if !ok {
+		if len(n.peers) >= maxStoredInfoHashes {
+			n.expirePeers(now)
+		}
+
+		if len(n.peers) >= maxStoredInfoHashes {
+			slog.Debug("Too many info hashes stored, ignoring announce from " + addr.String())
+			return
+		}
+
+		swarm = make(map[string]storedPeer)
+		n.peers[infoHash] = swarm
+	}
+
+	key := addr.String()
+
+	// Full swarm makes room by forgetting the peer we heard from the longest time ago
+	if _, exists := swarm[key]; !exists && len(swarm) >= maxStoredPeersPerInfoHash {
+		oldestKey := ""
+		for peerKey, peer := range swarm {
+			if oldestKey == "" || peer.seen.Before(swarm[oldestKey].seen) {
+				oldestKey = peerKey
+			}
+		}
+
+		delete(swarm, oldestKey)
+	}
+
+	swarm[key] = storedPeer{addr: addr, seen: now}
+}
+
+// Drops expired peers and the info hashes left without any
+func (n *Node) expirePeers(now time.Time) {
+	for infoHash, swarm := range n.peers {
+		for key, peer := range swarm {
+			if now.Sub(peer.seen) > peerTimeout {
+				delete(swarm, key)
+			}
+		}
+
+		if len(swarm) == 0 {
+			delete(n.peers, infoHash)
+		}
+	}
+}
+
+// Compact peers announced for infoHash, expired ones are dropped on the way
+func (n *Node) storedPeers(infoHash string) []any {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var peers []any
+
+	for key, peer := range n.peers[infoHash] {
+		if n.Now().Sub(peer.seen) > peerTimeout {
+			delete(n.peers[infoHash], key)
+			continue
+		}
+
+		if peer.addr.IP.To4() == nil {
+			continue
+		}
+
+		peers = append(peers, string(encodeCompactAddr(peer.addr)))
+	}
+
+	return peers
+}
+
+// Restores the routing table saved by Save
+func (n *Node) Load() error {
+	if n.NodeRepo == nil {
+		return nil
+	}
+
+	dbNodes, err := n.NodeRepo.GetAll()
+	if err != nil {
+		slog.Error("Could not retrieve DHT nodes.")
+		return err
+	}
+
+	for _, dbNode := range dbNodes {
+		ip := net.ParseIP(dbNode.IP)
+		if ip == nil {
+			continue
+		}
+
+		n.table.Insert(Contact{Id: dbNode.ProtocolNodeId, Addr: &net.UDPAddr{IP: ip, Port: dbNode.Port}, LastSeen: dbNode.LastSeen})
+	}
+
+	slog.Info("Loaded " + strconv.Itoa(n.table.Len()) + " DHT nodes.")
+
+	return nil
+}
+
+func (n *Node) Save() error {
+	if n.NodeRepo == nil {
+		return nil
+	}
+
+	err := n.NodeRepo.DeleteAll()
+	if err != nil {
+		slog.Error("Could not delete DHT nodes.")
+		return err
+	}
+
+	for _, contact := range n.table.Contacts() {
+		dbNode := db.DHTNode{
+			ProtocolNodeId: contact.Id,
+			IP:             contact.Addr.IP.String(),
+			Port:           contact.Addr.Port,
+			LastSeen:       contact.LastSeen,
+		}
+
+		err = n.NodeRepo.Create(&dbNode)
+		if err != nil {
+			slog.Error("Could not save DHT node.")
+			return err
+		}
+	}
+
+	return nil
+}
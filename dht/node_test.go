@@ -0,0 +1,315 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/db"
+)
+
+type memoryNodeRepository struct {
+	nodes []db.DHTNode
+}
+
+func (r *memoryNodeRepository) Create(node *db.DHTNode) error {
+	node.DHTNodeId = len(r.nodes) + 1
+	r.nodes = append(r.nodes, *node)
+	return nil
+}
+
+func (r *memoryNodeRepository) DeleteAll() error {
+	r.nodes = nil
+	return nil
+}
+
+func (r *memoryNodeRepository) GetAll() ([]db.DHTNode, error) {
+	return r.nodes, nil
+}
+
+func startTestNode(t *testing.T) *Node {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+
+	node := NewNode(GenerateNodeId(), conn)
+	node.Timeout = 500 * time.Millisecond
+
+	go node.Serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return node
+}
+
+func startTestNetwork(t *testing.T, size int) []*Node {
+	nodes := []*Node{startTestNode(t)}
+
+	for i := 1; i < size; i++ {
+		node := startTestNode(t)
+		node.BootstrapNodes = []string{nodes[0].Conn.LocalAddr().String()}
+
+		err := node.Bootstrap(context.Background())
+		if err != nil {
+			t.Fatalf("Could not bootstrap node %d %v", i, err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func TestBootstrapWithoutNodes(t *testing.T) {
+	node := startTestNode(t)
+
+	err := node.Bootstrap(context.Background())
+	if err != ErrNoContacts {
+		t.Errorf("Expected ErrNoContacts, got %v", err)
+	}
+
+	_, err = node.GetPeers(context.Background(), GenerateNodeId())
+	if err != ErrNoContacts {
+		t.Errorf("Expected ErrNoContacts, got %v", err)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startTestNetwork(t, 6)
+
+	for i, node := range nodes[1:] {
+		if node.RoutingTable().Len() == 0 {
+			t.Errorf("Expected node %d to know other nodes", i+1)
+			return
+		}
+	}
+
+	infoHash := GenerateNodeId()
+
+	err := nodes[1].AnnouncePeer(context.Background(), infoHash, 6881)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	peers, err := nodes[5].GetPeers(context.Background(), infoHash)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP("127.0.0.1")) || peers[0].Port != 6881 {
+		t.Errorf("Expected announced peer, got %#v", peers)
+	}
+
+	peers, err = nodes[5].GetPeers(context.Background(), GenerateNodeId())
+	if err != nil || len(peers) != 0 {
+		t.Errorf("Expected no peers for unknown info hash %v %#v", err, peers)
+	}
+}
+
+func TestAnnouncePeerImpliedPort(t *testing.T) {
+	nodes := startTestNetwork(t, 2)
+	infoHash := GenerateNodeId()
+	addr := nodes[0].Conn.LocalAddr().(*net.UDPAddr)
+
+	response, err := nodes[1].query(context.Background(), addr, methodGetPeers, map[string]any{"info_hash": string(infoHash)})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	args := map[string]any{"info_hash": string(infoHash), "port": 1, "implied_port": 1, "token": response["token"]}
+
+	_, err = nodes[1].query(context.Background(), addr, methodAnnouncePeer, args)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	peers := nodes[0].storedPeers(string(infoHash))
+	expected := string(encodeCompactAddr(nodes[1].Conn.LocalAddr().(*net.UDPAddr)))
+
+	if len(peers) != 1 || peers[0] != expected {
+		t.Errorf("Expected peer on source port, got %#v", peers)
+	}
+}
+
+func TestAnnouncePeerBadToken(t *testing.T) {
+	nodes := startTestNetwork(t, 2)
+	addr := nodes[0].Conn.LocalAddr().(*net.UDPAddr)
+
+	args := map[string]any{"info_hash": string(GenerateNodeId()), "port": 6881, "token": "forged"}
+
+	_, err := nodes[1].query(context.Background(), addr, methodAnnouncePeer, args)
+
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errorProtocol {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+
+	_, err = nodes[1].query(context.Background(), addr, "vote", map[string]any{})
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errorMethodUnknown {
+		t.Errorf("Expected method unknown error, got %v", err)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	tokens := tokenManager{}
+
+	token := tokens.token(ip, now)
+
+	if !tokens.valid(token, ip, now) || tokens.valid(token, net.ParseIP("10.0.0.2"), now) {
+		t.Errorf("Expected token to be bound to its IP")
+		return
+	}
+
+	// Previous secret is still accepted
+	if !tokens.valid(token, ip, now.Add(tokenSecretLifetime)) {
+		t.Errorf("Expected token to survive one rotation")
+		return
+	}
+
+	if tokens.valid(token, ip, now.Add(2*tokenSecretLifetime)) {
+		t.Errorf("Expected token to expire after two rotations")
+	}
+}
+
+func TestStoredPeersExpire(t *testing.T) {
+	now := time.Now()
+	node := NewNode(GenerateNodeId(), nil)
+	node.Now = func() time.Time { return now }
+
+	infoHash := string(GenerateNodeId())
+	node.storePeer(infoHash, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+
+	if len(node.storedPeers(infoHash)) != 1 {
+		t.Errorf("Expected stored peer")
+		return
+	}
+
+	now = now.Add(peerTimeout + time.Second)
+
+	if len(node.storedPeers(infoHash)) != 0 {
+		t.Errorf("Expected stored peer to expire")
+	}
+}
+
+func TestStoredPeersBounded(t *testing.T) {
+	now := time.Now()
+	node := NewNode(GenerateNodeId(), nil)
+	node.Now = func() time.Time { return now }
+
+	infoHash := string(GenerateNodeId())
+
+	for port := 1; port <= maxStoredPeersPerInfoHash+1; port++ {
+		node.storePeer(infoHash, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: port})
+		now = now.Add(time.Second)
+	}
+
+	swarm := node.peers[infoHash]
+	if _, kept := swarm["10.0.0.1:1"]; kept || len(swarm) != maxStoredPeersPerInfoHash {
+		t.Errorf("Expected oldest peer to make room, %d stored", len(swarm))
+		return
+	}
+
+	for i := len(node.peers); i < maxStoredInfoHashes; i++ {
+		node.storePeer(string(GenerateNodeId()), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6881})
+	}
+
+	extra := string(GenerateNodeId())
+	node.storePeer(extra, &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 6881})
+
+	if len(node.storedPeers(extra)) != 0 || len(node.peers) != maxStoredInfoHashes {
+		t.Errorf("Expected info hashes beyond the limit to be ignored, %d stored", len(node.peers))
+		return
+	}
+
+	// Once the stored ones expire there is room again
+	now = now.Add(peerTimeout + time.Second)
+	node.storePeer(extra, &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 6881})
+
+	if len(node.storedPeers(extra)) != 1 {
+		t.Errorf("Expected info hash to be stored after the others expired")
+	}
+}
+
+func TestResponseFromOtherAddressIsDropped(t *testing.T) {
+	node := startTestNode(t)
+
+	queried, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer queried.Close()
+
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer spoofer.Close()
+
+	queriedId := GenerateNodeId()
+
+	go func() {
+		packet := make([]byte, maxPacketSize)
+
+		size, from, err := queried.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+
+		query, err := decodeMessage(packet[:size])
+		if err != nil {
+			return
+		}
+
+		spoofed, _ := (&message{TransactionId: query.TransactionId, Type: messageResponse, Response: map[string]any{"id": string(GenerateNodeId())}}).encode()
+		spoofer.WriteTo(spoofed, from)
+
+		time.Sleep(50 * time.Millisecond)
+
+		response, _ := (&message{TransactionId: query.TransactionId, Type: messageResponse, Response: map[string]any{"id": string(queriedId)}}).encode()
+		queried.WriteTo(response, from)
+	}()
+
+	response, err := node.query(context.Background(), queried.LocalAddr().(*net.UDPAddr), methodPing, map[string]any{})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if id, _ := senderId(response); string(id) != string(queriedId) {
+		t.Errorf("Expected response of the queried node, got one from %x", id)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	nodes := startTestNetwork(t, 4)
+	repo := memoryNodeRepository{}
+
+	nodes[3].NodeRepo = &repo
+
+	err := nodes[3].Save()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(repo.nodes) != nodes[3].RoutingTable().Len() {
+		t.Errorf("Expected %d saved nodes, got %d", nodes[3].RoutingTable().Len(), len(repo.nodes))
+		return
+	}
+
+	restored := NewNode(nodes[3].Id, nil)
+	restored.NodeRepo = &repo
+
+	err = restored.Load()
+	if err != nil || restored.RoutingTable().Len() != len(repo.nodes) {
+		t.Errorf("Expected %d restored nodes %v", len(repo.nodes), err)
+	}
+}
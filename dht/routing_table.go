@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of contacts per bucket, also the number of closest nodes lookups aim for
+const bucketSize = 8
+
+// Contacts not heard from within this time may be replaced by new ones
+const contactStaleAfter = 15 * time.Minute
+
+type Contact struct {
+	Id       []byte
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+}
+
+// Buckets are indexed by the length of the prefix shared with our own id
+type RoutingTable struct {
+	self []byte
+
+	mutex   sync.Mutex
+	buckets [nodeIdLength * 8][]Contact
+}
+
+func NewRoutingTable(self []byte) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+func distance(a []byte, b []byte) []byte {
+	result := make([]byte, nodeIdLength)
+	for i := range result {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+func commonPrefixLength(a []byte, b []byte) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+
+		length := i * 8
+		for x&0x80 == 0 {
+			length++
+			x <<= 1
+		}
+
+		return length
+	}
+
+	return len(a) * 8
+}
+
+func (rt *RoutingTable) bucketIndex(id []byte) int {
+	index := commonPrefixLength(rt.self, id)
+	if index == len(rt.buckets) {
+		return -1
+	}
+
+	return index
+}
+
+// Known contacts are refreshed, new ones are added if there is room or a stale one can go.
+func (rt *RoutingTable) Insert(contact Contact) bool {
+	if len(contact.Id) != nodeIdLength {
+		return false
+	}
+
+	index := rt.bucketIndex(contact.Id)
+	if index < 0 {
+		return false
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	bucket := rt.buckets[index]
+
+	for i := range bucket {
+		if bytes.Equal(bucket[i].Id, contact.Id) {
+			// Most recently seen are kept at the end
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), contact)
+			return true
+		}
+	}
+
+	if len(bucket) < bucketSize {
+		rt.buckets[index] = append(bucket, contact)
+		return true
+	}
+
+	if contact.LastSeen.Sub(bucket[0].LastSeen) > contactStaleAfter {
+		rt.buckets[index] = append(bucket[1:len(bucket):len(bucket)], contact)
+		return true
+	}
+
+	return false
+}
+
+func (rt *RoutingTable) Remove(id []byte) {
+	index := rt.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	bucket := rt.buckets[index]
+
+	for i := range bucket {
+		if bytes.Equal(bucket[i].Id, id) {
+			rt.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+func (rt *RoutingTable) Contacts() []Contact {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	var contacts []Contact
+	for i := range rt.buckets {
+		contacts = append(contacts, rt.buckets[i]...)
+	}
+
+	return contacts
+}
+
+func (rt *RoutingTable) Len() int {
+	return len(rt.Contacts())
+}
+
+func sortByDistance(contacts []Contact, target []byte) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return bytes.Compare(distance(contacts[i].Id, target), distance(contacts[j].Id, target)) < 0
+	})
+}
+
+func (rt *RoutingTable) Closest(target []byte, count int) []Contact {
+	contacts := rt.Contacts()
+	sortByDistance(contacts, target)
+
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+
+	return contacts
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func idWithPrefix(prefix byte, last byte) []byte {
+	id := make([]byte, nodeIdLength)
+	id[0] = prefix
+	id[nodeIdLength-1] = last
+
+	return id
+}
+
+func contactFor(id []byte, seen time.Time) Contact {
+	return Contact{Id: id, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}, LastSeen: seen}
+}
+
+func TestCommonPrefixLength(t *testing.T) {
+	testCases := []struct {
+		a, b     []byte
+		expected int
+	}{
+		{idWithPrefix(0, 0), idWithPrefix(0x80, 0), 0},
+		{idWithPrefix(0, 0), idWithPrefix(0x01, 0), 7},
+		{idWithPrefix(0, 0), idWithPrefix(0, 1), nodeIdLength*8 - 1},
+		{idWithPrefix(0, 0), idWithPrefix(0, 0), nodeIdLength * 8},
+	}
+
+	for _, testCase := range testCases {
+		got := commonPrefixLength(testCase.a, testCase.b)
+		if got != testCase.expected {
+			t.Errorf("Expected %d, got %d", testCase.expected, got)
+		}
+	}
+}
+
+func TestRoutingTableBucketFull(t *testing.T) {
+	now := time.Now()
+	table := NewRoutingTable(idWithPrefix(0, 0))
+
+	// All of them share no prefix with us, so they land in the same bucket
+	for i := 0; i < bucketSize; i++ {
+		if !table.Insert(contactFor(idWithPrefix(0x80, byte(i)), now)) {
+			t.Errorf("Expected contact %d to be inserted", i)
+			return
+		}
+	}
+
+	if table.Insert(contactFor(idWithPrefix(0x80, 0xff), now)) {
+		t.Errorf("Expected full bucket to refuse new contact")
+		return
+	}
+
+	// Refreshing a known contact moves it to the back
+	if !table.Insert(contactFor(idWithPrefix(0x80, 0), now)) {
+		t.Errorf("Expected known contact to be refreshed")
+		return
+	}
+
+	// Now contact 1 is the oldest and may be replaced once it goes stale
+	later := now.Add(contactStaleAfter + time.Second)
+	if !table.Insert(contactFor(idWithPrefix(0x80, 0xff), later)) {
+		t.Errorf("Expected stale contact to be replaced")
+		return
+	}
+
+	for _, contact := range table.Contacts() {
+		if bytes.Equal(contact.Id, idWithPrefix(0x80, 1)) {
+			t.Errorf("Expected stale contact to be gone")
+		}
+	}
+
+	if table.Len() != bucketSize {
+		t.Errorf("Expected %d contacts, got %d", bucketSize, table.Len())
+	}
+
+	// Other buckets still have room
+	if !table.Insert(contactFor(idWithPrefix(0x40, 0), now)) {
+		t.Errorf("Expected contact in other bucket to be inserted")
+	}
+}
+
+func TestRoutingTableRejectsSelf(t *testing.T) {
+	self := idWithPrefix(0x12, 0x34)
+	table := NewRoutingTable(self)
+
+	if table.Insert(contactFor(self, time.Now())) || table.Insert(contactFor([]byte("short"), time.Now())) {
+		t.Errorf("Expected own id and malformed id to be refused")
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	now := time.Now()
+	table := NewRoutingTable(idWithPrefix(0, 0))
+
+	for _, prefix := range []byte{0x80, 0x40, 0x20, 0x10, 0x08} {
+		table.Insert(contactFor(idWithPrefix(prefix, 0), now))
+	}
+
+	closest := table.Closest(idWithPrefix(0x21, 0), 2)
+	if len(closest) != 2 || closest[0].Id[0] != 0x20 || closest[1].Id[0] != 0x08 {
+		t.Errorf("Unexpected closest contacts %#v", closest)
+		return
+	}
+
+	table.Remove(idWithPrefix(0x20, 0))
+
+	closest = table.Closest(idWithPrefix(0x21, 0), 1)
+	if len(closest) != 1 || closest[0].Id[0] != 0x08 {
+		t.Errorf("Unexpected closest contact after removal %#v", closest)
+	}
+}
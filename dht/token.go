@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const tokenSecretLifetime = 5 * time.Minute
+
+// Tokens handed out on get_peers are bound to the querying IP.
+// Secrets rotate, tokens made with the previous secret are still accepted.
+type tokenManager struct {
+	mutex     sync.Mutex
+	secret    []byte
+	previous  []byte
+	rotatedAt time.Time
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return secret
+}
+
+func (tm *tokenManager) rotate(now time.Time) {
+	if tm.secret == nil {
+		tm.secret = newSecret()
+		tm.rotatedAt = now
+		return
+	}
+
+	if now.Sub(tm.rotatedAt) >= tokenSecretLifetime {
+		tm.previous = tm.secret
+		tm.secret = newSecret()
+		tm.rotatedAt = now
+	}
+}
+
+func makeToken(secret []byte, ip net.IP) []byte {
+	hash := sha1.New()
+	hash.Write(secret)
+	hash.Write(ip)
+
+	return hash.Sum(nil)
+}
+
+func (tm *tokenManager) token(ip net.IP, now time.Time) []byte {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.rotate(now)
+
+	return makeToken(tm.secret, ip)
+}
+
+func (tm *tokenManager) valid(token []byte, ip net.IP, now time.Time) bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.rotate(now)
+
+	if bytes.Equal(token, makeToken(tm.secret, ip)) {
+		return true
+	}
+
+	return tm.previous != nil && bytes.Equal(token, makeToken(tm.previous, ip))
+}
@@ -11,13 +11,13 @@ type ClientRepositorySQLite struct {
 }
 
 func (r *ClientRepositorySQLite) Create(client *db.Client) error {
-	stmt, err := r.db.Prepare("INSERT INTO clients (protocol_id, created) VALUES (?, ?)")
+	stmt, err := r.db.Prepare("INSERT INTO clients (protocol_id, created, dht_node_id) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(client.ProtocolId, client.Created)
+	result, err := stmt.Exec(client.ProtocolId, client.Created, client.DHTNodeId)
 	if err != nil {
 		return err
 	}
@@ -33,11 +33,22 @@ func (r *ClientRepositorySQLite) Create(client *db.Client) error {
 	return nil
 }
 
+func (r *ClientRepositorySQLite) Update(client *db.Client) error {
+	stmt, err := r.db.Prepare("UPDATE clients SET protocol_id=?, created=?, dht_node_id=? WHERE client_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(client.ProtocolId, client.Created, client.DHTNodeId, client.ClientId)
+	return err
+}
+
 func (r *ClientRepositorySQLite) GetLast() (*db.Client, error) {
-	row := r.db.QueryRow("SELECT client_id, protocol_id, created FROM clients ORDER BY client_id DESC LIMIT 1")
+	row := r.db.QueryRow("SELECT client_id, protocol_id, created, dht_node_id FROM clients ORDER BY client_id DESC LIMIT 1")
 
 	var client db.Client
-	err := row.Scan(&client.ClientId, &client.ProtocolId, &client.Created)
+	err := row.Scan(&client.ClientId, &client.ProtocolId, &client.Created, &client.DHTNodeId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No rows found
@@ -46,5 +46,77 @@ func NewSQLiteDB(dbPath string, schemaPath string) (*SQLiteDB, error) {
 		return nil, err
 	}
 
+	err = addMissingColumns(database)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SQLiteDB{dbPath, schemaPath, database}, nil
 }
+
+// Columns added to tables after they were first released, the schema script
+// only creates tables that don't exist yet, so older databases get them here.
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"torrent", "seeding", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"torrent", "uploaded", "INTEGER NOT NULL DEFAULT 0"},
+	{"torrent", "downloaded", "INTEGER NOT NULL DEFAULT 0"},
+	{"torrent", "seeders", "INTEGER NOT NULL DEFAULT 0"},
+	{"torrent", "leechers", "INTEGER NOT NULL DEFAULT 0"},
+	{"torrent", "completed", "INTEGER NOT NULL DEFAULT 0"},
+	{"torrent", "scrape_time", "DATETIME"},
+	{"tracker", "protocol_tracker_id", "TEXT"},
+	{"tracker", "last_warning", "TEXT"},
+	{"clients", "dht_node_id", "BLOB"},
+	{"peer", "source", "TEXT NOT NULL DEFAULT 'tracker'"},
+}
+
+// Column names of table, empty if the table does not exist
+func tableColumns(database *sql.DB, table string) (map[string]bool, error) {
+	rows, err := database.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			return nil, err
+		}
+
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
+func addMissingColumns(database *sql.DB) error {
+	for _, added := range addedColumns {
+		columns, err := tableColumns(database, added.table)
+		if err != nil {
+			return err
+		}
+
+		// Table is not part of the schema, or the column is already there
+		if len(columns) == 0 || columns[added.column] {
+			continue
+		}
+
+		_, err = database.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s`, added.table, added.column, added.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package sqlite
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/db"
+)
+
+// Schema of the first release, before any column was added
+const firstSchema = `
+CREATE TABLE "torrent" (
+    "torrent_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "name" TEXT NOT NULL,
+    "announce" TEXT NOT NULL,
+    "size" INTEGER NOT NULL,
+    "hash_info" BLOB NOT NULL,
+    "created_time" DATETIME NOT NULL,
+    "paused" BOOLEAN NOT NULL,
+    "location" TEXT,
+    "progress" INTEGER,
+    "raw_meta_info" BLOB
+);
+
+CREATE TABLE "peer" (
+    "peer_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "protocol_peer_id" BLOB NOT NULL,
+    "ip" TEXT NOT NULL,
+    "port" INTEGER NOT NULL,
+    "torrent_id" INTEGER NOT NULL,
+    "reachable" BOOLEAN NOT NULL,
+    FOREIGN KEY ("torrent_id") REFERENCES "torrent" ("torrent_id") ON DELETE CASCADE
+);
+
+CREATE TABLE "clients" (
+    "client_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "protocol_id" BLOB,
+    "created" DATETIME
+);
+`
+
+// Tracker table as it was introduced with the announce list
+const trackerSchema = `
+CREATE TABLE "tracker" (
+    "tracker_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "torrent_id" INTEGER NOT NULL,
+    "url" TEXT NOT NULL,
+    "tier" INTEGER NOT NULL,
+    "position" INTEGER NOT NULL,
+    "last_announce" DATETIME,
+    "last_success" DATETIME,
+    "last_error" TEXT,
+    "peer_count" INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY ("torrent_id") REFERENCES "torrent" ("torrent_id") ON DELETE CASCADE
+);
+`
+
+func TestExistingDatabaseGetsNewColumns(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	firstSchemaPath := filepath.Join(dir, "first.sql")
+
+	err := os.WriteFile(firstSchemaPath, []byte(firstSchema+trackerSchema), 0644)
+	if err != nil {
+		t.Fatalf("Could not write schema %v", err)
+	}
+
+	old, err := NewSQLiteDB(dbPath, firstSchemaPath)
+	if err != nil {
+		t.Fatalf("Could not create old database %v", err)
+	}
+
+	_, err = old.db.Exec(`INSERT INTO torrent (name, announce, size, hash_info, created_time, paused, location, progress, raw_meta_info) VALUES ('old', 'http://tracker', 1, x'00', CURRENT_TIMESTAMP, 0, '', 0, x'00')`)
+	if err != nil {
+		t.Fatalf("Could not insert torrent %v", err)
+	}
+	old.db.Close()
+
+	expected := []struct {
+		table  string
+		column string
+	}{
+		{"torrent", "seeding"},
+		{"torrent", "uploaded"},
+		{"torrent", "downloaded"},
+		{"torrent", "seeders"},
+		{"torrent", "leechers"},
+		{"torrent", "completed"},
+		{"torrent", "scrape_time"},
+		{"tracker", "protocol_tracker_id"},
+		{"tracker", "last_warning"},
+		{"clients", "dht_node_id"},
+		{"peer", "source"},
+	}
+
+	// Second time around nothing is left to add
+	for i := 0; i < 2; i++ {
+		sqliteDb, err := NewSQLiteDB(dbPath, "script.sql")
+		if err != nil {
+			t.Errorf("Did not expect error on migration %v", err)
+			return
+		}
+
+		for _, added := range expected {
+			columns, err := tableColumns(sqliteDb.db, added.table)
+			if err != nil || !columns[added.column] {
+				t.Errorf("Expected column %s.%s to be added %v", added.table, added.column, err)
+				return
+			}
+		}
+
+		torrentRepo := TorrentRepositorySQLite{SQLiteDB: *sqliteDb}
+
+		torrents, err := torrentRepo.GetAll()
+		if err != nil || len(torrents) != 1 || torrents[0].Uploaded != 0 || torrents[0].ScrapeTime != nil {
+			t.Errorf("Expected old torrent to be readable %#v %v", torrents, err)
+			return
+		}
+
+		peerRepo := PeerRepositorySQLite{SQLiteDB: *sqliteDb}
+
+		peer := db.Peer{ProtocolPeerId: []byte("peer"), IP: "10.0.0.1", Port: 6881, TorrentId: torrents[0].TorrentId, Reachable: true, Source: db.PeerSourceDHT}
+		err = peerRepo.Create(&peer)
+		if err != nil {
+			t.Errorf("Expected peer source to be stored %v", err)
+			return
+		}
+
+		sqliteDb.db.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package sqlite
+
+import "example.com/db"
+
+type DHTNodeRepositorySQLite struct {
+	SQLiteDB
+}
+
+func (r *DHTNodeRepositorySQLite) Create(node *db.DHTNode) error {
+	stmt, err := r.db.Prepare(`
+		INSERT INTO dht_node (protocol_node_id, ip, port, last_seen)
+		VALUES (?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(node.ProtocolNodeId, node.IP, node.Port, node.LastSeen)
+	if err != nil {
+		return err
+	}
+
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	node.DHTNodeId = int(lastInsertID)
+
+	return nil
+}
+
+func (r *DHTNodeRepositorySQLite) DeleteAll() error {
+	_, err := r.db.Exec("DELETE FROM dht_node")
+	return err
+}
+
+func (r *DHTNodeRepositorySQLite) GetAll() ([]db.DHTNode, error) {
+	rows, err := r.db.Query("SELECT dht_node_id, protocol_node_id, ip, port, last_seen FROM dht_node")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []db.DHTNode
+	for rows.Next() {
+		var node db.DHTNode
+		err := rows.Scan(&node.DHTNodeId, &node.ProtocolNodeId, &node.IP, &node.Port, &node.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
@@ -12,15 +12,15 @@ type PeerRepositorySQLite struct {
 
 func (r *PeerRepositorySQLite) Create(peer *db.Peer) error {
 	stmt, err := r.db.Prepare(`
-		INSERT INTO peer (protocol_peer_id, ip, port, torrent_id, reachable)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO peer (protocol_peer_id, ip, port, torrent_id, reachable, source)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(peer.ProtocolPeerId, peer.IP, peer.Port, peer.TorrentId, peer.Reachable)
+	result, err := stmt.Exec(peer.ProtocolPeerId, peer.IP, peer.Port, peer.TorrentId, peer.Reachable, peer.Source)
 	if err != nil {
 		return err
 	}
@@ -37,7 +37,7 @@ func (r *PeerRepositorySQLite) Create(peer *db.Peer) error {
 func (r *PeerRepositorySQLite) Update(peer *db.Peer) error {
 	stmt, err := r.db.Prepare(`
 		UPDATE peer
-		SET protocol_peer_id=?, ip=?, port=?, torrent_id=?, reachable=?
+		SET protocol_peer_id=?, ip=?, port=?, torrent_id=?, reachable=?, source=?
 		WHERE peer_id=?
 	`)
 	if err != nil {
@@ -45,7 +45,7 @@ func (r *PeerRepositorySQLite) Update(peer *db.Peer) error {
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(peer.ProtocolPeerId, peer.IP, peer.Port, peer.TorrentId, peer.Reachable, peer.PeerId)
+	_, err = stmt.Exec(peer.ProtocolPeerId, peer.IP, peer.Port, peer.TorrentId, peer.Reachable, peer.Source, peer.PeerId)
 	return err
 }
 
@@ -59,7 +59,7 @@ func (r *PeerRepositorySQLite) GetByTorrentId(torrentId int) ([]db.Peer, error)
 	var peers []db.Peer
 	for rows.Next() {
 		var peer db.Peer
-		err := rows.Scan(&peer.PeerId, &peer.ProtocolPeerId, &peer.IP, &peer.Port, &peer.TorrentId, &peer.Reachable)
+		err := rows.Scan(&peer.PeerId, &peer.ProtocolPeerId, &peer.IP, &peer.Port, &peer.TorrentId, &peer.Reachable, &peer.Source)
 		if err != nil {
 			return nil, err
 		}
@@ -73,12 +73,12 @@ func (r *PeerRepositorySQLite) GetByTorrentIdAndProtocolPeerId(torrentId int, pr
 	var peer db.Peer
 
 	row := r.db.QueryRow(`
-		SELECT peer_id, protocol_peer_id, ip, port, torrent_id, reachable
+		SELECT peer_id, protocol_peer_id, ip, port, torrent_id, reachable, source
 		FROM peer
 		WHERE torrent_id = ? AND protocol_peer_id = ?;
 	`, torrentId, protocolPeerId)
 
-	err := row.Scan(&peer.PeerId, &peer.ProtocolPeerId, &peer.IP, &peer.Port, &peer.TorrentId, &peer.Reachable)
+	err := row.Scan(&peer.PeerId, &peer.ProtocolPeerId, &peer.IP, &peer.Port, &peer.TorrentId, &peer.Reachable, &peer.Source)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
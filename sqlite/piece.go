@@ -8,7 +8,7 @@ type PieceRepositorySQLite struct {
 
 func (r *PieceRepositorySQLite) Create(piece *db.Piece) error {
 	stmt, err := r.db.Prepare(`
-		INSERT INTO piece (torrent_id, peer_id, is_downloaded, start, end, index, length, confirmed)
+		INSERT INTO piece (torrent_id, peer_id, is_downloaded, start, end, "index", length, confirmed)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
@@ -33,7 +33,7 @@ func (r *PieceRepositorySQLite) Create(piece *db.Piece) error {
 func (r *PieceRepositorySQLite) Update(piece *db.Piece) error {
 	stmt, err := r.db.Prepare(`
 		UPDATE piece
-		SET torrent_id=?, peer_id=?, is_downloaded=?, start=?, end=?, index=?, length=?, confirmed=?
+		SET torrent_id=?, peer_id=?, is_downloaded=?, start=?, end=?, "index"=?, length=?, confirmed=?
 		WHERE piece_id=?
 	`)
 	if err != nil {
@@ -10,7 +10,14 @@ CREATE TABLE IF NOT EXISTS "torrent" (
     "paused" BOOLEAN NOT NULL,
     "location" TEXT,
     "progress" INTEGER,
-    "raw_meta_info" BLOB
+    "raw_meta_info" BLOB,
+    "seeding" BOOLEAN NOT NULL DEFAULT 0,
+    "uploaded" INTEGER NOT NULL DEFAULT 0,
+    "downloaded" INTEGER NOT NULL DEFAULT 0,
+    "seeders" INTEGER NOT NULL DEFAULT 0,
+    "leechers" INTEGER NOT NULL DEFAULT 0,
+    "completed" INTEGER NOT NULL DEFAULT 0,
+    "scrape_time" DATETIME
 );
 
 CREATE TABLE IF NOT EXISTS "tracker_announce" (
@@ -25,6 +32,21 @@ CREATE TABLE IF NOT EXISTS "tracker_announce" (
     FOREIGN KEY ("torrent_id") REFERENCES "torrent" ("torrent_id") ON DELETE CASCADE
 );
 
+CREATE TABLE IF NOT EXISTS "tracker" (
+    "tracker_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "torrent_id" INTEGER NOT NULL,
+    "url" TEXT NOT NULL,
+    "tier" INTEGER NOT NULL,
+    "position" INTEGER NOT NULL,
+    "last_announce" DATETIME,
+    "last_success" DATETIME,
+    "last_error" TEXT,
+    "peer_count" INTEGER NOT NULL DEFAULT 0,
+    "protocol_tracker_id" TEXT,
+    "last_warning" TEXT,
+    FOREIGN KEY ("torrent_id") REFERENCES "torrent" ("torrent_id") ON DELETE CASCADE
+);
+
 CREATE TABLE IF NOT EXISTS "peer" (
     "peer_id" INTEGER PRIMARY KEY AUTOINCREMENT,
     "protocol_peer_id" BLOB NOT NULL,
@@ -32,6 +54,7 @@ CREATE TABLE IF NOT EXISTS "peer" (
     "port" INTEGER NOT NULL,
     "torrent_id" INTEGER NOT NULL,
     "reachable" BOOLEAN NOT NULL,
+    "source" TEXT NOT NULL DEFAULT 'tracker',
     FOREIGN KEY ("torrent_id") REFERENCES "torrent" ("torrent_id") ON DELETE CASCADE
 );
 
@@ -52,5 +75,26 @@ CREATE TABLE IF NOT EXISTS "piece" (
 CREATE TABLE IF NOT EXISTS "clients" (
     "client_id" INTEGER PRIMARY KEY AUTOINCREMENT,
     "protocol_id" BLOB,
-    "created" DATETIME
+    "created" DATETIME,
+    "dht_node_id" BLOB
+);
+
+CREATE TABLE IF NOT EXISTS "swarm_peer" (
+    "swarm_peer_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "hash_info" BLOB NOT NULL,
+    "protocol_peer_id" BLOB NOT NULL,
+    "ip" TEXT NOT NULL,
+    "port" INTEGER NOT NULL,
+    "uploaded" INTEGER NOT NULL,
+    "downloaded" INTEGER NOT NULL,
+    "left" INTEGER NOT NULL,
+    "last_seen" DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "dht_node" (
+    "dht_node_id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "protocol_node_id" BLOB NOT NULL,
+    "ip" TEXT NOT NULL,
+    "port" INTEGER NOT NULL,
+    "last_seen" DATETIME NOT NULL
 );
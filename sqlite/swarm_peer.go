@@ -0,0 +1,74 @@
+package sqlite
+
+import "example.com/db"
+
+type SwarmPeerRepositorySQLite struct {
+	SQLiteDB
+}
+
+func (r *SwarmPeerRepositorySQLite) Create(peer *db.SwarmPeer) error {
+	stmt, err := r.db.Prepare(`
+		INSERT INTO swarm_peer (hash_info, protocol_peer_id, ip, port, uploaded, downloaded, "left", last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(peer.HashInfo, peer.ProtocolPeerId, peer.IP, peer.Port, peer.Uploaded, peer.Downloaded, peer.Left, peer.LastSeen)
+	if err != nil {
+		return err
+	}
+
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	peer.SwarmPeerId = int(lastInsertID)
+
+	return nil
+}
+
+func (r *SwarmPeerRepositorySQLite) Update(peer *db.SwarmPeer) error {
+	stmt, err := r.db.Prepare(`
+		UPDATE swarm_peer
+		SET hash_info=?, protocol_peer_id=?, ip=?, port=?, uploaded=?, downloaded=?, "left"=?, last_seen=?
+		WHERE swarm_peer_id=?
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(peer.HashInfo, peer.ProtocolPeerId, peer.IP, peer.Port, peer.Uploaded, peer.Downloaded, peer.Left, peer.LastSeen, peer.SwarmPeerId)
+	return err
+}
+
+func (r *SwarmPeerRepositorySQLite) Delete(peer *db.SwarmPeer) error {
+	_, err := r.db.Exec("DELETE FROM swarm_peer WHERE swarm_peer_id=?", peer.SwarmPeerId)
+	return err
+}
+
+func (r *SwarmPeerRepositorySQLite) GetAll() ([]db.SwarmPeer, error) {
+	rows, err := r.db.Query(`
+		SELECT swarm_peer_id, hash_info, protocol_peer_id, ip, port, uploaded, downloaded, "left", last_seen
+		FROM swarm_peer
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []db.SwarmPeer
+	for rows.Next() {
+		var peer db.SwarmPeer
+		err := rows.Scan(&peer.SwarmPeerId, &peer.HashInfo, &peer.ProtocolPeerId, &peer.IP, &peer.Port, &peer.Uploaded, &peer.Downloaded, &peer.Left, &peer.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,71 @@
+package sqlite
+
+import "example.com/db"
+
+type TrackerRepositorySQLite struct {
+	SQLiteDB
+}
+
+func (r *TrackerRepositorySQLite) Create(tracker *db.Tracker) error {
+	stmt, err := r.db.Prepare(`
+		INSERT INTO tracker (torrent_id, url, tier, position, last_announce, last_success, last_error, peer_count, protocol_tracker_id, last_warning)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(tracker.TorrentId, tracker.URL, tracker.Tier, tracker.Position, tracker.LastAnnounce, tracker.LastSuccess, tracker.LastError, tracker.PeerCount, tracker.ProtocolTrackerId, tracker.LastWarning)
+	if err != nil {
+		return err
+	}
+
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	tracker.TrackerId = int(lastInsertID)
+
+	return nil
+}
+
+func (r *TrackerRepositorySQLite) Update(tracker *db.Tracker) error {
+	stmt, err := r.db.Prepare(`
+		UPDATE tracker
+		SET torrent_id=?, url=?, tier=?, position=?, last_announce=?, last_success=?, last_error=?, peer_count=?, protocol_tracker_id=?, last_warning=?
+		WHERE tracker_id=?
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(tracker.TorrentId, tracker.URL, tracker.Tier, tracker.Position, tracker.LastAnnounce, tracker.LastSuccess, tracker.LastError, tracker.PeerCount, tracker.ProtocolTrackerId, tracker.LastWarning, tracker.TrackerId)
+	return err
+}
+
+func (r *TrackerRepositorySQLite) GetByTorrentId(torrentId int) ([]db.Tracker, error) {
+	rows, err := r.db.Query(`
+		SELECT tracker_id, torrent_id, url, tier, position, last_announce, last_success, last_error, peer_count, protocol_tracker_id, last_warning
+		FROM tracker
+		WHERE torrent_id=?
+		ORDER BY tier, position
+	`, torrentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trackers []db.Tracker
+	for rows.Next() {
+		var tracker db.Tracker
+		err := rows.Scan(&tracker.TrackerId, &tracker.TorrentId, &tracker.URL, &tracker.Tier, &tracker.Position, &tracker.LastAnnounce, &tracker.LastSuccess, &tracker.LastError, &tracker.PeerCount, &tracker.ProtocolTrackerId, &tracker.LastWarning)
+		if err != nil {
+			return nil, err
+		}
+		trackers = append(trackers, tracker)
+	}
+
+	return trackers, nil
+}
@@ -46,7 +46,7 @@ func (r *TrackerAnnounceRepositorySQLite) Update(announce *db.TrackerAnnounce) e
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(announce.TorrentId, announce.AnnounceTime, announce.Announciation, announce.ScheduledTime, announce.Error, announce.Done, announce.TrackerAnnounceId, announce.RawResponse)
+	_, err = stmt.Exec(announce.TorrentId, announce.AnnounceTime, announce.Announciation, announce.ScheduledTime, announce.Error, announce.Done, announce.RawResponse, announce.TrackerAnnounceId)
 	return err
 }
 
@@ -0,0 +1,337 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"example.com/bencode"
+)
+
+// Message id of the extension protocol, see BEP 10.
+const Extended byte = 20
+
+// Extended message id reserved for the extension handshake
+const ExtendedHandshakeId byte = 0
+
+// Sent as "v" in the extension handshake
+const ClientVersion = "TinyTorrent 0.1"
+
+// Number of outstanding requests we are willing to queue, sent as "reqq"
+const DefaultRequestQueue = 250
+
+var ErrExtensionNotSupported = errors.New("extension not supported by peer")
+var ErrInvalidExtensionHandshake = errors.New("invalid extension handshake")
+
+type ExtendedPayload struct {
+	ExtendedId byte
+	Payload    []byte
+}
+
+type ExtensionHandshake struct {
+	// Extension names mapped to the ids the sender wants to receive them on
+	M            map[string]int
+	Version      string
+	RequestQueue int
+	// Our address as seen by the sender
+	YourIP       net.IP
+	MetadataSize int
+	// Listen port of the sender
+	Port int
+}
+
+func EncodeExtensionHandshake(handshake *ExtensionHandshake) ([]byte, error) {
+	m := map[string]any{}
+	for name, id := range handshake.M {
+		m[name] = id
+	}
+
+	encoded := map[string]any{"m": m}
+
+	if handshake.Version != "" {
+		encoded["v"] = handshake.Version
+	}
+
+	if handshake.RequestQueue > 0 {
+		encoded["reqq"] = handshake.RequestQueue
+	}
+
+	if ip := handshake.YourIP.To4(); ip != nil {
+		encoded["yourip"] = string(ip)
+	} else if ip := handshake.YourIP.To16(); ip != nil {
+		encoded["yourip"] = string(ip)
+	}
+
+	if handshake.MetadataSize > 0 {
+		encoded["metadata_size"] = handshake.MetadataSize
+	}
+
+	if handshake.Port > 0 {
+		encoded["p"] = handshake.Port
+	}
+
+	return bencode.Marshal(encoded)
+}
+
+func ParseExtensionHandshake(data []byte) (*ExtensionHandshake, error) {
+	var decoded map[string]any
+
+	err := bencode.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := decoded["m"].(map[string]any)
+	if !ok {
+		return nil, ErrInvalidExtensionHandshake
+	}
+
+	handshake := ExtensionHandshake{M: make(map[string]int)}
+
+	for name, value := range m {
+		id, ok := value.(int)
+		if !ok || id < 0 || id > 255 {
+			return nil, ErrInvalidExtensionHandshake
+		}
+
+		handshake.M[name] = id
+	}
+
+	handshake.Version, _ = decoded["v"].(string)
+	handshake.RequestQueue, _ = decoded["reqq"].(int)
+	handshake.MetadataSize, _ = decoded["metadata_size"].(int)
+	handshake.Port, _ = decoded["p"].(int)
+
+	if yourIP, ok := decoded["yourip"].(string); ok && (len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		handshake.YourIP = net.IP(yourIP)
+	}
+
+	return &handshake, nil
+}
+
+type ExtensionHandler interface {
+	HandleExtended(seeder *Seeder, payload []byte) error
+}
+
+type ExtensionHandlerFunc func(seeder *Seeder, payload []byte) error
+
+func (f ExtensionHandlerFunc) HandleExtended(seeder *Seeder, payload []byte) error {
+	return f(seeder, payload)
+}
+
+// Extensions we support, each one gets the id remote peers send it to us on.
+type ExtensionRegistry struct {
+	mutex    sync.Mutex
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{handlers: make(map[string]ExtensionHandler)}
+}
+
+// Registering a name again replaces its handler but keeps its id.
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.handlers[name]; !ok {
+		r.names = append(r.names, name)
+	}
+
+	r.handlers[name] = handler
+
+	return r.localId(name)
+}
+
+func (r *ExtensionRegistry) localId(name string) byte {
+	for i := range r.names {
+		if r.names[i] == name {
+			return byte(i + 1)
+		}
+	}
+
+	return 0
+}
+
+func (r *ExtensionRegistry) LocalId(name string) byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.localId(name)
+}
+
+func (r *ExtensionRegistry) handler(id byte) (string, ExtensionHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id == 0 || int(id) > len(r.names) {
+		return "", nil
+	}
+
+	name := r.names[id-1]
+
+	return name, r.handlers[name]
+}
+
+func (r *ExtensionRegistry) handshakeM() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	m := make(map[string]int)
+	for i := range r.names {
+		m[r.names[i]] = i + 1
+	}
+
+	return m
+}
+
+func (seeder *Seeder) remoteSupportsExtensions() bool {
+	return seeder.RemoteHandshake != nil && seeder.RemoteHandshake.SupportsExtensionProtocol()
+}
+
+// Tells the peer which extensions we support and how large our info dictionary is.
+func (seeder *Seeder) SendExtensionHandshake() error {
+	if !seeder.remoteSupportsExtensions() {
+		return ErrExtensionNotSupported
+	}
+
+	handshake := ExtensionHandshake{
+		M:            map[string]int{},
+		Version:      ClientVersion,
+		RequestQueue: DefaultRequestQueue,
+		YourIP:       seeder.SeederInfo.IP,
+	}
+
+	// Unknown while fetching metadata for a magnet link
+	if seeder.MetaInfo != nil {
+		handshake.MetadataSize = len(seeder.MetaInfo.InfoBytes())
+	}
+
+	if seeder.Extensions != nil {
+		handshake.M = seeder.Extensions.handshakeM()
+	}
+
+	payload, err := EncodeExtensionHandshake(&handshake)
+	if err != nil {
+		return err
+	}
+
+	err = Send(seeder.SeederWriter, &PeerMessage{Type: Extended, Payload: ExtendedPayload{ExtendedId: ExtendedHandshakeId, Payload: payload}})
+	if err != nil {
+		return err
+	}
+
+	seeder.extensionHandshakeSent = true
+
+	return nil
+}
+
+// Sent right after the handshake, peers without the extension protocol are skipped.
+func (seeder *Seeder) NegotiateExtensions() error {
+	if !seeder.remoteSupportsExtensions() {
+		return nil
+	}
+
+	return seeder.SendExtensionHandshake()
+}
+
+// Everything sent right after the handshake, the Fast Extension wants our availability first.
+// SeederInfo.IP has to be known by then, the allowed fast set is generated from it.
+func (seeder *Seeder) Introduce(bitfield []byte) error {
+	pieceCount := 0
+	if seeder.MetaInfo != nil {
+		pieceCount = seeder.MetaInfo.GetPieceCount()
+	}
+
+	err := seeder.SendAvailability(bitfield, pieceCount)
+	if err != nil {
+		return err
+	}
+
+	err = seeder.SendAllowedFastSet(AllowedFastSetSize)
+	if err != nil {
+		return err
+	}
+
+	return seeder.NegotiateExtensions()
+}
+
+func (seeder *Seeder) SupportsExtension(name string) bool {
+	return seeder.remoteExtensionId(name) != 0
+}
+
+func (seeder *Seeder) remoteExtensionId(name string) int {
+	seeder.extensionsMutex.Lock()
+	defer seeder.extensionsMutex.Unlock()
+
+	return seeder.RemoteExtensions[name]
+}
+
+func (seeder *Seeder) remoteExtensionHandshake() *ExtensionHandshake {
+	seeder.extensionsMutex.Lock()
+	defer seeder.extensionsMutex.Unlock()
+
+	return seeder.RemoteExtensionHandshake
+}
+
+// Sends payload on the id the peer negotiated for the extension.
+func (seeder *Seeder) SendExtended(name string, payload []byte) error {
+	id := seeder.remoteExtensionId(name)
+	if id == 0 {
+		return ErrExtensionNotSupported
+	}
+
+	return Send(seeder.SeederWriter, &PeerMessage{Type: Extended, Payload: ExtendedPayload{ExtendedId: byte(id), Payload: payload}})
+}
+
+// Stores what the peer negotiated on handshakes, anything else goes to the registered handler.
+// Only an invalid handshake is an error, failures of handlers are logged.
+func (seeder *Seeder) HandleExtended(payload ExtendedPayload) error {
+	if payload.ExtendedId == ExtendedHandshakeId {
+		handshake, err := ParseExtensionHandshake(payload.Payload)
+		if err != nil {
+			return err
+		}
+
+		seeder.extensionsMutex.Lock()
+		defer seeder.extensionsMutex.Unlock()
+
+		if seeder.RemoteExtensions == nil {
+			seeder.RemoteExtensions = make(map[string]int)
+		}
+
+		// Later handshakes only update what they mention, id 0 disables an extension
+		for name, id := range handshake.M {
+			if id == 0 {
+				delete(seeder.RemoteExtensions, name)
+			} else {
+				seeder.RemoteExtensions[name] = id
+			}
+		}
+
+		seeder.RemoteExtensionHandshake = handshake
+
+		return nil
+	}
+
+	if seeder.Extensions == nil {
+		return nil
+	}
+
+	name, handler := seeder.Extensions.handler(payload.ExtendedId)
+	if handler == nil {
+		slog.Debug(fmt.Sprintf("Skipping unknown extended message id %d", payload.ExtendedId))
+		return nil
+	}
+
+	// Misbehaving extension messages are dropped, they don't end the connection
+	err := handler.HandleExtended(seeder, payload.Payload)
+	if err != nil {
+		slog.Debug("Dropping message of extension " + name + ": " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	handshake := ExtensionHandshake{
+		M:            map[string]int{"ut_pex": 1, "ut_metadata": 2},
+		Version:      ClientVersion,
+		RequestQueue: DefaultRequestQueue,
+		YourIP:       net.ParseIP("10.0.0.1"),
+		MetadataSize: 31235,
+		Port:         6881,
+	}
+
+	encoded, err := EncodeExtensionHandshake(&handshake)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	decoded, err := ParseExtensionHandshake(encoded)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if decoded.M["ut_pex"] != 1 || decoded.M["ut_metadata"] != 2 || decoded.Version != ClientVersion || decoded.RequestQueue != DefaultRequestQueue {
+		t.Errorf("Unexpected handshake %#v", decoded)
+		return
+	}
+
+	if !decoded.YourIP.Equal(handshake.YourIP) || decoded.MetadataSize != 31235 || decoded.Port != 6881 {
+		t.Errorf("Unexpected handshake %#v", decoded)
+	}
+
+	_, err = ParseExtensionHandshake([]byte("d1:v3:fooe"))
+	if err != ErrInvalidExtensionHandshake {
+		t.Errorf("Expected ErrInvalidExtensionHandshake, got %v", err)
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	registry := NewExtensionRegistry()
+
+	pexId := registry.Register("ut_pex", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error { return nil }))
+	metadataId := registry.Register("ut_metadata", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error { return nil }))
+
+	if pexId != 1 || metadataId != 2 {
+		t.Errorf("Unexpected ids %d %d", pexId, metadataId)
+		return
+	}
+
+	// Replacing keeps the id
+	if registry.Register("ut_pex", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error { return nil })) != 1 {
+		t.Errorf("Expected id to be kept")
+	}
+
+	if registry.LocalId("lt_donthave") != 0 {
+		t.Errorf("Expected unknown extension to have no id")
+	}
+}
+
+// Both sides of a connection which completed the BitTorrent handshake
+func extensionSeeders(local *ExtensionRegistry, remote *ExtensionRegistry) (*Seeder, *Seeder) {
+	localConn, remoteConn := net.Pipe()
+	extensionHandshake := &Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}}
+
+	localSeeder := Seeder{SeederReader: localConn, SeederWriter: localConn, Extensions: local, RemoteHandshake: extensionHandshake, SeederInfo: PeerInfo{IP: net.ParseIP("10.0.0.2")}}
+	remoteSeeder := Seeder{SeederReader: remoteConn, SeederWriter: remoteConn, Extensions: remote, RemoteHandshake: extensionHandshake}
+
+	return &localSeeder, &remoteSeeder
+}
+
+// Reads the next message on seeder and hands it to HandleExtended
+func receiveExtended(seeder *Seeder, t *testing.T) error {
+	msg, err := Receive(seeder.SeederReader)
+	if err != nil {
+		return err
+	}
+
+	if msg.Type != Extended {
+		t.Errorf("Expected extended message, got %d", msg.Type)
+	}
+
+	return seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+}
+
+func TestExtendedMessageRouting(t *testing.T) {
+	var received []byte
+
+	remoteRegistry := NewExtensionRegistry()
+	remoteRegistry.Register("lt_donthave", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error { return nil }))
+	remoteRegistry.Register("ut_pex", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error {
+		received = payload
+		return nil
+	}))
+
+	local, remote := extensionSeeders(NewExtensionRegistry(), remoteRegistry)
+	defer local.Close()
+	defer remote.Close()
+
+	// Remote tells us which ids it wants
+	go remote.SendExtensionHandshake()
+
+	err := receiveExtended(local, t)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if local.RemoteExtensions["ut_pex"] != 2 || local.RemoteExtensionHandshake.Version != ClientVersion || !local.SupportsExtension("lt_donthave") {
+		t.Errorf("Unexpected negotiated extensions %#v", local.RemoteExtensions)
+		return
+	}
+
+	// Message goes out on the remote id and lands in the remote handler
+	go local.SendExtended("ut_pex", []byte("payload"))
+
+	err = receiveExtended(remote, t)
+	if err != nil || !bytes.Equal(received, []byte("payload")) {
+		t.Errorf("Expected payload to be routed %v %q", err, received)
+		return
+	}
+
+	err = local.SendExtended("ut_metadata", []byte("payload"))
+	if err != ErrExtensionNotSupported {
+		t.Errorf("Expected ErrExtensionNotSupported, got %v", err)
+	}
+}
+
+func TestExtensionHandshakeUpdate(t *testing.T) {
+	seeder := Seeder{}
+
+	first, _ := EncodeExtensionHandshake(&ExtensionHandshake{M: map[string]int{"ut_pex": 1, "ut_metadata": 2}})
+	second, _ := EncodeExtensionHandshake(&ExtensionHandshake{M: map[string]int{"ut_pex": 0}})
+
+	seeder.HandleExtended(ExtendedPayload{ExtendedId: ExtendedHandshakeId, Payload: first})
+	seeder.HandleExtended(ExtendedPayload{ExtendedId: ExtendedHandshakeId, Payload: second})
+
+	if seeder.SupportsExtension("ut_pex") || seeder.RemoteExtensions["ut_metadata"] != 2 {
+		t.Errorf("Expected ut_pex to be disabled and ut_metadata kept %#v", seeder.RemoteExtensions)
+	}
+}
+
+func TestExtensionHandlerFailureIsDropped(t *testing.T) {
+	registry := NewExtensionRegistry()
+	id := registry.Register("ut_pex", ExtensionHandlerFunc(func(seeder *Seeder, payload []byte) error {
+		return ErrInvalidMetadataMessage
+	}))
+
+	seeder := Seeder{Extensions: registry}
+
+	err := seeder.HandleExtended(ExtendedPayload{ExtendedId: id, Payload: []byte("garbage")})
+	if err != nil {
+		t.Errorf("Expected failing handler to be ignored, got %v", err)
+	}
+
+	err = seeder.HandleExtended(ExtendedPayload{ExtendedId: ExtendedHandshakeId, Payload: []byte("garbage")})
+	if err == nil {
+		t.Errorf("Expected invalid extension handshake to fail")
+	}
+}
+
+func TestExtensionHandshakeRequiresReservedBit(t *testing.T) {
+	seeder := Seeder{RemoteHandshake: &Handshake{}}
+
+	err := seeder.SendExtensionHandshake()
+	if err != ErrExtensionNotSupported {
+		t.Errorf("Expected ErrExtensionNotSupported, got %v", err)
+	}
+}
+
+func TestNegotiateExtensions(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+	seeder := Seeder{SeederWriter: buffer, RemoteHandshake: &Handshake{}}
+
+	err := seeder.NegotiateExtensions()
+	if err != nil || buffer.Len() != 0 {
+		t.Errorf("Expected nothing to be sent without the reserved bit %v %v", err, buffer.Bytes())
+	}
+
+	seeder.RemoteHandshake = extensionReservedHandshake
+
+	err = seeder.NegotiateExtensions()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	msg, err := Receive(buffer)
+	if err != nil || msg.Type != Extended || msg.Payload.(ExtendedPayload).ExtendedId != ExtendedHandshakeId {
+		t.Errorf("Expected extension handshake, got %#v %v", msg, err)
+	}
+}
+
+func TestIntroduceSendsAvailabilityFirst(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+	metaInfo := MetaInfo{Info: GeneralInfo{PieceLength: BlockSize, Pieces: strings.Repeat("x", 10*pieceHashSize)}}
+	seeder := Seeder{SeederWriter: buffer, MetaInfo: &metaInfo, RemoteHandshake: fastReservedHandshake}
+
+	err := seeder.Introduce([]byte{0x80, 0})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	msg, err := Receive(buffer)
+	if err != nil || msg.Type != Bitfield {
+		t.Errorf("Expected bitfield first, got %#v %v", msg, err)
+		return
+	}
+
+	msg, err = Receive(buffer)
+	if err != nil || msg.Type != Extended || msg.Payload.(ExtendedPayload).ExtendedId != ExtendedHandshakeId {
+		t.Errorf("Expected extension handshake after the bitfield, got %#v %v", msg, err)
+	}
+}
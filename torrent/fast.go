@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Message ids of the Fast Extension, see BEP 6.
+const (
+	SuggestPiece byte = iota + 0x0D
+	HaveAll
+	HaveNone
+	RejectRequest
+	AllowedFast
+)
+
+// Number of pieces we let a choked peer request
+const AllowedFastSetSize = 10
+
+var ErrRequestRejected = errors.New("peer rejected request")
+
+var HaveAllMessage = PeerMessage{Type: HaveAll, Payload: nil}
+var HaveNoneMessage = PeerMessage{Type: HaveNone, Payload: nil}
+
+type SuggestPiecePayload struct {
+	Index int32
+}
+
+type RejectRequestPayload struct {
+	Index  int32
+	Begin  int32
+	Length int32
+}
+
+type AllowedFastPayload struct {
+	Index int32
+}
+
+// Pieces a peer at ip may request while choked, generated the canonical way so both sides agree.
+// Only IPv4 is covered by the algorithm, other addresses get no pieces.
+func GenerateAllowedFastSet(k int, ip net.IP, infoHash []byte, pieceCount int) []int {
+	ipv4 := ip.To4()
+	if ipv4 == nil || pieceCount <= 0 {
+		return nil
+	}
+
+	k = min(k, pieceCount)
+
+	// Only the /24 network counts, peers behind the same NAT share the set
+	x := append([]byte{ipv4[0], ipv4[1], ipv4[2], 0}, infoHash...)
+
+	set := []int{}
+	seen := make(map[int]bool)
+
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(pieceCount))
+
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+func (seeder *Seeder) fastExtension() bool {
+	return seeder.RemoteHandshake != nil && seeder.RemoteHandshake.SupportsFastExtension()
+}
+
+// Tells the peer which pieces we have, have all and have none replace the bitfield when possible.
+func (seeder *Seeder) SendAvailability(bitfield []byte, pieceCount int) error {
+	have := 0
+	for index := 0; index < pieceCount; index++ {
+		if hasPiece(bitfield, index) {
+			have++
+		}
+	}
+
+	if seeder.fastExtension() {
+		seeder.availabilitySent = true
+
+		switch have {
+		case 0:
+			return Send(seeder.SeederWriter, &HaveNoneMessage)
+		case pieceCount:
+			return Send(seeder.SeederWriter, &HaveAllMessage)
+		}
+	}
+
+	// Empty bitfield may be skipped without the Fast Extension
+	if have == 0 {
+		return nil
+	}
+
+	seeder.availabilitySent = true
+
+	return Send(seeder.SeederWriter, &PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: bitfield}})
+}
+
+// Lets the peer know the request won't be served, peers without the Fast Extension are not told.
+func (seeder *Seeder) RejectRequest(request RequestPayload) error {
+	if !seeder.fastExtension() {
+		return nil
+	}
+
+	reject := PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(request)}
+
+	return Send(seeder.SeederWriter, &reject)
+}
+
+// Sends the allowed fast set of the peer, it may request these pieces even while choked.
+func (seeder *Seeder) SendAllowedFastSet(k int) error {
+	if !seeder.fastExtension() || seeder.MetaInfo == nil {
+		return nil
+	}
+
+	set := GenerateAllowedFastSet(k, seeder.SeederInfo.IP, seeder.infoHash(), seeder.MetaInfo.GetPieceCount())
+
+	seeder.AllowedFast = make(map[int]bool)
+	for _, index := range set {
+		seeder.AllowedFast[index] = true
+	}
+
+	for _, index := range set {
+		err := Send(seeder.SeederWriter, &PeerMessage{Type: AllowedFast, Payload: AllowedFastPayload{Index: int32(index)}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Requests of these pieces are served even while we choke the peer
+func (seeder *Seeder) AllowsFast(index int) bool {
+	return seeder.AllowedFast[index]
+}
+
+func (seeder *Seeder) addAllowedFast(index int) {
+	if seeder.RemoteAllowedFast == nil {
+		seeder.RemoteAllowedFast = make(map[int]bool)
+	}
+
+	seeder.RemoteAllowedFast[index] = true
+}
@@ -0,0 +1,218 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+var fastReservedHandshake = &Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}}
+
+func TestGenerateAllowedFastSet(t *testing.T) {
+	// Example from BEP 6
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	testCases := []struct {
+		name       string
+		k          int
+		ip         net.IP
+		pieceCount int
+		wanted     []int
+	}{
+		{"Seven pieces", 7, ip, 1313, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"Nine pieces", 9, ip, 1313, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"Same network", 7, net.ParseIP("80.4.4.1"), 1313, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"IPv6", 7, net.ParseIP("2001:db8::1"), 1313, nil},
+	}
+
+	for i := range testCases {
+		set := GenerateAllowedFastSet(testCases[i].k, testCases[i].ip, infoHash, testCases[i].pieceCount)
+
+		if !reflect.DeepEqual(set, testCases[i].wanted) {
+			t.Errorf("%s expected %v, got %v", testCases[i].name, testCases[i].wanted, set)
+		}
+	}
+
+	// Torrents with fewer pieces than k allow all of them
+	set := GenerateAllowedFastSet(10, ip, infoHash, 3)
+	if len(set) != 3 {
+		t.Errorf("Expected every piece, got %v", set)
+	}
+}
+
+// Serves the piece to a fast extension peer. The first request of rejectBegin makes the peer choke,
+// it is rejected and the peer unchokes again. Refusing peers reject it every time without choking.
+func serveFastBlocks(conn net.Conn, data []byte, availability PeerMessage, allowedFast int, rejectBegin int, refuse bool) {
+	defer conn.Close()
+
+	choked := false
+
+	for {
+		msg, err := Receive(conn)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case Interested:
+			Send(conn, &availability)
+
+			// Stays choked, only the allowed fast piece is served
+			if allowedFast >= 0 {
+				Send(conn, &PeerMessage{Type: AllowedFast, Payload: AllowedFastPayload{Index: int32(allowedFast)}})
+			} else {
+				Send(conn, &UnchokeMessage)
+			}
+		case Request:
+			request := msg.Payload.(RequestPayload)
+
+			if int(request.Begin) == rejectBegin && refuse {
+				Send(conn, &PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(request)})
+				continue
+			}
+
+			if int(request.Begin) == rejectBegin && !choked {
+				choked = true
+
+				// Choke alone must not make the downloader give up, allowed fast requests are still served
+				Send(conn, &ChokeMessage)
+				if allowedFast < 0 {
+					Send(conn, &PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(request)})
+					Send(conn, &UnchokeMessage)
+					continue
+				}
+			}
+
+			block := data[request.Begin : request.Begin+request.Length]
+			Send(conn, &PeerMessage{Type: Piece, Payload: PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+		case Cancel:
+			// Allowed fast requests are not cancelled by a choke
+			if allowedFast >= 0 {
+				return
+			}
+		}
+	}
+}
+
+func TestDownloadPieceFastExtension(t *testing.T) {
+	data := make([]byte, 2*BlockSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	testCases := []struct {
+		name         string
+		availability PeerMessage
+		allowedFast  int
+		rejectBegin  int
+		refuse       bool
+		wantedError  error
+	}{
+		{"Have all", HaveAllMessage, -1, -1, false, nil},
+		{"Have none", HaveNoneMessage, -1, -1, false, ErrPieceNotAvailable},
+		{"Allowed fast while choked", HaveAllMessage, 0, -1, false, nil},
+		{"Allowed fast kept on choke", HaveAllMessage, 0, BlockSize, false, nil},
+		{"Rejected on choke requested again", HaveAllMessage, -1, BlockSize, false, nil},
+		{"Request refused", HaveAllMessage, -1, BlockSize, true, ErrRequestRejected},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			local, remote := loopbackPair(t)
+			defer local.Close()
+
+			go func() {
+				// We tell the peer we have nothing before anything else
+				msg, err := Receive(remote)
+				if err != nil || msg.Type != HaveNone {
+					remote.Close()
+					return
+				}
+
+				serveFastBlocks(remote, data, testCase.availability, testCase.allowedFast, testCase.rejectBegin, testCase.refuse)
+			}()
+
+			seeder := Seeder{SeederReader: local, SeederWriter: local, RemoteHandshake: fastReservedHandshake}
+
+			piece, err := seeder.DownloadPiece(0, len(data))
+			if err != testCase.wantedError {
+				t.Errorf("Wanted error %v, got %v", testCase.wantedError, err)
+				return
+			}
+
+			if err == nil && !bytes.Equal(piece, data) {
+				t.Errorf("Downloaded piece differs")
+			}
+		})
+	}
+}
+
+func TestRejectRequest(t *testing.T) {
+	request := RequestPayload{Index: 1, Begin: 2, Length: 3}
+
+	buffer := bytes.NewBuffer([]byte{})
+	seeder := Seeder{SeederWriter: buffer}
+
+	err := seeder.RejectRequest(request)
+	if err != nil || buffer.Len() != 0 {
+		t.Errorf("Expected nothing to be sent without the Fast Extension %v %v", err, buffer.Bytes())
+	}
+
+	seeder.RemoteHandshake = fastReservedHandshake
+
+	err = seeder.RejectRequest(request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	msg, err := Receive(buffer)
+	if err != nil || !reflect.DeepEqual(*msg, PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(request)}) {
+		t.Errorf("Expected reject, got %#v %v", msg, err)
+	}
+}
+
+func TestSendAvailability(t *testing.T) {
+	testCases := []struct {
+		name      string
+		handshake *Handshake
+		bitfield  []byte
+		wanted    []PeerMessage
+	}{
+		{"Have all", fastReservedHandshake, []byte{0xE0}, []PeerMessage{HaveAllMessage}},
+		{"Have none", fastReservedHandshake, []byte{0}, []PeerMessage{HaveNoneMessage}},
+		{"Partial", fastReservedHandshake, []byte{0xA0}, []PeerMessage{{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{0xA0}}}}},
+		{"Nothing without fast extension", &Handshake{}, []byte{0}, nil},
+		{"Bitfield without fast extension", &Handshake{}, []byte{0xE0}, []PeerMessage{{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{0xE0}}}}},
+	}
+
+	for i := range testCases {
+		buffer := bytes.NewBuffer([]byte{})
+		seeder := Seeder{SeederWriter: buffer, RemoteHandshake: testCases[i].handshake}
+
+		err := seeder.SendAvailability(testCases[i].bitfield, 3)
+		if err != nil {
+			t.Errorf("%s did not expect error %v", testCases[i].name, err)
+			continue
+		}
+
+		var sent []PeerMessage
+		for buffer.Len() > 0 {
+			msg, err := Receive(buffer)
+			if err != nil {
+				t.Errorf("%s could not receive %v", testCases[i].name, err)
+				break
+			}
+
+			sent = append(sent, *msg)
+		}
+
+		if !reflect.DeepEqual(sent, testCases[i].wanted) {
+			t.Errorf("%s expected %#v, got %#v", testCases[i].name, testCases[i].wanted, sent)
+		}
+	}
+}
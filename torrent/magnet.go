@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/bencode"
+)
+
+const magnetInfoHashPrefix = "urn:btih:"
+
+var ErrInvalidMagnet = errors.New("invalid magnet link")
+var ErrMagnetInfoHashMissing = errors.New("magnet link has no BitTorrent info hash")
+
+// Parsed magnet link, see BEP 9.
+type Magnet struct {
+	InfoHash    []byte
+	DisplayName string
+	Trackers    []string
+	// Peers given with x.pe
+	Peers []PeerInfo
+}
+
+// Info hashes come either as 40 hex or 32 base32 characters
+func parseMagnetInfoHash(encoded string) ([]byte, error) {
+	switch len(encoded) {
+	case 40:
+		return hex.DecodeString(encoded)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	}
+
+	return nil, ErrInvalidMagnet
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	magnetURL, err := url.Parse(uri)
+	if err != nil || magnetURL.Scheme != "magnet" {
+		return nil, ErrInvalidMagnet
+	}
+
+	query := magnetURL.Query()
+
+	magnet := Magnet{DisplayName: query.Get("dn"), Trackers: query["tr"]}
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), magnetInfoHashPrefix) {
+			continue
+		}
+
+		magnet.InfoHash, err = parseMagnetInfoHash(xt[len(magnetInfoHashPrefix):])
+		if err != nil {
+			return nil, ErrInvalidMagnet
+		}
+	}
+
+	if magnet.InfoHash == nil {
+		return nil, ErrMagnetInfoHashMissing
+	}
+
+	for _, peer := range query["x.pe"] {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		portNumber, err := strconv.Atoi(port)
+
+		// Hostnames are not resolved here
+		if ip == nil || err != nil || portNumber <= 0 || portNumber > 65535 {
+			continue
+		}
+
+		magnet.Peers = append(magnet.Peers, PeerInfo{IP: ip, Port: portNumber})
+	}
+
+	return &magnet, nil
+}
+
+// Builds the meta info from the fetched info dictionary, every tracker gets its own tier.
+func (magnet *Magnet) MetaInfo(info []byte) (*MetaInfo, error) {
+	if !bytes.Equal(hashInfo(info), magnet.InfoHash) {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	fields := map[string]any{
+		"announce":      "",
+		"comment":       "",
+		"created by":    ClientVersion,
+		"creation date": int(time.Now().Unix()),
+	}
+
+	if len(magnet.Trackers) > 0 {
+		tiers := []any{}
+		for _, tracker := range magnet.Trackers {
+			tiers = append(tiers, []any{tracker})
+		}
+
+		fields["announce"] = magnet.Trackers[0]
+		fields["announce-list"] = tiers
+	}
+
+	encoded, err := bencode.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Info sorts after every other key, it is appended as received so the hash stays the same
+	var buffer bytes.Buffer
+
+	buffer.Write(encoded[:len(encoded)-1])
+	buffer.WriteString("4:info")
+	buffer.Write(info)
+	buffer.WriteString("e")
+
+	metaInfo, err := ParseMetaInfo(&buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The info comes from an untrusted peer, its names are checked before anything is stored
+	err = metaInfo.CheckPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	return metaInfo, nil
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example.com/bencode"
+)
+
+func readExampleMetaInfo(path string, t *testing.T) *MetaInfo {
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open %s %v", path, err)
+	}
+	defer reader.Close()
+
+	metaInfo, err := ParseMetaInfo(reader)
+	if err != nil {
+		t.Fatalf("Could not parse %s %v", path, err)
+	}
+
+	return metaInfo
+}
+
+func TestParseMagnet(t *testing.T) {
+	infoHash, _ := hex.DecodeString("75439d5de343999ab377c617c2c647902956e282")
+	base32Hash := base32.StdEncoding.EncodeToString(infoHash)
+
+	magnet, err := ParseMagnet("magnet:?xt=urn:btih:75439d5de343999ab377c617c2c647902956e282&dn=ubuntu&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A6969&x.pe=10.0.0.1%3A6881&x.pe=%5B%3A%3A1%5D%3A6882&x.pe=peer.example%3A6883")
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if !bytes.Equal(magnet.InfoHash, infoHash) || magnet.DisplayName != "ubuntu" {
+		t.Errorf("Unexpected magnet %#v", magnet)
+		return
+	}
+
+	if !reflect.DeepEqual(magnet.Trackers, []string{"http://tracker.example/announce", "udp://tracker.example:6969"}) {
+		t.Errorf("Unexpected trackers %#v", magnet.Trackers)
+		return
+	}
+
+	// Hostnames are skipped
+	if len(magnet.Peers) != 2 || magnet.Peers[0].Port != 6881 || magnet.Peers[1].IP.String() != "::1" {
+		t.Errorf("Unexpected peers %#v", magnet.Peers)
+		return
+	}
+
+	magnet, err = ParseMagnet("magnet:?xt=urn:btih:" + base32Hash)
+	if err != nil || !bytes.Equal(magnet.InfoHash, infoHash) {
+		t.Errorf("Expected base32 info hash to be parsed %v %#v", err, magnet)
+	}
+
+	magnet, err = ParseMagnet("magnet:?xt=urn:btih:" + strings.ToLower(base32Hash))
+	if err != nil || !bytes.Equal(magnet.InfoHash, infoHash) {
+		t.Errorf("Expected lower case base32 info hash to be parsed %v %#v", err, magnet)
+	}
+
+	testCases := []struct {
+		uri         string
+		wantedError error
+	}{
+		{"http://example.com/?xt=urn:btih:75439d5de343999ab377c617c2c647902956e282", ErrInvalidMagnet},
+		{"magnet:?dn=nothing", ErrMagnetInfoHashMissing},
+		{"magnet:?xt=urn:sha1:75439d5de343999ab377c617c2c647902956e282", ErrMagnetInfoHashMissing},
+		{"magnet:?xt=urn:btih:75439d5de343", ErrInvalidMagnet},
+		{"magnet:?xt=urn:btih:zz439d5de343999ab377c617c2c647902956e282", ErrInvalidMagnet},
+	}
+
+	for _, testCase := range testCases {
+		_, err := ParseMagnet(testCase.uri)
+		if err != testCase.wantedError {
+			t.Errorf("Expected %v on %s, got %v", testCase.wantedError, testCase.uri, err)
+		}
+	}
+}
+
+func TestMagnetMetaInfo(t *testing.T) {
+	original := readExampleMetaInfo("examples/ubuntu-22.04.3-desktop-amd64.iso.torrent", t)
+
+	magnet := Magnet{InfoHash: original.GetInfoHash(), Trackers: []string{"http://a.example/announce", "http://b.example/announce"}}
+
+	metaInfo, err := magnet.MetaInfo(original.InfoBytes())
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if !bytes.Equal(metaInfo.GetInfoHash(), original.GetInfoHash()) || !reflect.DeepEqual(metaInfo.Info, original.Info) {
+		t.Errorf("Info differs from the original")
+		return
+	}
+
+	if metaInfo.Announce != "http://a.example/announce" || !reflect.DeepEqual(metaInfo.GetAnnounceTiers(), [][]string{{"http://a.example/announce"}, {"http://b.example/announce"}}) {
+		t.Errorf("Unexpected trackers %s %#v", metaInfo.Announce, metaInfo.GetAnnounceTiers())
+		return
+	}
+
+	magnet.InfoHash = GenerateRandomProtocolId()
+
+	_, err = magnet.MetaInfo(original.InfoBytes())
+	if err != ErrMetadataHashMismatch {
+		t.Errorf("Expected ErrMetadataHashMismatch, got %v", err)
+	}
+}
+
+func TestMagnetMetaInfoUnsafePath(t *testing.T) {
+	length := 1
+	encoded, err := bencode.Marshal(MetaInfo{Info: GeneralInfo{Name: "..", PieceLength: 1, Pieces: strings.Repeat("x", 20), Length: &length}})
+	if err != nil {
+		t.Errorf("Could not marshal metainfo %v", err)
+		return
+	}
+
+	unsafe, err := ParseMetaInfo(bytes.NewReader(encoded))
+	if err != nil {
+		t.Errorf("Could not parse metainfo %v", err)
+		return
+	}
+
+	magnet := Magnet{InfoHash: unsafe.GetInfoHash()}
+
+	_, err = magnet.MetaInfo(unsafe.InfoBytes())
+	if err != ErrUnsafePath {
+		t.Errorf("Expected ErrUnsafePath, got %v", err)
+	}
+}
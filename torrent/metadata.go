@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+
+	"example.com/bencode"
+)
+
+// Name of metadata exchange in the extension handshake, see BEP 9.
+const MetadataExtensionName = "ut_metadata"
+
+// Info dictionary is transferred in pieces of this size, only the last one may be smaller
+const MetadataPieceSize = 16 * 1024
+
+// Peers claiming larger info dictionaries are not trusted
+const MaxMetadataSize = 16 * 1024 * 1024
+
+const (
+	MetadataRequest = iota
+	MetadataData
+	MetadataReject
+)
+
+var ErrInvalidMetadataMessage = errors.New("invalid metadata message")
+var ErrMetadataRejected = errors.New("peer rejected metadata request")
+var ErrMetadataHashMismatch = errors.New("metadata does not match info hash")
+var ErrMetadataSizeUnknown = errors.New("peer did not tell metadata size")
+
+type MetadataMessage struct {
+	Type      int
+	Piece     int
+	TotalSize int
+	// Piece of the info dictionary, only on data messages
+	Data []byte
+}
+
+func hashInfo(info []byte) []byte {
+	hash := sha1.Sum(info)
+	return hash[:]
+}
+
+func EncodeMetadataMessage(message *MetadataMessage) ([]byte, error) {
+	dict := map[string]any{"msg_type": message.Type, "piece": message.Piece}
+
+	if message.Type == MetadataData {
+		dict["total_size"] = message.TotalSize
+	}
+
+	encoded, err := bencode.Marshal(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data follows the dictionary directly
+	return append(encoded, message.Data...), nil
+}
+
+func ParseMetadataMessage(payload []byte) (*MetadataMessage, error) {
+	reader := bytes.NewReader(payload)
+
+	var dict map[string]any
+
+	err := bencode.NewDecoder(reader).Decode(&dict)
+	if err != nil {
+		return nil, ErrInvalidMetadataMessage
+	}
+
+	message := MetadataMessage{}
+
+	var ok bool
+
+	message.Type, ok = dict["msg_type"].(int)
+	if !ok {
+		return nil, ErrInvalidMetadataMessage
+	}
+
+	message.Piece, ok = dict["piece"].(int)
+	if !ok || message.Piece < 0 {
+		return nil, ErrInvalidMetadataMessage
+	}
+
+	if message.Type == MetadataData {
+		message.TotalSize, _ = dict["total_size"].(int)
+		message.Data = payload[len(payload)-reader.Len():]
+	}
+
+	return &message, nil
+}
+
+func metadataPieceCount(size int) int {
+	return (size + MetadataPieceSize - 1) / MetadataPieceSize
+}
+
+// Serves our info dictionary to peers, requests are rejected while we don't have it.
+type MetadataHandler struct{}
+
+func (MetadataHandler) HandleExtended(seeder *Seeder, payload []byte) error {
+	message, err := ParseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	// Data and rejects are only expected while fetching, see FetchMetadata
+	if message.Type != MetadataRequest {
+		return nil
+	}
+
+	var info []byte
+	if seeder.MetaInfo != nil {
+		info = seeder.MetaInfo.InfoBytes()
+	}
+
+	response := MetadataMessage{Type: MetadataReject, Piece: message.Piece}
+
+	if info != nil && message.Piece < metadataPieceCount(len(info)) {
+		start := message.Piece * MetadataPieceSize
+		end := min(start+MetadataPieceSize, len(info))
+
+		response = MetadataMessage{Type: MetadataData, Piece: message.Piece, TotalSize: len(info), Data: info[start:end]}
+	}
+
+	encoded, err := EncodeMetadataMessage(&response)
+	if err != nil {
+		return err
+	}
+
+	return seeder.SendExtended(MetadataExtensionName, encoded)
+}
+
+// Waits for the extension handshake of the peer unless it already came.
+func (seeder *Seeder) receiveExtensionHandshake() error {
+	for seeder.remoteExtensionHandshake() == nil {
+		msg, err := Receive(seeder.SeederReader)
+		if err != nil {
+			return err
+		}
+
+		if msg.Type == Extended {
+			err = seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (seeder *Seeder) receiveMetadataPiece(localId byte) (*MetadataMessage, error) {
+	for {
+		msg, err := Receive(seeder.SeederReader)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Type != Extended {
+			continue
+		}
+
+		payload := msg.Payload.(ExtendedPayload)
+		if payload.ExtendedId != localId {
+			err = seeder.HandleExtended(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		message, err := ParseMetadataMessage(payload.Payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Type == MetadataRequest {
+			err = seeder.HandleExtended(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		return message, nil
+	}
+}
+
+// Downloads the info dictionary piece by piece and checks it against infoHash.
+// Extension handshake is sent here unless the connection already negotiated ut_metadata.
+func (seeder *Seeder) FetchMetadata(infoHash []byte) ([]byte, error) {
+	if seeder.Extensions == nil {
+		seeder.Extensions = NewExtensionRegistry()
+	}
+
+	localId := seeder.Extensions.LocalId(MetadataExtensionName)
+	registered := localId == 0
+
+	if registered {
+		localId = seeder.Extensions.Register(MetadataExtensionName, MetadataHandler{})
+	}
+
+	if registered || !seeder.extensionHandshakeSent {
+		err := seeder.SendExtensionHandshake()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := seeder.receiveExtensionHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	if !seeder.SupportsExtension(MetadataExtensionName) {
+		return nil, ErrExtensionNotSupported
+	}
+
+	size := seeder.remoteExtensionHandshake().MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		return nil, ErrMetadataSizeUnknown
+	}
+
+	info := make([]byte, 0, size)
+
+	for piece := 0; piece < metadataPieceCount(size); piece++ {
+		request, err := EncodeMetadataMessage(&MetadataMessage{Type: MetadataRequest, Piece: piece})
+		if err != nil {
+			return nil, err
+		}
+
+		err = seeder.SendExtended(MetadataExtensionName, request)
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := seeder.receiveMetadataPiece(localId)
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Type == MetadataReject {
+			return nil, ErrMetadataRejected
+		}
+
+		expectedLength := min(MetadataPieceSize, size-piece*MetadataPieceSize)
+
+		if message.Type != MetadataData || message.Piece != piece || len(message.Data) != expectedLength {
+			return nil, ErrInvalidMetadataMessage
+		}
+
+		info = append(info, message.Data...)
+	}
+
+	if !bytes.Equal(hashInfo(info), infoHash) {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	return info, nil
+}
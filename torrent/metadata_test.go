@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var extensionReservedHandshake = &Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}}
+
+func TestMetadataMessageRoundTrip(t *testing.T) {
+	testCases := []MetadataMessage{
+		{Type: MetadataRequest, Piece: 3},
+		{Type: MetadataReject, Piece: 1},
+		{Type: MetadataData, Piece: 2, TotalSize: 40000, Data: []byte("d4:infoe")},
+	}
+
+	for _, message := range testCases {
+		encoded, err := EncodeMetadataMessage(&message)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			continue
+		}
+
+		decoded, err := ParseMetadataMessage(encoded)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			continue
+		}
+
+		if decoded.Type != message.Type || decoded.Piece != message.Piece || decoded.TotalSize != message.TotalSize || !bytes.Equal(decoded.Data, message.Data) {
+			t.Errorf("Expected %#v, got %#v", message, decoded)
+		}
+	}
+
+	_, err := ParseMetadataMessage([]byte("d5:piecei0ee"))
+	if err != ErrInvalidMetadataMessage {
+		t.Errorf("Expected ErrInvalidMetadataMessage, got %v", err)
+	}
+}
+
+// Serves metadata of metaInfo on a loopback connection, returns the fetching side
+func startMetadataServer(metaInfo *MetaInfo, t *testing.T) *Seeder {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		registry := NewExtensionRegistry()
+		registry.Register(MetadataExtensionName, MetadataHandler{})
+
+		seeder := Seeder{SeederReader: conn, SeederWriter: conn, MetaInfo: metaInfo, Extensions: registry, RemoteHandshake: extensionReservedHandshake}
+
+		if seeder.SendExtensionHandshake() != nil {
+			return
+		}
+
+		for {
+			msg, err := Receive(conn)
+			if err != nil {
+				return
+			}
+
+			if msg.Type == Extended {
+				seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return &Seeder{SeederReader: conn, SeederWriter: conn, RemoteHandshake: extensionReservedHandshake}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	metaInfo := readExampleMetaInfo("examples/ubuntu-22.04.3-desktop-amd64.iso.torrent", t)
+
+	if len(metaInfo.InfoBytes()) <= MetadataPieceSize {
+		t.Errorf("Expected metadata to span several pieces")
+		return
+	}
+
+	seeder := startMetadataServer(metaInfo, t)
+
+	info, err := seeder.FetchMetadata(metaInfo.GetInfoHash())
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if !bytes.Equal(info, metaInfo.InfoBytes()) {
+		t.Errorf("Fetched metadata differs")
+	}
+}
+
+func TestFetchMetadataHashMismatch(t *testing.T) {
+	metaInfo := readExampleMetaInfo("examples/hello_world.torrent", t)
+	seeder := startMetadataServer(metaInfo, t)
+
+	_, err := seeder.FetchMetadata(GenerateRandomProtocolId())
+	if err != ErrMetadataHashMismatch {
+		t.Errorf("Expected ErrMetadataHashMismatch, got %v", err)
+	}
+}
+
+func TestFetchMetadataFromPeerWithoutIt(t *testing.T) {
+	seeder := startMetadataServer(nil, t)
+
+	_, err := seeder.FetchMetadata(GenerateRandomProtocolId())
+	if err != ErrMetadataSizeUnknown {
+		t.Errorf("Expected ErrMetadataSizeUnknown, got %v", err)
+	}
+}
+
+func TestMetadataHandlerRejects(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	seeder := Seeder{SeederWriter: remote, RemoteExtensions: map[string]int{MetadataExtensionName: 3}}
+
+	request, _ := EncodeMetadataMessage(&MetadataMessage{Type: MetadataRequest, Piece: 0})
+
+	go MetadataHandler{}.HandleExtended(&seeder, request)
+
+	msg, err := Receive(local)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	payload := msg.Payload.(ExtendedPayload)
+	response, err := ParseMetadataMessage(payload.Payload)
+
+	if payload.ExtendedId != 3 || err != nil || response.Type != MetadataReject {
+		t.Errorf("Expected reject on id 3 %v %#v", err, response)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"errors"
 	"io"
+	"strings"
 
 	"example.com/bencode"
 )
@@ -24,16 +25,22 @@ type GeneralInfo struct {
 
 type MetaInfo struct {
 	Announce     string      `bencode:"announce"`
+	AnnounceList *[][]string `bencode:"announce-list"`
 	Comment      string      `bencode:"comment"`
 	CreatedBy    string      `bencode:"created by"`
 	CreationDate int         `bencode:"creation date"`
 	Info         GeneralInfo `bencode:"info"`
 	RawBytes     []byte
 
-	infoHash []byte
+	infoHash  []byte
+	infoBytes []byte
 }
 
 var ErrLengthAndFilesNotSpecified = errors.New("either length or files must be specified")
+var ErrPieceIndexOutOfRange = errors.New("piece index out of range")
+var ErrUnsafePath = errors.New("unsafe file name in torrent")
+
+const pieceHashSize = sha1.Size
 
 func (metaInfo *MetaInfo) calculateInfoHash() error {
 	var anyMap map[string]any
@@ -62,6 +69,7 @@ func (metaInfo *MetaInfo) calculateInfoHash() error {
 	}
 
 	metaInfo.infoHash = h.Sum(nil)
+	metaInfo.infoBytes = infoBencodedBytes
 
 	return nil
 }
@@ -100,6 +108,15 @@ func (metaInfo *MetaInfo) GetInfoHash() []byte {
 	return metaInfo.infoHash
 }
 
+// Bencoded info dictionary, nil if the meta info was not parsed from bytes
+func (metaInfo *MetaInfo) InfoBytes() []byte {
+	if metaInfo.infoBytes == nil && metaInfo.RawBytes != nil {
+		metaInfo.calculateInfoHash()
+	}
+
+	return metaInfo.infoBytes
+}
+
 func (metaInfo *MetaInfo) GetFullLength() (int, error) {
 	if metaInfo.Info.Length != nil {
 		return *metaInfo.Info.Length, nil
@@ -116,3 +133,96 @@ func (metaInfo *MetaInfo) GetFullLength() (int, error) {
 
 	return 0, errors.New("Can't calculate full length!")
 }
+
+func (metaInfo *MetaInfo) GetPieceCount() int {
+	return len(metaInfo.Info.Pieces) / pieceHashSize
+}
+
+func (metaInfo *MetaInfo) GetPieceHash(index int) ([]byte, error) {
+	if index < 0 || index >= metaInfo.GetPieceCount() {
+		return nil, ErrPieceIndexOutOfRange
+	}
+
+	return []byte(metaInfo.Info.Pieces[index*pieceHashSize : (index+1)*pieceHashSize]), nil
+}
+
+func (metaInfo *MetaInfo) GetPieceLength(index int) (int, error) {
+	if index < 0 || index >= metaInfo.GetPieceCount() {
+		return 0, ErrPieceIndexOutOfRange
+	}
+
+	fullLength, err := metaInfo.GetFullLength()
+	if err != nil {
+		return 0, err
+	}
+
+	// Last piece takes whatever is left
+	remaining := fullLength - index*metaInfo.Info.PieceLength
+	if remaining < metaInfo.Info.PieceLength {
+		return remaining, nil
+	}
+
+	return metaInfo.Info.PieceLength, nil
+}
+
+// Single file torrents are presented as one file named after the torrent.
+func (metaInfo *MetaInfo) GetFiles() []FileInfo {
+	if metaInfo.Info.Length != nil {
+		return []FileInfo{{Length: *metaInfo.Info.Length, Path: []string{metaInfo.Info.Name}}}
+	}
+
+	if metaInfo.Info.Files != nil {
+		return *metaInfo.Info.Files
+	}
+
+	return nil
+}
+
+// Names must stay inside the torrent directory, so every element is a single plain name.
+func safePathElement(element string) bool {
+	if element == "" || element == "." || element == ".." {
+		return false
+	}
+
+	return !strings.ContainsAny(element, "/\\\x00")
+}
+
+// Checks the name and file paths before anything is created from them.
+func (metaInfo *MetaInfo) CheckPaths() error {
+	if !safePathElement(metaInfo.Info.Name) {
+		return ErrUnsafePath
+	}
+
+	for _, file := range metaInfo.GetFiles() {
+		if len(file.Path) == 0 {
+			return ErrUnsafePath
+		}
+
+		for _, element := range file.Path {
+			if !safePathElement(element) {
+				return ErrUnsafePath
+			}
+		}
+	}
+
+	return nil
+}
+
+// If announce-list is present announce is ignored, see BEP 12.
+func (metaInfo *MetaInfo) GetAnnounceTiers() [][]string {
+	var tiers [][]string
+
+	if metaInfo.AnnounceList != nil {
+		for _, tier := range *metaInfo.AnnounceList {
+			if len(tier) != 0 {
+				tiers = append(tiers, tier)
+			}
+		}
+	}
+
+	if len(tiers) == 0 && metaInfo.Announce != "" {
+		tiers = append(tiers, []string{metaInfo.Announce})
+	}
+
+	return tiers
+}
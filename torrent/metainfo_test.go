@@ -3,6 +3,7 @@ package torrent
 import (
 	"encoding/hex"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -83,3 +84,151 @@ func TestParseMetaInfo(t *testing.T) {
 		})
 	}
 }
+
+type pieceTestCase struct {
+	name         string
+	metaInfo     MetaInfo
+	index        int
+	wantedLength int
+	wantedError  error
+}
+
+func TestPieceLength(t *testing.T) {
+	length := 40
+	pieces := string(make([]byte, 3*pieceHashSize))
+	files := []FileInfo{{Length: 30, Path: []string{"a"}}, {Length: 20, Path: []string{"b"}}}
+
+	singleFile := MetaInfo{Info: GeneralInfo{Name: "single", PieceLength: 16, Pieces: pieces, Length: &length}}
+	multiFile := MetaInfo{Info: GeneralInfo{Name: "multi", PieceLength: 20, Pieces: pieces, Files: &files}}
+
+	testCases := []pieceTestCase{
+		{"First piece", singleFile, 0, 16, nil},
+		{"Last piece", singleFile, 2, 8, nil},
+		{"Multi file last piece", multiFile, 2, 10, nil},
+		{"Negative index", singleFile, -1, 0, ErrPieceIndexOutOfRange},
+		{"Index too big", singleFile, 3, 0, ErrPieceIndexOutOfRange},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			pieceLength, err := testCase.metaInfo.GetPieceLength(testCase.index)
+			if err != testCase.wantedError {
+				t.Errorf("Wanted error %v, got %v", testCase.wantedError, err)
+			}
+
+			if pieceLength != testCase.wantedLength {
+				t.Errorf("Wanted length %d, got %d", testCase.wantedLength, pieceLength)
+			}
+		})
+	}
+}
+
+func TestPieceHash(t *testing.T) {
+	reader, err := os.Open("examples/hello_world.torrent")
+	if err != nil {
+		t.Errorf("Could not open example %v", err)
+		return
+	}
+	defer reader.Close()
+
+	metaInfo, err := ParseMetaInfo(reader)
+	if err != nil {
+		t.Errorf("Could not parse example %v", err)
+		return
+	}
+
+	if metaInfo.GetPieceCount() == 0 {
+		t.Errorf("Expected pieces in %#v", metaInfo.Info)
+		return
+	}
+
+	lastIndex := metaInfo.GetPieceCount() - 1
+
+	hash, err := metaInfo.GetPieceHash(lastIndex)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if string(hash) != metaInfo.Info.Pieces[lastIndex*pieceHashSize:] {
+		t.Errorf("Wrong hash %x", hash)
+	}
+
+	_, err = metaInfo.GetPieceHash(lastIndex + 1)
+	if err != ErrPieceIndexOutOfRange {
+		t.Errorf("Expected %v, got %v", ErrPieceIndexOutOfRange, err)
+	}
+}
+
+type announceTiersTestCase struct {
+	name        string
+	filePath    string
+	wantedTiers [][]string
+}
+
+func TestGetAnnounceTiers(t *testing.T) {
+	testCases := []announceTiersTestCase{
+		{"Only announce", "examples/hello_world.torrent", [][]string{{"http://localhost:6969/announce"}}},
+		{"Announce list", "examples/lovecraft.torrent", [][]string{{"http://bt1.archive.org:6969/announce"}, {"http://bt2.archive.org:6969/announce"}}},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			reader, err := os.Open(testCase.filePath)
+			if err != nil {
+				t.Errorf("Could not open %s", testCase.filePath)
+				return
+			}
+			defer reader.Close()
+
+			metaInfo, err := ParseMetaInfo(reader)
+			if err != nil {
+				t.Errorf("Could not parse %s %v", testCase.filePath, err)
+				return
+			}
+
+			if !reflect.DeepEqual(metaInfo.GetAnnounceTiers(), testCase.wantedTiers) {
+				t.Errorf("Wanted %#v, got %#v", testCase.wantedTiers, metaInfo.GetAnnounceTiers())
+			}
+		})
+	}
+}
+
+type checkPathsTestCase struct {
+	name      string
+	info      GeneralInfo
+	wantedErr error
+}
+
+func TestCheckPaths(t *testing.T) {
+	length := 1
+	testCases := []checkPathsTestCase{
+		{"Single file", GeneralInfo{Name: "file", Length: &length}, nil},
+		{"Nested files", GeneralInfo{Name: "dir", Files: &[]FileInfo{{Length: 1, Path: []string{"sub", "file"}}}}, nil},
+		{"Empty name", GeneralInfo{Name: "", Length: &length}, ErrUnsafePath},
+		{"Parent name", GeneralInfo{Name: "..", Length: &length}, ErrUnsafePath},
+		{"Absolute name", GeneralInfo{Name: "/etc", Length: &length}, ErrUnsafePath},
+		{"Separator in name", GeneralInfo{Name: "a\\b", Length: &length}, ErrUnsafePath},
+		{"Parent in path", GeneralInfo{Name: "dir", Files: &[]FileInfo{{Length: 1, Path: []string{"..", "file"}}}}, ErrUnsafePath},
+		{"Current in path", GeneralInfo{Name: "dir", Files: &[]FileInfo{{Length: 1, Path: []string{".", "file"}}}}, ErrUnsafePath},
+		{"Separator in path", GeneralInfo{Name: "dir", Files: &[]FileInfo{{Length: 1, Path: []string{"../../file"}}}}, ErrUnsafePath},
+		{"Empty path", GeneralInfo{Name: "dir", Files: &[]FileInfo{{Length: 1, Path: []string{}}}}, ErrUnsafePath},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			metaInfo := MetaInfo{Info: testCase.info}
+
+			err := metaInfo.CheckPaths()
+			if err != testCase.wantedErr {
+				t.Errorf("Wanted %v, got %v", testCase.wantedErr, err)
+			}
+		})
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
+	"sync"
+	"time"
 )
 
 type Peer struct {
@@ -15,7 +18,7 @@ type Peer struct {
 	MetaInfoList []MetaInfo
 }
 
-const HandshakeMsg = "\x19" + "BitTorrent protocol"
+const HandshakeMsg = "\x13" + "BitTorrent protocol"
 
 const (
 	Choke byte = iota
@@ -27,9 +30,29 @@ const (
 	Request
 	Piece
 	Cancel
-	KeepAlive
 )
 
+// KeepAlive has no id on the wire, it is sent as a zero length message.
+const KeepAlive byte = 0xFF
+
+const lengthPrefixSize = 4
+
+// Largest block we serve, peers asking for more are refused.
+const MaxBlockLength = 1 << 17
+
+// Largest message we are willing to buffer, a bit more than the largest block.
+const MaxMessageLength = MaxBlockLength + 9
+
+// Size of a block requested from a peer, pieces are downloaded block by block.
+const BlockSize = 16 * 1024
+
+var ErrUnknownMessage = errors.New("unknown message id")
+var ErrInvalidMessageLength = errors.New("invalid message length")
+var ErrMessageTooLong = errors.New("message too long")
+var ErrPieceNotAvailable = errors.New("peer does not have the piece")
+var ErrChoked = errors.New("peer choked us")
+var ErrInvalidBlock = errors.New("received block of unexpected length")
+
 type PeerMessage struct {
 	Type    byte
 	Payload any
@@ -72,8 +95,47 @@ type Seeder struct {
 	SeederWriter io.Writer
 	SeederReader io.Reader
 	MetaInfo     *MetaInfo
+	// Used instead of MetaInfo while it is not known yet, e.g. for magnet links
+	InfoHash []byte
+	// Our own peer id which is sent in the handshake
+	ClientId []byte
+	// Filled once the remote side of the handshake is received
+	RemoteHandshake *Handshake
+	// Piece bytes transferred over this connection
+	Downloaded int
+	Uploaded   int
+	// Extensions we support on this connection, nil if none
+	Extensions *ExtensionRegistry
+	// Extension ids the remote side negotiated in its extension handshake,
+	// both are guarded by extensionsMutex since a PeerConn updates them while others send
+	RemoteExtensions         map[string]int
+	RemoteExtensionHandshake *ExtensionHandshake
+	extensionsMutex          sync.Mutex
+	extensionHandshakeSent   bool
+	// Pieces the peer lets us request while we are choked, see BEP 6
+	RemoteAllowedFast map[int]bool
+	// Pieces we let the peer request while it is choked, filled by SendAllowedFastSet
+	AllowedFast      map[int]bool
+	availabilitySent bool
+	// Requests kept in flight while downloading, adapted to the measured throughput
+	PipelineDepth  int
+	RequestTimeout time.Duration
+	pipelineStats  pipelineStats
+}
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash []byte
+	PeerId   []byte
 }
 
+type MetaInfoLookup func(infoHash []byte) (*MetaInfo, error)
+
+var ErrInvalidProtocol = errors.New("invalid handshake protocol")
+var ErrInfoHashMismatch = errors.New("info hash mismatch")
+var ErrPeerIdMismatch = errors.New("peer id mismatch")
+var ErrUnknownInfoHash = errors.New("unknown info hash")
+
 var letters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func GenerateRandomProtocolId() []byte {
@@ -86,6 +148,14 @@ func GenerateRandomProtocolId() []byte {
 	return b
 }
 
+func (seeder *Seeder) infoHash() []byte {
+	if seeder.MetaInfo != nil {
+		return seeder.MetaInfo.GetInfoHash()
+	}
+
+	return seeder.InfoHash
+}
+
 func (seeder *Seeder) InitiateHandshake() error {
 	n, err := seeder.SeederWriter.Write([]byte(HandshakeMsg))
 	if err != nil {
@@ -96,8 +166,8 @@ func (seeder *Seeder) InitiateHandshake() error {
 		return errors.New("Couldn't send handshake bytes")
 	}
 
-	// 8 empty bytes are next
-	reservedBytes := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	// 8 reserved bytes are next, we announce the extension protocol and the Fast Extension
+	reservedBytes := []byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}
 	n, err = seeder.SeederWriter.Write(reservedBytes)
 	if err != nil {
 		return err
@@ -107,7 +177,7 @@ func (seeder *Seeder) InitiateHandshake() error {
 		return errors.New("Couldn't send reserved bytes.")
 	}
 
-	infoHash := seeder.MetaInfo.GetInfoHash()
+	infoHash := seeder.infoHash()
 	n, err = seeder.SeederWriter.Write(infoHash)
 	if err != nil {
 		return err
@@ -117,30 +187,128 @@ func (seeder *Seeder) InitiateHandshake() error {
 		return errors.New("Couldn't send infohash bytes.")
 	}
 
-	n, err = seeder.SeederWriter.Write(seeder.SeederInfo.PeerId)
+	n, err = seeder.SeederWriter.Write(seeder.ClientId)
 	if err != nil {
 		return err
 	}
 
-	if n < len(seeder.SeederInfo.PeerId) {
+	if n < len(seeder.ClientId) {
 		return errors.New("Couldn't send peer id bytes.")
 	}
 
-	// If seeder agrees, it won't severe the connection.
+	// If seeder agrees, it will answer with its own handshake.
 	return nil
 }
 
-func Send(writer io.Writer, message *PeerMessage) error {
-	if message.Type == KeepAlive {
-		_, err := writer.Write([]byte{})
-		return err
+func ReadHandshake(reader io.Reader) (*Handshake, error) {
+	pstrLen := make([]byte, 1)
+
+	_, err := io.ReadFull(reader, pstrLen)
+	if err != nil {
+		return nil, err
+	}
+
+	pstr := make([]byte, pstrLen[0])
+
+	_, err = io.ReadFull(reader, pstr)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(pstrLen)+string(pstr) != HandshakeMsg {
+		return nil, ErrInvalidProtocol
+	}
+
+	// Reserved bytes, info hash and peer id
+	rest := make([]byte, 8+20+20)
+
+	_, err = io.ReadFull(reader, rest)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := Handshake{InfoHash: rest[8:28], PeerId: rest[28:48]}
+	copy(handshake.Reserved[:], rest[0:8])
+
+	return &handshake, nil
+}
+
+func (handshake *Handshake) SupportsExtensionProtocol() bool {
+	return handshake.Reserved[5]&0x10 != 0
+}
+
+func (handshake *Handshake) SupportsFastExtension() bool {
+	return handshake.Reserved[7]&0x04 != 0
+}
+
+func (handshake *Handshake) SupportsDHT() bool {
+	return handshake.Reserved[7]&0x01 != 0
+}
+
+func (seeder *Seeder) ReceiveHandshake() (*Handshake, error) {
+	handshake, err := ReadHandshake(seeder.SeederReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(handshake.InfoHash, seeder.infoHash()) {
+		return nil, ErrInfoHashMismatch
+	}
+
+	// Peer id is known only if tracker gave us non compact response
+	if len(seeder.SeederInfo.PeerId) != 0 && !bytes.Equal(handshake.PeerId, seeder.SeederInfo.PeerId) {
+		return nil, ErrPeerIdMismatch
+	}
+
+	seeder.SeederInfo.PeerId = handshake.PeerId
+	seeder.RemoteHandshake = handshake
+
+	return handshake, nil
+}
+
+func (seeder *Seeder) Close() error {
+	if closer, ok := seeder.SeederReader.(io.Closer); ok {
+		return closer.Close()
 	}
 
-	typeByte := []byte{message.Type}
-	buffer := bytes.NewBuffer(typeByte)
+	return nil
+}
 
-	// Todo
-	// Make this a little bit better :)
+func AcceptHandshake(reader io.Reader, writer io.Writer, clientId []byte, lookup MetaInfoLookup) (*Seeder, error) {
+	handshake, err := ReadHandshake(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	metaInfo, err := lookup(handshake.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if metaInfo == nil {
+		return nil, ErrUnknownInfoHash
+	}
+
+	seeder := Seeder{
+		SeederInfo:      PeerInfo{PeerId: handshake.PeerId},
+		SeederWriter:    writer,
+		SeederReader:    reader,
+		MetaInfo:        metaInfo,
+		ClientId:        clientId,
+		RemoteHandshake: handshake,
+	}
+
+	// Answer with our side of the handshake
+	err = seeder.InitiateHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	return &seeder, nil
+}
+
+func encodePayload(message *PeerMessage) []byte {
+	buffer := bytes.NewBuffer([]byte{message.Type})
 
 	switch payload := message.Payload.(type) {
 	case RequestPayload:
@@ -155,9 +323,31 @@ func Send(writer io.Writer, message *PeerMessage) error {
 		binary.Write(buffer, binary.BigEndian, payload.Bitfield)
 	case CancelPayload:
 		binary.Write(buffer, binary.BigEndian, payload)
+	case SuggestPiecePayload:
+		binary.Write(buffer, binary.BigEndian, payload)
+	case RejectRequestPayload:
+		binary.Write(buffer, binary.BigEndian, payload)
+	case AllowedFastPayload:
+		binary.Write(buffer, binary.BigEndian, payload)
+	case ExtendedPayload:
+		buffer.WriteByte(payload.ExtendedId)
+		buffer.Write(payload.Payload)
 	}
 
-	bytesToSend := buffer.Bytes()
+	return buffer.Bytes()
+}
+
+func Send(writer io.Writer, message *PeerMessage) error {
+	var body []byte
+
+	// Keep alive is just a zero length prefix without message id.
+	if message.Type != KeepAlive {
+		body = encodePayload(message)
+	}
+
+	bytesToSend := make([]byte, lengthPrefixSize, lengthPrefixSize+len(body))
+	binary.BigEndian.PutUint32(bytesToSend, uint32(len(body)))
+	bytesToSend = append(bytesToSend, body...)
 
 	n, err := writer.Write(bytesToSend)
 	if err != nil {
@@ -172,63 +362,352 @@ func Send(writer io.Writer, message *PeerMessage) error {
 	return nil
 }
 
-func Receive(reader io.Reader, allocator func(msgType byte) []byte) (*PeerMessage, error) {
-	typeByte := make([]byte, 1)
-
-	n, err := reader.Read(typeByte)
-	if err != nil {
-		return nil, err
-	}
-
-	if n == 0 {
-		return &KeepAliveMessage, nil
-	}
+func decodePayload(msgType byte, body []byte) (any, error) {
+	reader := bytes.NewReader(body)
 
-	var payload any
+	switch msgType {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		if len(body) != 0 {
+			return nil, ErrInvalidMessageLength
+		}
 
-	// TODO
-	// Write this better
-
-	switch typeByte[0] {
-	case Choke:
-		return &ChokeMessage, nil
-	case Unchoke:
-		return &UnchokeMessage, nil
-	case Interested:
-		return &InterestedMessage, nil
-	case NotInterested:
-		return &NotInterestedMessage, nil
+		return nil, nil
 	case Have:
 		havePayload := HavePayload{}
+		if len(body) != binary.Size(havePayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
 		binary.Read(reader, binary.BigEndian, &havePayload)
-		payload = havePayload
-		break
+		return havePayload, nil
 	case Request:
 		rqPayload := RequestPayload{}
+		if len(body) != binary.Size(rqPayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
 		binary.Read(reader, binary.BigEndian, &rqPayload)
-		payload = rqPayload
-		break
+		return rqPayload, nil
 	case Cancel:
 		cancPayload := CancelPayload{}
+		if len(body) != binary.Size(cancPayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
 		binary.Read(reader, binary.BigEndian, &cancPayload)
-		payload = cancPayload
-		break
+		return cancPayload, nil
+	case SuggestPiece:
+		suggestPayload := SuggestPiecePayload{}
+		if len(body) != binary.Size(suggestPayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
+		binary.Read(reader, binary.BigEndian, &suggestPayload)
+		return suggestPayload, nil
+	case RejectRequest:
+		rejectPayload := RejectRequestPayload{}
+		if len(body) != binary.Size(rejectPayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
+		binary.Read(reader, binary.BigEndian, &rejectPayload)
+		return rejectPayload, nil
+	case AllowedFast:
+		allowedPayload := AllowedFastPayload{}
+		if len(body) != binary.Size(allowedPayload) {
+			return nil, ErrInvalidMessageLength
+		}
+
+		binary.Read(reader, binary.BigEndian, &allowedPayload)
+		return allowedPayload, nil
 	case Bitfield:
-		bfPayload := BitfieldPayload{Bitfield: allocator(typeByte[0])}
-		binary.Read(reader, binary.BigEndian, &bfPayload.Bitfield)
-		payload = bfPayload
-		break
+		return BitfieldPayload{Bitfield: body}, nil
 	case Piece:
-		piecePayload := PiecePayload{Piece: allocator(typeByte[0])}
-		binary.Read(reader, binary.BigEndian, &piecePayload.Index)
-		binary.Read(reader, binary.BigEndian, &piecePayload.Begin)
-		binary.Read(reader, binary.BigEndian, &piecePayload.Piece)
+		// Index and begin come before the block itself
+		if len(body) < 8 {
+			return nil, ErrInvalidMessageLength
+		}
+
+		piecePayload := PiecePayload{
+			Index: int32(binary.BigEndian.Uint32(body[0:4])),
+			Begin: int32(binary.BigEndian.Uint32(body[4:8])),
+			Piece: body[8:],
+		}
+
+		return piecePayload, nil
+	case Extended:
+		if len(body) < 1 {
+			return nil, ErrInvalidMessageLength
+		}
+
+		return ExtendedPayload{ExtendedId: body[0], Payload: body[1:]}, nil
+	}
+
+	return nil, ErrUnknownMessage
+}
+
+func Receive(reader io.Reader) (*PeerMessage, error) {
+	for {
+		lengthBytes := make([]byte, lengthPrefixSize)
+
+		_, err := io.ReadFull(reader, lengthBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(lengthBytes)
+		if length == 0 {
+			keepAlive := KeepAliveMessage
+			return &keepAlive, nil
+		}
+
+		if length > MaxMessageLength {
+			return nil, ErrMessageTooLong
+		}
+
+		body := make([]byte, length)
+
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return nil, err
+		}
+
+		msgType := body[0]
 
-		payload = piecePayload
-		break
+		payload, err := decodePayload(msgType, body[1:])
+		if err == ErrUnknownMessage {
+			// Whole message is already consumed, so just move on to the next one.
+			slog.Debug(fmt.Sprintf("Skipping unknown message id %d of length %d", msgType, length))
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &PeerMessage{Type: msgType, Payload: payload}, nil
 	}
+}
 
-	peerMsg := PeerMessage{Type: typeByte[0], Payload: payload}
+func hasPiece(bitfield []byte, index int) bool {
+	byteIndex := index / 8
+	if byteIndex >= len(bitfield) {
+		return false
+	}
 
-	return &peerMsg, nil
+	return bitfield[byteIndex]>>(7-index%8)&1 != 0
+}
+
+// Returns once we may request the piece, true if that is only because it is allowed fast.
+func (seeder *Seeder) waitForUnchoke(index int) (bool, error) {
+	// Fast Extension wants our availability first, we don't offer anything here
+	if seeder.fastExtension() && !seeder.availabilitySent {
+		err := seeder.SendAvailability(nil, 0)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err := Send(seeder.SeederWriter, &InterestedMessage)
+	if err != nil {
+		return false, err
+	}
+
+	available := false
+
+	for {
+		msg, err := Receive(seeder.SeederReader)
+		if err != nil {
+			return false, err
+		}
+
+		switch msg.Type {
+		case Bitfield:
+			// Peers that have nothing are allowed to skip the bitfield
+			if !hasPiece(msg.Payload.(BitfieldPayload).Bitfield, index) {
+				return false, ErrPieceNotAvailable
+			}
+
+			available = true
+		case HaveAll:
+			available = true
+		case HaveNone:
+			return false, ErrPieceNotAvailable
+		case Have:
+			if int(msg.Payload.(HavePayload).Index) == index {
+				available = true
+			}
+		case AllowedFast:
+			seeder.addAllowedFast(int(msg.Payload.(AllowedFastPayload).Index))
+		case Unchoke:
+			return false, nil
+		case Extended:
+			err = seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+			if err != nil {
+				return false, err
+			}
+		}
+
+		// Allowed fast pieces can be requested without waiting to be unchoked
+		if available && seeder.RemoteAllowedFast[index] {
+			return true, nil
+		}
+	}
+}
+
+func findRequest(pending []pendingRequest, index int32, begin int32) int {
+	for i := range pending {
+		if pending[i].request.Index == index && pending[i].request.Begin == begin {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Blocks are requested several at a time, see pipelineDepth. Rejected blocks are requested again,
+// unless the peer rejects the same block twice while we are allowed to request it.
+func (seeder *Seeder) DownloadPiece(index int, length int) ([]byte, error) {
+	choked, err := seeder.waitForUnchoke(index)
+	if err != nil {
+		return nil, err
+	}
+
+	piece := make([]byte, length)
+
+	defer seeder.clearRequestDeadline()
+
+	var pending []pendingRequest
+	var rejected []RequestPayload
+	refused := make(map[int32]bool)
+	nextBegin := 0
+	received := 0
+	lastActivity := time.Now()
+
+	// Gaps between pieces are not part of the throughput
+	seeder.pipelineStats.lastArrival = time.Time{}
+
+	for received < length {
+		canRequest := !choked || seeder.RemoteAllowedFast[index]
+
+		for canRequest && (len(rejected) > 0 || nextBegin < length) && len(pending) < seeder.pipelineDepth() {
+			var request RequestPayload
+			if len(rejected) > 0 {
+				request = rejected[0]
+				rejected = rejected[1:]
+			} else {
+				request = RequestPayload{Index: int32(index), Begin: int32(nextBegin), Length: int32(min(BlockSize, length-nextBegin))}
+				nextBegin += int(request.Length)
+			}
+
+			err := Send(seeder.SeederWriter, &PeerMessage{Type: Request, Payload: request})
+			if err != nil {
+				return nil, err
+			}
+
+			now := time.Now()
+			if seeder.pipelineStats.lastArrival.IsZero() {
+				seeder.pipelineStats.lastArrival = now
+			}
+
+			pending = append(pending, pendingRequest{request: request, sentAt: now})
+		}
+
+		seeder.setRequestDeadline(pending, lastActivity)
+
+		msg, err := Receive(seeder.SeederReader)
+		if isTimeout(err) {
+			seeder.requestsTimedOut()
+			seeder.cancelRequests(pending)
+			return nil, ErrRequestTimeout
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		lastActivity = time.Now()
+
+		switch msg.Type {
+		case Choke:
+			choked = true
+
+			if !seeder.fastExtension() {
+				seeder.cancelRequests(pending)
+				return nil, ErrChoked
+			}
+
+			// Allowed fast requests stay valid, others are still answered by a block or a reject
+			if !seeder.RemoteAllowedFast[index] {
+				err = seeder.cancelRequests(pending)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case Unchoke:
+			choked = false
+		case RejectRequest:
+			reject := msg.Payload.(RejectRequestPayload)
+
+			i := findRequest(pending, reject.Index, reject.Begin)
+			if i < 0 || pending[i].request != RequestPayload(reject) {
+				continue
+			}
+
+			pending = append(pending[:i], pending[i+1:]...)
+
+			// Rejected while it could be served means the peer won't serve it
+			if !choked || seeder.RemoteAllowedFast[index] {
+				if refused[reject.Begin] {
+					seeder.cancelRequests(pending)
+					return nil, ErrRequestRejected
+				}
+
+				refused[reject.Begin] = true
+			}
+
+			rejected = append(rejected, RequestPayload(reject))
+		case AllowedFast:
+			seeder.addAllowedFast(int(msg.Payload.(AllowedFastPayload).Index))
+		case Piece:
+			payload := msg.Payload.(PiecePayload)
+
+			// Blocks we are not waiting for anymore are skipped
+			i := findRequest(pending, payload.Index, payload.Begin)
+			if i < 0 {
+				continue
+			}
+
+			if len(payload.Piece) != int(pending[i].request.Length) {
+				return nil, ErrInvalidBlock
+			}
+
+			copy(piece[payload.Begin:], payload.Piece)
+			seeder.Downloaded += len(payload.Piece)
+			received += len(payload.Piece)
+
+			seeder.blockArrived(len(payload.Piece), pending[i].sentAt, lastActivity)
+			pending = append(pending[:i], pending[i+1:]...)
+		case Extended:
+			err = seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return piece, nil
+}
+
+func (seeder *Seeder) SendBlock(index int, begin int, block []byte) error {
+	msg := PeerMessage{Type: Piece, Payload: PiecePayload{Index: int32(index), Begin: int32(begin), Piece: block}}
+
+	err := Send(seeder.SeederWriter, &msg)
+	if err != nil {
+		return err
+	}
+
+	seeder.Uploaded += len(block)
+
+	return nil
 }
@@ -0,0 +1,466 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers close connections that were silent for two minutes, keep-alives are sent before that
+const DefaultKeepAliveInterval = 90 * time.Second
+const DefaultIdleTimeout = 3 * time.Minute
+
+// Messages received but not yet consumed from Events
+const peerEventBuffer = 64
+
+var ErrPeerConnClosed = errors.New("peer connection closed")
+var ErrPeerIdle = errors.New("peer connection idle for too long")
+var ErrDuplicateRequest = errors.New("block already requested")
+
+// Received message, the state of the connection is already updated when it is delivered.
+// Last event carries the reason the connection was closed instead of a message.
+type PeerEvent struct {
+	Message *PeerMessage
+	Err     error
+}
+
+type PeerConnState struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// Connection to one peer after the handshake, reads and writes happen on their own goroutines.
+// Seeder must not be used for sending or receiving once the connection is started.
+type PeerConn struct {
+	Seeder            *Seeder
+	Conn              io.ReadWriteCloser
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+
+	mutex      sync.Mutex
+	state      PeerConnState
+	pieceCount int
+	// Pieces the peer has
+	bitfield []byte
+	// Requests we sent and requests the peer sent us, both waiting for a block
+	outgoing map[RequestPayload]bool
+	incoming map[RequestPayload]bool
+
+	events    chan PeerEvent
+	writes    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+	idleTimer *time.Timer
+}
+
+// Queues writes of the seeder to the write goroutine, so extensions can keep using SeederWriter
+type peerConnWriter struct {
+	pc *PeerConn
+}
+
+func (w peerConnWriter) Write(data []byte) (int, error) {
+	frame := make([]byte, len(data))
+	copy(frame, data)
+
+	select {
+	case w.pc.writes <- frame:
+		return len(data), nil
+	case <-w.pc.done:
+		return 0, w.pc.Err()
+	}
+}
+
+func NewPeerConn(seeder *Seeder, conn io.ReadWriteCloser) *PeerConn {
+	pieceCount := 0
+	if seeder.MetaInfo != nil {
+		pieceCount = seeder.MetaInfo.GetPieceCount()
+	}
+
+	pc := PeerConn{
+		Seeder:            seeder,
+		Conn:              conn,
+		KeepAliveInterval: DefaultKeepAliveInterval,
+		IdleTimeout:       DefaultIdleTimeout,
+		// Both sides start out choked and not interested
+		state:      PeerConnState{AmChoking: true, PeerChoking: true},
+		pieceCount: pieceCount,
+		bitfield:   make([]byte, (pieceCount+7)/8),
+		outgoing:   make(map[RequestPayload]bool),
+		incoming:   make(map[RequestPayload]bool),
+		events:     make(chan PeerEvent, peerEventBuffer),
+		writes:     make(chan []byte),
+		done:       make(chan struct{}),
+	}
+
+	seeder.SeederReader = conn
+	seeder.SeederWriter = peerConnWriter{pc: &pc}
+
+	return &pc
+}
+
+// Starts the read and write goroutines, Events must be drained until it is closed.
+func (pc *PeerConn) Start() {
+	pc.mutex.Lock()
+	pc.idleTimer = time.AfterFunc(pc.IdleTimeout, func() {
+		pc.closeWithError(ErrPeerIdle)
+	})
+	pc.mutex.Unlock()
+
+	go pc.readLoop()
+	go pc.writeLoop()
+}
+
+func (pc *PeerConn) Events() <-chan PeerEvent {
+	return pc.events
+}
+
+func (pc *PeerConn) Close() error {
+	pc.closeWithError(ErrPeerConnClosed)
+	return nil
+}
+
+// Reason the connection was closed, nil while it is open.
+func (pc *PeerConn) Err() error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.err
+}
+
+func (pc *PeerConn) closeWithError(err error) {
+	pc.closeOnce.Do(func() {
+		pc.mutex.Lock()
+		pc.err = err
+
+		if pc.idleTimer != nil {
+			pc.idleTimer.Stop()
+		}
+		pc.mutex.Unlock()
+
+		close(pc.done)
+		pc.Conn.Close()
+	})
+}
+
+func (pc *PeerConn) readLoop() {
+	defer close(pc.events)
+
+	for {
+		msg, err := Receive(pc.Conn)
+		if err != nil {
+			pc.closeWithError(err)
+			pc.events <- PeerEvent{Err: pc.Err()}
+			return
+		}
+
+		pc.idleTimer.Reset(pc.IdleTimeout)
+
+		deliver, err := pc.handleMessage(msg)
+		if err != nil {
+			pc.closeWithError(err)
+			pc.events <- PeerEvent{Err: pc.Err()}
+			return
+		}
+
+		if !deliver || msg.Type == KeepAlive {
+			continue
+		}
+
+		select {
+		case pc.events <- PeerEvent{Message: msg}:
+		case <-pc.done:
+			pc.events <- PeerEvent{Err: pc.Err()}
+			return
+		}
+	}
+}
+
+func (pc *PeerConn) writeLoop() {
+	keepAlive := time.NewTimer(pc.KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var frame []byte
+
+		select {
+		case <-pc.done:
+			return
+		case frame = <-pc.writes:
+		case <-keepAlive.C:
+			frame = make([]byte, lengthPrefixSize)
+		}
+
+		_, err := pc.Conn.Write(frame)
+		if err != nil {
+			pc.closeWithError(err)
+			return
+		}
+
+		// Anything we write keeps the connection alive
+		if !keepAlive.Stop() {
+			select {
+			case <-keepAlive.C:
+			default:
+			}
+		}
+
+		keepAlive.Reset(pc.KeepAliveInterval)
+	}
+}
+
+func setPiece(bitfield []byte, index int) {
+	bitfield[index/8] |= 1 << (7 - index%8)
+}
+
+// Queues a request of the peer, unless we choke it or it already has too many waiting.
+func (pc *PeerConn) queueRequest(request RequestPayload) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if (pc.state.AmChoking && !pc.Seeder.AllowsFast(int(request.Index))) || len(pc.incoming) >= DefaultRequestQueue {
+		return false
+	}
+
+	pc.incoming[request] = true
+
+	return true
+}
+
+// Updates the state from a received message, false if the message is not delivered
+func (pc *PeerConn) handleMessage(msg *PeerMessage) (bool, error) {
+	// Handlers may send on the seeder, which only queues the write
+	if msg.Type == Extended {
+		return true, pc.Seeder.HandleExtended(msg.Payload.(ExtendedPayload))
+	}
+
+	if msg.Type == Request {
+		request := msg.Payload.(RequestPayload)
+		if !pc.queueRequest(request) {
+			return false, pc.Seeder.RejectRequest(request)
+		}
+
+		return true, nil
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	switch msg.Type {
+	case Choke:
+		pc.state.PeerChoking = true
+
+		// Without the Fast Extension choking drops every request we sent
+		if !pc.Seeder.fastExtension() {
+			pc.outgoing = make(map[RequestPayload]bool)
+		}
+	case Unchoke:
+		pc.state.PeerChoking = false
+	case Interested:
+		pc.state.PeerInterested = true
+	case NotInterested:
+		pc.state.PeerInterested = false
+	case Have:
+		index := int(msg.Payload.(HavePayload).Index)
+		if index >= 0 && index < pc.pieceCount {
+			setPiece(pc.bitfield, index)
+		}
+	case Bitfield:
+		copy(pc.bitfield, msg.Payload.(BitfieldPayload).Bitfield)
+	case HaveAll:
+		for index := 0; index < pc.pieceCount; index++ {
+			setPiece(pc.bitfield, index)
+		}
+	case HaveNone:
+		pc.bitfield = make([]byte, len(pc.bitfield))
+	case Cancel:
+		delete(pc.incoming, RequestPayload(msg.Payload.(CancelPayload)))
+	case Piece:
+		payload := msg.Payload.(PiecePayload)
+		request := RequestPayload{Index: payload.Index, Begin: payload.Begin, Length: int32(len(payload.Piece))}
+
+		// Blocks we did not ask for are not counted
+		if pc.outgoing[request] {
+			delete(pc.outgoing, request)
+			pc.Seeder.Downloaded += len(payload.Piece)
+		}
+	case RejectRequest:
+		delete(pc.outgoing, RequestPayload(msg.Payload.(RejectRequestPayload)))
+	case AllowedFast:
+		pc.Seeder.addAllowedFast(int(msg.Payload.(AllowedFastPayload).Index))
+	}
+
+	return true, nil
+}
+
+func (pc *PeerConn) send(msg *PeerMessage) error {
+	return Send(peerConnWriter{pc: pc}, msg)
+}
+
+func (pc *PeerConn) State() PeerConnState {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.state
+}
+
+func (pc *PeerConn) HasPiece(index int) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return hasPiece(pc.bitfield, index)
+}
+
+// Bytes of requested blocks received and bytes of blocks sent
+func (pc *PeerConn) Transferred() (int, int) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return pc.Seeder.Downloaded, pc.Seeder.Uploaded
+}
+
+func sortedRequests(requests map[RequestPayload]bool) []RequestPayload {
+	sorted := make([]RequestPayload, 0, len(requests))
+	for request := range requests {
+		sorted = append(sorted, request)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Index != sorted[j].Index {
+			return sorted[i].Index < sorted[j].Index
+		}
+
+		return sorted[i].Begin < sorted[j].Begin
+	})
+
+	return sorted
+}
+
+// Requests we sent that are neither served nor rejected yet
+func (pc *PeerConn) Outgoing() []RequestPayload {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return sortedRequests(pc.outgoing)
+}
+
+// Requests of the peer we have not answered yet
+func (pc *PeerConn) Incoming() []RequestPayload {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	return sortedRequests(pc.incoming)
+}
+
+// Choking the peer drops its requests, with the Fast Extension each of them is rejected.
+func (pc *PeerConn) Choke() error {
+	pc.mutex.Lock()
+	pc.state.AmChoking = true
+
+	// Allowed fast requests are still served
+	var dropped []RequestPayload
+	for _, request := range sortedRequests(pc.incoming) {
+		if !pc.Seeder.AllowsFast(int(request.Index)) {
+			delete(pc.incoming, request)
+			dropped = append(dropped, request)
+		}
+	}
+	pc.mutex.Unlock()
+
+	err := pc.send(&ChokeMessage)
+	if err != nil {
+		return err
+	}
+
+	for _, request := range dropped {
+		err = pc.Seeder.RejectRequest(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pc *PeerConn) Unchoke() error {
+	pc.mutex.Lock()
+	pc.state.AmChoking = false
+	pc.mutex.Unlock()
+
+	return pc.send(&UnchokeMessage)
+}
+
+func (pc *PeerConn) Interested() error {
+	pc.mutex.Lock()
+	pc.state.AmInterested = true
+	pc.mutex.Unlock()
+
+	return pc.send(&InterestedMessage)
+}
+
+func (pc *PeerConn) NotInterested() error {
+	pc.mutex.Lock()
+	pc.state.AmInterested = false
+	pc.mutex.Unlock()
+
+	return pc.send(&NotInterestedMessage)
+}
+
+func (pc *PeerConn) Have(index int) error {
+	return pc.send(&PeerMessage{Type: Have, Payload: HavePayload{Index: int32(index)}})
+}
+
+// Requests are only sent while unchoked, or for pieces the peer allowed us to fetch fast.
+func (pc *PeerConn) Request(request RequestPayload) error {
+	pc.mutex.Lock()
+
+	if pc.state.PeerChoking && !pc.Seeder.RemoteAllowedFast[int(request.Index)] {
+		pc.mutex.Unlock()
+		return ErrChoked
+	}
+
+	if pc.outgoing[request] {
+		pc.mutex.Unlock()
+		return ErrDuplicateRequest
+	}
+
+	pc.outgoing[request] = true
+	pc.mutex.Unlock()
+
+	return pc.send(&PeerMessage{Type: Request, Payload: request})
+}
+
+func (pc *PeerConn) Cancel(request RequestPayload) error {
+	pc.mutex.Lock()
+	delete(pc.outgoing, request)
+	pc.mutex.Unlock()
+
+	return pc.send(&PeerMessage{Type: Cancel, Payload: CancelPayload(request)})
+}
+
+// Answers a request of the peer, false if it was cancelled or dropped in the meantime.
+func (pc *PeerConn) SendBlock(request RequestPayload, block []byte) (bool, error) {
+	pc.mutex.Lock()
+	if !pc.incoming[request] {
+		pc.mutex.Unlock()
+		return false, nil
+	}
+
+	delete(pc.incoming, request)
+	pc.Seeder.Uploaded += len(block)
+	pc.mutex.Unlock()
+
+	return true, pc.send(&PeerMessage{Type: Piece, Payload: PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+}
+
+func (pc *PeerConn) RejectRequest(request RequestPayload) error {
+	pc.mutex.Lock()
+	delete(pc.incoming, request)
+	pc.mutex.Unlock()
+
+	return pc.Seeder.RejectRequest(request)
+}
@@ -0,0 +1,393 @@
+package torrent
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connection to a torrent of 10 pieces, remote is the side of the peer
+func startPeerConn(handshake *Handshake) (*PeerConn, net.Conn) {
+	local, remote := net.Pipe()
+
+	metaInfo := MetaInfo{Info: GeneralInfo{PieceLength: BlockSize, Pieces: strings.Repeat("x", 10*pieceHashSize)}}
+	seeder := Seeder{MetaInfo: &metaInfo, RemoteHandshake: handshake}
+
+	pc := NewPeerConn(&seeder, local)
+	pc.Start()
+
+	return pc, remote
+}
+
+// Waits for the event of the message type, earlier ones are skipped
+func waitForEvent(pc *PeerConn, msgType byte, t *testing.T) *PeerEvent {
+	for event := range pc.Events() {
+		if event.Err != nil {
+			t.Errorf("Connection closed while waiting for %d: %v", msgType, event.Err)
+			return nil
+		}
+
+		if event.Message.Type == msgType {
+			return &event
+		}
+	}
+
+	t.Errorf("Events closed while waiting for %d", msgType)
+	return nil
+}
+
+func waitForClose(pc *PeerConn) error {
+	var err error
+	for event := range pc.Events() {
+		err = event.Err
+	}
+
+	return err
+}
+
+func TestPeerConnRemoteState(t *testing.T) {
+	pc, remote := startPeerConn(&Handshake{})
+	defer pc.Close()
+
+	if pc.State() != (PeerConnState{AmChoking: true, PeerChoking: true}) {
+		t.Errorf("Expected both sides to start choked %#v", pc.State())
+	}
+
+	go func() {
+		Send(remote, &PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{0x80, 0}}})
+		Send(remote, &PeerMessage{Type: Have, Payload: HavePayload{Index: 9}})
+		Send(remote, &InterestedMessage)
+		Send(remote, &UnchokeMessage)
+	}()
+
+	waitForEvent(pc, Unchoke, t)
+
+	if pc.State() != (PeerConnState{AmChoking: true, PeerChoking: false, PeerInterested: true}) {
+		t.Errorf("Expected remote state to be tracked %#v", pc.State())
+	}
+
+	if !pc.HasPiece(0) || !pc.HasPiece(9) || pc.HasPiece(1) {
+		t.Errorf("Expected pieces 0 and 9 to be available %v", pc.bitfield)
+	}
+
+	go Send(remote, &HaveNoneMessage)
+	waitForEvent(pc, HaveNone, t)
+
+	if pc.HasPiece(0) {
+		t.Errorf("Expected no pieces after have none")
+	}
+}
+
+func TestPeerConnOutgoingRequests(t *testing.T) {
+	pc, remote := startPeerConn(&Handshake{})
+	defer pc.Close()
+
+	request := RequestPayload{Index: 1, Begin: 0, Length: 4}
+
+	err := pc.Request(request)
+	if err != ErrChoked {
+		t.Errorf("Expected ErrChoked while choked, got %v", err)
+	}
+
+	go Send(remote, &UnchokeMessage)
+	waitForEvent(pc, Unchoke, t)
+
+	other := RequestPayload{Index: 2, Begin: 0, Length: 4}
+
+	go func() {
+		pc.Request(request)
+		pc.Request(other)
+	}()
+
+	for _, wanted := range []RequestPayload{request, other} {
+		msg, err := Receive(remote)
+		if err != nil || msg.Type != Request || msg.Payload.(RequestPayload) != wanted {
+			t.Errorf("Expected request %#v, got %#v %v", wanted, msg, err)
+			return
+		}
+	}
+
+	if err := pc.Request(request); err != ErrDuplicateRequest {
+		t.Errorf("Expected ErrDuplicateRequest, got %v", err)
+	}
+
+	go Send(remote, &PeerMessage{Type: Piece, Payload: PiecePayload{Index: 1, Begin: 0, Piece: []byte{1, 2, 3, 4}}})
+	waitForEvent(pc, Piece, t)
+
+	if !reflect.DeepEqual(pc.Outgoing(), []RequestPayload{other}) {
+		t.Errorf("Expected only the unanswered request to be outstanding %#v", pc.Outgoing())
+	}
+
+	if downloaded, _ := pc.Transferred(); downloaded != 4 {
+		t.Errorf("Expected 4 bytes downloaded, got %d", downloaded)
+	}
+
+	// Choke drops the rest without the Fast Extension
+	go Send(remote, &ChokeMessage)
+	waitForEvent(pc, Choke, t)
+
+	if len(pc.Outgoing()) != 0 || !pc.State().PeerChoking {
+		t.Errorf("Expected choke to drop requests %#v", pc.Outgoing())
+	}
+}
+
+func TestPeerConnRejectReleasesRequest(t *testing.T) {
+	pc, remote := startPeerConn(fastReservedHandshake)
+	defer pc.Close()
+
+	request := RequestPayload{Index: 3, Begin: 0, Length: 4}
+
+	go Send(remote, &PeerMessage{Type: AllowedFast, Payload: AllowedFastPayload{Index: 3}})
+	waitForEvent(pc, AllowedFast, t)
+
+	// Allowed fast pieces can be requested while choked
+	go pc.Request(request)
+
+	msg, err := Receive(remote)
+	if err != nil || msg.Type != Request {
+		t.Errorf("Expected request, got %#v %v", msg, err)
+		return
+	}
+
+	// Reject is only sent once the state after the choke was checked
+	chokeChecked := make(chan struct{})
+	go func() {
+		Send(remote, &ChokeMessage)
+		<-chokeChecked
+		Send(remote, &PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(request)})
+	}()
+
+	waitForEvent(pc, Choke, t)
+
+	// Choke alone keeps requests with the Fast Extension
+	if len(pc.Outgoing()) != 1 {
+		t.Errorf("Expected request to be kept on choke %#v", pc.Outgoing())
+	}
+
+	close(chokeChecked)
+
+	waitForEvent(pc, RejectRequest, t)
+
+	if len(pc.Outgoing()) != 0 {
+		t.Errorf("Expected reject to release request %#v", pc.Outgoing())
+	}
+}
+
+func TestPeerConnIncomingRequests(t *testing.T) {
+	pc, remote := startPeerConn(fastReservedHandshake)
+	defer pc.Close()
+
+	served := RequestPayload{Index: 0, Begin: 0, Length: 2}
+	cancelled := RequestPayload{Index: 0, Begin: 2, Length: 2}
+	rejected := RequestPayload{Index: 1, Begin: 0, Length: 2}
+
+	go pc.Unchoke()
+
+	msg, err := Receive(remote)
+	if err != nil || msg.Type != Unchoke {
+		t.Errorf("Expected unchoke, got %#v %v", msg, err)
+		return
+	}
+
+	go func() {
+		Send(remote, &PeerMessage{Type: Request, Payload: served})
+		Send(remote, &PeerMessage{Type: Request, Payload: cancelled})
+		Send(remote, &PeerMessage{Type: Request, Payload: rejected})
+		Send(remote, &PeerMessage{Type: Cancel, Payload: CancelPayload(cancelled)})
+	}()
+
+	waitForEvent(pc, Cancel, t)
+
+	if !reflect.DeepEqual(pc.Incoming(), []RequestPayload{served, rejected}) {
+		t.Errorf("Expected cancelled request to be dropped %#v", pc.Incoming())
+		return
+	}
+
+	go func() {
+		pc.SendBlock(served, []byte{7, 8})
+		pc.Choke()
+	}()
+
+	expected := []PeerMessage{
+		{Type: Piece, Payload: PiecePayload{Index: 0, Begin: 0, Piece: []byte{7, 8}}},
+		ChokeMessage,
+		{Type: RejectRequest, Payload: RejectRequestPayload(rejected)},
+	}
+
+	for i := range expected {
+		msg, err = Receive(remote)
+		if err != nil || !reflect.DeepEqual(*msg, expected[i]) {
+			t.Errorf("Expected %#v, got %#v %v", expected[i], msg, err)
+			return
+		}
+	}
+
+	sent, err := pc.SendBlock(cancelled, []byte{1, 2})
+	if sent || err != nil {
+		t.Errorf("Did not expect cancelled block to be sent %v", err)
+	}
+
+	if _, uploaded := pc.Transferred(); uploaded != 2 {
+		t.Errorf("Expected 2 bytes uploaded, got %d", uploaded)
+	}
+}
+
+func TestPeerConnRefusedRequests(t *testing.T) {
+	pc, remote := startPeerConn(fastReservedHandshake)
+	defer pc.Close()
+
+	choked := RequestPayload{Index: 0, Begin: 0, Length: 2}
+
+	go Send(remote, &PeerMessage{Type: Request, Payload: choked})
+
+	msg, err := Receive(remote)
+	if err != nil || !reflect.DeepEqual(*msg, PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(choked)}) {
+		t.Errorf("Expected request to be rejected while choked, got %#v %v", msg, err)
+		return
+	}
+
+	go pc.Unchoke()
+	Receive(remote)
+
+	// Queued requests are delivered, nobody answers them here
+	go func() {
+		for range pc.Events() {
+		}
+	}()
+
+	go func() {
+		for begin := 0; begin <= DefaultRequestQueue; begin++ {
+			Send(remote, &PeerMessage{Type: Request, Payload: RequestPayload{Index: 1, Begin: int32(begin), Length: 1}})
+		}
+	}()
+
+	overflow := RequestPayload{Index: 1, Begin: DefaultRequestQueue, Length: 1}
+
+	msg, err = Receive(remote)
+	if err != nil || !reflect.DeepEqual(*msg, PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(overflow)}) {
+		t.Errorf("Expected request beyond the queue to be rejected, got %#v %v", msg, err)
+		return
+	}
+
+	if len(pc.Incoming()) != DefaultRequestQueue {
+		t.Errorf("Expected %d queued requests, got %d", DefaultRequestQueue, len(pc.Incoming()))
+	}
+}
+
+func TestPeerConnAllowedFastWhileChoked(t *testing.T) {
+	pc, remote := startPeerConn(fastReservedHandshake)
+	defer pc.Close()
+
+	pc.Seeder.AllowedFast = map[int]bool{2: true}
+
+	allowed := RequestPayload{Index: 2, Begin: 0, Length: 2}
+	choked := RequestPayload{Index: 3, Begin: 0, Length: 2}
+
+	go func() {
+		Send(remote, &PeerMessage{Type: Request, Payload: allowed})
+		Send(remote, &PeerMessage{Type: Request, Payload: choked})
+	}()
+
+	msg, err := Receive(remote)
+	if err != nil || !reflect.DeepEqual(*msg, PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload(choked)}) {
+		t.Errorf("Expected only the choked request to be rejected, got %#v %v", msg, err)
+		return
+	}
+
+	if event := waitForEvent(pc, Request, t); event == nil || event.Message.Payload.(RequestPayload) != allowed {
+		t.Errorf("Expected allowed fast request to be delivered %#v", event)
+		return
+	}
+
+	go func() {
+		pc.Unchoke()
+		pc.Choke()
+		pc.SendBlock(allowed, []byte{7, 8})
+	}()
+
+	expected := []PeerMessage{
+		UnchokeMessage,
+		ChokeMessage,
+		{Type: Piece, Payload: PiecePayload{Index: 2, Begin: 0, Piece: []byte{7, 8}}},
+	}
+
+	for i := range expected {
+		msg, err = Receive(remote)
+		if err != nil || !reflect.DeepEqual(*msg, expected[i]) {
+			t.Errorf("Expected %#v, got %#v %v", expected[i], msg, err)
+			return
+		}
+	}
+}
+
+func TestPeerConnKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+
+	pc := NewPeerConn(&Seeder{}, local)
+	pc.KeepAliveInterval = 10 * time.Millisecond
+	pc.Start()
+	defer pc.Close()
+
+	msg, err := Receive(remote)
+	if err != nil || msg.Type != KeepAlive {
+		t.Errorf("Expected keep alive, got %#v %v", msg, err)
+	}
+}
+
+func TestPeerConnIdle(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	pc := NewPeerConn(&Seeder{}, local)
+	pc.IdleTimeout = 20 * time.Millisecond
+	pc.Start()
+
+	// Our own keep alives don't count, only what the peer sends
+	go func() {
+		for {
+			if _, err := Receive(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := waitForClose(pc); err != ErrPeerIdle {
+		t.Errorf("Expected ErrPeerIdle, got %v", err)
+	}
+}
+
+func TestPeerConnClose(t *testing.T) {
+	pc, remote := startPeerConn(&Handshake{})
+	defer remote.Close()
+
+	pc.Close()
+
+	if err := waitForClose(pc); err != ErrPeerConnClosed {
+		t.Errorf("Expected ErrPeerConnClosed, got %v", err)
+	}
+
+	if err := pc.Interested(); err != ErrPeerConnClosed {
+		t.Errorf("Expected sending on closed connection to fail, got %v", err)
+	}
+}
+
+func TestPeerConnExtensionHandshakeWhileSending(t *testing.T) {
+	pc, remote := startPeerConn(extensionReservedHandshake)
+	defer pc.Close()
+
+	handshake, _ := EncodeExtensionHandshake(&ExtensionHandshake{M: map[string]int{"ut_pex": 1}, RequestQueue: 10})
+
+	go Send(remote, &PeerMessage{Type: Extended, Payload: ExtendedPayload{ExtendedId: ExtendedHandshakeId, Payload: handshake}})
+
+	// Negotiated extensions are read while the read goroutine stores them
+	for !pc.Seeder.SupportsExtension("ut_pex") {
+		pc.Seeder.pipelineLimit()
+		time.Sleep(time.Millisecond)
+	}
+
+	if pc.Seeder.pipelineLimit() != 10 {
+		t.Errorf("Expected reqq of the peer to limit the pipeline, got %d", pc.Seeder.pipelineLimit())
+	}
+}
@@ -2,6 +2,8 @@ package torrent
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"reflect"
 	"testing"
 )
@@ -9,7 +11,7 @@ import (
 func TestInitiatingHandshake(t *testing.T) {
 	writeBuffer := bytes.NewBuffer([]byte{})
 
-	seeder := Seeder{SeederInfo: PeerInfo{PeerId: GenerateRandomProtocolId()}, SeederWriter: writeBuffer, MetaInfo: &MetaInfo{infoHash: GenerateRandomProtocolId()}}
+	seeder := Seeder{SeederInfo: PeerInfo{PeerId: GenerateRandomProtocolId()}, SeederWriter: writeBuffer, MetaInfo: &MetaInfo{infoHash: GenerateRandomProtocolId()}, ClientId: GenerateRandomProtocolId()}
 
 	err := seeder.InitiateHandshake()
 
@@ -22,9 +24,9 @@ func TestInitiatingHandshake(t *testing.T) {
 		bytes []byte
 	}{
 		{"Protocol", []byte(HandshakeMsg)},
-		{"Reserved", make([]byte, 8)},
+		{"Reserved", []byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}},
 		{"Infohash", seeder.MetaInfo.GetInfoHash()},
-		{"PeerId", seeder.SeederInfo.PeerId},
+		{"PeerId", seeder.ClientId},
 	}
 
 	for i := range expectingSequence {
@@ -47,6 +49,121 @@ func TestInitiatingHandshake(t *testing.T) {
 	}
 }
 
+func buildHandshake(pstr string, reserved []byte, infoHash []byte, peerId []byte) []byte {
+	handshake := []byte{byte(len(pstr))}
+	handshake = append(handshake, []byte(pstr)...)
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, infoHash...)
+	handshake = append(handshake, peerId...)
+
+	return handshake
+}
+
+type receiveHandshakeTestCase struct {
+	name          string
+	knownPeerId   []byte
+	handshake     []byte
+	wantedError   error
+	wantExtension bool
+}
+
+func TestReceiveHandshake(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+	peerId := GenerateRandomProtocolId()
+	extensionReserved := []byte{0, 0, 0, 0, 0, 0x10, 0, 0}
+
+	testCases := []receiveHandshakeTestCase{
+		{"Valid", peerId, buildHandshake("BitTorrent protocol", make([]byte, 8), infoHash, peerId), nil, false},
+		{"Peer id unknown", nil, buildHandshake("BitTorrent protocol", extensionReserved, infoHash, peerId), nil, true},
+		{"Wrong protocol", peerId, buildHandshake("BitTorrent protocal", make([]byte, 8), infoHash, peerId), ErrInvalidProtocol, false},
+		{"Wrong info hash", peerId, buildHandshake("BitTorrent protocol", make([]byte, 8), GenerateRandomProtocolId(), peerId), ErrInfoHashMismatch, false},
+		{"Wrong peer id", peerId, buildHandshake("BitTorrent protocol", make([]byte, 8), infoHash, GenerateRandomProtocolId()), ErrPeerIdMismatch, false},
+		{"Truncated", peerId, buildHandshake("BitTorrent protocol", make([]byte, 8), infoHash, nil), io.ErrUnexpectedEOF, false},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			seeder := Seeder{
+				SeederInfo:   PeerInfo{PeerId: testCase.knownPeerId},
+				SeederReader: bytes.NewBuffer(testCase.handshake),
+				MetaInfo:     &MetaInfo{infoHash: infoHash},
+			}
+
+			handshake, err := seeder.ReceiveHandshake()
+			if err != testCase.wantedError {
+				t.Errorf("Wanted error %v, got %v", testCase.wantedError, err)
+				return
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(seeder.SeederInfo.PeerId, peerId) {
+				t.Errorf("Peer id not set %#v", seeder.SeederInfo.PeerId)
+			}
+
+			if seeder.RemoteHandshake != handshake {
+				t.Errorf("Remote handshake not stored")
+			}
+
+			if handshake.SupportsExtensionProtocol() != testCase.wantExtension {
+				t.Errorf("Wanted extension support %v", testCase.wantExtension)
+			}
+		})
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	metaInfo := &MetaInfo{infoHash: GenerateRandomProtocolId()}
+	clientId := GenerateRandomProtocolId()
+	peerId := GenerateRandomProtocolId()
+
+	lookup := func(infoHash []byte) (*MetaInfo, error) {
+		if bytes.Equal(infoHash, metaInfo.GetInfoHash()) {
+			return metaInfo, nil
+		}
+
+		return nil, nil
+	}
+
+	t.Run("Known torrent", func(t *testing.T) {
+		reader := bytes.NewBuffer(buildHandshake("BitTorrent protocol", make([]byte, 8), metaInfo.GetInfoHash(), peerId))
+		writer := bytes.NewBuffer([]byte{})
+
+		seeder, err := AcceptHandshake(reader, writer, clientId, lookup)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			return
+		}
+
+		if seeder.MetaInfo != metaInfo || !reflect.DeepEqual(seeder.SeederInfo.PeerId, peerId) {
+			t.Errorf("Seeder not set properly %#v", seeder)
+		}
+
+		answer := buildHandshake("BitTorrent protocol", []byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}, metaInfo.GetInfoHash(), clientId)
+		if !reflect.DeepEqual(writer.Bytes(), answer) {
+			t.Errorf("Expected answer %#v, got %#v", answer, writer.Bytes())
+		}
+	})
+
+	t.Run("Unknown torrent", func(t *testing.T) {
+		reader := bytes.NewBuffer(buildHandshake("BitTorrent protocol", make([]byte, 8), GenerateRandomProtocolId(), peerId))
+		writer := bytes.NewBuffer([]byte{})
+
+		_, err := AcceptHandshake(reader, writer, clientId, lookup)
+		if err != ErrUnknownInfoHash {
+			t.Errorf("Expected %v, got %v", ErrUnknownInfoHash, err)
+		}
+
+		if writer.Len() != 0 {
+			t.Errorf("Did not expect handshake to be answered")
+		}
+	})
+}
+
 type peerMsgSendTestCase struct {
 	name        string
 	msg         PeerMessage
@@ -56,15 +173,22 @@ type peerMsgSendTestCase struct {
 
 func TestSend(t *testing.T) {
 	testCases := []peerMsgSendTestCase{
-		{"Choke send", ChokeMessage, []byte{Choke}, nil},
-		{"Unchoke send", UnchokeMessage, []byte{Unchoke}, nil},
-		{"Interested send", InterestedMessage, []byte{Interested}, nil},
-		{"Not interested send", NotInterestedMessage, []byte{NotInterested}, nil},
-		{"Keepalive send", KeepAliveMessage, []byte{}, nil},
-		{"Bitfield send", PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{1, 2, 3, 4}}}, []byte{5, 1, 2, 3, 4}, nil},
-		{"Request send", PeerMessage{Type: Request, Payload: RequestPayload{Index: 0, Begin: 1, Length: 5}}, []byte{6, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, nil},
-		{"Piece send", PeerMessage{Type: Piece, Payload: PiecePayload{Index: 0, Begin: 0, Piece: []byte{1, 2, 3, 4, 5}}}, []byte{7, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5}, nil},
-		{"Cancel send", PeerMessage{Type: Cancel, Payload: CancelPayload{Index: 0, Begin: 1, Length: 5}}, []byte{8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, nil},
+		{"Choke send", ChokeMessage, []byte{0, 0, 0, 1, Choke}, nil},
+		{"Unchoke send", UnchokeMessage, []byte{0, 0, 0, 1, Unchoke}, nil},
+		{"Interested send", InterestedMessage, []byte{0, 0, 0, 1, Interested}, nil},
+		{"Not interested send", NotInterestedMessage, []byte{0, 0, 0, 1, NotInterested}, nil},
+		{"Keepalive send", KeepAliveMessage, []byte{0, 0, 0, 0}, nil},
+		{"Have send", PeerMessage{Type: Have, Payload: HavePayload{Index: 7}}, []byte{0, 0, 0, 5, 4, 0, 0, 0, 7}, nil},
+		{"Bitfield send", PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{1, 2, 3, 4}}}, []byte{0, 0, 0, 5, 5, 1, 2, 3, 4}, nil},
+		{"Request send", PeerMessage{Type: Request, Payload: RequestPayload{Index: 0, Begin: 1, Length: 5}}, []byte{0, 0, 0, 13, 6, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, nil},
+		{"Piece send", PeerMessage{Type: Piece, Payload: PiecePayload{Index: 0, Begin: 0, Piece: []byte{1, 2, 3, 4, 5}}}, []byte{0, 0, 0, 14, 7, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5}, nil},
+		{"Extended send", PeerMessage{Type: Extended, Payload: ExtendedPayload{ExtendedId: 3, Payload: []byte("de")}}, []byte{0, 0, 0, 4, Extended, 3, 'd', 'e'}, nil},
+		{"Cancel send", PeerMessage{Type: Cancel, Payload: CancelPayload{Index: 0, Begin: 1, Length: 5}}, []byte{0, 0, 0, 13, 8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, nil},
+		{"Have all send", HaveAllMessage, []byte{0, 0, 0, 1, HaveAll}, nil},
+		{"Have none send", HaveNoneMessage, []byte{0, 0, 0, 1, HaveNone}, nil},
+		{"Suggest piece send", PeerMessage{Type: SuggestPiece, Payload: SuggestPiecePayload{Index: 7}}, []byte{0, 0, 0, 5, SuggestPiece, 0, 0, 0, 7}, nil},
+		{"Reject request send", PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload{Index: 0, Begin: 1, Length: 5}}, []byte{0, 0, 0, 13, RejectRequest, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, nil},
+		{"Allowed fast send", PeerMessage{Type: AllowedFast, Payload: AllowedFastPayload{Index: 3}}, []byte{0, 0, 0, 5, AllowedFast, 0, 0, 0, 3}, nil},
 	}
 
 	for i := range testCases {
@@ -95,15 +219,29 @@ type peerMsgReceiveTestCase struct {
 
 func TestReceive(t *testing.T) {
 	testCases := []peerMsgReceiveTestCase{
-		{"Choke recv", []byte{Choke}, ChokeMessage, nil},
-		{"Unchoke recv", []byte{Unchoke}, UnchokeMessage, nil},
-		{"Interested recv", []byte{Interested}, InterestedMessage, nil},
-		{"Not interested recv", []byte{NotInterested}, NotInterestedMessage, nil},
-		// {"Keepalive recv", []byte{}, KeepAliveMessage, nil},
-		{"Bitfield recv", []byte{5, 1, 2, 3, 4}, PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{1, 2, 3, 4}}}, nil},
-		{"Request recv", []byte{6, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, PeerMessage{Type: Request, Payload: RequestPayload{Index: 0, Begin: 1, Length: 5}}, nil},
-		{"Piece recv", []byte{7, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4, 5}, PeerMessage{Type: Piece, Payload: PiecePayload{Index: 0, Begin: 1, Piece: []byte{1, 2, 3, 4, 5}}}, nil},
-		{"Cancel recv", []byte{8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, PeerMessage{Type: Cancel, Payload: CancelPayload{Index: 0, Begin: 1, Length: 5}}, nil},
+		{"Choke recv", []byte{0, 0, 0, 1, Choke}, ChokeMessage, nil},
+		{"Unchoke recv", []byte{0, 0, 0, 1, Unchoke}, UnchokeMessage, nil},
+		{"Interested recv", []byte{0, 0, 0, 1, Interested}, InterestedMessage, nil},
+		{"Not interested recv", []byte{0, 0, 0, 1, NotInterested}, NotInterestedMessage, nil},
+		{"Keepalive recv", []byte{0, 0, 0, 0}, KeepAliveMessage, nil},
+		{"Have recv", []byte{0, 0, 0, 5, 4, 0, 0, 0, 7}, PeerMessage{Type: Have, Payload: HavePayload{Index: 7}}, nil},
+		{"Bitfield recv", []byte{0, 0, 0, 5, 5, 1, 2, 3, 4}, PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: []byte{1, 2, 3, 4}}}, nil},
+		{"Request recv", []byte{0, 0, 0, 13, 6, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, PeerMessage{Type: Request, Payload: RequestPayload{Index: 0, Begin: 1, Length: 5}}, nil},
+		{"Piece recv", []byte{0, 0, 0, 14, 7, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4, 5}, PeerMessage{Type: Piece, Payload: PiecePayload{Index: 0, Begin: 1, Piece: []byte{1, 2, 3, 4, 5}}}, nil},
+		{"Cancel recv", []byte{0, 0, 0, 13, 8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, PeerMessage{Type: Cancel, Payload: CancelPayload{Index: 0, Begin: 1, Length: 5}}, nil},
+		{"Extended recv", []byte{0, 0, 0, 4, Extended, 3, 'd', 'e'}, PeerMessage{Type: Extended, Payload: ExtendedPayload{ExtendedId: 3, Payload: []byte("de")}}, nil},
+		{"Have all recv", []byte{0, 0, 0, 1, HaveAll}, HaveAllMessage, nil},
+		{"Have none recv", []byte{0, 0, 0, 1, HaveNone}, HaveNoneMessage, nil},
+		{"Suggest piece recv", []byte{0, 0, 0, 5, SuggestPiece, 0, 0, 0, 7}, PeerMessage{Type: SuggestPiece, Payload: SuggestPiecePayload{Index: 7}}, nil},
+		{"Reject request recv", []byte{0, 0, 0, 13, RejectRequest, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 5}, PeerMessage{Type: RejectRequest, Payload: RejectRequestPayload{Index: 0, Begin: 1, Length: 5}}, nil},
+		{"Allowed fast recv", []byte{0, 0, 0, 5, AllowedFast, 0, 0, 0, 3}, PeerMessage{Type: AllowedFast, Payload: AllowedFastPayload{Index: 3}}, nil},
+		{"Have all with payload", []byte{0, 0, 0, 2, HaveAll, 1}, PeerMessage{}, ErrInvalidMessageLength},
+		{"Allowed fast too short", []byte{0, 0, 0, 3, AllowedFast, 0, 0}, PeerMessage{}, ErrInvalidMessageLength},
+		{"Extended without id", []byte{0, 0, 0, 1, Extended}, PeerMessage{}, ErrInvalidMessageLength},
+		{"Unknown skipped", []byte{0, 0, 0, 3, 99, 1, 2, 0, 0, 0, 1, Unchoke}, UnchokeMessage, nil},
+		{"Have too short", []byte{0, 0, 0, 3, 4, 0, 0}, PeerMessage{}, ErrInvalidMessageLength},
+		{"Too long", []byte{0xFF, 0, 0, 0, 7}, PeerMessage{}, ErrMessageTooLong},
+		{"Truncated", []byte{0, 0, 0, 5, 5, 1, 2}, PeerMessage{}, io.ErrUnexpectedEOF},
 	}
 
 	for i := range testCases {
@@ -111,16 +249,12 @@ func TestReceive(t *testing.T) {
 
 		writer.Write(testCases[i].bytesToReceive)
 
-		msg, err := Receive(writer, func(msgType byte) []byte {
-			switch msgType {
-			case Bitfield:
-				return make([]byte, 4)
-			case Piece:
-				return make([]byte, 5)
-			default:
-				return nil
-			}
-		})
+		msg, err := Receive(writer)
+
+		if err == nil && testCases[i].wantedError != nil {
+			t.Errorf("%s wanted error %#v, but got none", testCases[i].name, testCases[i].wantedError)
+			continue
+		}
 
 		if err == nil {
 			if !reflect.DeepEqual(testCases[i].peerMsg, *msg) {
@@ -135,3 +269,136 @@ func TestReceive(t *testing.T) {
 		}
 	}
 }
+
+// Connected TCP pair, net.Pipe would block while both sides write several messages
+func loopbackPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect %v", err)
+	}
+
+	remote := <-accepted
+	if remote == nil {
+		t.Fatalf("Could not accept connection")
+	}
+
+	return local, remote
+}
+
+type downloadPieceTestCase struct {
+	name        string
+	bitfield    []byte
+	chokeAfter  int
+	wantedError error
+}
+
+func serveBlocks(conn net.Conn, data []byte, bitfield []byte, chokeAfter int) {
+	defer conn.Close()
+
+	served := 0
+
+	for {
+		msg, err := Receive(conn)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case Interested:
+			// Answer only once we got something
+			Send(conn, &PeerMessage{Type: Bitfield, Payload: BitfieldPayload{Bitfield: bitfield}})
+			Send(conn, &UnchokeMessage)
+		case Request:
+			if served == chokeAfter {
+				Send(conn, &ChokeMessage)
+				continue
+			}
+
+			request := msg.Payload.(RequestPayload)
+			block := data[request.Begin : request.Begin+request.Length]
+
+			// Unrelated traffic in between should be ignored
+			Send(conn, &KeepAliveMessage)
+			Send(conn, &PeerMessage{Type: Piece, Payload: PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+			served++
+		}
+	}
+}
+
+func TestDownloadPiece(t *testing.T) {
+	data := make([]byte, 2*BlockSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	testCases := []downloadPieceTestCase{
+		{"Whole piece", []byte{0x80}, -1, nil},
+		{"Piece not available", []byte{0x40}, -1, ErrPieceNotAvailable},
+		{"Choked in the middle", []byte{0x80}, 1, ErrChoked},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			local, remote := loopbackPair(t)
+			defer local.Close()
+
+			go serveBlocks(remote, data, testCase.bitfield, testCase.chokeAfter)
+
+			seeder := Seeder{SeederReader: local, SeederWriter: local}
+
+			piece, err := seeder.DownloadPiece(0, len(data))
+			if err != testCase.wantedError {
+				t.Errorf("Wanted error %v, got %v", testCase.wantedError, err)
+				return
+			}
+
+			if err == nil && !bytes.Equal(piece, data) {
+				t.Errorf("Downloaded piece differs")
+			}
+
+			if err == nil && seeder.Downloaded != len(data) {
+				t.Errorf("Expected %d bytes to be counted, got %d", len(data), seeder.Downloaded)
+			}
+		})
+	}
+}
+
+func TestSendBlock(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+	seeder := Seeder{SeederWriter: buffer}
+
+	err := seeder.SendBlock(1, 2, []byte{1, 2, 3})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	msg, err := Receive(buffer)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	wanted := PeerMessage{Type: Piece, Payload: PiecePayload{Index: 1, Begin: 2, Piece: []byte{1, 2, 3}}}
+	if !reflect.DeepEqual(*msg, wanted) {
+		t.Errorf("Expected %#v, got %#v", wanted, msg)
+	}
+
+	if seeder.Uploaded != 3 {
+		t.Errorf("Expected 3 bytes to be counted, got %d", seeder.Uploaded)
+	}
+}
@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"example.com/bencode"
+)
+
+// Name of peer exchange in the extension handshake, see BEP 11.
+const PexExtensionName = "ut_pex"
+
+// Flags sent along with every added peer
+const (
+	PexPrefersEncryption byte = 0x01
+	PexSeed              byte = 0x02
+	PexSupportsUTP       byte = 0x04
+	PexSupportsHolepunch byte = 0x08
+	PexReachable         byte = 0x10
+)
+
+// A single message must not carry more added or dropped peers than this
+const PexMaxPeers = 50
+
+type PexPeer struct {
+	PeerInfo
+	Flags byte
+}
+
+// Peers we got connected to and disconnected from since the previous message
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []PeerInfo
+}
+
+func encodeCompactPeer(peer PeerInfo) []byte {
+	ip := peer.IP.To4()
+	if ip == nil {
+		ip = peer.IP.To16()
+	}
+
+	encoded := make([]byte, len(ip)+2)
+	copy(encoded, ip)
+	binary.BigEndian.PutUint16(encoded[len(ip):], uint16(peer.Port))
+
+	return encoded
+}
+
+func EncodePexMessage(message *PexMessage) ([]byte, error) {
+	var added, addedFlags, added6, added6Flags bytes.Buffer
+
+	for _, peer := range message.Added {
+		if peer.IP.To4() != nil {
+			added.Write(encodeCompactPeer(peer.PeerInfo))
+			addedFlags.WriteByte(peer.Flags)
+		} else {
+			added6.Write(encodeCompactPeer(peer.PeerInfo))
+			added6Flags.WriteByte(peer.Flags)
+		}
+	}
+
+	var dropped, dropped6 bytes.Buffer
+
+	for _, peer := range message.Dropped {
+		if peer.IP.To4() != nil {
+			dropped.Write(encodeCompactPeer(peer))
+		} else {
+			dropped6.Write(encodeCompactPeer(peer))
+		}
+	}
+
+	encoded := map[string]any{
+		"added":    added.String(),
+		"added.f":  addedFlags.String(),
+		"added6":   added6.String(),
+		"added6.f": added6Flags.String(),
+		"dropped":  dropped.String(),
+		"dropped6": dropped6.String(),
+	}
+
+	return bencode.Marshal(encoded)
+}
+
+func parsePexAdded(decoded map[string]any, key string, entrySize int) ([]PexPeer, error) {
+	compact, _ := decoded[key].(string)
+
+	peers, err := parseCompactPeers(compact, entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flags are optional, they are ignored unless there is one per peer
+	flags, _ := decoded[key+".f"].(string)
+	if len(flags) != len(peers) {
+		flags = ""
+	}
+
+	var pexPeers []PexPeer
+
+	for i := range peers {
+		pexPeer := PexPeer{PeerInfo: peers[i]}
+		if flags != "" {
+			pexPeer.Flags = flags[i]
+		}
+
+		pexPeers = append(pexPeers, pexPeer)
+	}
+
+	return pexPeers, nil
+}
+
+func ParsePexMessage(data []byte) (*PexMessage, error) {
+	var decoded map[string]any
+
+	err := bencode.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	message := PexMessage{}
+
+	for _, added := range []struct {
+		key       string
+		entrySize int
+	}{{"added", compactPeerSize}, {"added6", compactPeer6Size}} {
+		peers, err := parsePexAdded(decoded, added.key, added.entrySize)
+		if err != nil {
+			return nil, err
+		}
+
+		message.Added = append(message.Added, peers...)
+	}
+
+	for _, dropped := range []struct {
+		key       string
+		entrySize int
+	}{{"dropped", compactPeerSize}, {"dropped6", compactPeer6Size}} {
+		compact, _ := decoded[dropped.key].(string)
+
+		peers, err := parseCompactPeers(compact, dropped.entrySize)
+		if err != nil {
+			return nil, err
+		}
+
+		message.Dropped = append(message.Dropped, peers...)
+	}
+
+	return &message, nil
+}
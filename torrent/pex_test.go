@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"example.com/bencode"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	message := PexMessage{
+		Added: []PexPeer{
+			{PeerInfo: PeerInfo{IP: net.ParseIP("10.0.0.1"), Port: 6881}, Flags: PexSeed | PexReachable},
+			{PeerInfo: PeerInfo{IP: net.ParseIP("2001:db8::1"), Port: 6882}, Flags: PexSupportsUTP},
+			{PeerInfo: PeerInfo{IP: net.ParseIP("10.0.0.2"), Port: 6883}},
+		},
+		Dropped: []PeerInfo{
+			{IP: net.ParseIP("10.0.0.3"), Port: 6884},
+			{IP: net.ParseIP("2001:db8::2"), Port: 6885},
+		},
+	}
+
+	encoded, err := EncodePexMessage(&message)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	decoded, err := ParsePexMessage(encoded)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	// IPv4 peers come first
+	expectedAdded := []PexPeer{message.Added[0], message.Added[2], message.Added[1]}
+
+	if len(decoded.Added) != len(expectedAdded) || len(decoded.Dropped) != 2 {
+		t.Errorf("Unexpected message %#v", decoded)
+		return
+	}
+
+	for i := range expectedAdded {
+		if !decoded.Added[i].IP.Equal(expectedAdded[i].IP) || decoded.Added[i].Port != expectedAdded[i].Port || decoded.Added[i].Flags != expectedAdded[i].Flags {
+			t.Errorf("Expected %#v, got %#v", expectedAdded[i], decoded.Added[i])
+		}
+	}
+
+	for i := range message.Dropped {
+		if !decoded.Dropped[i].IP.Equal(message.Dropped[i].IP) || decoded.Dropped[i].Port != message.Dropped[i].Port {
+			t.Errorf("Expected %#v, got %#v", message.Dropped[i], decoded.Dropped[i])
+		}
+	}
+}
+
+func TestParsePexMessageWithoutFlags(t *testing.T) {
+	data, _ := bencode.Marshal(map[string]any{"added": "\x0a\x00\x00\x01\x1a\xe1"})
+
+	decoded, err := ParsePexMessage(data)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(decoded.Added) != 1 || decoded.Added[0].Port != 6881 || decoded.Added[0].Flags != 0 || len(decoded.Dropped) != 0 {
+		t.Errorf("Unexpected message %#v", decoded)
+	}
+}
+
+func TestParsePexMessageMalformed(t *testing.T) {
+	testCases := []map[string]any{
+		{"added": "\x0a\x00\x00\x01\x1a"},
+		{"added6": "\x0a\x00\x00\x01\x1a\xe1"},
+		{"dropped": "\x0a"},
+	}
+
+	for _, testCase := range testCases {
+		data, _ := bencode.Marshal(testCase)
+
+		_, err := ParsePexMessage(data)
+		if err != ErrMalformedCompactPeers {
+			t.Errorf("Expected ErrMalformedCompactPeers on %#v, got %v", testCase, err)
+		}
+	}
+}
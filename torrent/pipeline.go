@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Requests kept in flight before anything about the peer is measured
+const DefaultPipelineDepth = 5
+
+// Pipeline never shrinks below this, unless the peer asks for fewer with reqq
+const MinPipelineDepth = 2
+
+const MaxPipelineDepth = 128
+
+// Requested block that did not arrive for this long is given up on
+const DefaultRequestTimeout = 30 * time.Second
+
+// Weight of a new throughput sample in the smoothed rate
+const rateSmoothing = 0.2
+
+var ErrRequestTimeout = errors.New("requested block did not arrive in time")
+
+type pendingRequest struct {
+	request RequestPayload
+	sentAt  time.Time
+}
+
+// Measurements of the blocks downloaded over one connection
+type pipelineStats struct {
+	// Bytes per second, smoothed over the arrivals
+	rate float64
+	// Shortest time between a request and its block, the closest we get to the round trip time
+	minRTT      time.Duration
+	lastArrival time.Time
+}
+
+// Pipeline of one peer, kept by the caller so the next piece from the same peer
+// starts with what was measured instead of DefaultPipelineDepth.
+type PipelineState struct {
+	Depth int
+	stats pipelineStats
+}
+
+func (seeder *Seeder) PipelineState() PipelineState {
+	return PipelineState{Depth: seeder.PipelineDepth, stats: seeder.pipelineStats}
+}
+
+func (seeder *Seeder) RestorePipelineState(state PipelineState) {
+	seeder.PipelineDepth = state.Depth
+	seeder.pipelineStats = state.stats
+}
+
+// Enough requests to cover the bandwidth delay product, plus some headroom
+// so the peer always has the next block queued.
+func adaptPipelineDepth(rate float64, minRTT time.Duration) int {
+	inFlight := rate * minRTT.Seconds() / BlockSize
+
+	return min(int(math.Ceil(inFlight))+MinPipelineDepth, MaxPipelineDepth)
+}
+
+// Peers tell how many requests they queue with reqq, anything beyond may be dropped.
+func (seeder *Seeder) pipelineLimit() int {
+	limit := MaxPipelineDepth
+
+	handshake := seeder.remoteExtensionHandshake()
+	if handshake != nil && handshake.RequestQueue > 0 {
+		limit = min(limit, handshake.RequestQueue)
+	}
+
+	return limit
+}
+
+func (seeder *Seeder) pipelineDepth() int {
+	depth := seeder.PipelineDepth
+	if depth <= 0 {
+		depth = DefaultPipelineDepth
+	}
+
+	limit := seeder.pipelineLimit()
+
+	return max(min(depth, limit), min(MinPipelineDepth, limit))
+}
+
+func (seeder *Seeder) requestTimeout() time.Duration {
+	if seeder.RequestTimeout > 0 {
+		return seeder.RequestTimeout
+	}
+
+	return DefaultRequestTimeout
+}
+
+func (seeder *Seeder) blockArrived(length int, sentAt time.Time, now time.Time) {
+	stats := &seeder.pipelineStats
+
+	rtt := now.Sub(sentAt)
+	if stats.minRTT == 0 || rtt < stats.minRTT {
+		stats.minRTT = rtt
+	}
+
+	interval := now.Sub(stats.lastArrival)
+	if !stats.lastArrival.IsZero() && interval > 0 {
+		sample := float64(length) / interval.Seconds()
+
+		if stats.rate == 0 {
+			stats.rate = sample
+		} else {
+			stats.rate = (1-rateSmoothing)*stats.rate + rateSmoothing*sample
+		}
+	}
+
+	stats.lastArrival = now
+
+	seeder.PipelineDepth = adaptPipelineDepth(stats.rate, stats.minRTT)
+}
+
+// Requests that time out point at a congested peer, so the pipeline is halved.
+func (seeder *Seeder) requestsTimedOut() {
+	seeder.PipelineDepth = max(seeder.pipelineDepth()/2, MinPipelineDepth)
+}
+
+func (seeder *Seeder) cancelRequests(pending []pendingRequest) error {
+	for i := range pending {
+		err := Send(seeder.SeederWriter, &PeerMessage{Type: Cancel, Payload: CancelPayload(pending[i].request)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Oldest request must arrive within the timeout, waiting to be unchoked counts the same.
+func (seeder *Seeder) setRequestDeadline(pending []pendingRequest, lastActivity time.Time) {
+	deadliner, ok := seeder.SeederReader.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return
+	}
+
+	since := lastActivity
+	if len(pending) > 0 {
+		since = pending[0].sentAt
+	}
+
+	deadliner.SetReadDeadline(since.Add(seeder.requestTimeout()))
+}
+
+func (seeder *Seeder) clearRequestDeadline() {
+	if deadliner, ok := seeder.SeederReader.(interface{ SetReadDeadline(time.Time) error }); ok {
+		deadliner.SetReadDeadline(time.Time{})
+	}
+}
+
+func isTimeout(err error) bool {
+	timeout, ok := err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
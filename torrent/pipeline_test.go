@@ -0,0 +1,225 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdaptPipelineDepth(t *testing.T) {
+	testCases := []struct {
+		name   string
+		rate   float64
+		minRTT time.Duration
+		wanted int
+	}{
+		{"Nothing measured", 0, 0, MinPipelineDepth},
+		{"One MB per second over 100ms", 1000000, 100 * time.Millisecond, 9},
+		{"Fast link far away", 1e9, time.Second, MaxPipelineDepth},
+	}
+
+	for i := range testCases {
+		depth := adaptPipelineDepth(testCases[i].rate, testCases[i].minRTT)
+		if depth != testCases[i].wanted {
+			t.Errorf("%s expected %d, got %d", testCases[i].name, testCases[i].wanted, depth)
+		}
+	}
+}
+
+func TestPipelineDepthLimit(t *testing.T) {
+	testCases := []struct {
+		name      string
+		depth     int
+		handshake *ExtensionHandshake
+		wanted    int
+	}{
+		{"Default", 0, nil, DefaultPipelineDepth},
+		{"Adapted", 40, nil, 40},
+		{"Peer queue", 40, &ExtensionHandshake{RequestQueue: 3}, 3},
+		{"Peer queue below minimum", 0, &ExtensionHandshake{RequestQueue: 1}, 1},
+		{"Peer queue not told", 40, &ExtensionHandshake{}, 40},
+	}
+
+	for i := range testCases {
+		seeder := Seeder{PipelineDepth: testCases[i].depth, RemoteExtensionHandshake: testCases[i].handshake}
+
+		if depth := seeder.pipelineDepth(); depth != testCases[i].wanted {
+			t.Errorf("%s expected %d, got %d", testCases[i].name, testCases[i].wanted, depth)
+		}
+	}
+}
+
+// Answers requests only once they stop coming, so the most requests in flight can be counted
+func serveQueuedBlocks(conn net.Conn, data []byte, mostInFlight chan<- int) {
+	defer conn.Close()
+
+	var queued []RequestPayload
+	most := 0
+
+	for {
+		if len(queued) > 0 {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		msg, err := Receive(conn)
+		if isTimeout(err) {
+			for _, request := range queued {
+				block := data[request.Begin : request.Begin+request.Length]
+				Send(conn, &PeerMessage{Type: Piece, Payload: PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+			}
+
+			queued = nil
+			continue
+		}
+
+		if err != nil {
+			mostInFlight <- most
+			return
+		}
+
+		switch msg.Type {
+		case Interested:
+			Send(conn, &UnchokeMessage)
+		case Request:
+			queued = append(queued, msg.Payload.(RequestPayload))
+			most = max(most, len(queued))
+		}
+	}
+}
+
+func TestDownloadPiecePipelined(t *testing.T) {
+	data := make([]byte, 8*BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	testCases := []struct {
+		name      string
+		handshake *ExtensionHandshake
+		wanted    int
+	}{
+		{"Default depth", nil, DefaultPipelineDepth},
+		{"Peer queue respected", &ExtensionHandshake{RequestQueue: 3}, 3},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			local, remote := loopbackPair(t)
+
+			mostInFlight := make(chan int, 1)
+			go serveQueuedBlocks(remote, data, mostInFlight)
+
+			seeder := Seeder{SeederReader: local, SeederWriter: local, RemoteExtensionHandshake: testCase.handshake}
+
+			piece, err := seeder.DownloadPiece(0, len(data))
+			local.Close()
+
+			if err != nil {
+				t.Errorf("Did not expect error %v", err)
+				return
+			}
+
+			if !bytes.Equal(piece, data) {
+				t.Errorf("Downloaded piece differs")
+			}
+
+			if most := <-mostInFlight; most != testCase.wanted {
+				t.Errorf("Expected at most %d requests in flight, got %d", testCase.wanted, most)
+			}
+		})
+	}
+}
+
+// Collects cancels after the first block, requests are never answered when serveFirst is false
+func serveThenCancels(conn net.Conn, data []byte, serveFirst bool, cancels chan<- []CancelPayload) {
+	defer conn.Close()
+
+	var received []CancelPayload
+	served := false
+
+	for {
+		msg, err := Receive(conn)
+		if err != nil {
+			cancels <- received
+			return
+		}
+
+		switch msg.Type {
+		case Interested:
+			Send(conn, &UnchokeMessage)
+		case Request:
+			request := msg.Payload.(RequestPayload)
+
+			if !serveFirst || served {
+				continue
+			}
+
+			block := data[request.Begin : request.Begin+request.Length]
+			Send(conn, &PeerMessage{Type: Piece, Payload: PiecePayload{Index: request.Index, Begin: request.Begin, Piece: block}})
+			Send(conn, &ChokeMessage)
+			served = true
+		case Cancel:
+			received = append(received, msg.Payload.(CancelPayload))
+		}
+	}
+}
+
+func TestDownloadPieceChokeCancels(t *testing.T) {
+	data := make([]byte, 3*BlockSize)
+
+	local, remote := loopbackPair(t)
+
+	cancels := make(chan []CancelPayload, 1)
+	go serveThenCancels(remote, data, true, cancels)
+
+	seeder := Seeder{SeederReader: local, SeederWriter: local}
+
+	_, err := seeder.DownloadPiece(0, len(data))
+	local.Close()
+
+	if err != ErrChoked {
+		t.Errorf("Expected ErrChoked, got %v", err)
+		return
+	}
+
+	expected := []CancelPayload{{Index: 0, Begin: BlockSize, Length: BlockSize}, {Index: 0, Begin: 2 * BlockSize, Length: BlockSize}}
+
+	if received := <-cancels; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected cancels %v, got %v", expected, received)
+	}
+}
+
+func TestDownloadPieceRequestTimeout(t *testing.T) {
+	data := make([]byte, 2*BlockSize)
+
+	local, remote := loopbackPair(t)
+
+	cancels := make(chan []CancelPayload, 1)
+	go serveThenCancels(remote, data, false, cancels)
+
+	seeder := Seeder{SeederReader: local, SeederWriter: local, RequestTimeout: 50 * time.Millisecond, PipelineDepth: 8}
+
+	_, err := seeder.DownloadPiece(0, len(data))
+	local.Close()
+
+	if err != ErrRequestTimeout {
+		t.Errorf("Expected ErrRequestTimeout, got %v", err)
+		return
+	}
+
+	expected := []CancelPayload{{Index: 0, Begin: 0, Length: BlockSize}, {Index: 0, Begin: BlockSize, Length: BlockSize}}
+
+	if received := <-cancels; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected cancels %v, got %v", expected, received)
+	}
+
+	if seeder.PipelineDepth != 4 {
+		t.Errorf("Expected pipeline to be halved, got %d", seeder.PipelineDepth)
+	}
+}
@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,10 +11,18 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"example.com/bencode"
 )
 
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
 type AnnounceRequest struct {
 	AnnounceURL string
 	PeerId      []byte
@@ -21,6 +31,19 @@ type AnnounceRequest struct {
 	Uploaded    int
 	Downloaded  int
 	Left        int
+	Event       string
+	TrackerId   string
+	// Optional addresses of ours, for dual-stack clients (BEP 7)
+	IPv4 net.IP
+	IPv6 net.IP
+	// IP address or DNS name overriding the address the request comes from
+	IP       string
+	Compact  bool
+	NoPeerId bool
+	// Number of wanted peers, tracker default is used when 0
+	NumWant int
+	// Identifies us across IP changes, should stay the same for the session
+	Key uint32
 }
 
 type PeerInfo struct {
@@ -31,10 +54,45 @@ type PeerInfo struct {
 
 type AnnounceResponse struct {
 	Interval    int
+	MinInterval int
+	// Has to be sent back on next announces if not empty
+	TrackerId      string
+	WarningMessage string
+	// Number of seeders and leechers
+	Complete    int
+	Incomplete  int
 	Peers       []PeerInfo
 	RawResponse []byte
 }
 
+type ScrapeFile struct {
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+type ScrapeResponse struct {
+	// Keyed by raw info hash
+	Files map[string]ScrapeFile
+}
+
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+var ErrMalformedCompactPeers = errors.New("compact peer string has invalid length")
+
+// 4 or 16 bytes of IP address followed by 2 bytes of port
+const compactPeerSize = net.IPv4len + 2
+const compactPeer6Size = net.IPv6len + 2
+
+// Announce URLs may carry their own query, e.g. passkey, which is kept as is.
+func appendQuery(requestURL *url.URL, q url.Values) {
+	if requestURL.RawQuery == "" {
+		requestURL.RawQuery = q.Encode()
+		return
+	}
+
+	requestURL.RawQuery = requestURL.RawQuery + "&" + q.Encode()
+}
+
 func buildTrackerRequest(request *AnnounceRequest) (*http.Request, error) {
 	httpReq, err := http.NewRequest("GET", request.AnnounceURL, nil)
 	if err != nil {
@@ -45,27 +103,97 @@ func buildTrackerRequest(request *AnnounceRequest) (*http.Request, error) {
 
 	q.Add("info_hash", string(request.InfoHash))
 	q.Add("peer_id", string(request.PeerId))
-	// IP is optional
-	// q.Add("ip", "")
 	q.Add("port", strconv.Itoa(request.Port))
 	q.Add("uploaded", strconv.Itoa(request.Uploaded))
 	q.Add("downloaded", strconv.Itoa(request.Downloaded))
 	q.Add("left", strconv.Itoa(request.Left))
-	// Event is optional -> event=started|completed|stopped
-	// q.Add("event")
+	// Event is optional, regular announces don't have it
+	if request.Event != EventNone {
+		q.Add("event", request.Event)
+	}
+	if request.TrackerId != "" {
+		q.Add("trackerid", request.TrackerId)
+	}
+	if request.IPv4.To4() != nil {
+		q.Add("ipv4", request.IPv4.String())
+	}
+	if request.IPv6 != nil && request.IPv6.To4() == nil {
+		q.Add("ipv6", request.IPv6.String())
+	}
+	if request.IP != "" {
+		q.Add("ip", request.IP)
+	}
+	if request.Compact {
+		q.Add("compact", "1")
+	}
+	if request.NoPeerId {
+		q.Add("no_peer_id", "1")
+	}
+	if request.NumWant > 0 {
+		q.Add("numwant", strconv.Itoa(request.NumWant))
+	}
+	if request.Key != 0 {
+		q.Add("key", fmt.Sprintf("%08x", request.Key))
+	}
 
-	httpReq.URL.RawQuery = q.Encode()
+	appendQuery(httpReq.URL, q)
 
 	return httpReq, nil
 }
 
-func readAnnounceResponse(response *http.Response) (*AnnounceResponse, error) {
-	if response.StatusCode < 200 || response.StatusCode > 300 {
-		errMsg := fmt.Sprintf("Server responded with NOK %#v", response)
-		return nil, errors.New(errMsg)
+func failureReason(data []byte) string {
+	type failureResponse struct {
+		FailureReason *string `bencode:"failure reason"`
+	}
+
+	var response failureResponse
+
+	err := bencode.Unmarshal(data, &response)
+	if err != nil || response.FailureReason == nil {
+		return ""
+	}
+
+	return *response.FailureReason
+}
+
+// Fields which are the same in standard and compact format, and may be missing
+func parseOptionalAnnounceFields(data []byte, announceResponse *AnnounceResponse) error {
+	type optionalAnnounceFields struct {
+		MinInterval    *int    `bencode:"min interval"`
+		TrackerId      *string `bencode:"tracker id"`
+		WarningMessage *string `bencode:"warning message"`
+		Complete       *int    `bencode:"complete"`
+		Incomplete     *int    `bencode:"incomplete"`
 	}
 
-	return ParseAnnounceResponse(response.Body)
+	var fields optionalAnnounceFields
+
+	err := bencode.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	if fields.MinInterval != nil {
+		announceResponse.MinInterval = *fields.MinInterval
+	}
+
+	if fields.TrackerId != nil {
+		announceResponse.TrackerId = *fields.TrackerId
+	}
+
+	if fields.WarningMessage != nil {
+		announceResponse.WarningMessage = *fields.WarningMessage
+	}
+
+	if fields.Complete != nil {
+		announceResponse.Complete = *fields.Complete
+	}
+
+	if fields.Incomplete != nil {
+		announceResponse.Incomplete = *fields.Incomplete
+	}
+
+	return nil
 }
 
 func parseStandardAnnounceResponse(data []byte) (*AnnounceResponse, error) {
@@ -78,6 +206,7 @@ func parseStandardAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 	type standardAnnounceResponse struct {
 		Interval      *int        `bencode:"interval"`
 		Peers         *[]peerInfo `bencode:"peers"`
+		Peers6        *string     `bencode:"peers6"`
 		FailureReason *string     `bencode:"failure reason"`
 	}
 
@@ -100,8 +229,13 @@ func parseStandardAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 
 	announceResponse := AnnounceResponse{Interval: *response.Interval}
 
+	err = parseOptionalAnnounceFields(data, &announceResponse)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := range *response.Peers {
-		pInfo := PeerInfo{PeerId: []byte((*response.Peers)[i].PeerId), IP: net.ParseIP(((*response.Peers)[i].IP)), Port: (*response.Peers)[i].Port}
+		pInfo := PeerInfo{PeerId: []byte((*response.Peers)[i].PeerId), IP: parsePeerIP((*response.Peers)[i].IP), Port: (*response.Peers)[i].Port}
 
 		if pInfo.IP == nil {
 			continue
@@ -110,13 +244,52 @@ func parseStandardAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 		announceResponse.Peers = append(announceResponse.Peers, pInfo)
 	}
 
+	if response.Peers6 != nil {
+		peers, err := parseCompactPeers(*response.Peers6, compactPeer6Size)
+		if err != nil {
+			return nil, err
+		}
+
+		announceResponse.Peers = append(announceResponse.Peers, peers...)
+	}
+
 	return &announceResponse, nil
 }
 
+// Trackers may send IPv6 literals in brackets
+func parsePeerIP(ip string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]"))
+}
+
+func parseCompactPeers(peers string, entrySize int) ([]PeerInfo, error) {
+	peerBytes := []byte(peers)
+
+	if len(peerBytes)%entrySize != 0 {
+		return nil, ErrMalformedCompactPeers
+	}
+
+	var peerInfos []PeerInfo
+
+	for i := 0; i < len(peerBytes); i += entrySize {
+		ipLength := entrySize - 2
+
+		ip := make(net.IP, ipLength)
+		copy(ip, peerBytes[i:i+ipLength])
+
+		port := binary.BigEndian.Uint16(peerBytes[i+ipLength : i+entrySize])
+
+		// PeerId is not supplied in compact format
+		peerInfos = append(peerInfos, PeerInfo{IP: ip, Port: int(port)})
+	}
+
+	return peerInfos, nil
+}
+
 func parseCompactAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 	type compactAnnounceResponse struct {
 		Interval      *int    `bencode:"interval"`
 		Peers         *string `bencode:"peers"`
+		Peers6        *string `bencode:"peers6"`
 		FailureReason *string `bencode:"failure reason"`
 	}
 
@@ -131,7 +304,8 @@ func parseCompactAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 		return nil, errors.New(*response.FailureReason)
 	}
 
-	if response.Interval == nil || response.Peers == nil {
+	// IPv6 only trackers may send just peers6
+	if response.Interval == nil || (response.Peers == nil && response.Peers6 == nil) {
 		// This should not happen
 		errMsg := fmt.Sprintf("Unexpected error, tracker response invalid: %#v", response)
 		return nil, errors.New(errMsg)
@@ -139,19 +313,27 @@ func parseCompactAnnounceResponse(data []byte) (*AnnounceResponse, error) {
 
 	announceResponse := AnnounceResponse{Interval: *response.Interval}
 
-	peerBytes := []byte(*(response.Peers))
-	// 4 bytes IP address, 2 bytes port
-	for i := 0; i < len(peerBytes); i += 6 {
-		ip := fmt.Sprintf("%d.%d.%d.%d", peerBytes[i], peerBytes[i+1], peerBytes[i+2], peerBytes[i+3])
+	err = parseOptionalAnnounceFields(data, &announceResponse)
+	if err != nil {
+		return nil, err
+	}
 
-		var port uint16
+	if response.Peers != nil {
+		peers, err := parseCompactPeers(*response.Peers, compactPeerSize)
+		if err != nil {
+			return nil, err
+		}
 
-		port = uint16(peerBytes[i+4]) << 8
-		port = port | uint16(peerBytes[i+5])
+		announceResponse.Peers = append(announceResponse.Peers, peers...)
+	}
 
-		// PeerId is not supplied in compact format
-		pInfo := PeerInfo{IP: net.ParseIP(ip), Port: int(port)}
-		announceResponse.Peers = append(announceResponse.Peers, pInfo)
+	if response.Peers6 != nil {
+		peers, err := parseCompactPeers(*response.Peers6, compactPeer6Size)
+		if err != nil {
+			return nil, err
+		}
+
+		announceResponse.Peers = append(announceResponse.Peers, peers...)
 	}
 
 	return &announceResponse, nil
@@ -173,6 +355,14 @@ func ParseAnnounceResponse(reader io.Reader) (*AnnounceResponse, error) {
 		if err != nil {
 			slog.Info("Compact parser failed " + err.Error())
 
+			if errors.Is(err, ErrMalformedCompactPeers) {
+				return nil, err
+			}
+
+			if reason := failureReason(bytes); reason != "" {
+				return nil, errors.New(reason)
+			}
+
 			return nil, errors.New("Could not parse announce response.")
 		}
 	}
@@ -182,21 +372,99 @@ func ParseAnnounceResponse(reader io.Reader) (*AnnounceResponse, error) {
 	return announceResponse, nil
 }
 
-func Announce(request *AnnounceRequest) (*AnnounceResponse, error) {
-	httpRequest, err := buildTrackerRequest(request)
+// Scrape URL is the announce URL with the last "announce" path segment
+// replaced by "scrape" (BEP 48), UDP trackers scrape on the same endpoint.
+func ScrapeURL(announceURL string) (string, error) {
+	if strings.HasPrefix(announceURL, "udp://") {
+		return announceURL, nil
+	}
+
+	parsedURL, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+
+	lastSlash := strings.LastIndex(parsedURL.Path, "/")
+	lastSegment := parsedURL.Path[lastSlash+1:]
+
+	if !strings.HasPrefix(lastSegment, "announce") {
+		return "", ErrScrapeNotSupported
+	}
+
+	parsedURL.Path = parsedURL.Path[:lastSlash+1] + "scrape" + strings.TrimPrefix(lastSegment, "announce")
+
+	return parsedURL.String(), nil
+}
+
+func buildScrapeRequest(scrapeURL string, infoHashes [][]byte) (*http.Request, error) {
+	httpReq, err := http.NewRequest("GET", scrapeURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	q := url.Values{}
+
+	for i := range infoHashes {
+		q.Add("info_hash", string(infoHashes[i]))
+	}
+
+	appendQuery(httpReq.URL, q)
+
+	return httpReq, nil
+}
+
+func ParseScrapeResponse(reader io.Reader) (*ScrapeResponse, error) {
+	type scrapeResponse struct {
+		Files         *map[string]any `bencode:"files"`
+		FailureReason *string         `bencode:"failure reason"`
+	}
+
+	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 
-	trackerResponse, err := readAnnounceResponse(httpResponse)
+	var response scrapeResponse
+
+	err = bencode.Unmarshal(data, &response)
 	if err != nil {
 		return nil, err
 	}
 
-	return trackerResponse, nil
+	if response.FailureReason != nil {
+		return nil, errors.New(*response.FailureReason)
+	}
+
+	if response.Files == nil {
+		errMsg := fmt.Sprintf("Unexpected error, scrape response invalid: %#v", response)
+		return nil, errors.New(errMsg)
+	}
+
+	scrape := ScrapeResponse{Files: make(map[string]ScrapeFile)}
+
+	for infoHash, value := range *response.Files {
+		stats, ok := value.(map[string]any)
+		if !ok {
+			errMsg := fmt.Sprintf("Unexpected error, scrape entry invalid: %#v", value)
+			return nil, errors.New(errMsg)
+		}
+
+		// Missing counters are left at zero
+		complete, _ := stats["complete"].(int)
+		downloaded, _ := stats["downloaded"].(int)
+		incomplete, _ := stats["incomplete"].(int)
+
+		scrape.Files[infoHash] = ScrapeFile{Complete: complete, Downloaded: downloaded, Incomplete: incomplete}
+	}
+
+	return &scrape, nil
+}
+
+// Several info hashes can be scraped with a single request
+func Scrape(announceURL string, infoHashes [][]byte) (*ScrapeResponse, error) {
+	return DefaultTrackerClient.Scrape(context.Background(), announceURL, infoHashes)
+}
+
+func Announce(request *AnnounceRequest) (*AnnounceResponse, error) {
+	return DefaultTrackerClient.Announce(context.Background(), request)
 }
@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultTrackerTimeout = 30 * time.Second
+const defaultTrackerUserAgent = "tinytorrent/0.1"
+
+// Announce responses are small, anything bigger is most likely not a tracker
+const defaultMaxTrackerResponseSize = 1 << 20
+
+var ErrTrackerResponseTooLarge = errors.New("tracker response too large")
+
+// Fields left empty fall back to the defaults of NewTrackerClient
+type TrackerClient struct {
+	HTTPClient *http.Client
+	UDPClient  *UDPTrackerClient
+	// Applies to every request, on top of the context deadline
+	Timeout         time.Duration
+	UserAgent       string
+	MaxResponseSize int
+}
+
+func NewTrackerClient() *TrackerClient {
+	return &TrackerClient{
+		HTTPClient:      &http.Client{},
+		UDPClient:       DefaultUDPTrackerClient,
+		Timeout:         defaultTrackerTimeout,
+		UserAgent:       defaultTrackerUserAgent,
+		MaxResponseSize: defaultMaxTrackerResponseSize,
+	}
+}
+
+var DefaultTrackerClient = NewTrackerClient()
+
+func (tc *TrackerClient) httpClient() *http.Client {
+	if tc.HTTPClient == nil {
+		return http.DefaultClient
+	}
+
+	return tc.HTTPClient
+}
+
+func (tc *TrackerClient) udpClient() *UDPTrackerClient {
+	if tc.UDPClient == nil {
+		return DefaultUDPTrackerClient
+	}
+
+	return tc.UDPClient
+}
+
+func (tc *TrackerClient) userAgent() string {
+	if tc.UserAgent == "" {
+		return defaultTrackerUserAgent
+	}
+
+	return tc.UserAgent
+}
+
+func (tc *TrackerClient) maxResponseSize() int {
+	if tc.MaxResponseSize <= 0 {
+		return defaultMaxTrackerResponseSize
+	}
+
+	return tc.MaxResponseSize
+}
+
+func (tc *TrackerClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if tc.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, tc.Timeout)
+}
+
+// Sends request and returns the whole body, gzip is decoded here
+// so it works regardless of the transport configuration.
+func (tc *TrackerClient) do(ctx context.Context, httpRequest *http.Request) ([]byte, error) {
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("User-Agent", tc.userAgent())
+	httpRequest.Header.Set("Accept-Encoding", "gzip")
+
+	httpResponse, err := tc.httpClient().Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 300 {
+		errMsg := fmt.Sprintf("Server responded with NOK %#v", httpResponse)
+		return nil, errors.New(errMsg)
+	}
+
+	var body io.Reader = httpResponse.Body
+
+	if strings.EqualFold(httpResponse.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(httpResponse.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		body = gzipReader
+	}
+
+	// One byte more than allowed tells if the limit was exceeded
+	maxResponseSize := tc.maxResponseSize()
+
+	data, err := io.ReadAll(io.LimitReader(body, int64(maxResponseSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxResponseSize {
+		return nil, ErrTrackerResponseTooLarge
+	}
+
+	return data, nil
+}
+
+func (tc *TrackerClient) Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	ctx, cancel := tc.withTimeout(ctx)
+	defer cancel()
+
+	if strings.HasPrefix(request.AnnounceURL, "udp://") {
+		return tc.udpClient().Announce(ctx, request)
+	}
+
+	httpRequest, err := buildTrackerRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := tc.do(ctx, httpRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseAnnounceResponse(bytes.NewReader(data))
+}
+
+func (tc *TrackerClient) Scrape(ctx context.Context, announceURL string, infoHashes [][]byte) (*ScrapeResponse, error) {
+	ctx, cancel := tc.withTimeout(ctx)
+	defer cancel()
+
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(scrapeURL, "udp://") {
+		return tc.udpClient().Scrape(ctx, scrapeURL, infoHashes)
+	}
+
+	httpRequest, err := buildScrapeRequest(scrapeURL, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := tc.do(ctx, httpRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseScrapeResponse(bytes.NewReader(data))
+}
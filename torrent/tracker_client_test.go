@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const announceResponseBody = "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"
+
+func TestTrackerClientAnnounce(t *testing.T) {
+	var userAgent string
+
+	trackerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+
+			writer := gzip.NewWriter(w)
+			writer.Write([]byte(announceResponseBody))
+			writer.Close()
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 2048))
+		case "/hung":
+			<-r.Context().Done()
+		default:
+			w.Write([]byte(announceResponseBody))
+		}
+	}))
+	defer trackerServer.Close()
+
+	testCases := []struct {
+		name      string
+		path      string
+		wantedErr error
+	}{
+		{"Plain response", "/announce", nil},
+		{"Gzip response", "/gzip", nil},
+		{"Response too large", "/large", ErrTrackerResponseTooLarge},
+		{"Tracker hangs", "/hung", context.DeadlineExceeded},
+	}
+
+	trackerClient := NewTrackerClient()
+	trackerClient.Timeout = 100 * time.Millisecond
+	trackerClient.UserAgent = "test-agent"
+	trackerClient.MaxResponseSize = 1024
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			request := AnnounceRequest{AnnounceURL: trackerServer.URL + testCase.path, PeerId: GenerateRandomProtocolId(), InfoHash: GenerateRandomProtocolId()}
+
+			response, err := trackerClient.Announce(context.Background(), &request)
+			if testCase.wantedErr != nil {
+				if !errors.Is(err, testCase.wantedErr) {
+					t.Errorf("Wanted error %v, got %v", testCase.wantedErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Did not expect error %v", err)
+				return
+			}
+
+			if response.Interval != 60 || len(response.Peers) != 1 {
+				t.Errorf("Unexpected response %#v", response)
+				return
+			}
+
+			if userAgent != "test-agent" {
+				t.Errorf("Unexpected user agent %s", userAgent)
+			}
+		})
+	}
+}
+
+func TestTrackerClientZeroValue(t *testing.T) {
+	var userAgent string
+
+	trackerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(announceResponseBody))
+	}))
+	defer trackerServer.Close()
+
+	udpTracker, err := startUDPStandInTracker(GenerateRandomProtocolId(), 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer udpTracker.close()
+
+	trackerClient := TrackerClient{}
+
+	request := AnnounceRequest{AnnounceURL: trackerServer.URL + "/announce", PeerId: GenerateRandomProtocolId(), InfoHash: GenerateRandomProtocolId()}
+
+	response, err := trackerClient.Announce(context.Background(), &request)
+	if err != nil || len(response.Peers) != 1 {
+		t.Errorf("Expected defaults to be used %v %#v", err, response)
+		return
+	}
+
+	if userAgent != defaultTrackerUserAgent {
+		t.Errorf("Expected default user agent, got %q", userAgent)
+		return
+	}
+
+	request = AnnounceRequest{AnnounceURL: udpTracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: udpTracker.infoHash}
+
+	response, err = trackerClient.Announce(context.Background(), &request)
+	if err != nil || len(response.Peers) != 2 {
+		t.Errorf("Expected default UDP client to be used %v %#v", err, response)
+	}
+}
+
+func TestUDPAnnounceCancelled(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	// Tracker never answers
+	tracker, err := startUDPStandInTracker(infoHash, 100)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	udpClient := NewUDPTrackerClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash}
+
+	start := time.Now()
+
+	_, err = udpClient.Announce(ctx, &request)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wanted deadline exceeded, got %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("Announce was not interrupted by context")
+	}
+}
@@ -2,10 +2,13 @@ package torrent
 
 import (
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -100,3 +103,244 @@ func TestAnnounce(t *testing.T) {
 
 	}
 }
+
+type parseAnnounceTestCase struct {
+	name              string
+	response          string
+	wantedInterval    int
+	wantedMinInterval int
+	wantedPeers       int
+	wantedLastIP      string
+}
+
+func TestParseAnnounceResponse(t *testing.T) {
+	testCases := []parseAnnounceTestCase{
+		{"Compact with min interval", "d8:intervali1800e12:min intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e", 1800, 900, 1, "127.0.0.1"},
+		{"Standard without min interval", "d8:intervali60e5:peersld2:ip9:127.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eeee", 60, 0, 1, "127.0.0.1"},
+		{"Compact with peers6", "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", 60, 0, 2, "2001:db8::1"},
+		{"Only peers6", "d8:intervali60e6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", 60, 0, 1, "::1"},
+		{"Standard with IPv6 literal", "d8:intervali60e5:peersld2:ip5:[::1]7:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eeee", 60, 0, 1, "::1"},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			response, err := ParseAnnounceResponse(strings.NewReader(testCase.response))
+			if err != nil {
+				t.Errorf("Did not expect error %v", err)
+				return
+			}
+
+			if response.Interval != testCase.wantedInterval || response.MinInterval != testCase.wantedMinInterval || len(response.Peers) != testCase.wantedPeers {
+				t.Errorf("Unexpected response %#v", response)
+				return
+			}
+
+			if response.Peers[len(response.Peers)-1].IP.String() != testCase.wantedLastIP {
+				t.Errorf("Unexpected peer IP %v", response.Peers[len(response.Peers)-1].IP)
+			}
+		})
+	}
+}
+
+func TestParseAnnounceResponseOptionalFields(t *testing.T) {
+	responses := []string{
+		"d8:completei5e10:incompletei7e8:intervali60e5:peers0:10:tracker id3:abc15:warning message4:slowe",
+		"d8:completei5e10:incompletei7e8:intervali60e5:peersle10:tracker id3:abc15:warning message4:slowe",
+	}
+
+	for _, response := range responses {
+		announceResponse, err := ParseAnnounceResponse(strings.NewReader(response))
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			continue
+		}
+
+		wanted := AnnounceResponse{Interval: 60, TrackerId: "abc", WarningMessage: "slow", Complete: 5, Incomplete: 7, RawResponse: []byte(response)}
+		if !reflect.DeepEqual(*announceResponse, wanted) {
+			t.Errorf("Unexpected response %#v", announceResponse)
+		}
+	}
+}
+
+func TestBuildTrackerRequestTrackerId(t *testing.T) {
+	request := AnnounceRequest{AnnounceURL: "http://localhost/announce", TrackerId: "abc"}
+
+	httpRequest, err := buildTrackerRequest(&request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if httpRequest.URL.Query().Get("trackerid") != "abc" {
+		t.Errorf("Expected tracker id in %s", httpRequest.URL.RawQuery)
+	}
+}
+
+func TestBuildTrackerRequestOptionalParameters(t *testing.T) {
+	request := AnnounceRequest{
+		AnnounceURL: "http://localhost/announce?passkey=a%2Fb",
+		IP:          "tracker.example.com",
+		Compact:     true,
+		NoPeerId:    true,
+		NumWant:     30,
+		Key:         0xCAFEBABE,
+	}
+
+	httpRequest, err := buildTrackerRequest(&request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if !strings.HasPrefix(httpRequest.URL.RawQuery, "passkey=a%2Fb&") {
+		t.Errorf("Expected passkey to be preserved in %s", httpRequest.URL.RawQuery)
+	}
+
+	query := httpRequest.URL.Query()
+
+	wanted := map[string]string{"ip": "tracker.example.com", "compact": "1", "no_peer_id": "1", "numwant": "30", "key": "cafebabe", "info_hash": ""}
+	for key, value := range wanted {
+		if query.Get(key) != value {
+			t.Errorf("Expected %s=%s in %s", key, value, httpRequest.URL.RawQuery)
+		}
+	}
+
+	request = AnnounceRequest{AnnounceURL: "http://localhost/announce"}
+
+	httpRequest, _ = buildTrackerRequest(&request)
+	for _, key := range []string{"ip", "compact", "no_peer_id", "numwant", "key"} {
+		if httpRequest.URL.Query().Has(key) {
+			t.Errorf("Did not expect %s in %s", key, httpRequest.URL.RawQuery)
+		}
+	}
+}
+
+func TestParseAnnounceFailureReason(t *testing.T) {
+	_, err := ParseAnnounceResponse(strings.NewReader("d14:failure reason9:forbiddene"))
+	if err == nil || err.Error() != "forbidden" {
+		t.Errorf("Expected failure reason, got %v", err)
+	}
+}
+
+func TestParseMalformedCompactPeers(t *testing.T) {
+	responses := []string{
+		"d8:intervali60e5:peers5:\x7f\x00\x00\x01\x1ae",
+		"d8:intervali60e6:peers67:\x7f\x00\x00\x01\x1a\xe1\x00e",
+	}
+
+	for _, response := range responses {
+		_, err := ParseAnnounceResponse(strings.NewReader(response))
+		if err != ErrMalformedCompactPeers {
+			t.Errorf("Expected malformed peers error, got %v", err)
+		}
+	}
+}
+
+func TestBuildTrackerRequestAddresses(t *testing.T) {
+	request := AnnounceRequest{AnnounceURL: "http://localhost/announce", IPv4: net.ParseIP("10.0.0.1"), IPv6: net.ParseIP("2001:db8::1")}
+
+	httpRequest, err := buildTrackerRequest(&request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	query := httpRequest.URL.Query()
+	if query.Get("ipv4") != "10.0.0.1" || query.Get("ipv6") != "2001:db8::1" {
+		t.Errorf("Unexpected addresses in %s", httpRequest.URL.RawQuery)
+	}
+
+	request = AnnounceRequest{AnnounceURL: "http://localhost/announce"}
+
+	httpRequest, _ = buildTrackerRequest(&request)
+	if httpRequest.URL.Query().Has("ipv4") || httpRequest.URL.Query().Has("ipv6") {
+		t.Errorf("Did not expect addresses in %s", httpRequest.URL.RawQuery)
+	}
+}
+
+func TestBuildTrackerRequestEvent(t *testing.T) {
+	for _, event := range []string{EventNone, EventStarted, EventCompleted, EventStopped} {
+		request := AnnounceRequest{AnnounceURL: "http://localhost/announce", PeerId: GenerateRandomProtocolId(), InfoHash: GenerateRandomProtocolId(), Event: event}
+
+		httpRequest, err := buildTrackerRequest(&request)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			continue
+		}
+
+		query := httpRequest.URL.Query()
+		if query.Get("event") != event || query.Has("event") != (event != EventNone) {
+			t.Errorf("Expected event %#v in %s", event, httpRequest.URL.RawQuery)
+		}
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	testCases := []struct {
+		announceURL string
+		wantedURL   string
+		wantedErr   error
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", nil},
+		{"http://example.com/x/announce", "http://example.com/x/scrape", nil},
+		{"http://example.com/announce.php", "http://example.com/scrape.php", nil},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644", nil},
+		{"http://example.com/a", "", ErrScrapeNotSupported},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4", nil},
+		{"http://example.com/x%064announce", "", ErrScrapeNotSupported},
+		{"udp://example.com:6969", "udp://example.com:6969", nil},
+	}
+
+	for _, testCase := range testCases {
+		scrapeURL, err := ScrapeURL(testCase.announceURL)
+		if err != testCase.wantedErr || scrapeURL != testCase.wantedURL {
+			t.Errorf("%s: got %#v %v, wanted %#v %v", testCase.announceURL, scrapeURL, err, testCase.wantedURL, testCase.wantedErr)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	infoHashes := [][]byte{[]byte("aaaaaaaaaaaaaaaaaaaa"), []byte("bbbbbbbbbbbbbbbbbbbb")}
+
+	var requestedHashes []string
+
+	trackerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		requestedHashes = r.URL.Query()["info_hash"]
+
+		w.Write([]byte("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10ee20:bbbbbbbbbbbbbbbbbbbbd8:completei1e10:downloadedi2e10:incompletei3eeee"))
+	}))
+	defer trackerServer.Close()
+
+	scrapeResponse, err := Scrape(trackerServer.URL+"/announce", infoHashes)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(requestedHashes) != 2 || requestedHashes[0] != string(infoHashes[0]) || requestedHashes[1] != string(infoHashes[1]) {
+		t.Errorf("Expected both info hashes in one request, got %#v", requestedHashes)
+	}
+
+	wanted := map[string]ScrapeFile{
+		string(infoHashes[0]): {Complete: 5, Downloaded: 50, Incomplete: 10},
+		string(infoHashes[1]): {Complete: 1, Downloaded: 2, Incomplete: 3},
+	}
+
+	if !reflect.DeepEqual(scrapeResponse.Files, wanted) {
+		t.Errorf("Unexpected scrape response %#v", scrapeResponse.Files)
+	}
+}
+
+func TestParseScrapeResponseFailure(t *testing.T) {
+	_, err := ParseScrapeResponse(strings.NewReader("d14:failure reason9:forbiddene"))
+	if err == nil || err.Error() != "forbidden" {
+		t.Errorf("Expected failure reason, got %v", err)
+	}
+}
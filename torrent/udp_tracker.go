@@ -0,0 +1,379 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"example.com/bencode"
+)
+
+// Magic constant identifying the UDP tracker protocol, see BEP 15.
+const UDPProtocolId int64 = 0x41727101980
+
+const (
+	UDPActionConnect int32 = iota
+	UDPActionAnnounce
+	UDPActionScrape
+	UDPActionError
+)
+
+// Event values on the wire differ from the HTTP ones.
+var udpEvents = map[string]int32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// Connection ids may be used for one minute after they are issued.
+const udpConnectionIdLifetime = time.Minute
+
+const defaultUDPBaseTimeout = 15 * time.Second
+const defaultUDPMaxRetries = 8
+
+// Largest UDP payload, peer lists of IPv6 trackers easily exceed a few kilobytes
+const udpMaxPacketSize = 65535
+
+var ErrTransactionMismatch = errors.New("transaction id mismatch")
+var ErrUnexpectedAction = errors.New("unexpected action in tracker response")
+var ErrTruncatedResponse = errors.New("tracker response too short")
+
+// Error message sent by the tracker instead of the expected response
+type udpTrackerError string
+
+func (e udpTrackerError) Error() string {
+	return string(e)
+}
+
+type udpConnectionId struct {
+	id       int64
+	obtained time.Time
+}
+
+type UDPTrackerClient struct {
+	// Retransmission timeout is BaseTimeout * 2^n, where n is the retry number
+	BaseTimeout time.Duration
+	MaxRetries  int
+
+	mutex         sync.Mutex
+	connectionIds map[string]udpConnectionId
+}
+
+func NewUDPTrackerClient() *UDPTrackerClient {
+	return &UDPTrackerClient{
+		BaseTimeout:   defaultUDPBaseTimeout,
+		MaxRetries:    defaultUDPMaxRetries,
+		connectionIds: make(map[string]udpConnectionId),
+	}
+}
+
+var DefaultUDPTrackerClient = NewUDPTrackerClient()
+
+func udpTrackerHost(trackerURL string) (string, error) {
+	parsedURL, err := url.Parse(trackerURL)
+	if err != nil {
+		return "", err
+	}
+
+	if parsedURL.Scheme != "udp" {
+		errMsg := fmt.Sprintf("Not an UDP tracker %s", trackerURL)
+		return "", errors.New(errMsg)
+	}
+
+	return parsedURL.Host, nil
+}
+
+// Sends packet until a response with the same transaction id arrives, or retries are exhausted.
+func (u *UDPTrackerClient) roundTrip(conn net.Conn, packet []byte, transactionId int32, stillValid func() bool) ([]byte, error) {
+	response := make([]byte, udpMaxPacketSize)
+
+	for n := 0; n <= u.MaxRetries; n++ {
+		if stillValid != nil && !stillValid() {
+			return nil, os.ErrDeadlineExceeded
+		}
+
+		_, err := conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(u.BaseTimeout * (1 << n)))
+
+		for {
+			length, err := conn.Read(response)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			if length < 8 {
+				continue
+			}
+
+			// Late answers to previous transmissions are just dropped
+			if int32(binary.BigEndian.Uint32(response[4:8])) != transactionId {
+				continue
+			}
+
+			action := int32(binary.BigEndian.Uint32(response[0:4]))
+			if action == UDPActionError {
+				return nil, udpTrackerError(response[8:length])
+			}
+
+			return response[:length], nil
+		}
+	}
+
+	return nil, os.ErrDeadlineExceeded
+}
+
+func (u *UDPTrackerClient) connect(conn net.Conn) (int64, error) {
+	transactionId := rand.Int31()
+
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, UDPProtocolId)
+	binary.Write(buffer, binary.BigEndian, UDPActionConnect)
+	binary.Write(buffer, binary.BigEndian, transactionId)
+
+	response, err := u.roundTrip(conn, buffer.Bytes(), transactionId, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 16 {
+		return 0, ErrTruncatedResponse
+	}
+
+	if int32(binary.BigEndian.Uint32(response[0:4])) != UDPActionConnect {
+		return 0, ErrUnexpectedAction
+	}
+
+	return int64(binary.BigEndian.Uint64(response[8:16])), nil
+}
+
+// Returns true as well when the id was taken from the cache instead of connecting.
+func (u *UDPTrackerClient) connectionId(conn net.Conn, host string) (udpConnectionId, bool, error) {
+	u.mutex.Lock()
+	cached, exists := u.connectionIds[host]
+	u.mutex.Unlock()
+
+	if exists && time.Since(cached.obtained) < udpConnectionIdLifetime {
+		return cached, true, nil
+	}
+
+	obtained := time.Now()
+
+	id, err := u.connect(conn)
+	if err != nil {
+		return udpConnectionId{}, false, err
+	}
+
+	connectionId := udpConnectionId{id: id, obtained: obtained}
+
+	u.mutex.Lock()
+	u.connectionIds[host] = connectionId
+	u.mutex.Unlock()
+
+	return connectionId, false, nil
+}
+
+// Other requests may have replaced the id in the meantime, those are kept.
+func (u *UDPTrackerClient) forgetConnectionId(host string, connectionId udpConnectionId) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.connectionIds[host] == connectionId {
+		delete(u.connectionIds, host)
+	}
+}
+
+// Connection id can expire while we are retransmitting, in that case a new one is requested.
+// Trackers may also refuse a cached id, e.g. when it was issued to another source port,
+// then it is dropped and the request is repeated once with a new one.
+// Remote address is returned as well, peer entry size depends on its family.
+func (u *UDPTrackerClient) request(ctx context.Context, trackerURL string, action int32, body []byte) ([]byte, net.Addr, error) {
+	host, err := udpTrackerHost(trackerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	// Closing the connection interrupts any pending read
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	reconnected := false
+
+	for {
+		connectionId, cached, err := u.connectionId(conn, host)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		transactionId := rand.Int31()
+
+		buffer := bytes.NewBuffer([]byte{})
+		binary.Write(buffer, binary.BigEndian, connectionId.id)
+		binary.Write(buffer, binary.BigEndian, action)
+		binary.Write(buffer, binary.BigEndian, transactionId)
+		buffer.Write(body)
+
+		stillValid := func() bool {
+			return time.Since(connectionId.obtained) < udpConnectionIdLifetime
+		}
+
+		response, err := u.roundTrip(conn, buffer.Bytes(), transactionId, stillValid)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) && !stillValid() {
+			continue
+		}
+
+		var trackerError udpTrackerError
+		if errors.As(err, &trackerError) && cached && !reconnected {
+			u.forgetConnectionId(host, connectionId)
+			reconnected = true
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if int32(binary.BigEndian.Uint32(response[0:4])) != action {
+			return nil, nil, ErrUnexpectedAction
+		}
+
+		return response[8:], conn.RemoteAddr(), nil
+	}
+}
+
+func (u *UDPTrackerClient) Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	event, exists := udpEvents[request.Event]
+	if !exists {
+		errMsg := fmt.Sprintf("Unknown event %s", request.Event)
+		return nil, errors.New(errMsg)
+	}
+
+	body := bytes.NewBuffer([]byte{})
+	body.Write(request.InfoHash)
+	body.Write(request.PeerId)
+	binary.Write(body, binary.BigEndian, int64(request.Downloaded))
+	binary.Write(body, binary.BigEndian, int64(request.Left))
+	binary.Write(body, binary.BigEndian, int64(request.Uploaded))
+	binary.Write(body, binary.BigEndian, event)
+	// Only IPv4 address can be given, zero leaves it to the tracker
+	ip := net.IPv4zero.To4()
+	if parsedIP := net.ParseIP(request.IP).To4(); parsedIP != nil {
+		ip = parsedIP
+	}
+	body.Write(ip)
+	binary.Write(body, binary.BigEndian, request.Key)
+	// -1 leaves number of wanted peers to the tracker
+	numWant := int32(-1)
+	if request.NumWant > 0 {
+		numWant = int32(request.NumWant)
+	}
+	binary.Write(body, binary.BigEndian, numWant)
+	binary.Write(body, binary.BigEndian, uint16(request.Port))
+
+	response, remoteAddr, err := u.request(ctx, request.AnnounceURL, UDPActionAnnounce, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Interval, leechers and seeders come before peers
+	if len(response) < 12 {
+		return nil, ErrTruncatedResponse
+	}
+
+	interval := int(binary.BigEndian.Uint32(response[0:4]))
+	leechers := int(binary.BigEndian.Uint32(response[4:8]))
+	seeders := int(binary.BigEndian.Uint32(response[8:12]))
+	peers := response[12:]
+
+	// Trackers reached over IPv6 send 18 byte peer entries
+	peersKey := "peers"
+	if udpAddr, ok := remoteAddr.(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+		peersKey = "peers6"
+	}
+
+	// Keep raw response in the same shape as a compact HTTP one,
+	// so it can be parsed again later on.
+	rawResponse, err := bencode.Marshal(map[string]any{
+		"interval":   interval,
+		"complete":   seeders,
+		"incomplete": leechers,
+		peersKey:     string(peers),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	announceResponse, err := parseCompactAnnounceResponse(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	announceResponse.RawResponse = rawResponse
+
+	return announceResponse, nil
+}
+
+func (u *UDPTrackerClient) Scrape(ctx context.Context, announceURL string, infoHashes [][]byte) (*ScrapeResponse, error) {
+	body := bytes.NewBuffer([]byte{})
+	for i := range infoHashes {
+		body.Write(infoHashes[i])
+	}
+
+	response, _, err := u.request(ctx, announceURL, UDPActionScrape, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Seeders, completed and leechers for every info hash in the same order
+	if len(response) < 12*len(infoHashes) {
+		return nil, ErrTruncatedResponse
+	}
+
+	scrapeResponse := ScrapeResponse{Files: make(map[string]ScrapeFile)}
+
+	for i := range infoHashes {
+		entry := response[12*i : 12*(i+1)]
+
+		scrapeResponse.Files[string(infoHashes[i])] = ScrapeFile{
+			Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+
+	return &scrapeResponse, nil
+}
@@ -0,0 +1,399 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type udpStandInTracker struct {
+	conn         net.PacketConn
+	connectionId int64
+	infoHash     []byte
+	peers        []byte
+	dropFirst    int32
+	connects     atomic.Int32
+	received     atomic.Int32
+	lastAnnounce atomic.Value
+}
+
+var standInPeers = []byte{127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}
+
+func startUDPStandInTracker(infoHash []byte, dropFirst int32) (*udpStandInTracker, error) {
+	return startUDPStandInTrackerOn("127.0.0.1:0", infoHash, standInPeers, dropFirst)
+}
+
+// Peers are given up front, they are read by the serving goroutine
+func startUDPStandInTrackerOn(address string, infoHash []byte, peers []byte, dropFirst int32) (*udpStandInTracker, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	tracker := udpStandInTracker{
+		conn:         conn,
+		connectionId: 0x1122334455,
+		infoHash:     infoHash,
+		peers:        peers,
+		dropFirst:    dropFirst,
+	}
+
+	go tracker.serve()
+
+	return &tracker, nil
+}
+
+func (s *udpStandInTracker) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpStandInTracker) close() {
+	s.conn.Close()
+}
+
+func (s *udpStandInTracker) serve() {
+	packet := make([]byte, 2048)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+
+		if s.received.Add(1) <= s.dropFirst {
+			continue
+		}
+
+		response := s.handle(packet[:n])
+		if response != nil {
+			s.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *udpStandInTracker) handle(packet []byte) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionId := int64(binary.BigEndian.Uint64(packet[0:8]))
+	action := int32(binary.BigEndian.Uint32(packet[8:12]))
+	transactionId := packet[12:16]
+
+	response := bytes.NewBuffer([]byte{})
+
+	writeError := func(message string) []byte {
+		response.Reset()
+		binary.Write(response, binary.BigEndian, UDPActionError)
+		response.Write(transactionId)
+		response.WriteString(message)
+
+		return response.Bytes()
+	}
+
+	if action == UDPActionConnect {
+		if connectionId != UDPProtocolId {
+			return writeError("wrong protocol")
+		}
+
+		s.connects.Add(1)
+
+		binary.Write(response, binary.BigEndian, UDPActionConnect)
+		response.Write(transactionId)
+		binary.Write(response, binary.BigEndian, s.connectionId)
+
+		return response.Bytes()
+	}
+
+	if connectionId != s.connectionId {
+		return writeError("bad connection id")
+	}
+
+	switch action {
+	case UDPActionAnnounce:
+		if !bytes.Equal(packet[16:36], s.infoHash) {
+			return writeError("unknown torrent")
+		}
+
+		s.lastAnnounce.Store(append([]byte{}, packet...))
+
+		binary.Write(response, binary.BigEndian, UDPActionAnnounce)
+		response.Write(transactionId)
+		binary.Write(response, binary.BigEndian, []int32{1800, 2, 3})
+		response.Write(s.peers)
+	case UDPActionScrape:
+		binary.Write(response, binary.BigEndian, UDPActionScrape)
+		response.Write(transactionId)
+
+		for i := 16; i+20 <= len(packet); i += 20 {
+			binary.Write(response, binary.BigEndian, []int32{3, 10, 2})
+		}
+	}
+
+	return response.Bytes()
+}
+
+func newTestUDPTrackerClient() *UDPTrackerClient {
+	udpClient := NewUDPTrackerClient()
+	udpClient.BaseTimeout = 20 * time.Millisecond
+	udpClient.MaxRetries = 3
+
+	return udpClient
+}
+
+type udpAnnounceTestCase struct {
+	name        string
+	dropFirst   int32
+	wrongHash   bool
+	wantedError string
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	testCases := []udpAnnounceTestCase{
+		{"Announce OK", 0, false, ""},
+		{"Lost packets retransmitted", 2, false, ""},
+		{"Tracker error", 0, true, "unknown torrent"},
+		{"Tracker not answering", 100, false, os.ErrDeadlineExceeded.Error()},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+
+		t.Run(testCase.name, func(t *testing.T) {
+			infoHash := GenerateRandomProtocolId()
+
+			tracker, err := startUDPStandInTracker(infoHash, testCase.dropFirst)
+			if err != nil {
+				t.Errorf("Could not start tracker %v", err)
+				return
+			}
+			defer tracker.close()
+
+			request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881, Event: EventStarted}
+			if testCase.wrongHash {
+				request.InfoHash = GenerateRandomProtocolId()
+			}
+
+			response, err := newTestUDPTrackerClient().Announce(context.Background(), &request)
+			if testCase.wantedError != "" {
+				if err == nil || err.Error() != testCase.wantedError {
+					t.Errorf("Wanted error %s, got %v", testCase.wantedError, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Did not expect error %v", err)
+				return
+			}
+
+			if response.Interval != 1800 || len(response.Peers) != 2 || response.Peers[1].Port != 0x1ae2 {
+				t.Errorf("Unexpected response %#v", response)
+				return
+			}
+
+			reparsed, err := ParseAnnounceResponse(bytes.NewReader(response.RawResponse))
+			if err != nil || len(reparsed.Peers) != 2 {
+				t.Errorf("Expected raw response to be parsable %v", err)
+			}
+		})
+	}
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	peers := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1)
+
+	tracker, err := startUDPStandInTrackerOn("[::1]:0", infoHash, peers, 0)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available %v", err)
+	}
+	defer tracker.close()
+
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881}
+
+	response, err := newTestUDPTrackerClient().Announce(context.Background(), &request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(response.Peers) != 1 || response.Peers[0].IP.String() != "2001:db8::1" || response.Peers[0].Port != 0x1ae1 {
+		t.Errorf("Unexpected response %#v", response)
+	}
+}
+
+func TestUDPAnnounceOptionalFields(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	tracker, err := startUDPStandInTracker(infoHash, 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881, IP: "10.0.0.1", Key: 0xCAFEBABE, NumWant: 30}
+
+	_, err = newTestUDPTrackerClient().Announce(context.Background(), &request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	packet := tracker.lastAnnounce.Load().([]byte)
+
+	// Connection id, action and transaction id, then info hash, peer id, three counters and event
+	fields := packet[16+20+20+24+4:]
+
+	if !net.IP(fields[0:4]).Equal(net.ParseIP("10.0.0.1")) || binary.BigEndian.Uint32(fields[4:8]) != 0xCAFEBABE || binary.BigEndian.Uint32(fields[8:12]) != 30 {
+		t.Errorf("Unexpected optional fields %x", fields)
+	}
+}
+
+func TestUDPConnectionIdCached(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	tracker, err := startUDPStandInTracker(infoHash, 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	udpClient := newTestUDPTrackerClient()
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881}
+
+	for i := 0; i < 3; i++ {
+		if _, err := udpClient.Announce(context.Background(), &request); err != nil {
+			t.Errorf("Did not expect error %v", err)
+			return
+		}
+	}
+
+	if tracker.connects.Load() != 1 {
+		t.Errorf("Expected one connect, got %d", tracker.connects.Load())
+	}
+
+	// Expired connection id is replaced
+	udpClient.connectionIds[tracker.conn.LocalAddr().String()] = udpConnectionId{id: 1, obtained: time.Now().Add(-2 * time.Minute)}
+
+	if _, err := udpClient.Announce(context.Background(), &request); err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if tracker.connects.Load() != 2 {
+		t.Errorf("Expected reconnect, got %d connects", tracker.connects.Load())
+	}
+}
+
+func TestUDPConnectionIdRefused(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	tracker, err := startUDPStandInTracker(infoHash, 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	udpClient := newTestUDPTrackerClient()
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881}
+
+	// Not expired yet, but the tracker does not know it anymore
+	udpClient.connectionIds[tracker.conn.LocalAddr().String()] = udpConnectionId{id: 1, obtained: time.Now()}
+
+	if _, err := udpClient.Announce(context.Background(), &request); err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if tracker.connects.Load() != 1 || udpClient.connectionIds[tracker.conn.LocalAddr().String()].id != tracker.connectionId {
+		t.Errorf("Expected refused connection id to be replaced, got %d connects", tracker.connects.Load())
+	}
+}
+
+func TestUDPAnnounceManyPeers(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	peers := bytes.Repeat(append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1), 500)
+
+	tracker, err := startUDPStandInTrackerOn("[::1]:0", infoHash, peers, 0)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available %v", err)
+	}
+	defer tracker.close()
+
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881}
+
+	response, err := newTestUDPTrackerClient().Announce(context.Background(), &request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(response.Peers) != 500 {
+		t.Errorf("Expected 500 peers, got %d", len(response.Peers))
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	tracker, err := startUDPStandInTracker(GenerateRandomProtocolId(), 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	infoHashes := [][]byte{GenerateRandomProtocolId(), GenerateRandomProtocolId()}
+
+	response, err := newTestUDPTrackerClient().Scrape(context.Background(), tracker.url(), infoHashes)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	for i := range infoHashes {
+		file, exists := response.Files[string(infoHashes[i])]
+		if !exists || file != (ScrapeFile{Complete: 3, Downloaded: 10, Incomplete: 2}) {
+			t.Errorf("Unexpected scrape of %d %#v", i, file)
+		}
+	}
+}
+
+func TestAnnounceDispatchesUDP(t *testing.T) {
+	infoHash := GenerateRandomProtocolId()
+
+	tracker, err := startUDPStandInTracker(infoHash, 0)
+	if err != nil {
+		t.Errorf("Could not start tracker %v", err)
+		return
+	}
+	defer tracker.close()
+
+	request := AnnounceRequest{AnnounceURL: tracker.url(), PeerId: GenerateRandomProtocolId(), InfoHash: infoHash, Port: 6881}
+
+	response, err := Announce(&request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if len(response.Peers) != 2 {
+		t.Errorf("Unexpected response %#v", response)
+	}
+
+	_, err = Announce(&AnnounceRequest{AnnounceURL: "udp://[::1", InfoHash: infoHash})
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected URL error, got %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/bencode"
+	"example.com/db"
+)
+
+const defaultInterval = 30 * time.Minute
+const defaultMinInterval = 5 * time.Minute
+
+// Peers missing two announces in a row are considered gone
+const defaultPeerTimeout = 2 * defaultInterval
+
+const defaultNumWant = 50
+const maxNumWant = 200
+
+const infoHashLength = 20
+const peerIdLength = 20
+
+var ErrInvalidInfoHash = errors.New("invalid info hash")
+var ErrInvalidPeerId = errors.New("invalid peer id")
+var ErrInvalidPort = errors.New("invalid port")
+var ErrInfoHashNotAllowed = errors.New("info hash not allowed")
+
+type Server struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTimeout time.Duration
+	// Optional, swarms are kept only in memory without it
+	PeerRepo db.SwarmPeerRepository
+	Now      func() time.Time
+	// Proxies whose requests may tell the address of the peer with the ip parameter,
+	// requests from private networks may always do so
+	TrustedProxies []*net.IPNet
+
+	mutex  sync.Mutex
+	swarms map[string]*swarm
+	// Nil means every info hash is allowed
+	whitelist map[string]bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		Interval:    defaultInterval,
+		MinInterval: defaultMinInterval,
+		PeerTimeout: defaultPeerTimeout,
+		swarms:      make(map[string]*swarm),
+	}
+}
+
+func (s *Server) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+
+	return s.Now()
+}
+
+// Once an info hash is allowed, only allowed ones are tracked
+func (s *Server) Allow(infoHash []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.whitelist == nil {
+		s.whitelist = make(map[string]bool)
+	}
+
+	s.whitelist[string(infoHash)] = true
+}
+
+func (s *Server) allowed(infoHash string) bool {
+	return s.whitelist == nil || s.whitelist[infoHash]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Paths may be prefixed, e.g. with a passkey
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		s.handleAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		s.handleScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeBencoded(w http.ResponseWriter, response map[string]any) {
+	responseBytes, err := bencode.Marshal(response)
+	if err != nil {
+		slog.Error("Could not encode tracker response " + err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(responseBytes)
+}
+
+// Failures are reported in the body, status stays OK
+func writeFailure(w http.ResponseWriter, reason error) {
+	writeBencoded(w, map[string]any{"failure reason": reason.Error()})
+}
+
+type announce struct {
+	infoHash   string
+	peerId     string
+	ip         net.IP
+	port       int
+	uploaded   int
+	downloaded int
+	left       int
+	event      string
+	compact    bool
+	noPeerId   bool
+	numWant    int
+}
+
+func queryInt(r *http.Request, key string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		errMsg := fmt.Sprintf("invalid %s", key)
+		return 0, errors.New(errMsg)
+	}
+
+	return number, nil
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// Announced ip is only taken from requests we trust, anyone else could register peers on addresses they don't own
+func (s *Server) trustsAnnouncedIP(remote net.IP) bool {
+	if remote.IsLoopback() || remote.IsPrivate() {
+		return true
+	}
+
+	for _, proxy := range s.TrustedProxies {
+		if proxy.Contains(remote) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) parseAnnounce(r *http.Request) (*announce, error) {
+	q := r.URL.Query()
+
+	a := announce{
+		infoHash: q.Get("info_hash"),
+		peerId:   q.Get("peer_id"),
+		event:    q.Get("event"),
+		compact:  q.Get("compact") == "1",
+		noPeerId: q.Has("no_peer_id"),
+	}
+
+	if len(a.infoHash) != infoHashLength {
+		return nil, ErrInvalidInfoHash
+	}
+
+	if len(a.peerId) != peerIdLength {
+		return nil, ErrInvalidPeerId
+	}
+
+	var err error
+
+	a.port, err = queryInt(r, "port", 0)
+	if err != nil || a.port <= 0 || a.port > 65535 {
+		return nil, ErrInvalidPort
+	}
+
+	for key, target := range map[string]*int{"uploaded": &a.uploaded, "downloaded": &a.downloaded, "left": &a.left} {
+		*target, err = queryInt(r, key, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.numWant, err = queryInt(r, "numwant", defaultNumWant)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.numWant < 0 || a.numWant > maxNumWant {
+		a.numWant = maxNumWant
+	}
+
+	a.ip = remoteIP(r)
+	if a.ip == nil {
+		return nil, errors.New("unknown peer address")
+	}
+
+	// Announced IP is taken only if it is a literal, DNS names are not resolved
+	announcedIP := net.ParseIP(q.Get("ip"))
+	if announcedIP != nil && s.trustsAnnouncedIP(a.ip) {
+		a.ip = announcedIP
+	}
+
+	return &a, nil
+}
+
+type announceResult struct {
+	peers      []*db.SwarmPeer
+	complete   int
+	incomplete int
+}
+
+// Updates the swarm with the announcing peer, shared by HTTP and UDP
+func (s *Server) announce(a *announce) (*announceResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.allowed(a.infoHash) {
+		return nil, ErrInfoHashNotAllowed
+	}
+
+	now := s.now()
+
+	sw := s.getSwarm(a.infoHash, true)
+	s.expireSwarm(sw, now)
+
+	if a.event == "stopped" {
+		s.removePeer(sw, a.peerId)
+	} else {
+		peer, exists := sw.peers[a.peerId]
+		if !exists {
+			peer = &db.SwarmPeer{HashInfo: []byte(a.infoHash), ProtocolPeerId: []byte(a.peerId)}
+			sw.peers[a.peerId] = peer
+		}
+
+		peer.IP = a.ip.String()
+		peer.Port = a.port
+		peer.Uploaded = a.uploaded
+		peer.Downloaded = a.downloaded
+		peer.Left = a.left
+		peer.LastSeen = now
+
+		s.savePeer(peer)
+
+		if a.event == "completed" {
+			sw.completed++
+		}
+	}
+
+	result := announceResult{peers: s.selectPeers(sw, a)}
+	result.complete, result.incomplete = sw.counts()
+
+	return &result, nil
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	a, err := s.parseAnnounce(r)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	result, err := s.announce(a)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	response := map[string]any{
+		"interval":     int(s.Interval.Seconds()),
+		"min interval": int(s.MinInterval.Seconds()),
+		"complete":     result.complete,
+		"incomplete":   result.incomplete,
+	}
+
+	if a.compact {
+		compactPeers, compactPeers6 := encodeCompactPeers(result.peers)
+
+		response["peers"] = compactPeers
+		if len(compactPeers6) > 0 {
+			response["peers6"] = compactPeers6
+		}
+	} else {
+		response["peers"] = encodePeers(result.peers, a.noPeerId)
+	}
+
+	writeBencoded(w, response)
+}
+
+// Up to numWant peers other than the announcing one, map order makes it random
+func (s *Server) selectPeers(sw *swarm, a *announce) []*db.SwarmPeer {
+	var peers []*db.SwarmPeer
+
+	for peerId, peer := range sw.peers {
+		if len(peers) >= a.numWant {
+			break
+		}
+
+		if peerId == a.peerId {
+			continue
+		}
+
+		// Seeders have no use of other seeders
+		if a.left == 0 && peer.Left == 0 {
+			continue
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+func encodeCompactPeers(peers []*db.SwarmPeer) (string, string) {
+	compactPeers := []byte{}
+	compactPeers6 := []byte{}
+
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.IP)
+		port := []byte{byte(peer.Port >> 8), byte(peer.Port)}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			compactPeers = append(append(compactPeers, ip4...), port...)
+		} else {
+			compactPeers6 = append(append(compactPeers6, ip.To16()...), port...)
+		}
+	}
+
+	return string(compactPeers), string(compactPeers6)
+}
+
+func encodePeers(peers []*db.SwarmPeer, noPeerId bool) []any {
+	encoded := []any{}
+
+	for _, peer := range peers {
+		encodedPeer := map[string]any{"ip": peer.IP, "port": peer.Port}
+		if !noPeerId {
+			encodedPeer["peer id"] = string(peer.ProtocolPeerId)
+		}
+
+		encoded = append(encoded, encodedPeer)
+	}
+
+	return encoded
+}
+
+type scrapeEntry struct {
+	complete   int
+	downloaded int
+	incomplete int
+}
+
+// Unknown and not allowed info hashes are left out
+func (s *Server) scrape(infoHashes []string) map[string]scrapeEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Without info hashes every swarm is scraped
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	now := s.now()
+	entries := make(map[string]scrapeEntry)
+
+	for _, infoHash := range infoHashes {
+		sw := s.getSwarm(infoHash, false)
+		if sw == nil || !s.allowed(infoHash) {
+			continue
+		}
+
+		s.expireSwarm(sw, now)
+
+		complete, incomplete := sw.counts()
+		entries[infoHash] = scrapeEntry{complete: complete, downloaded: sw.completed, incomplete: incomplete}
+	}
+
+	return entries
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	files := make(map[string]any)
+
+	for infoHash, entry := range s.scrape(r.URL.Query()["info_hash"]) {
+		files[infoHash] = map[string]any{
+			"complete":   entry.complete,
+			"downloaded": entry.downloaded,
+			"incomplete": entry.incomplete,
+		}
+	}
+
+	writeBencoded(w, map[string]any{"files": files})
+}
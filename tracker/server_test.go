@@ -0,0 +1,266 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"example.com/db"
+	"example.com/torrent"
+)
+
+type memoryPeerRepository struct {
+	peers  map[int]db.SwarmPeer
+	nextId int
+}
+
+func newMemoryPeerRepository() *memoryPeerRepository {
+	return &memoryPeerRepository{peers: make(map[int]db.SwarmPeer)}
+}
+
+func (m *memoryPeerRepository) Create(peer *db.SwarmPeer) error {
+	m.nextId++
+	peer.SwarmPeerId = m.nextId
+	m.peers[peer.SwarmPeerId] = *peer
+
+	return nil
+}
+
+func (m *memoryPeerRepository) Update(peer *db.SwarmPeer) error {
+	m.peers[peer.SwarmPeerId] = *peer
+
+	return nil
+}
+
+func (m *memoryPeerRepository) Delete(peer *db.SwarmPeer) error {
+	delete(m.peers, peer.SwarmPeerId)
+
+	return nil
+}
+
+func (m *memoryPeerRepository) GetAll() ([]db.SwarmPeer, error) {
+	var peers []db.SwarmPeer
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+type testTracker struct {
+	server     *Server
+	httpServer *httptest.Server
+	now        time.Time
+}
+
+func startTestTracker() *testTracker {
+	tracker := testTracker{server: NewServer(), now: time.Now()}
+	tracker.server.Now = func() time.Time {
+		return tracker.now
+	}
+	tracker.httpServer = httptest.NewServer(tracker.server)
+
+	return &tracker
+}
+
+func (tt *testTracker) announce(infoHash []byte, peerId []byte, port int, left int, event string, compact bool) (*torrent.AnnounceResponse, error) {
+	request := torrent.AnnounceRequest{
+		AnnounceURL: tt.httpServer.URL + "/announce",
+		InfoHash:    infoHash,
+		PeerId:      peerId,
+		Port:        port,
+		Left:        left,
+		Event:       event,
+		Compact:     compact,
+	}
+
+	return torrent.NewTrackerClient().Announce(context.Background(), &request)
+}
+
+func TestAnnounce(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		tracker := startTestTracker()
+		defer tracker.httpServer.Close()
+
+		infoHash := torrent.GenerateRandomProtocolId()
+		seederId := torrent.GenerateRandomProtocolId()
+
+		_, err := tracker.announce(infoHash, seederId, 6881, 0, torrent.EventStarted, compact)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			return
+		}
+
+		response, err := tracker.announce(infoHash, torrent.GenerateRandomProtocolId(), 6882, 100, torrent.EventStarted, compact)
+		if err != nil {
+			t.Errorf("Did not expect error %v", err)
+			return
+		}
+
+		if response.Complete != 1 || response.Incomplete != 1 || response.Interval != int(defaultInterval.Seconds()) {
+			t.Errorf("Unexpected response %#v", response)
+			return
+		}
+
+		if len(response.Peers) != 1 || response.Peers[0].Port != 6881 || !response.Peers[0].IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("Expected seeder in peers %#v", response.Peers)
+			return
+		}
+
+		if !compact && string(response.Peers[0].PeerId) != string(seederId) {
+			t.Errorf("Expected peer id in standard response %#v", response.Peers[0])
+			return
+		}
+	}
+}
+
+func TestAnnounceStoppedAndExpired(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	infoHash := torrent.GenerateRandomProtocolId()
+	stoppingId := torrent.GenerateRandomProtocolId()
+
+	tracker.announce(infoHash, stoppingId, 6881, 0, torrent.EventStarted, true)
+	tracker.announce(infoHash, torrent.GenerateRandomProtocolId(), 6882, 0, torrent.EventStarted, true)
+
+	response, err := tracker.announce(infoHash, stoppingId, 6881, 0, torrent.EventStopped, true)
+	if err != nil || response.Complete != 1 {
+		t.Errorf("Expected stopped peer to be removed %v %#v", err, response)
+		return
+	}
+
+	tracker.now = tracker.now.Add(defaultPeerTimeout + time.Second)
+
+	response, err = tracker.announce(infoHash, torrent.GenerateRandomProtocolId(), 6883, 100, torrent.EventStarted, true)
+	if err != nil || response.Complete != 0 || response.Incomplete != 1 || len(response.Peers) != 0 {
+		t.Errorf("Expected silent peer to expire %v %#v", err, response)
+		return
+	}
+}
+
+func TestAnnounceWhitelist(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	allowed := torrent.GenerateRandomProtocolId()
+	tracker.server.Allow(allowed)
+
+	_, err := tracker.announce(allowed, torrent.GenerateRandomProtocolId(), 6881, 0, torrent.EventStarted, true)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	_, err = tracker.announce(torrent.GenerateRandomProtocolId(), torrent.GenerateRandomProtocolId(), 6881, 0, torrent.EventStarted, true)
+	if err == nil || err.Error() != ErrInfoHashNotAllowed.Error() {
+		t.Errorf("Expected %v, got %v", ErrInfoHashNotAllowed, err)
+		return
+	}
+}
+
+func TestAnnounceInvalidRequest(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	_, err := tracker.announce([]byte("short"), torrent.GenerateRandomProtocolId(), 6881, 0, torrent.EventNone, true)
+	if err == nil || err.Error() != ErrInvalidInfoHash.Error() {
+		t.Errorf("Expected %v, got %v", ErrInvalidInfoHash, err)
+	}
+
+	_, err = tracker.announce(torrent.GenerateRandomProtocolId(), torrent.GenerateRandomProtocolId(), 0, 0, torrent.EventNone, true)
+	if err == nil || err.Error() != ErrInvalidPort.Error() {
+		t.Errorf("Expected %v, got %v", ErrInvalidPort, err)
+	}
+}
+
+func TestAnnouncedIP(t *testing.T) {
+	server := NewServer()
+	_, proxy, _ := net.ParseCIDR("203.0.113.0/24")
+	server.TrustedProxies = []*net.IPNet{proxy}
+
+	query := "/announce?info_hash=" + url.QueryEscape(string(torrent.GenerateRandomProtocolId())) + "&peer_id=" + url.QueryEscape(string(torrent.GenerateRandomProtocolId())) + "&port=6881&ip=198.51.100.7"
+
+	testCases := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"192.0.2.1:5000", "192.0.2.1"},
+		{"203.0.113.5:5000", "198.51.100.7"},
+		{"10.0.0.2:5000", "198.51.100.7"},
+		{"[::1]:5000", "198.51.100.7"},
+	}
+
+	for _, testCase := range testCases {
+		request := httptest.NewRequest("GET", query, nil)
+		request.RemoteAddr = testCase.remoteAddr
+
+		a, err := server.parseAnnounce(request)
+		if err != nil || !a.ip.Equal(net.ParseIP(testCase.expected)) {
+			t.Errorf("Expected %s for request from %s, got %#v %v", testCase.expected, testCase.remoteAddr, a, err)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	first := torrent.GenerateRandomProtocolId()
+	second := torrent.GenerateRandomProtocolId()
+
+	tracker.announce(first, torrent.GenerateRandomProtocolId(), 6881, 0, torrent.EventCompleted, true)
+	tracker.announce(first, torrent.GenerateRandomProtocolId(), 6882, 10, torrent.EventStarted, true)
+	tracker.announce(second, torrent.GenerateRandomProtocolId(), 6883, 10, torrent.EventStarted, true)
+
+	scrapeResponse, err := torrent.NewTrackerClient().Scrape(context.Background(), tracker.httpServer.URL+"/announce", [][]byte{first, second})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if scrapeResponse.Files[string(first)] != (torrent.ScrapeFile{Complete: 1, Downloaded: 1, Incomplete: 1}) {
+		t.Errorf("Unexpected scrape of first %#v", scrapeResponse.Files)
+	}
+
+	if scrapeResponse.Files[string(second)] != (torrent.ScrapeFile{Complete: 0, Downloaded: 0, Incomplete: 1}) {
+		t.Errorf("Unexpected scrape of second %#v", scrapeResponse.Files)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	peerRepo := newMemoryPeerRepository()
+
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+	tracker.server.PeerRepo = peerRepo
+
+	infoHash := torrent.GenerateRandomProtocolId()
+
+	tracker.announce(infoHash, torrent.GenerateRandomProtocolId(), 6881, 0, torrent.EventStarted, true)
+
+	if len(peerRepo.peers) != 1 {
+		t.Errorf("Expected peer to be persisted %#v", peerRepo.peers)
+		return
+	}
+
+	// A new server picks up the swarm
+	restarted := startTestTracker()
+	defer restarted.httpServer.Close()
+	restarted.server.PeerRepo = peerRepo
+
+	err := restarted.server.Load()
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	response, err := restarted.announce(infoHash, torrent.GenerateRandomProtocolId(), 6882, 10, torrent.EventStarted, true)
+	if err != nil || len(response.Peers) != 1 || response.Peers[0].Port != 6881 {
+		t.Errorf("Expected persisted peer %v %#v", err, response)
+		return
+	}
+}
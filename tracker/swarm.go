@@ -0,0 +1,127 @@
+package tracker
+
+import (
+	"log/slog"
+	"time"
+
+	"example.com/db"
+)
+
+type swarm struct {
+	// Keyed by protocol peer id
+	peers     map[string]*db.SwarmPeer
+	completed int
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: make(map[string]*db.SwarmPeer)}
+}
+
+// Seeders and leechers
+func (sw *swarm) counts() (int, int) {
+	complete := 0
+
+	for _, peer := range sw.peers {
+		if peer.Left == 0 {
+			complete++
+		}
+	}
+
+	return complete, len(sw.peers) - complete
+}
+
+func (s *Server) getSwarm(infoHash string, create bool) *swarm {
+	sw, exists := s.swarms[infoHash]
+	if !exists && create {
+		sw = newSwarm()
+		s.swarms[infoHash] = sw
+	}
+
+	return sw
+}
+
+func (s *Server) savePeer(peer *db.SwarmPeer) {
+	if s.PeerRepo == nil {
+		return
+	}
+
+	var err error
+
+	if peer.SwarmPeerId == 0 {
+		err = s.PeerRepo.Create(peer)
+	} else {
+		err = s.PeerRepo.Update(peer)
+	}
+
+	// In memory state is what answers announces, so only log here
+	if err != nil {
+		slog.Error("Could not save swarm peer " + err.Error())
+	}
+}
+
+func (s *Server) removePeer(sw *swarm, peerId string) {
+	peer, exists := sw.peers[peerId]
+	if !exists {
+		return
+	}
+
+	delete(sw.peers, peerId)
+
+	if s.PeerRepo == nil || peer.SwarmPeerId == 0 {
+		return
+	}
+
+	err := s.PeerRepo.Delete(peer)
+	if err != nil {
+		slog.Error("Could not delete swarm peer " + err.Error())
+	}
+}
+
+func (s *Server) expireSwarm(sw *swarm, now time.Time) {
+	for peerId, peer := range sw.peers {
+		if now.Sub(peer.LastSeen) > s.PeerTimeout {
+			s.removePeer(sw, peerId)
+		}
+	}
+}
+
+// Removes peers which did not announce within PeerTimeout
+func (s *Server) ExpirePeers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+
+	for infoHash, sw := range s.swarms {
+		s.expireSwarm(sw, now)
+
+		if len(sw.peers) == 0 && sw.completed == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+// Restores swarms from PeerRepo, peers which expired meanwhile are dropped
+func (s *Server) Load() error {
+	if s.PeerRepo == nil {
+		return nil
+	}
+
+	dbPeers, err := s.PeerRepo.GetAll()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	for i := range dbPeers {
+		peer := dbPeers[i]
+
+		sw := s.getSwarm(string(peer.HashInfo), true)
+		sw.peers[string(peer.ProtocolPeerId)] = &peer
+	}
+	s.mutex.Unlock()
+
+	s.ExpirePeers()
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Magic constant identifying the UDP tracker protocol, see BEP 15.
+const udpProtocolId int64 = 0x41727101980
+
+const (
+	udpActionConnect int32 = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+var udpEvents = map[int32]string{
+	0: "",
+	1: "completed",
+	2: "started",
+	3: "stopped",
+}
+
+// Clients use connection ids for one minute, some slack is given on our side
+const defaultConnectionIdLifetime = 2 * time.Minute
+
+const udpMaxPacketSize = 2048
+
+// Connection id, action and transaction id
+const udpHeaderSize = 16
+const udpAnnounceSize = 98
+
+// As many info hashes as fit into a packet
+const udpMaxScrapeHashes = 74
+
+var ErrUnknownConnectionId = errors.New("unknown connection id")
+var ErrInvalidPacket = errors.New("invalid packet")
+
+type udpConnection struct {
+	ip     string
+	issued time.Time
+}
+
+// Serves BEP 15 announces and scrapes on top of the swarms of Server,
+// so the same swarm can be reached over HTTP and UDP.
+type UDPServer struct {
+	Server               *Server
+	ConnectionIdLifetime time.Duration
+
+	mutex       sync.Mutex
+	connections map[int64]udpConnection
+}
+
+func NewUDPServer(server *Server) *UDPServer {
+	return &UDPServer{
+		Server:               server,
+		ConnectionIdLifetime: defaultConnectionIdLifetime,
+		connections:          make(map[int64]udpConnection),
+	}
+}
+
+// Blocks until conn is closed
+func (u *UDPServer) Serve(conn net.PacketConn) error {
+	packet := make([]byte, udpMaxPacketSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		response := u.handle(packet[:n], addr)
+		if response == nil {
+			continue
+		}
+
+		_, err = conn.WriteTo(response, addr)
+		if err != nil {
+			slog.Warn("Could not answer UDP tracker request " + err.Error())
+		}
+	}
+}
+
+// Clients may send every request from a new source port, so only the IP counts, see BEP 15.
+func udpSourceIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+func (u *UDPServer) issueConnectionId(addr net.Addr) int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := u.Server.now()
+
+	for id, connection := range u.connections {
+		if now.Sub(connection.issued) > u.ConnectionIdLifetime {
+			delete(u.connections, id)
+		}
+	}
+
+	id := rand.Int63()
+	u.connections[id] = udpConnection{ip: udpSourceIP(addr), issued: now}
+
+	return id
+}
+
+// Connection id is only valid for the IP it was issued to
+func (u *UDPServer) validConnectionId(id int64, addr net.Addr) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	connection, exists := u.connections[id]
+	if !exists || connection.ip != udpSourceIP(addr) {
+		return false
+	}
+
+	return u.Server.now().Sub(connection.issued) <= u.ConnectionIdLifetime
+}
+
+func udpError(transactionId []byte, err error) []byte {
+	response := bytes.NewBuffer([]byte{})
+	binary.Write(response, binary.BigEndian, udpActionError)
+	response.Write(transactionId)
+	response.WriteString(err.Error())
+
+	return response.Bytes()
+}
+
+// Returns nil for packets which are not worth an answer
+func (u *UDPServer) handle(packet []byte, addr net.Addr) []byte {
+	if len(packet) < udpHeaderSize {
+		return nil
+	}
+
+	connectionId := int64(binary.BigEndian.Uint64(packet[0:8]))
+	action := int32(binary.BigEndian.Uint32(packet[8:12]))
+	transactionId := packet[12:16]
+
+	if action == udpActionConnect {
+		if connectionId != udpProtocolId {
+			return nil
+		}
+
+		response := bytes.NewBuffer([]byte{})
+		binary.Write(response, binary.BigEndian, udpActionConnect)
+		response.Write(transactionId)
+		binary.Write(response, binary.BigEndian, u.issueConnectionId(addr))
+
+		return response.Bytes()
+	}
+
+	if !u.validConnectionId(connectionId, addr) {
+		return udpError(transactionId, ErrUnknownConnectionId)
+	}
+
+	var response []byte
+	var err error
+
+	switch action {
+	case udpActionAnnounce:
+		response, err = u.handleAnnounce(packet, addr)
+	case udpActionScrape:
+		response, err = u.handleScrape(packet)
+	default:
+		err = ErrInvalidPacket
+	}
+
+	if err != nil {
+		return udpError(transactionId, err)
+	}
+
+	header := bytes.NewBuffer([]byte{})
+	binary.Write(header, binary.BigEndian, action)
+	header.Write(transactionId)
+
+	return append(header.Bytes(), response...)
+}
+
+func (u *UDPServer) handleAnnounce(packet []byte, addr net.Addr) ([]byte, error) {
+	if len(packet) < udpAnnounceSize {
+		return nil, ErrInvalidPacket
+	}
+
+	event, exists := udpEvents[int32(binary.BigEndian.Uint32(packet[80:84]))]
+	if !exists {
+		return nil, ErrInvalidPacket
+	}
+
+	a := announce{
+		infoHash:   string(packet[16:36]),
+		peerId:     string(packet[36:56]),
+		downloaded: int(binary.BigEndian.Uint64(packet[56:64])),
+		left:       int(binary.BigEndian.Uint64(packet[64:72])),
+		uploaded:   int(binary.BigEndian.Uint64(packet[72:80])),
+		event:      event,
+		port:       int(binary.BigEndian.Uint16(packet[96:98])),
+		compact:    true,
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, ErrInvalidPacket
+	}
+
+	// Zero means the address the packet came from, others are only taken from trusted senders
+	a.ip = udpAddr.IP
+	if ip := net.IP(packet[84:88]); !ip.Equal(net.IPv4zero) && u.Server.trustsAnnouncedIP(udpAddr.IP) {
+		a.ip = ip
+	}
+
+	numWant := int(int32(binary.BigEndian.Uint32(packet[92:96])))
+	a.numWant = numWant
+	if numWant < 0 {
+		a.numWant = defaultNumWant
+	}
+	if numWant > maxNumWant {
+		a.numWant = maxNumWant
+	}
+
+	if a.port == 0 {
+		return nil, ErrInvalidPort
+	}
+
+	result, err := u.Server.announce(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	response := bytes.NewBuffer([]byte{})
+	binary.Write(response, binary.BigEndian, int32(u.Server.Interval.Seconds()))
+	binary.Write(response, binary.BigEndian, int32(result.incomplete))
+	binary.Write(response, binary.BigEndian, int32(result.complete))
+
+	// Peer entries have the size of the address family the request came over
+	compactPeers, compactPeers6 := encodeCompactPeers(result.peers)
+	if udpAddr.IP.To4() != nil {
+		response.WriteString(compactPeers)
+	} else {
+		response.WriteString(compactPeers6)
+	}
+
+	return response.Bytes(), nil
+}
+
+func (u *UDPServer) handleScrape(packet []byte) ([]byte, error) {
+	hashes := packet[udpHeaderSize:]
+	if len(hashes)%infoHashLength != 0 || len(hashes)/infoHashLength > udpMaxScrapeHashes {
+		return nil, ErrInvalidPacket
+	}
+
+	var infoHashes []string
+	for i := 0; i < len(hashes); i += infoHashLength {
+		infoHashes = append(infoHashes, string(hashes[i:i+infoHashLength]))
+	}
+
+	entries := u.Server.scrape(infoHashes)
+
+	// Same order as requested, unknown ones are all zeros
+	response := bytes.NewBuffer([]byte{})
+	for _, infoHash := range infoHashes {
+		entry := entries[infoHash]
+
+		binary.Write(response, binary.BigEndian, int32(entry.complete))
+		binary.Write(response, binary.BigEndian, int32(entry.downloaded))
+		binary.Write(response, binary.BigEndian, int32(entry.incomplete))
+	}
+
+	return response.Bytes(), nil
+}
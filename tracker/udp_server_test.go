@@ -0,0 +1,210 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/torrent"
+)
+
+func startTestUDPServer(tracker *testTracker) (*UDPServer, net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	udpServer := NewUDPServer(tracker.server)
+	go udpServer.Serve(conn)
+
+	return udpServer, conn, nil
+}
+
+func TestUDPServerSharesSwarm(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	_, conn, err := startTestUDPServer(tracker)
+	if err != nil {
+		t.Errorf("Could not start UDP server %v", err)
+		return
+	}
+	defer conn.Close()
+
+	udpURL := "udp://" + conn.LocalAddr().String() + "/announce"
+	infoHash := torrent.GenerateRandomProtocolId()
+
+	// Seeder over UDP
+	request := torrent.AnnounceRequest{AnnounceURL: udpURL, InfoHash: infoHash, PeerId: torrent.GenerateRandomProtocolId(), Port: 6881, Event: torrent.EventStarted}
+
+	_, err = torrent.NewUDPTrackerClient().Announce(context.Background(), &request)
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	// Leecher over HTTP sees it
+	response, err := tracker.announce(infoHash, torrent.GenerateRandomProtocolId(), 6882, 100, torrent.EventStarted, true)
+	if err != nil || len(response.Peers) != 1 || response.Peers[0].Port != 6881 {
+		t.Errorf("Expected UDP peer over HTTP %v %#v", err, response)
+		return
+	}
+
+	// And the other way around
+	request = torrent.AnnounceRequest{AnnounceURL: udpURL, InfoHash: infoHash, PeerId: torrent.GenerateRandomProtocolId(), Port: 6883, Left: 100, NumWant: 10}
+
+	response, err = torrent.NewUDPTrackerClient().Announce(context.Background(), &request)
+	if err != nil || len(response.Peers) != 2 || response.Complete != 1 || response.Incomplete != 2 {
+		t.Errorf("Expected both peers over UDP %v %#v", err, response)
+		return
+	}
+
+	scrapeResponse, err := torrent.NewUDPTrackerClient().Scrape(context.Background(), udpURL, [][]byte{infoHash, torrent.GenerateRandomProtocolId()})
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if scrapeResponse.Files[string(infoHash)] != (torrent.ScrapeFile{Complete: 1, Incomplete: 2}) {
+		t.Errorf("Unexpected scrape %#v", scrapeResponse.Files)
+	}
+}
+
+func TestUDPServerWhitelist(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+	tracker.server.Allow(torrent.GenerateRandomProtocolId())
+
+	_, conn, err := startTestUDPServer(tracker)
+	if err != nil {
+		t.Errorf("Could not start UDP server %v", err)
+		return
+	}
+	defer conn.Close()
+
+	request := torrent.AnnounceRequest{AnnounceURL: "udp://" + conn.LocalAddr().String(), InfoHash: torrent.GenerateRandomProtocolId(), PeerId: torrent.GenerateRandomProtocolId(), Port: 6881}
+
+	_, err = torrent.NewUDPTrackerClient().Announce(context.Background(), &request)
+	if err == nil || err.Error() != ErrInfoHashNotAllowed.Error() {
+		t.Errorf("Expected %v, got %v", ErrInfoHashNotAllowed, err)
+	}
+}
+
+func TestUDPServerConnectionIdExpiry(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	udpServer := NewUDPServer(tracker.server)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	otherPort := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882}
+	otherAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6881}
+
+	connect := bytes.NewBuffer([]byte{})
+	binary.Write(connect, binary.BigEndian, udpProtocolId)
+	binary.Write(connect, binary.BigEndian, udpActionConnect)
+	binary.Write(connect, binary.BigEndian, int32(1))
+
+	response := udpServer.handle(connect.Bytes(), addr)
+	if len(response) != 16 {
+		t.Errorf("Unexpected connect response %x", response)
+		return
+	}
+
+	scrape := bytes.NewBuffer([]byte{})
+	scrape.Write(response[8:16])
+	binary.Write(scrape, binary.BigEndian, udpActionScrape)
+	binary.Write(scrape, binary.BigEndian, int32(2))
+	scrape.Write(torrent.GenerateRandomProtocolId())
+
+	action := func(response []byte) int32 {
+		return int32(binary.BigEndian.Uint32(response[0:4]))
+	}
+
+	if response := udpServer.handle(scrape.Bytes(), addr); action(response) != udpActionScrape {
+		t.Errorf("Expected scrape to be answered %x", response)
+	}
+
+	if response := udpServer.handle(scrape.Bytes(), otherPort); action(response) != udpActionScrape {
+		t.Errorf("Expected connection id to be valid from another port %x", response)
+	}
+
+	if response := udpServer.handle(scrape.Bytes(), otherAddr); action(response) != udpActionError {
+		t.Errorf("Expected connection id to be bound to IP %x", response)
+	}
+
+	tracker.now = tracker.now.Add(defaultConnectionIdLifetime + time.Second)
+
+	if response := udpServer.handle(scrape.Bytes(), addr); action(response) != udpActionError {
+		t.Errorf("Expected connection id to expire %x", response)
+	}
+}
+
+func TestUDPServerConnectionIdAcrossSockets(t *testing.T) {
+	tracker := startTestTracker()
+	defer tracker.httpServer.Close()
+
+	_, conn, err := startTestUDPServer(tracker)
+	if err != nil {
+		t.Errorf("Could not start UDP server %v", err)
+		return
+	}
+	defer conn.Close()
+
+	exchange := func(packet []byte) ([]byte, error) {
+		socket, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		defer socket.Close()
+
+		_, err = socket.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+		response := make([]byte, udpMaxPacketSize)
+
+		n, err := socket.Read(response)
+		if err != nil {
+			return nil, err
+		}
+
+		return response[:n], nil
+	}
+
+	connect := bytes.NewBuffer([]byte{})
+	binary.Write(connect, binary.BigEndian, udpProtocolId)
+	binary.Write(connect, binary.BigEndian, udpActionConnect)
+	binary.Write(connect, binary.BigEndian, int32(1))
+
+	response, err := exchange(connect.Bytes())
+	if err != nil || len(response) != 16 {
+		t.Errorf("Unexpected connect response %x %v", response, err)
+		return
+	}
+
+	announce := bytes.NewBuffer([]byte{})
+	announce.Write(response[8:16])
+	binary.Write(announce, binary.BigEndian, udpActionAnnounce)
+	binary.Write(announce, binary.BigEndian, int32(2))
+	announce.Write(torrent.GenerateRandomProtocolId())
+	announce.Write(torrent.GenerateRandomProtocolId())
+	binary.Write(announce, binary.BigEndian, []int64{0, 100, 0})
+	binary.Write(announce, binary.BigEndian, []int32{2, 0, 0, -1})
+	binary.Write(announce, binary.BigEndian, uint16(6881))
+
+	// Sent from a new socket, so from another source port
+	response, err = exchange(announce.Bytes())
+	if err != nil {
+		t.Errorf("Did not expect error %v", err)
+		return
+	}
+
+	if int32(binary.BigEndian.Uint32(response[0:4])) != udpActionAnnounce {
+		t.Errorf("Expected announce to be answered, got %q", response[8:])
+	}
+}